@@ -0,0 +1,90 @@
+package donutdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/schemav2"
+)
+
+// FileExistsErr is returned (wrapped) when the destination of an
+// operation that creates a file already exists.
+var FileExistsErr = errors.New("file already exists")
+
+// CloneOptions configures Clone.
+type CloneOptions struct {
+	// LockTimeout is how long to wait for other clients to release
+	// the source file's lock. Defaults to DefaultMigrateLockTimeout.
+	LockTimeout time.Duration
+}
+
+// Clone creates dst as a copy-on-write clone of the schemav2 file src.
+//
+// The clone's metadata references src's existing sectors, so cloning
+// only copies metadata no matter how large the file is. After that the
+// two files are independent: writes to either one store new sectors
+// without affecting the other, and since either may still reference a
+// sector, neither deletes the sectors it replaces or, when deleted, the
+// ones it had. CollectGarbage removes them once no file or snapshot
+// references them.
+//
+// src is locked exclusively while it is cloned, so the clone always
+// captures a committed transaction. dst has the same schema version,
+// sector size, compression and encryption key as src. Clone fails with
+// FileExistsErr if dst already exists.
+func Clone(db DynamoClient, table, src, dst string, opts CloneOptions) error {
+	if src == dst {
+		return fmt.Errorf("can't clone %q onto itself", src)
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultMigrateLockTimeout
+	}
+
+	existing, _, err := fetchFileMeta(db, table, dst)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%w: %q", FileExistsErr, dst)
+	}
+
+	meta, lm, err := lockSharedSectors(db, table, src, opts.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lm.Close()
+
+	fileIDBytes := make([]byte, 20)
+	if _, err := rand.Read(fileIDBytes); err != nil {
+		return err
+	}
+
+	clone := *meta
+	clone.OrigName = dst
+	clone.RandID = base64.URLEncoding.EncodeToString(fileIDBytes)
+	clone.LockRowKey = dynamo.FileLockPrefix + clone.RandID + "-" + dst
+	clone.DataRandID, clone.DataName = meta.SectorNamespace()
+	clone.Generation = 1
+
+	if err := lm.Err(); err != nil {
+		return err
+	}
+
+	if clone.MetaVersion >= 3 {
+		err = schemav2.CreateMetaV3(db, table, &clone)
+	} else {
+		err = createMetaV1(db, table, &clone)
+	}
+	if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+		return fmt.Errorf("%w: %q", FileExistsErr, dst)
+	} else if err != nil {
+		return fmt.Errorf("clone %q err: %w", src, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb"
+	"github.com/spf13/cobra"
+)
+
+var cloneLockTimeout time.Duration
+
+func cloneCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "clone <table> <src_filename> <dst_filename>",
+		Short: "Create a copy-on-write clone of a file",
+		Run:   cloneAction,
+	}
+
+	cmd.Flags().DurationVar(&cloneLockTimeout, "lock-timeout", donutdb.DefaultMigrateLockTimeout, "How long to wait for other clients to release the source file's lock")
+
+	return &cmd
+}
+
+func cloneAction(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalf("Usage: clone <dynamodb_table> <src_file> <dst_file>")
+	}
+
+	table := args[0]
+	src := args[1]
+	dst := args[2]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	err := donutdb.Clone(dynamoClient, table, src, dst, donutdb.CloneOptions{
+		LockTimeout: cloneLockTimeout,
+	})
+	if err != nil {
+		log.Fatalf("clone %s err: %s", src, err)
+	}
+
+	log.Printf("cloned %s to %s\n", src, dst)
+}
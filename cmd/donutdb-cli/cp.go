@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cpDstTable    string
+	cpDstRegion   string
+	cpDstEndpoint string
+	cpLockTimeout time.Duration
+	cpConcurrency int
+)
+
+func cpCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "cp <table> <src_filename> <dst_filename>",
+		Short: "Copy a file to another name or table without going through SQLite",
+		Run:   cpAction,
+	}
+
+	cmd.Flags().StringVar(&cpDstTable, "dst-table", "", "Table to copy to (defaults to the source table)")
+	cmd.Flags().StringVar(&cpDstRegion, "dst-region", "", "Region of the destination table (defaults to the source region)")
+	cmd.Flags().StringVar(&cpDstEndpoint, "dst-endpoint", "", "DynamoDB endpoint URL of the destination table")
+	cmd.Flags().DurationVar(&cpLockTimeout, "lock-timeout", donutdb.DefaultMigrateLockTimeout, "How long to wait for other clients to release the source file's lock")
+	cmd.Flags().IntVar(&cpConcurrency, "concurrency", donutdb.DefaultReadConcurrency, "Number of sector batches to copy at once (v2 and v3 files)")
+
+	return &cmd
+}
+
+func cpAction(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalf("Usage: cp <dynamodb_table> <src_file> <dst_file>")
+	}
+
+	table := args[0]
+	src := args[1]
+	dst := args[2]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	srcClient := dynamodb.New(sess)
+
+	dstTable := table
+	if cpDstTable != "" {
+		dstTable = cpDstTable
+	}
+
+	dstClient := srcClient
+	if cpDstRegion != "" || cpDstEndpoint != "" {
+		dstConfig := &aws.Config{
+			Region: &region,
+		}
+		if cpDstRegion != "" {
+			dstConfig.Region = &cpDstRegion
+		}
+		if cpDstEndpoint != "" {
+			dstConfig.Endpoint = &cpDstEndpoint
+		}
+		dstClient = dynamodb.New(session.New(dstConfig))
+	}
+
+	err := donutdb.Copy(srcClient, table, src, dstClient, dstTable, dst, donutdb.CopyOptions{
+		LockTimeout: cpLockTimeout,
+		Concurrency: cpConcurrency,
+	})
+	if err != nil {
+		log.Fatalf("cp %s err: %s", src, err)
+	}
+
+	log.Printf("copied %s to %s/%s\n", src, dstTable, dst)
+}
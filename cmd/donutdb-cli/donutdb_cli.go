@@ -5,6 +5,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -22,8 +23,11 @@ var (
 
 const (
 	fileMetaKey = "file-meta-v1"
-	hKey        = "hash_key"
-	rKey        = "range_key"
+
+	fileMetaV3Prefix = "file-meta-v3-"
+	fileDirV3Key     = "file-dir-v3"
+	hKey             = "hash_key"
+	rKey             = "range_key"
 )
 
 var rootCmd = &cobra.Command{
@@ -40,6 +44,15 @@ func main() {
 	rootCmd.AddCommand(pullFileCommand())
 	rootCmd.AddCommand(pushFileCommand())
 	rootCmd.AddCommand(rmFileCommand())
+	rootCmd.AddCommand(mvCommand())
+	rootCmd.AddCommand(cpCommand())
+	rootCmd.AddCommand(gcCommand())
+	rootCmd.AddCommand(fsckCommand())
+	rootCmd.AddCommand(migrateCommand())
+	rootCmd.AddCommand(snapshotCommand())
+	rootCmd.AddCommand(cloneCommand())
+	rootCmd.AddCommand(historyCommand())
+	rootCmd.AddCommand(rollbackCommand())
 	rootCmd.AddCommand(debugCommand())
 	err := rootCmd.Execute()
 	if err != nil {
@@ -98,6 +111,46 @@ func lsFilesAction(cmd *cobra.Command, args []string) {
 			fmt.Printf("%s\n", k)
 		}
 	}
+
+	err = dynamoClient.QueryPages(&dynamodb.QueryInput{
+		TableName:              &table,
+		KeyConditionExpression: aws.String("hash_key = :hk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hk": {
+				S: aws.String(fileDirV3Key),
+			},
+		},
+	}, func(out *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range out.Items {
+			name := *item["name"].S
+			if !verboseOutput {
+				fmt.Printf("%s\n", name)
+				continue
+			}
+
+			metaRow, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+				TableName: &table,
+				Key: map[string]*dynamodb.AttributeValue{
+					hKey: {
+						S: aws.String(fileMetaV3Prefix + name),
+					},
+					rKey: {
+						N: aws.String("0"),
+					},
+				},
+			})
+			if err != nil {
+				log.Fatalf("GetItem err: %s", err)
+			}
+			if meta := metaRow.Item["meta"]; meta != nil {
+				fmt.Printf("%s %s\n", name, *meta.S)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatalf("Query err: %s", err)
+	}
 }
 
 func pullFileCommand() *cobra.Command {
@@ -220,7 +273,10 @@ func pushFileAction(cmd *cobra.Command, args []string) {
 		log.Fatalf("Failed to push file to dynamodb: %s", err)
 	}
 
-	w.File.Sync(0)
+	err = w.File.Sync(0)
+	if err != nil {
+		log.Fatalf("Failed to commit file to dynamodb: %s", err)
+	}
 
 	log.Printf("pushed %s to %s\n", srcFileName, dstFileName)
 }
@@ -256,6 +312,114 @@ func rmFileAction(cmd *cobra.Command, args []string) {
 	}
 }
 
+var (
+	gcDryRun      bool
+	gcGracePeriod time.Duration
+)
+
+func gcCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "gc <table>",
+		Short: "Delete orphaned sectors not referenced by any file",
+		Run:   gcAction,
+	}
+
+	cmd.Flags().BoolVarP(&gcDryRun, "dry-run", "n", false, "Only report orphaned items, don't delete them")
+	cmd.Flags().DurationVar(&gcGracePeriod, "grace-period", donutdb.DefaultGCGracePeriod, "Keep unreferenced sectors newer than this")
+
+	return &cmd
+}
+
+func gcAction(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("Usage: gc <dynamodb_table>")
+	}
+
+	table := args[0]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	result, err := donutdb.CollectGarbage(dynamoClient, table, donutdb.GCOptions{
+		DryRun:      gcDryRun,
+		GracePeriod: gcGracePeriod,
+	})
+	if err != nil {
+		log.Fatalf("gc err: %s", err)
+	}
+
+	for _, o := range result.Orphans {
+		file := o.File
+		if file == "" {
+			file = "<deleted>"
+		}
+		fmt.Printf("%s %s %s\n", file, o.HashKey, o.RangeKey)
+	}
+
+	verb := "deleted"
+	if gcDryRun {
+		verb = "would delete"
+	}
+	log.Printf("scanned %d items, %s %d orphans, skipped %d recent or locked sectors\n", result.ScannedItems, verb, len(result.Orphans), result.Skipped)
+}
+
+var (
+	migrateLockTimeout time.Duration
+	migrateKeyFiles    []string
+)
+
+func migrateCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "migrate <table> <filename...>",
+		Short: "Migrate schemav1 files to the schemav2 layout",
+		Run:   migrateAction,
+	}
+
+	cmd.Flags().DurationVar(&migrateLockTimeout, "lock-timeout", donutdb.DefaultMigrateLockTimeout, "How long to wait for other clients to release each file's lock")
+	cmd.Flags().StringArrayVar(&migrateKeyFiles, "key", nil, "Encrypt migrated files with this key, as <key_id>=<path to 32 byte key file>")
+
+	return &cmd
+}
+
+func migrateAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatalf("Usage: migrate <dynamodb_table> <file...>")
+	}
+
+	table := args[0]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	opts := donutdb.MigrateOptions{
+		LockTimeout: migrateLockTimeout,
+	}
+	if len(migrateKeyFiles) > 0 {
+		keys, err := loadKeyFiles(migrateKeyFiles)
+		if err != nil {
+			log.Fatalf("Load keys err: %s", err)
+		}
+		opts.Keys = keys
+	}
+
+	for _, name := range args[1:] {
+		result, err := donutdb.MigrateToV2(dynamoClient, table, name, opts)
+		if err != nil {
+			log.Fatalf("migrate %s err: %s", name, err)
+		}
+
+		if result.Migrated {
+			log.Printf("migrated %s: size=%d sectors=%d, removed %d v1 rows\n", name, result.Size, result.Sectors, result.RemovedRows)
+		} else {
+			log.Printf("%s is already v2 or later, removed %d leftover v1 rows\n", name, result.RemovedRows)
+		}
+	}
+}
+
 type writerFromWriterAt struct {
 	sqlite3vfs.File
 	offset int
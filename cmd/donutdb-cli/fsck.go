@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/psanford/donutdb"
+	"github.com/psanford/donutdb/encryption"
+	"github.com/psanford/sqlite3vfs"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fsckJSON           bool
+	fsckIntegrityCheck bool
+	fsckKeyFiles       []string
+)
+
+func fsckCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "fsck <table> [filename...]",
+		Short: "Check files for missing or corrupt sectors and metadata",
+		Run:   fsckAction,
+	}
+
+	cmd.Flags().BoolVar(&fsckJSON, "json", false, "Print the report as JSON")
+	cmd.Flags().BoolVar(&fsckIntegrityCheck, "integrity-check", false, "Also run SQLite's PRAGMA integrity_check on each database")
+	cmd.Flags().StringArrayVar(&fsckKeyFiles, "key", nil, "Encryption key as <key_id>=<path to 32 byte key file>, may be repeated")
+
+	return &cmd
+}
+
+func fsckAction(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("Usage: fsck <dynamodb_table> [file...]")
+	}
+
+	table := args[0]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	opts := donutdb.FsckOptions{
+		Files: args[1:],
+	}
+
+	if len(fsckKeyFiles) > 0 {
+		keys, err := loadKeyFiles(fsckKeyFiles)
+		if err != nil {
+			log.Fatalf("Load keys err: %s", err)
+		}
+		opts.Keys = keys
+	}
+
+	report, err := donutdb.Fsck(dynamoClient, table, opts)
+	if err != nil {
+		log.Fatalf("fsck err: %s", err)
+	}
+
+	if fsckIntegrityCheck {
+		vfsOpts := []donutdb.Option{}
+		if opts.Keys != nil {
+			vfsOpts = append(vfsOpts, donutdb.WithEncryption(opts.Keys))
+		}
+		vfs := donutdb.New(dynamoClient, table, vfsOpts...)
+		err = sqlite3vfs.RegisterVFS("donutdb", vfs)
+		if err != nil {
+			log.Fatalf("Register VFS err: %s", err)
+		}
+
+		for _, f := range report.Files {
+			if !f.ContentChecked || isJournal(f.Name) || hasProblems(report, f.Name) {
+				continue
+			}
+
+			results, err := integrityCheck(f.Name)
+			if err != nil {
+				results = []string{err.Error()}
+			}
+			for _, r := range results {
+				report.Problems = append(report.Problems, donutdb.FsckProblem{
+					File:   f.Name,
+					Check:  donutdb.FsckIntegrityCheck,
+					Detail: r,
+				})
+			}
+		}
+	}
+
+	if fsckJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, f := range report.Files {
+			content := ""
+			if !f.ContentChecked {
+				content = " (content not checked)"
+			}
+			fmt.Printf("file %s schema=v%d size=%d sectors=%d%s\n", f.Name, f.SchemaVersion, f.Size, f.Sectors, content)
+		}
+		for _, p := range report.Problems {
+			fmt.Printf("problem %s file=%q key=%q: %s\n", p.Check, p.File, p.Key, p.Detail)
+		}
+	}
+
+	if !report.OK() {
+		log.Printf("found %d problems in %d files\n", len(report.Problems), len(report.Files))
+		os.Exit(2)
+	}
+	log.Printf("checked %d files, no problems found\n", len(report.Files))
+}
+
+// integrityCheck runs PRAGMA integrity_check on name through the
+// donutdb VFS and returns the problems it reports.
+func integrityCheck(name string) ([]string, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?vfs=donutdb&mode=ro", name))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		if r != "ok" {
+			results = append(results, r)
+		}
+	}
+
+	return results, rows.Err()
+}
+
+func isJournal(name string) bool {
+	return strings.HasSuffix(name, "-journal") || strings.HasSuffix(name, "-wal")
+}
+
+func hasProblems(report *donutdb.FsckReport, name string) bool {
+	for _, p := range report.Problems {
+		if p.File == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadKeyFiles builds a key provider from <key_id>=<path> flags.
+func loadKeyFiles(specs []string) (encryption.KeyProvider, error) {
+	keys := encryption.StaticKeys{
+		Keys: make(map[string][]byte),
+	}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid key %q, expected <key_id>=<path>", spec)
+		}
+		key, err := os.ReadFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		keys.Keys[parts[0]] = key
+		if keys.CurrentID == "" {
+			keys.CurrentID = parts[0]
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb"
+	"github.com/spf13/cobra"
+)
+
+func mvCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "mv <table> <src_filename> <dst_filename>",
+		Short: "Rename a file",
+		Run:   mvAction,
+	}
+
+	return &cmd
+}
+
+func mvAction(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalf("Usage: mv <dynamodb_table> <src_file> <dst_file>")
+	}
+
+	table := args[0]
+	src := args[1]
+	dst := args[2]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	err := donutdb.Rename(dynamoClient, table, src, dst)
+	if err != nil {
+		log.Fatalf("mv %s err: %s", src, err)
+	}
+}
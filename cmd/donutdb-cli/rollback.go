@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rollbackTo          string
+	rollbackLockTimeout time.Duration
+
+	historyKeep        int
+	historyLockTimeout time.Duration
+)
+
+func rollbackCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "rollback <table> <filename> --to <time|version>",
+		Short: "Roll a file back to an earlier version from its metadata history",
+		Run:   rollbackAction,
+	}
+
+	cmd.Flags().StringVar(&rollbackTo, "to", "", "Version to roll back to: a generation number, an RFC3339 time, or a duration ago like 2h")
+	cmd.Flags().DurationVar(&rollbackLockTimeout, "lock-timeout", donutdb.DefaultMigrateLockTimeout, "How long to wait for other clients to release the file's lock")
+
+	return &cmd
+}
+
+func rollbackAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 || rollbackTo == "" {
+		log.Fatalf("Usage: rollback <dynamodb_table> <file> --to <time|version>")
+	}
+
+	table := args[0]
+	file := args[1]
+
+	opts := donutdb.RollbackOptions{
+		LockTimeout: rollbackLockTimeout,
+	}
+	if version, err := strconv.ParseInt(rollbackTo, 10, 64); err == nil {
+		opts.Version = version
+	} else if t, err := time.Parse(time.RFC3339, rollbackTo); err == nil {
+		opts.Time = t
+	} else if d, err := time.ParseDuration(rollbackTo); err == nil {
+		opts.Time = time.Now().Add(-d)
+	} else {
+		log.Fatalf("Invalid --to %q, expected a version, an RFC3339 time or a duration", rollbackTo)
+	}
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	version, err := donutdb.Rollback(dynamoClient, table, file, opts)
+	if err != nil {
+		log.Fatalf("rollback %s err: %s", file, err)
+	}
+
+	log.Printf("rolled %s back to version %d from %s size=%d\n", file, version.Generation, version.Committed.Format(time.RFC3339), version.Size)
+}
+
+func historyCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "history <table> <filename>",
+		Short: "List or configure the metadata history of a file",
+		Run:   historyAction,
+	}
+
+	cmd.Flags().IntVar(&historyKeep, "keep", -1, "Set the number of versions to keep; 0 disables history")
+	cmd.Flags().DurationVar(&historyLockTimeout, "lock-timeout", donutdb.DefaultMigrateLockTimeout, "How long to wait for other clients to release the file's lock")
+
+	return &cmd
+}
+
+func historyAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatalf("Usage: history <dynamodb_table> <file>")
+	}
+
+	table := args[0]
+	file := args[1]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	if historyKeep >= 0 {
+		err := donutdb.SetMetaHistory(dynamoClient, table, file, historyKeep, donutdb.HistoryOptions{
+			LockTimeout: historyLockTimeout,
+		})
+		if err != nil {
+			log.Fatalf("set history of %s err: %s", file, err)
+		}
+		return
+	}
+
+	versions, err := donutdb.MetaHistory(dynamoClient, table, file)
+	if err != nil {
+		log.Fatalf("list history err: %s", err)
+	}
+
+	for _, v := range versions {
+		fmt.Printf("%d %s %d\n", v.Generation, v.Committed.Format(time.RFC3339), v.Size)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb"
+	"github.com/spf13/cobra"
+)
+
+var snapshotLockTimeout time.Duration
+
+func snapshotCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "snapshot",
+		Short: "Manage read-only point-in-time snapshots of files",
+	}
+
+	cmd.AddCommand(snapshotCreateCommand())
+	cmd.AddCommand(snapshotListCommand())
+	cmd.AddCommand(snapshotRmCommand())
+
+	return &cmd
+}
+
+func snapshotCreateCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "create <table> <filename> <snapshot>",
+		Short: "Snapshot the current content of a file",
+		Run:   snapshotCreateAction,
+	}
+
+	cmd.Flags().DurationVar(&snapshotLockTimeout, "lock-timeout", donutdb.DefaultMigrateLockTimeout, "How long to wait for other clients to release the file's lock")
+
+	return &cmd
+}
+
+func snapshotCreateAction(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalf("Usage: snapshot create <dynamodb_table> <file> <snapshot>")
+	}
+
+	table := args[0]
+	file := args[1]
+	name := args[2]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	info, err := donutdb.CreateSnapshot(dynamoClient, table, file, name, donutdb.SnapshotOptions{
+		LockTimeout: snapshotLockTimeout,
+	})
+	if err != nil {
+		log.Fatalf("snapshot %s err: %s", file, err)
+	}
+
+	log.Printf("created snapshot %s%s%s size=%d\n", file, donutdb.SnapshotSeparator, name, info.Size)
+}
+
+func snapshotListCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "list <table> <filename>",
+		Short: "List the snapshots of a file",
+		Run:   snapshotListAction,
+	}
+
+	return &cmd
+}
+
+func snapshotListAction(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatalf("Usage: snapshot list <dynamodb_table> <file>")
+	}
+
+	table := args[0]
+	file := args[1]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	snaps, err := donutdb.ListSnapshots(dynamoClient, table, file)
+	if err != nil {
+		log.Fatalf("list snapshots err: %s", err)
+	}
+
+	for _, snap := range snaps {
+		fmt.Printf("%s %s %d\n", snap.Name, snap.Created.Format(time.RFC3339), snap.Size)
+	}
+}
+
+func snapshotRmCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "rm <table> <filename> <snapshot>",
+		Short: "Remove a snapshot",
+		Run:   snapshotRmAction,
+	}
+
+	return &cmd
+}
+
+func snapshotRmAction(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		log.Fatalf("Usage: snapshot rm <dynamodb_table> <file> <snapshot>")
+	}
+
+	table := args[0]
+	file := args[1]
+	name := args[2]
+
+	sess := session.New(&aws.Config{
+		Region: &region,
+	})
+	dynamoClient := dynamodb.New(sess)
+
+	err := donutdb.DeleteSnapshot(dynamoClient, table, file, name)
+	if err != nil {
+		log.Fatalf("rm snapshot err: %s", err)
+	}
+}
@@ -0,0 +1,297 @@
+// Package compression is the registry of codecs donutdb uses to
+// compress sector data.
+//
+// A file's codec is chosen when the file is created and its name is
+// recorded in the file's metadata, so every later reader and writer
+// of the file uses the same codec no matter how it was configured.
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec compresses and decompresses sector data.
+type Codec interface {
+	// Name identifies the codec in file metadata. Looking the name
+	// up in the registry must return an equivalent codec.
+	Name() string
+
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) []byte
+
+	// Decompress appends the decompressed form of src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// UnknownCodecErr is returned when a file's metadata names a codec
+// that isn't registered in this process.
+var UnknownCodecErr = errors.New("unknown compression codec")
+
+const (
+	// DefaultName is the codec files are created with by default:
+	// zstd at its fastest level. It is also assumed for files whose
+	// metadata doesn't record a codec.
+	DefaultName = "zstd"
+
+	zstdPrefix = "zstd"
+	dictInfix  = "-dict-"
+)
+
+var (
+	// None stores sectors uncompressed.
+	None Codec = noneCodec{}
+
+	// Snappy compresses sectors in the snappy block format.
+	Snappy Codec = snappyCodec{}
+
+	// S2 compresses sectors in the S2 block format, which is faster
+	// than snappy and usually compresses better.
+	S2 Codec = s2Codec{}
+)
+
+var (
+	mu       sync.Mutex
+	registry = map[string]Codec{
+		None.Name():   None,
+		Snappy.Name(): Snappy,
+		S2.Name():     S2,
+	}
+	zstdDicts = make(map[uint32][]byte)
+)
+
+// Register makes a custom codec available to Lookup. It returns an
+// error if a codec is already registered under its name.
+func Register(c Codec) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := registry[c.Name()]; ok {
+		return fmt.Errorf("compression codec %q already registered", c.Name())
+	}
+	registry[c.Name()] = c
+	return nil
+}
+
+// Lookup returns the codec recorded in a file's metadata. An empty
+// name means DefaultName.
+func Lookup(name string) (Codec, error) {
+	if name == "" {
+		name = DefaultName
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if c, ok := registry[name]; ok {
+		return c, nil
+	}
+
+	if !strings.HasPrefix(name, zstdPrefix) {
+		return nil, fmt.Errorf("%w: %q", UnknownCodecErr, name)
+	}
+
+	// zstd codecs are created on first use, since an encoder for every
+	// level and dictionary would use a lot of memory for nothing
+	level, dictID, err := parseZstdName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var dict []byte
+	if dictID != 0 {
+		dict = zstdDicts[dictID]
+		if dict == nil {
+			return nil, fmt.Errorf("%w: %q: zstd dictionary %d is not registered", UnknownCodecErr, name, dictID)
+		}
+	}
+
+	c, err := newZstdCodec(level, dict, dictID)
+	if err != nil {
+		return nil, err
+	}
+	registry[name] = c
+	return c, nil
+}
+
+// Zstd returns a zstd codec at the given standard zstd compression
+// level (1-22). Levels map onto the four speeds supported by
+// klauspost/compress: fastest (below 3), default (3-5), better (6-9)
+// and best (10 and above).
+func Zstd(level int) (Codec, error) {
+	return Lookup(zstdName(zstd.EncoderLevelFromZstd(level), 0))
+}
+
+// ZstdDict returns a zstd codec that compresses with a trained
+// dictionary, such as one made by `zstd --train`. Dictionaries help
+// most with small sectors that share a lot of structure.
+//
+// The dictionary is registered by its ID, so every process that reads
+// files created with this codec must call ZstdDict with the same
+// dictionary first.
+func ZstdDict(dict []byte, level int) (Codec, error) {
+	// validate the dictionary before registering it
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict))
+	if err != nil {
+		return nil, fmt.Errorf("load zstd dictionary: %w", err)
+	}
+	enc.Close()
+
+	id := binary.LittleEndian.Uint32(dict[4:8])
+
+	mu.Lock()
+	existing := zstdDicts[id]
+	if existing != nil && string(existing) != string(dict) {
+		mu.Unlock()
+		return nil, fmt.Errorf("a different zstd dictionary with id %d is already registered", id)
+	}
+	zstdDicts[id] = append([]byte(nil), dict...)
+	mu.Unlock()
+
+	return Lookup(zstdName(zstd.EncoderLevelFromZstd(level), id))
+}
+
+// zstdName returns the codec name for a zstd level and dictionary.
+// Fastest without a dictionary is plain "zstd", which is what files
+// were always compressed with before codecs were configurable.
+func zstdName(level zstd.EncoderLevel, dictID uint32) string {
+	name := zstdPrefix
+	if level != zstd.SpeedFastest {
+		name += "-" + level.String()
+	}
+	if dictID != 0 {
+		name += dictInfix + strconv.FormatUint(uint64(dictID), 10)
+	}
+	return name
+}
+
+func parseZstdName(name string) (zstd.EncoderLevel, uint32, error) {
+	rest := strings.TrimPrefix(name, zstdPrefix)
+
+	var dictID uint32
+	if i := strings.Index(rest, dictInfix); i >= 0 {
+		id, err := strconv.ParseUint(rest[i+len(dictInfix):], 10, 32)
+		if err != nil || id == 0 {
+			return 0, 0, fmt.Errorf("%w: %q", UnknownCodecErr, name)
+		}
+		dictID = uint32(id)
+		rest = rest[:i]
+	}
+
+	level := zstd.SpeedFastest
+	if rest != "" {
+		ok, l := zstd.EncoderLevelFromString(strings.TrimPrefix(rest, "-"))
+		if !ok || !strings.HasPrefix(rest, "-") {
+			return 0, 0, fmt.Errorf("%w: %q", UnknownCodecErr, name)
+		}
+		level = l
+	}
+
+	// make sure we don't cache the same codec under two names
+	if zstdName(level, dictID) != name {
+		return 0, 0, fmt.Errorf("%w: %q", UnknownCodecErr, name)
+	}
+
+	return level, dictID, nil
+}
+
+type zstdCodec struct {
+	name string
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+}
+
+func newZstdCodec(level zstd.EncoderLevel, dict []byte, dictID uint32) (*zstdCodec, error) {
+	eopts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+	var dopts []zstd.DOption
+	if dict != nil {
+		eopts = append(eopts, zstd.WithEncoderDict(dict))
+		dopts = append(dopts, zstd.WithDecoderDicts(dict))
+	}
+
+	enc, err := zstd.NewWriter(nil, eopts...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, dopts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdCodec{
+		name: zstdName(level, dictID),
+		enc:  enc,
+		dec:  dec,
+	}, nil
+}
+
+func (c *zstdCodec) Name() string {
+	return c.name
+}
+
+func (c *zstdCodec) Compress(dst, src []byte) []byte {
+	return c.enc.EncodeAll(src, dst)
+}
+
+func (c *zstdCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, dst)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) Compress(dst, src []byte) []byte {
+	return append(dst, src...)
+}
+
+func (noneCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Compress(dst, src []byte) []byte {
+	return append(dst, s2.EncodeSnappy(nil, src)...)
+}
+
+// Decompress decodes snappy blocks with the s2 decoder, which
+// understands both formats.
+func (snappyCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return s2Decompress(dst, src)
+}
+
+type s2Codec struct{}
+
+func (s2Codec) Name() string {
+	return "s2"
+}
+
+func (s2Codec) Compress(dst, src []byte) []byte {
+	return append(dst, s2.Encode(nil, src)...)
+}
+
+func (s2Codec) Decompress(dst, src []byte) ([]byte, error) {
+	return s2Decompress(dst, src)
+}
+
+func s2Decompress(dst, src []byte) ([]byte, error) {
+	out, err := s2.Decode(nil, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, out...), nil
+}
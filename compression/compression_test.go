@@ -0,0 +1,110 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func sampleData() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 4096; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"user-%d","email":"user%d@example.com","active":true}`+"\n", i, i, i)
+	}
+	return buf.Bytes()
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	dict, err := os.ReadFile("testdata/sector.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zstdBest, err := Zstd(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdDict, err := ZstdDict(dict, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := sampleData()
+
+	checks := []struct {
+		codec Codec
+		name  string
+	}{
+		{None, "none"},
+		{Snappy, "snappy"},
+		{S2, "s2"},
+		{zstdBest, "zstd-best"},
+		{zstdDict, fmt.Sprintf("zstd-default-dict-%d", zstdDictID(dict))},
+	}
+
+	for _, check := range checks {
+		if check.codec.Name() != check.name {
+			t.Fatalf("codec name got=%q expected=%q", check.codec.Name(), check.name)
+		}
+
+		prefix := []byte("prefix")
+		comp := check.codec.Compress(append([]byte(nil), prefix...), data)
+		if !bytes.HasPrefix(comp, prefix) {
+			t.Fatalf("%s: Compress did not append to dst", check.name)
+		}
+		comp = comp[len(prefix):]
+
+		if check.codec != None && len(comp) >= len(data) {
+			t.Errorf("%s: data did not compress: %d >= %d", check.name, len(comp), len(data))
+		}
+
+		// decompress with the codec looked up by name, like a reader would
+		lookedUp, err := Lookup(check.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := lookedUp.Decompress(nil, comp)
+		if err != nil {
+			t.Fatalf("%s: decompress err: %s", check.name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: round trip mismatch", check.name)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	c, err := Lookup("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name() != DefaultName {
+		t.Fatalf("empty name got=%q expected=%q", c.Name(), DefaultName)
+	}
+
+	fastest, err := Zstd(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fastest != c {
+		t.Fatalf("Zstd(1) should be the default codec, got %q", fastest.Name())
+	}
+
+	for _, name := range []string{"gzip", "zstd-fastest", "zstd-", "zstd-bogus", "zstd-dict-0", "zstd-dict-424242"} {
+		_, err := Lookup(name)
+		if !errors.Is(err, UnknownCodecErr) {
+			t.Errorf("Lookup(%q) err got=%v expected=%v", name, err, UnknownCodecErr)
+		}
+	}
+
+	err = Register(S2)
+	if err == nil {
+		t.Fatal("expected error registering a duplicate codec name")
+	}
+}
+
+func zstdDictID(dict []byte) uint32 {
+	return uint32(dict[4]) | uint32(dict[5])<<8 | uint32(dict[6])<<16 | uint32(dict[7])<<24
+}
@@ -0,0 +1,106 @@
+package donutdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/schemav1"
+	"github.com/psanford/donutdb/internal/schemav2"
+)
+
+// CopyOptions configures Copy.
+type CopyOptions struct {
+	// LockTimeout is how long to wait for other clients to release
+	// the source file's lock. Defaults to DefaultMigrateLockTimeout.
+	LockTimeout time.Duration
+
+	// Concurrency is the maximum number of sector batches being
+	// copied at once. Defaults to DefaultReadConcurrency. Schema v1
+	// files are always copied one batch at a time.
+	Concurrency int
+}
+
+// Copy copies the file src in srcTable to dst in dstTable.
+// srcDB and dstDB may be the same client, or clients for different
+// regions or endpoints.
+//
+// Unlike Clone, Copy writes a full copy of every sector, so dst doesn't
+// depend on src in any way. The sectors are streamed through
+// BatchGetItem and BatchWriteItem exactly as they are stored, without
+// going through SQLite or decoding them (schema v1 data rows are copied
+// with Query and BatchWriteItem), and dst gets src's schema version,
+// sector size, compression and encryption key.
+//
+// src is locked exclusively for the duration of the copy, so the copy
+// always captures a committed transaction. dst's metadata is only
+// created once all of its sectors have been written, so dst never
+// appears partially copied. Copy fails with FileExistsErr if dst
+// already exists; sectors copied before that was noticed are removed
+// by CollectGarbage.
+func Copy(srcDB DynamoClient, srcTable, src string, dstDB DynamoClient, dstTable, dst string, opts CopyOptions) error {
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultMigrateLockTimeout
+	}
+	if opts.Concurrency < 1 {
+		opts.Concurrency = DefaultReadConcurrency
+	}
+
+	existing, _, err := fetchFileMeta(dstDB, dstTable, dst)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%w: %q", FileExistsErr, dst)
+	}
+
+	meta, _, lm, err := lockFileVersion(srcDB, srcTable, src, opts.LockTimeout, 1)
+	if err != nil {
+		return err
+	}
+	defer lm.Close()
+
+	fileIDBytes := make([]byte, 20)
+	if _, err := rand.Read(fileIDBytes); err != nil {
+		return err
+	}
+
+	copied := *meta
+	copied.OrigName = dst
+	copied.RandID = base64.URLEncoding.EncodeToString(fileIDBytes)
+	copied.LockRowKey = dynamo.FileLockPrefix + copied.RandID + "-" + dst
+	copied.DataRandID, copied.DataName = "", ""
+	copied.Generation = 1
+	// nothing else references the copy's sectors yet
+	copied.SharedSectors = copied.HistorySize > 0
+
+	if copied.MetaVersion < 2 {
+		copied.DataRowKey = dynamo.FileDataPrefix + copied.RandID + "-" + dst
+		err = schemav1.CopyRows(srcDB, srcTable, meta, dstDB, dstTable, &copied, lm.Err)
+	} else {
+		err = schemav2.CopySectors(srcDB, srcTable, meta, dstDB, dstTable, &copied, opts.Concurrency, lm.Err)
+	}
+	if err != nil {
+		return fmt.Errorf("copy %q err: %w", src, err)
+	}
+
+	if err := lm.Err(); err != nil {
+		return err
+	}
+
+	if copied.MetaVersion >= 3 {
+		err = schemav2.CreateMetaV3(dstDB, dstTable, &copied)
+	} else {
+		err = createMetaV1(dstDB, dstTable, &copied)
+	}
+	if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+		return fmt.Errorf("%w: %q", FileExistsErr, dst)
+	} else if err != nil {
+		return fmt.Errorf("copy %q err: %w", src, err)
+	}
+
+	return nil
+}
@@ -20,7 +20,7 @@ import (
 )
 
 var (
-	mode        = flag.String("mode", "local", "local|donutdb|local-dynamo")
+	mode        = flag.String("mode", "local", "local|donutdb|local-dynamo (local-dynamo uses an in-memory fake unless DONUTDB_DYNAMODB_* is set)")
 	dynamoTable = flag.String("dynamo-table", "", "Table to use for donutDB")
 	region      = flag.String("region", "us-east-1", "AWS Region")
 )
@@ -12,6 +12,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/fakedynamo"
 )
 
 type dynamoServerInfo struct {
@@ -19,7 +21,7 @@ type dynamoServerInfo struct {
 	Addr      string
 	TableName string
 	Cleanup   func()
-	db        *dynamodb.DynamoDB
+	db        dynamo.Client
 }
 
 func setupDynamoServer() (*dynamoServerInfo, error) {
@@ -79,25 +81,37 @@ func setupDynamoServer() (*dynamoServerInfo, error) {
 		}
 	}
 
+	var tableCreator interface {
+		CreateTable(*dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error)
+	}
+
 	if info.Region == "" {
-		return nil, fmt.Errorf("Missing required environment variables to connect to dynamodb (either local or remote)")
+		// no dynamodb endpoint configured, use the in-memory fake
+		log.Printf("Using in-memory fake dynamodb")
+		fake := fakedynamo.New()
+		info.db = fake
+		tableCreator = fake
+	} else {
+		sess := session.Must(session.NewSessionWithOptions(session.Options{
+			Config: aws.Config{
+				Region:     &info.Region,
+				Endpoint:   &info.Addr,
+				MaxRetries: aws.Int(0),
+				// LogLevel: aws.LogLevel(aws.LogDebug),
+				// Logger:   aws.NewDefaultLogger(),
+			},
+		}))
+		db := dynamodb.New(sess)
+		info.db = db
+		tableCreator = db
 	}
 
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:     &info.Region,
-			Endpoint:   &info.Addr,
-			MaxRetries: aws.Int(0),
-			// LogLevel: aws.LogLevel(aws.LogDebug),
-			// Logger:   aws.NewDefaultLogger(),
-		},
-	}))
-	info.db = dynamodb.New(sess)
-
-	if info.TableName == "" {
-		info.TableName = fmt.Sprintf("donutdb-test-%d", time.Now().UnixNano())
-
-		_, err := info.db.CreateTable(&dynamodb.CreateTableInput{
+	if _, isFake := info.db.(*fakedynamo.DB); info.TableName == "" || isFake {
+		if info.TableName == "" {
+			info.TableName = fmt.Sprintf("donutdb-test-%d", time.Now().UnixNano())
+		}
+
+		_, err := tableCreator.CreateTable(&dynamodb.CreateTableInput{
 			TableName: &info.TableName,
 			AttributeDefinitions: []*dynamodb.AttributeDefinition{
 				{
@@ -1,27 +1,62 @@
 package donutdb
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"path/filepath"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/encryption"
 	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/lock"
 	"github.com/psanford/donutdb/internal/schemav1"
 	"github.com/psanford/donutdb/internal/schemav2"
 	"github.com/psanford/donutdb/sectorcache"
 	"github.com/psanford/sqlite3vfs"
 )
 
-func New(dynamoClient *dynamodb.DynamoDB, table string, opts ...Option) sqlite3vfs.VFS {
+// MetaConflictErr is returned (wrapped) when a write fails because the
+// file's metadata was changed by another client since it was read,
+// typically because our lock lease was lost. The write is not applied;
+// callers can retry the transaction.
+var MetaConflictErr = dynamo.MetaConflictErr
+
+// LeaseLostErr is returned (wrapped) by file operations after the
+// file's lock lease was lost, either because another client took the
+// lock or because the lease expired before it could be renewed. SQLite
+// reports it as an I/O error. Pending writes are discarded and the
+// transaction can be retried once it has been rolled back.
+var LeaseLostErr = lock.LeaseLostErr
+
+// CorruptSectorError describes a sector that failed its integrity check
+// when it was read: its content didn't match the hash in its sector ID,
+// it couldn't be decompressed, or it failed decryption. SQLite reports
+// it as SQLITE_CORRUPT. Every corrupt sector is also counted in the
+// donutdb_corrupt_sector_count Prometheus counter, by reason.
+type CorruptSectorError = dynamo.CorruptSectorError
+
+// DynamoClient is the subset of the DynamoDB API used by donutdb.
+// A *dynamodb.DynamoDB satisfies this interface. Request contexts,
+// CollectGarbage, Fsck and renaming schema V3 files also use the
+// *WithContext, Scan and TransactWriteItems calls when the client
+// provides them.
+type DynamoClient = dynamo.Client
+
+// New creates a new sqlite3vfs.VFS backed by the given DynamoDB table.
+func New(dynamoClient DynamoClient, table string, opts ...Option) sqlite3vfs.VFS {
 	options := options{
-		sectorSize: dynamo.DefaultSectorSize,
+		sectorSize:       dynamo.DefaultSectorSize,
+		readConcurrency:  DefaultReadConcurrency,
+		writeConcurrency: DefaultWriteConcurrency,
 	}
 	for _, opt := range opts {
 		err := opt.setOption(&options)
@@ -36,17 +71,47 @@ func New(dynamoClient *dynamodb.DynamoDB, table string, opts ...Option) sqlite3v
 	}
 	v := vfs{
 		db:                   dynamoClient,
+		rawDB:                dynamoClient,
 		table:                table,
 		ownerID:              hex.EncodeToString(ownerIDBytes),
 		sectorSize:           options.sectorSize,
+		compressAlg:          compression.DefaultName,
+		keys:                 options.keys,
+		metaHistory:          options.metaHistory,
 		sectorCache:          options.sectorCache,
+		lockStrategy:         options.lockStrategy,
+		leaseLostHandler:     options.leaseLostHandler,
+		lockOptions:          options.lockOptions,
 		defaultSchemaVersion: 2,
+		v2Options: schemav2.Options{
+			ReadConcurrency:  options.readConcurrency,
+			WriteConcurrency: options.writeConcurrency,
+			ReadAhead:        options.readAhead,
+			Keys:             options.keys,
+		},
+	}
+
+	if options.ctx != nil || options.fileContext != nil || options.requestTimeout > 0 {
+		ctx := options.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		v.ctx = ctx
+		v.fileContext = options.fileContext
+		v.requestTimeout = options.requestTimeout
+		v.db = dynamo.WithContext(dynamoClient, func() context.Context {
+			return ctx
+		}, v.requestTimeout)
 	}
 
 	if options.changeLogWriter != nil {
 		v.changeLogWriter = json.NewEncoder(options.changeLogWriter)
 	}
 
+	if options.compression != nil {
+		v.compressAlg = options.compression.Name()
+	}
+
 	if options.defaultSchemaVersion != 0 {
 		v.defaultSchemaVersion = options.defaultSchemaVersion
 	}
@@ -55,18 +120,34 @@ func New(dynamoClient *dynamodb.DynamoDB, table string, opts ...Option) sqlite3v
 }
 
 type vfs struct {
-	db                   *dynamodb.DynamoDB
+	db                   dynamo.Client
 	table                string
 	ownerID              string
 	defaultSchemaVersion int
 	sectorCache          sectorcache.CacheV2
-
-	sectorSize int64
+	lockStrategy         LockStrategy
+	leaseLostHandler     func(name string, err error)
+	lockOptions          lock.Options
+	v2Options            schemav2.Options
+
+	// rawDB is the client passed to New. If a context or request
+	// timeout was set db wraps it to apply them.
+	rawDB          dynamo.Client
+	ctx            context.Context
+	fileContext    func(name string) context.Context
+	requestTimeout time.Duration
+
+	sectorSize  int64
+	compressAlg string
+	keys        encryption.KeyProvider
+	metaHistory int
 
 	changeLogWriter *json.Encoder
 }
 
 func (v *vfs) Open(name string, flags sqlite3vfs.OpenFlag) (retFile sqlite3vfs.File, retFlag sqlite3vfs.OpenFlag, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if v.changeLogWriter != nil {
 		r := changeLogRecord{
 			TS:       time.Now(),
@@ -87,17 +168,49 @@ func (v *vfs) Open(name string, flags sqlite3vfs.OpenFlag) (retFile sqlite3vfs.F
 		}()
 	}
 
+	// a real file named like a snapshot takes precedence over it
+	if _, _, ok := splitSnapshotName(name); ok {
+		existing, _, err := fetchFileMeta(v.fileClient(name), v.table, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if existing == nil {
+			f, err := v.openSnapshot(name)
+			if err != nil {
+				return nil, 0, err
+			}
+			if f != nil {
+				return f, (flags &^ (sqlite3vfs.OpenReadWrite | sqlite3vfs.OpenCreate)) | sqlite3vfs.OpenReadOnly, nil
+			}
+		}
+	}
+
 	meta := dynamo.FileMetaV1V2{
 		MetaVersion: v.defaultSchemaVersion,
 		OrigName:    name,
 		SectorSize:  v.sectorSize,
-		CompressAlg: "zstd",
+		CompressAlg: v.compressAlg,
+		Generation:  1,
 	}
 
+	db := v.fileClient(name)
+
 	// try in loop incase we a racing with another client.
 	// give up if we fail 100 times in a row
 	for i := 0; i < 100; i++ {
-		existing, err := v.db.GetItem(&dynamodb.GetItemInput{
+		v3Meta, _, err := schemav2.FetchMetaV3(db, v.table, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if v3Meta != nil {
+			f, err := v.fileFromMeta(v3Meta)
+			if err != nil {
+				return nil, 0, err
+			}
+			return f, flags, nil
+		}
+
+		existing, err := db.GetItem(&dynamodb.GetItemInput{
 			TableName:            &v.table,
 			ConsistentRead:       aws.Bool(true),
 			ProjectionExpression: aws.String("#fname"),
@@ -131,32 +244,35 @@ func (v *vfs) Open(name string, flags sqlite3vfs.OpenFlag) (retFile sqlite3vfs.F
 			}
 			meta.LockRowKey = dynamo.FileLockPrefix + meta.RandID + "-" + name
 
-			metaBytes, err := json.Marshal(meta)
-			if err != nil {
-				return nil, 0, err
+			// only the new file is encrypted, so keep the key out of meta
+			// in case we lose the race and open an existing file instead
+			createMeta := meta
+			if v.keys != nil {
+				if v.defaultSchemaVersion < 2 {
+					return nil, 0, errors.New("encryption requires schema version 2 or later")
+				}
+				keyID, _, err := v.keys.CurrentKey()
+				if err != nil {
+					return nil, 0, fmt.Errorf("get current encryption key: %w", err)
+				}
+				createMeta.EncryptAlg = encryption.AlgAES256GCM
+				createMeta.KeyID = keyID
 			}
 
-			_, err = v.db.UpdateItem(&dynamodb.UpdateItemInput{
-				TableName:           &v.table,
-				UpdateExpression:    aws.String("SET #fname=:meta"),
-				ConditionExpression: aws.String("attribute_not_exists(#fname)"),
-				Key: map[string]*dynamodb.AttributeValue{
-					dynamo.HKey: {
-						S: aws.String(dynamo.FileMetaKey),
-					},
-					dynamo.RKey: {
-						N: aws.String("0"),
-					},
-				},
-				ExpressionAttributeNames: map[string]*string{
-					"#fname": aws.String(name),
-				},
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":meta": {
-						S: aws.String(string(metaBytes)),
-					},
-				},
-			})
+			// journals and other temporary files don't need history
+			if v.metaHistory > 0 && flags&sqlite3vfs.OpenMainDB != 0 {
+				if v.defaultSchemaVersion < 2 {
+					return nil, 0, errors.New("metadata history requires schema version 2 or later")
+				}
+				createMeta.HistorySize = v.metaHistory
+				createMeta.SharedSectors = true
+			}
+
+			if v.defaultSchemaVersion >= 3 {
+				err = schemav2.CreateMetaV3(db, v.table, &createMeta)
+			} else {
+				err = createMetaV1(db, v.table, &createMeta)
+			}
 
 			if err != nil {
 				if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
@@ -166,7 +282,7 @@ func (v *vfs) Open(name string, flags sqlite3vfs.OpenFlag) (retFile sqlite3vfs.F
 				return nil, 0, err
 			}
 
-			f, err := v.fileFromMeta(&meta)
+			f, err := v.fileFromMeta(&createMeta)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -189,18 +305,161 @@ func (v *vfs) Open(name string, flags sqlite3vfs.OpenFlag) (retFile sqlite3vfs.F
 	return nil, flags, errors.New("failed to get/create file metadata too many times due to races")
 }
 
+// openSnapshot opens name read-only if it is of the form "file@snapshot"
+// and that snapshot exists. It returns nil otherwise, so that files
+// with an "@" in their name can still be used. Open only calls it when
+// no file is named name.
+func (v *vfs) openSnapshot(name string) (sqlite3vfs.File, error) {
+	file, snapName, ok := splitSnapshotName(name)
+	if !ok {
+		return nil, nil
+	}
+
+	db := v.fileClient(file)
+	snap, err := schemav2.FetchSnapshot(db, v.table, file, snapName)
+	if err != nil || snap == nil {
+		return nil, err
+	}
+
+	return schemav2.SnapshotFromMeta(snap.Meta, v.table, db, v.changeLogWriter, v.sectorCache, v.v2Options)
+}
+
+// createMetaV1 adds meta to the shared file-meta-v1 item. This is
+// where v1 and v2 files keep their metadata. It returns a
+// *dynamodb.ConditionalCheckFailedException if a file with the same
+// name exists in any schema version.
+func createMetaV1(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) error {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	v3Key := map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: aws.String(dynamo.MetaV3Key(meta.OrigName)),
+		},
+		dynamo.RKey: {
+			N: aws.String("0"),
+		},
+	}
+	update := &dynamodb.Update{
+		TableName:           &table,
+		UpdateExpression:    aws.String("SET #fname=:meta"),
+		ConditionExpression: aws.String("attribute_not_exists(#fname)"),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileMetaKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#fname": aws.String(meta.OrigName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":meta": {
+				S: aws.String(string(metaBytes)),
+			},
+		},
+	}
+	exists := fmt.Sprintf("file %q already exists", meta.OrigName)
+
+	if !dynamo.SupportsTransactions(db) {
+		out, err := db.GetItem(&dynamodb.GetItemInput{
+			TableName:      &table,
+			ConsistentRead: aws.Bool(true),
+			Key:            v3Key,
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Item) > 0 {
+			return &dynamodb.ConditionalCheckFailedException{
+				Message_: &exists,
+			}
+		}
+
+		_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 update.TableName,
+			UpdateExpression:          update.UpdateExpression,
+			ConditionExpression:       update.ConditionExpression,
+			Key:                       update.Key,
+			ExpressionAttributeNames:  update.ExpressionAttributeNames,
+			ExpressionAttributeValues: update.ExpressionAttributeValues,
+		})
+		return err
+	}
+
+	_, err = dynamo.TransactWriteItems(db, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				ConditionCheck: &dynamodb.ConditionCheck{
+					TableName:           &table,
+					ConditionExpression: aws.String("attribute_not_exists(hash_key)"),
+					Key:                 v3Key,
+				},
+			},
+			{
+				Update: update,
+			},
+		},
+	})
+	return dynamo.ConditionFailedErr(err, exists)
+}
+
 func (v *vfs) fileFromMeta(meta *dynamo.FileMetaV1V2) (sqlite3vfs.File, error) {
 	if meta.MetaVersion == 0 || meta.MetaVersion == 1 {
-		return schemav1.FileFromMeta(meta, v.table, v.ownerID, v.db, v.changeLogWriter)
-	} else if meta.MetaVersion == 2 {
-		return schemav2.FileFromMeta(meta, v.table, v.ownerID, v.db, v.changeLogWriter, v.sectorCache)
+		return schemav1.FileFromMeta(meta, v.table, v.fileClient(meta.OrigName), v.changeLogWriter, v.newLockManager(meta))
+	} else if meta.MetaVersion == 2 || meta.MetaVersion == 3 {
+		return schemav2.FileFromMeta(meta, v.table, v.fileClient(meta.OrigName), v.changeLogWriter, v.sectorCache, v.newLockManager(meta), v.v2Options)
 	}
 
 	return nil, errors.New("Invalid schema version")
 
 }
 
+// fileClient returns the client to use for requests on behalf of the
+// file name.
+func (v *vfs) fileClient(name string) dynamo.Client {
+	if v.fileContext == nil {
+		return v.db
+	}
+
+	return dynamo.WithContext(v.rawDB, func() context.Context {
+		if ctx := v.fileContext(name); ctx != nil {
+			return ctx
+		}
+		return v.ctx
+	}, v.requestTimeout)
+}
+
+func (v *vfs) newLockManager(meta *dynamo.FileMetaV1V2) lock.LockManager {
+	opts := v.lockOptions
+	if v.leaseLostHandler != nil {
+		name := meta.OrigName
+		opts.OnLeaseLost = func(err error) {
+			v.leaseLostHandler(name, err)
+		}
+	}
+
+	// Every handle needs its own owner: two connections to the same
+	// file in this process must not share a reader lease or writer slot.
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(err)
+	}
+	owner := v.ownerID + "-" + hex.EncodeToString(suffix)
+
+	if v.lockStrategy == MultiReaderLock {
+		return lock.NewMultiReaderLockManager(v.db, v.table, meta.LockRowKey, owner, opts)
+	}
+	return lock.NewGlobalLockManger(v.db, v.table, meta.LockRowKey, owner, opts)
+}
+
 func (v *vfs) Delete(name string, dirSync bool) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if v.changeLogWriter != nil {
 		r := changeLogRecord{
 			TS:      time.Now(),
@@ -219,7 +478,57 @@ func (v *vfs) Delete(name string, dirSync bool) (retErr error) {
 		}()
 	}
 
-	existing, err := v.db.Query(&dynamodb.QueryInput{
+	db := v.fileClient(name)
+
+	meta, rawMeta, err := schemav2.FetchMetaV3(db, v.table, name)
+	if err != nil {
+		return err
+	}
+
+	if meta != nil {
+		err = schemav2.DeleteMetaV3(db, v.table, meta, rawMeta)
+	} else {
+		meta, err = v.deleteMetaV1(db, name)
+	}
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return nil
+	}
+
+	f, err := v.fileFromMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	ff := f.(interface {
+		CleanupSectors(*dynamo.FileMetaV1V2) error
+	})
+
+	// The file is already gone at this point. If cleanup fails the
+	// remaining sectors are orphaned and will be removed by CollectGarbage,
+	// so don't fail the delete.
+	err = ff.CleanupSectors(meta)
+	if err != nil {
+		log.Printf("donutdb: cleanup sectors for deleted file %q err: %s", name, err)
+	}
+
+	if meta.HistorySize > 0 {
+		err = schemav2.DeleteHistory(db, v.table, meta)
+		if err != nil {
+			log.Printf("donutdb: delete metadata history for deleted file %q err: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// deleteMetaV1 removes name from the shared file-meta-v1 item and
+// returns its metadata, or nil if there is no such file.
+func (v *vfs) deleteMetaV1(db dynamo.Client, name string) (*dynamo.FileMetaV1V2, error) {
+	existing, err := db.Query(&dynamodb.QueryInput{
 		TableName:            &v.table,
 		Limit:                aws.Int64(1),
 		ConsistentRead:       aws.Bool(true),
@@ -239,11 +548,11 @@ func (v *vfs) Delete(name string, dirSync bool) (retErr error) {
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(existing.Items) == 0 {
-		return nil
+	if len(existing.Items) == 0 || existing.Items[0][name] == nil {
+		return nil, nil
 	}
 
 	metaBytes := *existing.Items[0][name].S
@@ -251,10 +560,10 @@ func (v *vfs) Delete(name string, dirSync bool) (retErr error) {
 	var meta dynamo.FileMetaV1V2
 	err = json.Unmarshal([]byte(metaBytes), &meta)
 	if err != nil {
-		return fmt.Errorf("unmarshal file meta v1 err: %w", err)
+		return nil, fmt.Errorf("unmarshal file meta v1 err: %w", err)
 	}
 
-	_, err = v.db.UpdateItem(&dynamodb.UpdateItemInput{
+	_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
 		TableName:           &v.table,
 		UpdateExpression:    aws.String("REMOVE #fname"),
 		ConditionExpression: aws.String("#fname=:meta"),
@@ -277,23 +586,15 @@ func (v *vfs) Delete(name string, dirSync bool) (retErr error) {
 	})
 
 	if err != nil {
-		return err
-	}
-
-	f, err := v.fileFromMeta(&meta)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ff := f.(interface {
-		CleanupSectors(*dynamo.FileMetaV1V2) error
-	})
-
-	go ff.CleanupSectors(&meta)
-	return nil
+	return &meta, nil
 }
 
 func (v *vfs) Access(name string, flag sqlite3vfs.AccessFlag) (retOk bool, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if v.changeLogWriter != nil {
 		r := changeLogRecord{
 			TS:      time.Now(),
@@ -312,7 +613,30 @@ func (v *vfs) Access(name string, flag sqlite3vfs.AccessFlag) (retOk bool, retEr
 		}()
 	}
 
-	existing, err := v.db.Query(&dynamodb.QueryInput{
+	db := v.fileClient(name)
+
+	v3Item, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:            &v.table,
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("hash_key"),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.MetaV3Key(name)),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if len(v3Item.Item) > 0 {
+		return true, nil
+	}
+
+	existing, err := db.Query(&dynamodb.QueryInput{
 		TableName:            &v.table,
 		Limit:                aws.Int64(1),
 		ConsistentRead:       aws.Bool(true),
@@ -337,6 +661,16 @@ func (v *vfs) Access(name string, flag sqlite3vfs.AccessFlag) (retOk bool, retEr
 
 	exists := len(existing.Items) > 0 && len(existing.Items[0]) > 0
 
+	if file, snapName, ok := splitSnapshotName(name); ok && !exists {
+		snap, err := schemav2.FetchSnapshot(v.fileClient(file), v.table, file, snapName)
+		if err != nil {
+			return false, err
+		}
+		if snap != nil {
+			return flag != sqlite3vfs.AccessReadWrite, nil
+		}
+	}
+
 	if flag == sqlite3vfs.AccessExists {
 		return exists, nil
 	}
@@ -374,5 +708,10 @@ func (v *vfs) LsFiles() ([]string, error) {
 		out = append(out, k)
 	}
 
-	return out, nil
+	v3Files, err := schemav2.ListFilesV3(v.db, v.table)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, v3Files...), nil
 }
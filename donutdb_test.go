@@ -2,24 +2,39 @@ package donutdb
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/google/go-cmp/cmp"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/encryption"
 	"github.com/psanford/donutdb/internal/dynamo"
 	"github.com/psanford/donutdb/internal/dynamotest"
+	"github.com/psanford/donutdb/internal/fakedynamo"
 	"github.com/psanford/donutdb/internal/schemav1"
+	"github.com/psanford/donutdb/internal/schemav2"
+	"github.com/psanford/donutdb/sectorcache"
 	"github.com/psanford/sqlite3vfs"
 )
 
-var schemaVersions = []int{1, 2}
+var schemaVersions = []int{1, 2, 3}
 
 func TestDonutDB(t *testing.T) {
 	for _, version := range schemaVersions {
@@ -478,6 +493,381 @@ func TestReadWriteCases(t *testing.T) {
 	}
 }
 
+func TestAtomicSyncSchemaV2(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer serverInfo.Cleanup()
+
+	writerVFS := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024))
+	readerVFS := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024))
+
+	fname := fmt.Sprintf("unbolted-tinsmith-%d", time.Now().UnixNano())
+
+	wf, _, err := writerVFS.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wf.Close()
+
+	orig := make([]byte, 4096)
+	rand.Read(orig)
+	_, err = wf.WriteAt(orig, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wf.Sync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write enough sectors to trigger multiple staging flushes
+	data := make([]byte, 100*1024)
+	rand.Read(data)
+	_, err = wf.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rf, _, err := readerVFS.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	size, err := rf.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(orig)) {
+		t.Fatalf("reader saw uncommitted size: got=%d expected=%d", size, len(orig))
+	}
+
+	got := make([]byte, len(orig))
+	_, err = rf.ReadAt(got, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(orig, got) {
+		t.Fatal("reader saw uncommitted data before Sync")
+	}
+
+	err = wf.Sync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err = rf.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("reader size after sync: got=%d expected=%d", size, len(data))
+	}
+
+	got = make([]byte, len(data))
+	_, err = rf.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("reader data mismatch after Sync")
+	}
+}
+
+func TestMetaConflictSchemaV2(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer serverInfo.Cleanup()
+
+	vfs1 := New(serverInfo.DB, serverInfo.TableName)
+	vfs2 := New(serverInfo.DB, serverInfo.TableName)
+
+	fname := fmt.Sprintf("sheathing-gumdrop-%d", time.Now().UnixNano())
+
+	f1, _, err := vfs1.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+
+	f2, _, err := vfs2.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	// simulate two writers that both believe they hold the lock
+	_, err = f1.WriteAt([]byte("first-writer"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f2.WriteAt([]byte("second-writer"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f1.Sync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f2.Sync(0)
+	if !errors.Is(err, MetaConflictErr) {
+		t.Fatalf("expected MetaConflictErr but got %v", err)
+	}
+
+	got := make([]byte, len("first-writer"))
+	_, err = f1.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if string(got) != "first-writer" {
+		t.Fatalf("got %q expected %q", got, "first-writer")
+	}
+}
+
+func TestSchemaV3SectorMap(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer serverInfo.Cleanup()
+
+	v := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024), WithDefaultSchemaVersion(3))
+
+	fname := fmt.Sprintf("spoonbill-ledger-%d", time.Now().UnixNano())
+
+	f, _, err := v.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// enough sectors to need two sector map chunks
+	sectorCount := schemav2.SectorMapChunkSize + 100
+	data := make([]byte, sectorCount*1024)
+	rand.Read(data)
+
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	countChunks := func() int {
+		out, err := dynamo.Scan(serverInfo.DB, &dynamodb.ScanInput{
+			TableName: &serverInfo.TableName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, item := range out.Items {
+			if strings.HasPrefix(*item[dynamo.HKey].S, dynamo.FileSectorMapV3Prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	if n := countChunks(); n != 2 {
+		t.Fatalf("expected 2 sector map chunks but got %d", n)
+	}
+
+	meta, _, err := schemav2.FetchMetaV3(serverInfo.DB, serverInfo.TableName, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.SectorChunks) != 2 || len(meta.Sectors) != sectorCount {
+		t.Fatalf("got %d chunks and %d sectors, expected 2 and %d", len(meta.SectorChunks), len(meta.Sectors), sectorCount)
+	}
+
+	// rewriting a sector in the second chunk replaces just that chunk
+	copy(data[len(data)-1024:], "spoonbill")
+	_, err = f.WriteAt(data[len(data)-1024:], int64(len(data)-1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countChunks(); n != 2 {
+		t.Fatalf("expected the superseded chunk to be deleted, got %d sector map chunks", n)
+	}
+
+	vfs2 := New(serverInfo.DB, serverInfo.TableName)
+	f2, _, err := vfs2.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(data))
+	_, err = f2.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file content mismatch")
+	}
+	f2.Close()
+
+	files, err := v.(*vfs).LsFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(files, []string{fname}) {
+		t.Fatalf("LsFiles got %v expected [%s]", files, fname)
+	}
+
+	err = v.Delete(fname, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err = v.(*vfs).LsFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("LsFiles after delete got %v", files)
+	}
+
+	if n := countChunks(); n != 0 {
+		t.Fatalf("expected no sector map chunks after delete but got %d", n)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer serverInfo.Cleanup()
+
+	vfs := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024), WithDefaultSchemaVersion(3))
+
+	keepName := fmt.Sprintf("gc-keep-%d", time.Now().UnixNano())
+	lostName := fmt.Sprintf("gc-lost-%d", time.Now().UnixNano())
+
+	keep, _, err := vfs.Open(keepName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keep.Close()
+
+	_, err = keep.WriteAt(bytes.Repeat([]byte("a"), 2048), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = keep.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// overwriting sector 0 leaves the old version orphaned
+	_, err = keep.WriteAt(bytes.Repeat([]byte("b"), 1024), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = keep.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	lost, _, err := vfs.Open(lostName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lost.WriteAt(bytes.Repeat([]byte("c"), 3000), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lost.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+	lost.Close()
+
+	// simulate a delete whose sector cleanup never ran
+	_, err = serverInfo.DB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &serverInfo.TableName,
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {S: aws.String(dynamo.MetaV3Key(lostName))},
+			dynamo.RKey: {N: aws.String("0")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// everything is within the default grace period
+	result, err := CollectGarbage(serverInfo.DB, serverInfo.TableName, GCOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Orphans) != 0 || result.Skipped != 4 {
+		t.Fatalf("expected 0 orphans, 4 skipped but got %d orphans, %d skipped", len(result.Orphans), result.Skipped)
+	}
+
+	opts := GCOptions{
+		DryRun:      true,
+		GracePeriod: time.Nanosecond,
+	}
+	result, err = CollectGarbage(serverInfo.DB, serverInfo.TableName, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keepOrphans, lostOrphans int
+	for _, o := range result.Orphans {
+		switch o.File {
+		case keepName:
+			keepOrphans++
+		case "":
+			lostOrphans++
+		default:
+			t.Fatalf("unexpected orphan %+v", o)
+		}
+	}
+	if keepOrphans != 1 || lostOrphans != 3 {
+		t.Fatalf("expected 1 superseded and 3 deleted file orphans but got %d and %d", keepOrphans, lostOrphans)
+	}
+
+	opts.DryRun = false
+	result, err = CollectGarbage(serverInfo.DB, serverInfo.TableName, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Orphans) != 4 {
+		t.Fatalf("expected 4 deleted orphans but got %d", len(result.Orphans))
+	}
+
+	result, err = CollectGarbage(serverInfo.DB, serverInfo.TableName, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Orphans) != 0 {
+		t.Fatalf("expected no orphans after gc but got %+v", result.Orphans)
+	}
+
+	got := make([]byte, 2048)
+	_, err = keep.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	expect := append(bytes.Repeat([]byte("b"), 1024), bytes.Repeat([]byte("a"), 1024)...)
+	if !bytes.Equal(got, expect) {
+		t.Fatalf("file content changed after gc")
+	}
+}
+
 func TestErrorOnBadSectorSchemaV1(t *testing.T) {
 	serverInfo, err := dynamotest.SetupDynamoServer()
 	if err != nil {
@@ -734,3 +1124,2273 @@ type sizeOff struct {
 	size   int
 	offset int64
 }
+
+func TestFileContextCancel(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	var (
+		mu          sync.Mutex
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+	fileCtx := func(name string) context.Context {
+		mu.Lock()
+		defer mu.Unlock()
+		return ctx
+	}
+
+	v := New(serverInfo.DB, serverInfo.TableName, WithFileContext(fileCtx), WithRequestTimeout(10*time.Second))
+	vfsName := fmt.Sprintf("dynamodb-ctx-%d", time.Now().UnixNano())
+	err = sqlite3vfs.RegisterVFS(vfsName, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbName := fmt.Sprintf("donutdb-ctx-test-%d.db", time.Now().UnixNano())
+	db, err := sql.Open("sqlite3", dbName+"?vfs="+vfsName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE foo (id int NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO foo (id) VALUES (1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	_, err = db.Exec(`INSERT INTO foo (id) VALUES (2)`)
+	if err == nil || !strings.Contains(err.Error(), "disk I/O error") {
+		t.Fatalf("insert with canceled context got err=%v expected disk I/O error", err)
+	}
+
+	mu.Lock()
+	ctx, cancel = context.WithCancel(context.Background())
+	mu.Unlock()
+	defer cancel()
+
+	// the failed transaction was rolled back and can be retried
+	_, err = db.Exec(`INSERT INTO foo (id) VALUES (2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT count(*) FROM foo`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("row count got=%d expected=2", count)
+	}
+}
+
+// metaReadCounter counts GetItem calls for file metadata.
+type metaReadCounter struct {
+	DynamoClient
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (c *metaReadCounter) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	hk := aws.StringValue(input.Key[dynamo.HKey].S)
+	if hk == dynamo.FileMetaKey || strings.HasPrefix(hk, dynamo.FileMetaV3Prefix) {
+		c.mu.Lock()
+		c.reads++
+		c.mu.Unlock()
+	}
+	return c.DynamoClient.GetItem(input)
+}
+
+func (c *metaReadCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reads
+}
+
+func TestMetaCachedUnderLock(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		serverInfo, err := dynamotest.SetupDynamoServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer serverInfo.Cleanup()
+
+		counter := &metaReadCounter{DynamoClient: serverInfo.DB}
+		v := New(counter, serverInfo.TableName, WithSectorSize(1024), WithDefaultSchemaVersion(version))
+
+		fname := fmt.Sprintf("metacache-%d-%d", version, time.Now().UnixNano())
+		f, _, err := v.Open(fname, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		err = f.Lock(sqlite3vfs.LockShared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Lock(sqlite3vfs.LockReserved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Lock(sqlite3vfs.LockExclusive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := bytes.Repeat([]byte("x"), 4096)
+		_, err = f.WriteAt(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Sync(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := counter.count()
+
+		got := make([]byte, len(data))
+		for i := 0; i < 5; i++ {
+			size, err := f.FileSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != int64(len(data)) {
+				t.Fatalf("v%d size got=%d expected=%d", version, size, len(data))
+			}
+			_, err = f.ReadAt(got, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("v%d read data mismatch", version)
+		}
+
+		if reads := counter.count() - start; reads != 0 {
+			t.Fatalf("v%d metadata read %d times while locked after commit, expected 0", version, reads)
+		}
+
+		err = f.Unlock(sqlite3vfs.LockNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a new lock sees changes made by other clients
+		start = counter.count()
+		err = f.Lock(sqlite3vfs.LockShared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			_, err = f.FileSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reads := counter.count() - start; reads != 1 {
+			t.Fatalf("v%d metadata read %d times after relock, expected 1", version, reads)
+		}
+		err = f.Unlock(sqlite3vfs.LockNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParallelReadAndReadAhead(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	if fake, ok := serverInfo.DB.(*fakedynamo.DB); ok {
+		// make the parallel batches deal with unprocessed keys
+		fake.BatchGetItemLimit = 7
+	}
+
+	const (
+		sectorSize = 1024
+		numSectors = 300
+	)
+
+	writer := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(sectorSize))
+	fname := fmt.Sprintf("read-ahead-%d", time.Now().UnixNano())
+
+	data := make([]byte, sectorSize*numSectors)
+	rand.Read(data)
+
+	wf, _, err := writer.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wf.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wf.Sync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.Close()
+
+	cache := sectorcache.NewLRU(1 << 20)
+	v := New(serverInfo.DB, serverInfo.TableName, WithReadConcurrency(4), WithReadAhead(32), WithSectorCacheV2(cache))
+
+	// one big read fans out over many batches
+	f, _, err := v.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	_, err = f.ReadAt(got, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("parallel read data mismatch")
+	}
+	f.Close()
+
+	fname2 := fname + "-2"
+	wf, _, err = writer.Open(fname2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data2 := make([]byte, sectorSize*numSectors)
+	rand.Read(data2)
+	_, err = wf.WriteAt(data2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wf.Sync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.Close()
+
+	// a few sequential reads start read-ahead
+	f, _, err = v.Open(fname2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, sectorSize)
+	for i := 0; i < 3; i++ {
+		_, err = f.ReadAt(buf, int64(i*sectorSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close waits for the prefetch to finish
+	f.Close()
+
+	before := cache.Stats()
+
+	f, _, err = v.Open(fname2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// sectors 2 through 33 were prefetched
+	for i := 3; i < 34; i++ {
+		_, err = f.ReadAt(buf, int64(i*sectorSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data2[i*sectorSize:(i+1)*sectorSize]) {
+			t.Fatalf("sector %d data mismatch", i)
+		}
+	}
+
+	after := cache.Stats()
+	if hits := after.Hits - before.Hits; hits < 31 {
+		t.Fatalf("got %d cache hits for prefetched sectors, expected at least 31", hits)
+	}
+}
+
+func TestBatchWriteUnprocessedRetry(t *testing.T) {
+	for _, version := range schemaVersions {
+		serverInfo, err := dynamotest.SetupDynamoServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer serverInfo.Cleanup()
+
+		fake, ok := serverInfo.DB.(*fakedynamo.DB)
+		if !ok {
+			t.Skip("requires the fake dynamodb to simulate throttling")
+		}
+		// full batch writes leave some of their items unprocessed
+		fake.BatchWriteItemLimit = 20
+
+		v := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024), WithDefaultSchemaVersion(version), WithWriteConcurrency(4))
+
+		fname := fmt.Sprintf("unprocessed-%d-%d", version, time.Now().UnixNano())
+		f, _, err := v.Open(fname, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		data := make([]byte, 1024*120)
+		rand.Read(data)
+		_, err = f.WriteAt(data, 0)
+		if err != nil {
+			t.Fatalf("v%d write: %s", version, err)
+		}
+		err = f.Sync(0)
+		if err != nil {
+			t.Fatalf("v%d sync: %s", version, err)
+		}
+
+		got := make([]byte, len(data))
+		_, err = f.ReadAt(got, 0)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("v%d data mismatch after throttled writes", version)
+		}
+	}
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	zstdBest, err := compression.Zstd(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// readers use the default codec and must honor each file's own
+	reader := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024))
+
+	for _, codec := range []compression.Codec{compression.None, compression.S2, compression.Snappy, zstdBest} {
+		for _, schemaVersion := range []int{1, 3} {
+			writer := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024), WithCompression(codec), WithDefaultSchemaVersion(schemaVersion))
+			fname := fmt.Sprintf("compress-%s-v%d-%d", codec.Name(), schemaVersion, time.Now().UnixNano())
+
+			data := bytes.Repeat([]byte("pelican "), 1024)
+
+			wf, _, err := writer.Open(fname, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = wf.WriteAt(data, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = wf.Sync(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wf.Close()
+
+			if schemaVersion == 3 {
+				meta, _, err := schemav2.FetchMetaV3(serverInfo.DB, serverInfo.TableName, fname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if meta.CompressAlg != codec.Name() {
+					t.Fatalf("CompressAlg got=%q expected=%q", meta.CompressAlg, codec.Name())
+				}
+			}
+
+			rf, _, err := reader.Open(fname, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(data))
+			_, err = rf.ReadAt(got, 0)
+			if err != nil {
+				t.Fatalf("%s v%d: read err: %s", codec.Name(), schemaVersion, err)
+			}
+			rf.Close()
+
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s v%d: read data mismatch", codec.Name(), schemaVersion)
+			}
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	keys := encryption.StaticKeys{
+		CurrentID: "key-1",
+		Keys: map[string][]byte{
+			"key-1": bytes.Repeat([]byte{0x11}, encryption.KeySize),
+		},
+	}
+
+	cache := sectorcache.NewLRU(1 << 20)
+	v := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024), WithEncryption(keys), WithSectorCacheV2(cache), WithCompression(compression.None), WithDefaultSchemaVersion(3))
+	fname := fmt.Sprintf("encrypted-%d", time.Now().UnixNano())
+
+	data := bytes.Repeat([]byte("secret-heron "), 400)
+
+	f, _, err := v.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	meta, _, err := schemav2.FetchMetaV3(serverInfo.DB, serverInfo.TableName, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.KeyID != "key-1" || meta.EncryptAlg != encryption.AlgAES256GCM {
+		t.Fatalf("got key_id=%q encrypt_alg=%q", meta.KeyID, meta.EncryptAlg)
+	}
+
+	// neither the table nor the cache should hold any plaintext
+	out, err := dynamo.Scan(serverInfo.DB, &dynamodb.ScanInput{
+		TableName: &serverInfo.TableName,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sectorItems []map[string]*dynamodb.AttributeValue
+	for _, item := range out.Items {
+		if attr := item["bytes"]; attr != nil && bytes.Contains(attr.B, []byte("secret-heron")) {
+			t.Fatalf("plaintext found in item %s", *item[dynamo.HKey].S)
+		}
+		if strings.HasPrefix(*item[dynamo.HKey].S, dynamo.FileDataV2Prefix) {
+			sectorItems = append(sectorItems, item)
+		}
+	}
+	for _, id := range meta.Sectors {
+		if cached := cache.Get(id); bytes.Contains(cached, []byte("secret-heron")) {
+			t.Fatalf("plaintext found in cached sector %s", id)
+		}
+	}
+
+	readAll := func(v sqlite3vfs.VFS) ([]byte, error) {
+		f, _, err := v.Open(fname, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		got := make([]byte, len(data))
+		_, err = f.ReadAt(got, 0)
+		return got, err
+	}
+
+	// rotating the current key keeps old files readable
+	keys.CurrentID = "key-2"
+	keys.Keys["key-2"] = bytes.Repeat([]byte{0x22}, encryption.KeySize)
+	got, err := readAll(New(serverInfo.DB, serverInfo.TableName, WithEncryption(keys)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read data mismatch")
+	}
+
+	// the cached sectors are sealed too, but still usable
+	got, err = readAll(New(serverInfo.DB, serverInfo.TableName, WithEncryption(keys), WithSectorCacheV2(cache)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read data from cache mismatch")
+	}
+
+	if _, err := readAll(New(serverInfo.DB, serverInfo.TableName)); err == nil {
+		t.Fatal("expected error opening an encrypted file without a key provider")
+	}
+
+	// tampering with a stored sector is detected on read
+	tampered := sectorItems[0]
+	tampered["bytes"].B[len(tampered["bytes"].B)-1] ^= 1
+	_, err = serverInfo.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: &serverInfo.TableName,
+		Item:      tampered,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readAll(New(serverInfo.DB, serverInfo.TableName, WithEncryption(keys)))
+	if err != sqlite3vfs.CorruptError {
+		t.Fatalf("tampered sector err got=%v expected=%v", err, sqlite3vfs.CorruptError)
+	}
+}
+
+func TestSectorCorruption(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	v := New(serverInfo.DB, serverInfo.TableName, WithSectorSize(1024), WithDefaultSchemaVersion(3))
+	fname := fmt.Sprintf("corrupt-%d", time.Now().UnixNano())
+
+	data := make([]byte, 3*1024)
+	rand.Read(data)
+
+	f, _, err := v.Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Sync(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	meta, _, err := schemav2.FetchMetaV3(serverInfo.DB, serverInfo.TableName, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codec, err := compression.Lookup(meta.CompressAlg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overwrite := func(sectorID string, stored []byte) {
+		_, err := serverInfo.DB.PutItem(&dynamodb.PutItemInput{
+			TableName: &serverInfo.TableName,
+			Item: map[string]*dynamodb.AttributeValue{
+				dynamo.HKey: {
+					S: aws.String(dynamo.SectorKey(meta.RandID, fname, sectorID)),
+				},
+				dynamo.RKey: {
+					N: aws.String("0"),
+				},
+				"bytes": {
+					B: stored,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// sector 0 decompresses fine but has the wrong content,
+	// sector 1 isn't valid zstd at all
+	overwrite(meta.Sectors[0], codec.Compress(nil, bytes.Repeat([]byte{'x'}, 1024)))
+	overwrite(meta.Sectors[1], []byte("not zstd"))
+
+	checks := []struct {
+		off    int64
+		reason string
+	}{
+		{0, dynamo.CorruptHashMismatch},
+		{1024, dynamo.CorruptDecompress},
+	}
+
+	for _, check := range checks {
+		before := corruptSectorCount(t, check.reason)
+
+		f, _, err := New(serverInfo.DB, serverInfo.TableName).Open(fname, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.ReadAt(make([]byte, 1024), check.off)
+		f.Close()
+
+		if err != sqlite3vfs.CorruptError {
+			t.Fatalf("read at %d err got=%v expected=%v", check.off, err, sqlite3vfs.CorruptError)
+		}
+
+		if after := corruptSectorCount(t, check.reason); after != before+1 {
+			t.Fatalf("corrupt sector count for %s got=%v expected=%v", check.reason, after, before+1)
+		}
+	}
+
+	// the intact sector is still readable
+	f, _, err = New(serverInfo.DB, serverInfo.TableName).Open(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := make([]byte, 1024)
+	_, err = f.ReadAt(got, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[2048:]) {
+		t.Fatal("read data mismatch")
+	}
+}
+
+// corruptSectorCount returns the donutdb_corrupt_sector_count metric
+// for reason.
+func corruptSectorCount(t *testing.T, reason string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "donutdb_corrupt_sector_count" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if label.GetName() == "reason" && label.GetValue() == reason {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestFsck(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	prefix := fmt.Sprintf("fsck-%d", time.Now().UnixNano())
+	v3Name := prefix + "-v3"
+	v1Name := prefix + "-v1"
+
+	for _, file := range []struct {
+		name    string
+		version int
+	}{
+		{v3Name, 3},
+		{v1Name, 1},
+	} {
+		v := New(db, table, WithSectorSize(1024), WithDefaultSchemaVersion(file.version))
+		f, _, err := v.Open(file.name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 3*1024+100)
+		rand.Read(data)
+		_, err = f.WriteAt(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Sync(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	report, err := Fsck(db, table, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("expected clean report, got problems: %+v", report.Problems)
+	}
+	if len(report.Files) != 2 {
+		t.Fatalf("expected 2 files in report, got %+v", report.Files)
+	}
+	for _, f := range report.Files {
+		if !f.ContentChecked {
+			t.Fatalf("content of %s was not checked", f.Name)
+		}
+	}
+
+	meta, _, err := schemav2.FetchMetaV3(db, table, v3Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt one sector and remove another
+	_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: &table,
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.SectorKey(meta.RandID, v3Name, meta.Sectors[0])),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+		UpdateExpression: aws.String("SET #bytes = :bytes"),
+		ExpressionAttributeNames: map[string]*string{
+			"#bytes": aws.String("bytes"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":bytes": {
+				B: []byte("garbage"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &table,
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.SectorKey(meta.RandID, v3Name, meta.Sectors[2])),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remove a v1 sector from the middle of the file
+	var v1Meta dynamo.FileMetaV1V2
+	metaRow, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: &table,
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileMetaKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal([]byte(*metaRow.Item[v1Name].S), &v1Meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &table,
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(v1Meta.DataRowKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("1024"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leave behind an expired lock and a lock for a deleted file
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMicro(), 10)
+	for _, lockKey := range []string{meta.LockRowKey, dynamo.FileLockPrefix + "gone-" + prefix} {
+		_, err = db.PutItem(&dynamodb.PutItemInput{
+			TableName: &table,
+			Item: map[string]*dynamodb.AttributeValue{
+				dynamo.HKey: {
+					S: aws.String(lockKey),
+				},
+				dynamo.RKey: {
+					N: aws.String("0"),
+				},
+				"owner_id": {
+					S: aws.String("crashed"),
+				},
+				"deadline_us": {
+					N: aws.String(expired),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err = Fsck(db, table, FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, p := range report.Problems {
+		got = append(got, p.File+" "+p.Check)
+	}
+	sort.Strings(got)
+
+	expect := []string{
+		" " + FsckStaleLock,
+		v1Name + " " + FsckSectorMissing,
+		v3Name + " " + FsckDecompress,
+		v3Name + " " + FsckSectorMissing,
+		v3Name + " " + FsckStaleLock,
+	}
+	if diff := cmp.Diff(expect, got); diff != "" {
+		t.Fatalf("problems mismatch (-want +got):\n%s", diff)
+	}
+
+	// limiting the check to one file skips the lock rows
+	report, err = Fsck(db, table, FsckOptions{Files: []string{v1Name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 || len(report.Problems) != 1 || report.Problems[0].Check != FsckSectorMissing {
+		t.Fatalf("unexpected report for %s: %+v", v1Name, report)
+	}
+}
+
+func TestMigrateToV2(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	name := fmt.Sprintf("migrate-%d", time.Now().UnixNano())
+
+	v1 := New(db, table, WithSectorSize(1024), WithDefaultSchemaVersion(1))
+	oldFile, _, err := v1.Open(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldFile.Close()
+
+	data := make([]byte, 3*1024+100)
+	rand.Read(data)
+	_, err = oldFile.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a client holding the lock keeps the migration from starting
+	err = oldFile.Lock(sqlite3vfs.LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = MigrateToV2(db, table, name, MigrateOptions{LockTimeout: 100 * time.Millisecond})
+	if err == nil {
+		t.Fatal("expected migration of a locked file to fail")
+	}
+	err = oldFile.Unlock(sqlite3vfs.LockNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := MigrateToV2(db, table, name, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := MigrateResult{
+		Migrated:    true,
+		Size:        int64(len(data)),
+		Sectors:     4,
+		RemovedRows: 4,
+	}
+	if diff := cmp.Diff(expect, *result); diff != "" {
+		t.Fatalf("result mismatch (-want +got):\n%s", diff)
+	}
+
+	err = oldFile.Lock(sqlite3vfs.LockShared)
+	if !errors.Is(err, FileMigratedErr) {
+		t.Fatalf("expected FileMigratedErr locking the old v1 file, got %v", err)
+	}
+
+	v := New(db, table)
+	f, _, err := v.Open(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.(*schemav2.File); !ok {
+		t.Fatalf("expected a schemav2 file after migration, got %T", f)
+	}
+	got := make([]byte, len(data))
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("migrated file content mismatch")
+	}
+	f.Close()
+
+	report, err := Fsck(db, table, FsckOptions{Files: []string{name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Files[0].SchemaVersion != 2 {
+		t.Fatalf("unexpected fsck report after migration: %+v", report)
+	}
+
+	// Resuming a migration that was interrupted after the swap only
+	// removes the remaining v1 rows.
+	meta, _, err := fetchMetaV1(db, table, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName: &table,
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileDataPrefix + meta.RandID + "-" + name),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+			"bytes": {
+				B: []byte("leftover"),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = MigrateToV2(db, table, name, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect.Migrated = false
+	expect.RemovedRows = 1
+	if diff := cmp.Diff(expect, *result); diff != "" {
+		t.Fatalf("resume result mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	name := fmt.Sprintf("snapshot-%d", time.Now().UnixNano())
+
+	v := New(db, table, WithSectorSize(1024))
+	f, _, err := v.Open(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := bytes.Repeat([]byte("a"), 3000)
+	_, err = f.WriteAt(orig, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := CreateSnapshot(db, table, name, "before", SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(orig)) {
+		t.Fatalf("snapshot size got %d expected %d", info.Size, len(orig))
+	}
+
+	_, err = CreateSnapshot(db, table, name, "before", SnapshotOptions{})
+	if !errors.Is(err, SnapshotExistsErr) {
+		t.Fatalf("expected SnapshotExistsErr for a duplicate snapshot, got %v", err)
+	}
+	_, err = CreateSnapshot(db, table, name, "a@b", SnapshotOptions{})
+	if err == nil {
+		t.Fatal("expected an error for a snapshot name containing @")
+	}
+
+	// overwrite and truncate the file; the snapshot keeps the old content
+	_, err = f.WriteAt(bytes.Repeat([]byte("b"), 1024), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Truncate(1024); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	snapName := name + SnapshotSeparator + "before"
+
+	checkSnapshot := func() {
+		t.Helper()
+
+		v := New(db, table)
+		ok, err := v.Access(snapName, sqlite3vfs.AccessExists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("expected %s to exist", snapName)
+		}
+
+		snap, flags, err := v.Open(snapName, sqlite3vfs.OpenReadWrite|sqlite3vfs.OpenMainDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		if flags&sqlite3vfs.OpenReadOnly == 0 || flags&sqlite3vfs.OpenReadWrite != 0 {
+			t.Fatalf("expected snapshot to be opened read-only, got flags %x", flags)
+		}
+
+		size, err := snap.FileSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(orig)) {
+			t.Fatalf("snapshot file size got %d expected %d", size, len(orig))
+		}
+
+		got := make([]byte, len(orig))
+		_, err = snap.ReadAt(got, 0)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, orig) {
+			t.Fatal("snapshot content mismatch")
+		}
+
+		_, err = snap.WriteAt([]byte("c"), 0)
+		if err == nil {
+			t.Fatal("expected write to snapshot to fail")
+		}
+		err = snap.Lock(sqlite3vfs.LockReserved)
+		if err == nil {
+			t.Fatal("expected reserved lock on snapshot to fail")
+		}
+	}
+
+	checkSnapshot()
+
+	gcOpts := GCOptions{
+		GracePeriod: time.Nanosecond,
+	}
+	fileOrphans := func() int {
+		t.Helper()
+
+		result, err := CollectGarbage(db, table, gcOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		for _, o := range result.Orphans {
+			if strings.Contains(o.HashKey, name) {
+				count++
+			}
+		}
+		return count
+	}
+
+	// every sector the writes replaced is still referenced by the snapshot
+	if n := fileOrphans(); n != 0 {
+		t.Fatalf("expected gc to keep the snapshot's sectors but it removed %d", n)
+	}
+
+	err = v.Delete(name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSnapshot()
+
+	// only the sector written after the snapshot is garbage now
+	if n := fileOrphans(); n != 1 {
+		t.Fatalf("expected 1 orphan after deleting the file but got %d", n)
+	}
+
+	checkSnapshot()
+
+	snaps, err := ListSnapshots(db, table, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].Name != "before" || snaps[0].Size != int64(len(orig)) {
+		t.Fatalf("unexpected snapshot list %+v", snaps)
+	}
+
+	err = DeleteSnapshot(db, table, name, "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteSnapshot(db, table, name, "before")
+	if err == nil {
+		t.Fatal("expected deleting a missing snapshot to fail")
+	}
+
+	if n := fileOrphans(); n != 3 {
+		t.Fatalf("expected the snapshot's 3 sectors to be collected but got %d", n)
+	}
+
+	ok, err := v.Access(snapName, sqlite3vfs.AccessExists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatalf("expected %s to no longer exist", snapName)
+	}
+}
+
+func TestClone(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	ts := time.Now().UnixNano()
+	srcName := fmt.Sprintf("clone-src-%d", ts)
+	dstName := fmt.Sprintf("clone-dst-%d", ts)
+
+	v := New(db, table, WithSectorSize(1024), WithDefaultSchemaVersion(3))
+	src, _, err := v.Open(srcName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	// enough sectors to need two sector map chunks
+	data := make([]byte, (schemav2.SectorMapChunkSize+100)*1024)
+	rand.Read(data)
+	_, err = src.WriteAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = src.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Clone(db, table, srcName, dstName, CloneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Clone(db, table, srcName, dstName, CloneOptions{})
+	if !errors.Is(err, FileExistsErr) {
+		t.Fatalf("expected FileExistsErr cloning onto an existing file, got %v", err)
+	}
+
+	dst, _, err := v.Open(dstName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	checkContent := func(f sqlite3vfs.File, expect []byte) {
+		t.Helper()
+
+		size, err := f.FileSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(expect)) {
+			t.Fatalf("file size got %d expected %d", size, len(expect))
+		}
+		got := make([]byte, len(expect))
+		_, err = f.ReadAt(got, 0)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expect) {
+			t.Fatal("file content mismatch")
+		}
+	}
+
+	checkContent(dst, data)
+
+	// writes to either file aren't seen by the other
+	dstData := append([]byte(nil), data...)
+	copy(dstData, bytes.Repeat([]byte("b"), 1024))
+	_, err = dst.WriteAt(dstData[:1024], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dst.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	srcData := append([]byte(nil), data...)
+	copy(srcData[1024:], bytes.Repeat([]byte("c"), 1024))
+	_, err = src.WriteAt(srcData[1024:2048], 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = src.Sync(0); err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(src, srcData)
+	checkContent(dst, dstData)
+
+	err = v.Delete(srcName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the deleted file's sectors and its first sector map chunk are
+	// garbage now, along with the original first chunk they shared
+	result, err := CollectGarbage(db, table, GCOptions{GracePeriod: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orphans int
+	for _, o := range result.Orphans {
+		if strings.Contains(o.HashKey, srcName) {
+			orphans++
+		}
+	}
+	if orphans != 4 {
+		t.Fatalf("expected 4 orphans after deleting the source but got %d", orphans)
+	}
+
+	dst2, _, err := New(db, table).Open(dstName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst2.Close()
+	checkContent(dst2, dstData)
+
+	report, err := Fsck(db, table, FsckOptions{Files: []string{dstName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() {
+		t.Fatalf("fsck of clone found problems: %+v", report.Problems)
+	}
+}
+
+func TestMetaHistoryRollback(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	name := fmt.Sprintf("history-%d", time.Now().UnixNano())
+
+	v := New(db, table, WithSectorSize(1024), WithMetaHistory(3))
+	f, _, err := v.Open(name, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	write := func(f sqlite3vfs.File, b byte, off int64, n int) {
+		t.Helper()
+		_, err := f.WriteAt(bytes.Repeat([]byte{b}, n), off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generations := func() []int64 {
+		t.Helper()
+		versions, err := MetaHistory(db, table, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gens []int64
+		for _, v := range versions {
+			gens = append(gens, v.Generation)
+		}
+		return gens
+	}
+
+	write(f, 'a', 0, 2048) // generation 2
+	write(f, 'b', 0, 1024)
+	write(f, 'c', 0, 1024)
+	write(f, 'd', 0, 1024)
+
+	if diff := cmp.Diff([]int64{3, 4, 5}, generations()); diff != "" {
+		t.Fatalf("history mismatch (-want +got):\n%s", diff)
+	}
+
+	version, err := Rollback(db, table, name, RollbackOptions{Version: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Generation != 3 || version.Size != 2048 {
+		t.Fatalf("unexpected rolled back version %+v", version)
+	}
+
+	got := make([]byte, 2048)
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	expect := append(bytes.Repeat([]byte("b"), 1024), bytes.Repeat([]byte("a"), 1024)...)
+	if !bytes.Equal(got, expect) {
+		t.Fatal("content mismatch after rollback")
+	}
+
+	// the rollback is recorded as a new version
+	if diff := cmp.Diff([]int64{4, 5, 6}, generations()); diff != "" {
+		t.Fatalf("history mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = Rollback(db, table, name, RollbackOptions{Version: 2})
+	if err == nil {
+		t.Fatal("expected rollback to a version no longer in the history to fail")
+	}
+	_, err = Rollback(db, table, name, RollbackOptions{Time: time.Now().Add(-time.Hour)})
+	if err == nil {
+		t.Fatal("expected rollback to before the oldest version to fail")
+	}
+
+	// only the first version of sector 0 is no longer referenced
+	result, err := CollectGarbage(db, table, GCOptions{GracePeriod: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orphans int
+	for _, o := range result.Orphans {
+		if strings.Contains(o.HashKey, name) {
+			orphans++
+		}
+	}
+	if orphans != 1 {
+		t.Fatalf("expected 1 orphan but got %d", orphans)
+	}
+
+	version, err = Rollback(db, table, name, RollbackOptions{Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Generation != 6 {
+		t.Fatalf("expected rollback to now to pick version 6, got %d", version.Generation)
+	}
+
+	// journals don't get history
+	journal, _, err := v.Open(name+"-journal", sqlite3vfs.OpenMainJournal|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(journal, 'j', 0, 100)
+	journal.Close()
+	versions, err := MetaHistory(db, table, name+"-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Fatalf("expected no history for a journal, got %+v", versions)
+	}
+
+	err = SetMetaHistory(db, table, name, 0, HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gens := generations(); len(gens) != 0 {
+		t.Fatalf("expected no history after disabling it, got %v", gens)
+	}
+
+	err = SetMetaHistory(db, table, name, 2, HistoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]int64{9}, generations()); diff != "" {
+		t.Fatalf("history mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRename(t *testing.T) {
+	for _, version := range []int{2, 3} {
+		serverInfo, err := dynamotest.SetupDynamoServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer serverInfo.Cleanup()
+
+		db := serverInfo.DB
+		table := serverInfo.TableName
+
+		ts := time.Now().UnixNano()
+		srcName := fmt.Sprintf("rename-src-%d-%d", version, ts)
+		dstName := fmt.Sprintf("rename-dst-%d-%d", version, ts)
+		takenName := fmt.Sprintf("rename-taken-%d-%d", version, ts)
+
+		v := New(db, table, WithSectorSize(1024), WithDefaultSchemaVersion(version), WithMetaHistory(2))
+		flags := sqlite3vfs.OpenMainDB | sqlite3vfs.OpenCreate | sqlite3vfs.OpenReadWrite
+
+		src, _, err := v.Open(srcName, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+
+		data := make([]byte, 3*1024)
+		rand.Read(data)
+		_, err = src.WriteAt(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = src.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+
+		taken, _, err := v.Open(takenName, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		taken.Close()
+
+		err = src.Lock(sqlite3vfs.LockShared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Rename(db, table, srcName, dstName)
+		if !errors.Is(err, FileLockedErr) {
+			t.Fatalf("expected FileLockedErr renaming a locked file, got %v", err)
+		}
+		err = src.Unlock(sqlite3vfs.LockNone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Rename(db, table, srcName, takenName)
+		if !errors.Is(err, FileExistsErr) {
+			t.Fatalf("expected FileExistsErr renaming onto an existing file, got %v", err)
+		}
+
+		err = Rename(db, table, srcName, dstName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exists, err := v.Access(srcName, sqlite3vfs.AccessExists)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatalf("v%d: %s still exists after rename", version, srcName)
+		}
+
+		checkContent := func(f sqlite3vfs.File, expect []byte) {
+			t.Helper()
+
+			got := make([]byte, len(expect))
+			_, err = f.ReadAt(got, 0)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, expect) {
+				t.Fatalf("v%d: file content mismatch", version)
+			}
+		}
+
+		dst, _, err := v.Open(dstName, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+		checkContent(dst, data)
+
+		// the renamed file keeps writing to its original sectors' namespace
+		copy(data, bytes.Repeat([]byte("d"), 1024))
+		_, err = dst.WriteAt(data[:1024], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = dst.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+
+		versions, err := MetaHistory(db, table, dstName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 {
+			t.Fatalf("v%d: expected the history to move with the file, got %+v", version, versions)
+		}
+
+		_, err = CollectGarbage(db, table, GCOptions{GracePeriod: time.Nanosecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst2, _, err := New(db, table).Open(dstName, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkContent(dst2, data)
+		dst2.Close()
+
+		report, err := Fsck(db, table, FsckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.OK() {
+			t.Fatalf("v%d: fsck after rename found problems: %+v", version, report.Problems)
+		}
+
+		// renaming back to the original name drops the indirection
+		err = Rename(db, table, dstName, srcName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, _, err := fetchFileMeta(db, table, srcName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta == nil || meta.DataRandID != "" || meta.DataName != "" {
+			t.Fatalf("v%d: unexpected metadata after renaming back: %+v", version, meta)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	for _, version := range []int{1, 2, 3} {
+		srcServer, err := dynamotest.SetupDynamoServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srcServer.Cleanup()
+
+		// stands in for a table in another region
+		dstServer, err := dynamotest.SetupDynamoServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dstServer.Cleanup()
+
+		ts := time.Now().UnixNano()
+		srcName := fmt.Sprintf("copy-src-%d-%d", version, ts)
+		dstName := fmt.Sprintf("copy-dst-%d-%d", version, ts)
+
+		v := New(srcServer.DB, srcServer.TableName, WithSectorSize(1024), WithDefaultSchemaVersion(version), WithCompression(compression.Snappy))
+		src, _, err := v.Open(srcName, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+
+		// enough sectors to need two sector map chunks in v3
+		data := make([]byte, (schemav2.SectorMapChunkSize+100)*1024)
+		rand.Read(data)
+		_, err = src.WriteAt(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = src.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+
+		targets := []struct {
+			server *dynamotest.DynamoServerInfo
+			name   string
+		}{
+			{srcServer, dstName},
+			{dstServer, dstName + "-remote"},
+		}
+
+		for _, target := range targets {
+			err = Copy(srcServer.DB, srcServer.TableName, srcName, target.server.DB, target.server.TableName, target.name, CopyOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err = Copy(srcServer.DB, srcServer.TableName, srcName, srcServer.DB, srcServer.TableName, dstName, CopyOptions{})
+		if !errors.Is(err, FileExistsErr) {
+			t.Fatalf("expected FileExistsErr copying onto an existing file, got %v", err)
+		}
+
+		srcMeta, _, err := fetchFileMeta(srcServer.DB, srcServer.TableName, srcName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the copies don't depend on the source's sectors
+		err = v.Delete(srcName, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, target := range targets {
+			server := target.server
+			meta, _, err := fetchFileMeta(server.DB, server.TableName, target.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.MetaVersion != srcMeta.MetaVersion || meta.SectorSize != srcMeta.SectorSize || meta.CompressAlg != srcMeta.CompressAlg {
+				t.Fatalf("v%d: copy metadata mismatch got=%+v expected=%+v", version, meta, srcMeta)
+			}
+
+			f, _, err := New(server.DB, server.TableName).Open(target.name, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(data))
+			_, err = f.ReadAt(got, 0)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			f.Close()
+			if !bytes.Equal(got, data) {
+				t.Fatalf("v%d: copy content mismatch", version)
+			}
+
+			report, err := Fsck(server.DB, server.TableName, FsckOptions{Files: []string{target.name}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.OK() {
+				t.Fatalf("v%d: fsck of copy found problems: %+v", version, report.Problems)
+			}
+		}
+	}
+}
+
+func TestUnlockReportsLostLease(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	lost := make(chan error, 1)
+	v := New(db, table, WithSectorSize(1024), WithLockLease(200*time.Millisecond, 50*time.Millisecond), WithLeaseLostHandler(func(name string, err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}))
+
+	name := fmt.Sprintf("unlock-lease-%d", time.Now().UnixNano())
+	f, _, err := v.Open(name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, level := range []sqlite3vfs.LockType{sqlite3vfs.LockShared, sqlite3vfs.LockReserved, sqlite3vfs.LockExclusive} {
+		if err := f.Lock(level); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// written without a Sync, as with synchronous=OFF
+	_, err = f.WriteAt(bytes.Repeat([]byte("a"), 1024), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, _, err := fetchFileMeta(db, table, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else takes over the lock out from under us
+	deadline := strconv.FormatInt(time.Now().Add(time.Minute).UnixMicro(), 10)
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName: &table,
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: &meta.LockRowKey,
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+			"owner_id": {
+				S: aws.String("thief"),
+			},
+			"deadline_us": {
+				N: &deadline,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the lease to be lost")
+	}
+
+	err = f.Unlock(sqlite3vfs.LockNone)
+	if err == nil {
+		t.Fatal("expected Unlock to report the uncommitted transaction")
+	}
+
+	size, err := f.FileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("uncommitted write is visible, size=%d", size)
+	}
+}
+
+// baseClient hides every method of the wrapped client that isn't part
+// of DynamoClient.
+type baseClient struct {
+	DynamoClient
+}
+
+func TestBaseClient(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := baseClient{serverInfo.DB}
+	table := serverInfo.TableName
+	ts := time.Now().UnixNano()
+	flags := sqlite3vfs.OpenMainDB | sqlite3vfs.OpenCreate | sqlite3vfs.OpenReadWrite
+
+	for _, version := range []int{2, 3} {
+		srcName := fmt.Sprintf("base-src-%d-%d", version, ts)
+		dstName := fmt.Sprintf("base-dst-%d-%d", version, ts)
+
+		v := New(db, table, WithSectorSize(1024), WithDefaultSchemaVersion(version))
+		f, _, err := v.Open(srcName, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt([]byte("hello"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		err = Rename(db, table, srcName, dstName)
+		if version == 2 && err != nil {
+			t.Fatalf("v2 rename without transactions: %s", err)
+		}
+		if version == 3 && !errors.Is(err, dynamo.UnsupportedErr) {
+			t.Fatalf("expected UnsupportedErr renaming a v3 file without transactions, got %v", err)
+		}
+	}
+
+	_, err = dynamo.Scan(db, &dynamodb.ScanInput{
+		TableName: &table,
+	})
+	if !errors.Is(err, dynamo.UnsupportedErr) {
+		t.Fatalf("expected UnsupportedErr scanning without Scan, got %v", err)
+	}
+}
+
+func TestCreateMetaV3Race(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	table := serverInfo.TableName
+	ts := time.Now().UnixNano()
+
+	dirRandID := func(name string) string {
+		t.Helper()
+		out, err := serverInfo.DB.GetItem(&dynamodb.GetItemInput{
+			TableName:      &table,
+			ConsistentRead: aws.Bool(true),
+			Key: map[string]*dynamodb.AttributeValue{
+				dynamo.HKey: {
+					S: aws.String(dynamo.FileDirV3Key),
+				},
+				dynamo.RKey: {
+					N: aws.String(dynamo.DirV3RangeKey(name)),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Item["rand_id"] == nil {
+			return ""
+		}
+		return *out.Item["rand_id"].S
+	}
+
+	clients := []struct {
+		label string
+		db    DynamoClient
+	}{
+		{"transact", serverInfo.DB},
+		{"base", baseClient{serverInfo.DB}},
+	}
+	for _, c := range clients {
+		name := fmt.Sprintf("create-race-%s-%d", c.label, ts)
+
+		winner := &dynamo.FileMetaV1V2{
+			MetaVersion: 3,
+			OrigName:    name,
+			RandID:      "winner",
+			LockRowKey:  dynamo.FileLockPrefix + "winner-" + name,
+		}
+		err = schemav2.CreateMetaV3(c.db, table, winner)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loser := *winner
+		loser.RandID = "loser"
+		loser.LockRowKey = dynamo.FileLockPrefix + "loser-" + name
+		err = schemav2.CreateMetaV3(c.db, table, &loser)
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); !match {
+			t.Fatalf("%s: expected ConditionalCheckFailedException for losing create, got %v", c.label, err)
+		}
+		if got := dirRandID(name); got != "winner" {
+			t.Fatalf("%s: losing create changed directory entry rand_id to %q", c.label, got)
+		}
+
+		_, rawMeta, err := schemav2.FetchMetaV3(c.db, table, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = schemav2.DeleteMetaV3(c.db, table, winner, rawMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := dirRandID(name); got != "" {
+			t.Fatalf("%s: directory entry left behind after delete (rand_id %q)", c.label, got)
+		}
+
+		// a stale entry left by a failed create is replaced
+		_, err = serverInfo.DB.PutItem(&dynamodb.PutItemInput{
+			TableName: &table,
+			Item: map[string]*dynamodb.AttributeValue{
+				dynamo.HKey: {
+					S: aws.String(dynamo.FileDirV3Key),
+				},
+				dynamo.RKey: {
+					N: aws.String(dynamo.DirV3RangeKey(name)),
+				},
+				"name": {
+					S: aws.String(name),
+				},
+				"rand_id": {
+					S: aws.String("stale"),
+				},
+				dynamo.SectorTSAttr: {
+					N: aws.String(strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)),
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = schemav2.CreateMetaV3(c.db, table, &loser)
+		if err != nil {
+			t.Fatalf("%s: create over stale directory entry: %s", c.label, err)
+		}
+		if got := dirRandID(name); got != "loser" {
+			t.Fatalf("%s: stale directory entry not replaced, rand_id %q", c.label, got)
+		}
+	}
+}
+
+func TestGCKeepsRenameHistory(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	ts := time.Now().UnixNano()
+	srcName := fmt.Sprintf("gc-rename-src-%d", ts)
+	dstName := fmt.Sprintf("gc-rename-dst-%d", ts)
+
+	v := New(db, table, WithSectorSize(1024), WithMetaHistory(2))
+	f, _, err := v.Open(srcName, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, b := range []byte("ab") {
+		_, err = f.WriteAt(bytes.Repeat([]byte{b}, 1024), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	meta, _, err := fetchFileMeta(db, table, srcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rename copies the history to the new name before the metadata
+	// moves. Garbage collection in between must leave the copy alone.
+	err = schemav2.CopyHistory(db, table, meta, dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CollectGarbage(db, table, GCOptions{GracePeriod: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range result.Orphans {
+		if strings.HasPrefix(o.HashKey, dynamo.FileHistPrefix) {
+			t.Fatalf("collected live history row %+v", o)
+		}
+	}
+
+	entries, err := schemav2.ListHistoryPartition(db, table, dynamo.HistoryKey(meta.RandID, dstName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the copied history to survive gc, got %d entries", len(entries))
+	}
+}
+
+// relockingClient takes a lease on lockRow just before it is deleted,
+// as a stale handle locking the file again would.
+type relockingClient struct {
+	DynamoClient
+	table   string
+	lockRow string
+}
+
+func (c *relockingClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	if aws.StringValue(input.Key[dynamo.HKey].S) == c.lockRow {
+		deadline := strconv.FormatInt(time.Now().Add(time.Minute).UnixMicro(), 10)
+		_, err := c.DynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:        &c.table,
+			Key:              input.Key,
+			UpdateExpression: aws.String("SET owner_id = :own, deadline_us = :dus"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":own": {S: aws.String("stale-handle")},
+				":dus": {N: &deadline},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.DynamoClient.DeleteItem(input)
+}
+
+func TestRenameKeepsHeldLockRow(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	table := serverInfo.TableName
+	ts := time.Now().UnixNano()
+	srcName := fmt.Sprintf("rename-held-src-%d", ts)
+	dstName := fmt.Sprintf("rename-held-dst-%d", ts)
+
+	v := New(serverInfo.DB, table, WithSectorSize(1024))
+	f, _, err := v.Open(srcName, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	meta, _, err := fetchFileMeta(serverInfo.DB, table, srcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := &relockingClient{
+		DynamoClient: serverInfo.DB,
+		table:        table,
+		lockRow:      meta.LockRowKey,
+	}
+	err = Rename(db, table, srcName, dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := serverInfo.DB.GetItem(&dynamodb.GetItemInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {S: &meta.LockRowKey},
+			dynamo.RKey: {N: aws.String("0")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Item) == 0 {
+		t.Fatal("rename deleted a lock row holding a live lease")
+	}
+}
+
+func TestLockHandlesInOneVFS(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	for _, strategy := range []LockStrategy{GlobalLock, MultiReaderLock} {
+		name := fmt.Sprintf("handles-%d-%d", strategy, time.Now().UnixNano())
+		v := New(serverInfo.DB, serverInfo.TableName, WithLockStrategy(strategy))
+
+		a, _, err := v.Open(name, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer a.Close()
+		b, _, err := v.Open(name, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		err = a.Lock(sqlite3vfs.LockShared)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// b's locks must treat a as another client
+		err = b.Lock(sqlite3vfs.LockShared)
+		if err == nil {
+			err = b.Lock(sqlite3vfs.LockReserved)
+		}
+		if err == nil {
+			err = b.Lock(sqlite3vfs.LockExclusive)
+		}
+		if err != sqlite3vfs.BusyError {
+			t.Fatalf("strategy %d: expected busy locking b while a holds SHARED, got %v", strategy, err)
+		}
+		b.Unlock(sqlite3vfs.LockNone)
+
+		// and must not have removed a's lease
+		err = a.Lock(sqlite3vfs.LockReserved)
+		if err == nil {
+			err = a.Lock(sqlite3vfs.LockExclusive)
+		}
+		if err != nil {
+			t.Fatalf("strategy %d: lock a after b gave up: %s", strategy, err)
+		}
+		err = a.Unlock(sqlite3vfs.LockNone)
+		if err != nil {
+			t.Fatalf("strategy %d: unlock a: %s", strategy, err)
+		}
+	}
+}
+
+func TestCreateChecksOtherSchema(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	table := serverInfo.TableName
+	ts := time.Now().UnixNano()
+
+	clients := []struct {
+		label string
+		db    DynamoClient
+	}{
+		{"transact", serverInfo.DB},
+		{"base", baseClient{serverInfo.DB}},
+	}
+	for _, c := range clients {
+		v2Name := fmt.Sprintf("other-schema-v2-%s-%d", c.label, ts)
+		v3Name := fmt.Sprintf("other-schema-v3-%s-%d", c.label, ts)
+
+		for name, version := range map[string]int{v2Name: 2, v3Name: 3} {
+			v := New(c.db, table, WithDefaultSchemaVersion(version))
+			f, _, err := v.Open(name, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+
+		meta := &dynamo.FileMetaV1V2{
+			MetaVersion: 3,
+			OrigName:    v2Name,
+			RandID:      "other",
+			LockRowKey:  dynamo.FileLockPrefix + "other-" + v2Name,
+		}
+		err = schemav2.CreateMetaV3(c.db, table, meta)
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); !match {
+			t.Fatalf("%s: expected ConditionalCheckFailedException creating v3 file over v2 file, got %v", c.label, err)
+		}
+
+		meta.MetaVersion = 2
+		meta.OrigName = v3Name
+		meta.LockRowKey = dynamo.FileLockPrefix + "other-" + v3Name
+		err = createMetaV1(c.db, table, meta)
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); !match {
+			t.Fatalf("%s: expected ConditionalCheckFailedException creating v2 file over v3 file, got %v", c.label, err)
+		}
+	}
+}
+
+func TestCollectGarbageReaderLocked(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+	name := fmt.Sprintf("gc-reader-%d", time.Now().UnixNano())
+
+	v := New(db, table, WithSectorSize(1024), WithLockStrategy(MultiReaderLock))
+	f, _, err := v.Open(name, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenCreate|sqlite3vfs.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// overwriting sector 0 leaves the old version orphaned
+	for _, b := range []byte("ab") {
+		_, err = f.WriteAt(bytes.Repeat([]byte{b}, 1024), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a reader's lease alone has to keep gc away from the file
+	err = f.Lock(sqlite3vfs.LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := GCOptions{
+		DryRun:      true,
+		GracePeriod: time.Nanosecond,
+	}
+	result, err := CollectGarbage(db, table, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Orphans) != 0 || result.Skipped != 1 {
+		t.Fatalf("expected 0 orphans, 1 skipped with a reader lease but got %d orphans, %d skipped", len(result.Orphans), result.Skipped)
+	}
+
+	err = f.Unlock(sqlite3vfs.LockNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = CollectGarbage(db, table, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Orphans) != 1 {
+		t.Fatalf("expected 1 orphan after unlock but got %d", len(result.Orphans))
+	}
+}
+
+func TestSnapshotNameShadowedByFile(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	db := serverInfo.DB
+	table := serverInfo.TableName
+
+	base := fmt.Sprintf("shadow-%d", time.Now().UnixNano())
+	atName := base + SnapshotSeparator + "snap"
+	flags := sqlite3vfs.OpenMainDB | sqlite3vfs.OpenCreate | sqlite3vfs.OpenReadWrite
+
+	v := New(db, table, WithSectorSize(1024))
+	for name, content := range map[string]string{atName: "real file", base: "snapshot"} {
+		f, _, err := v.Open(name, flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt([]byte(content), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = f.Sync(0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	_, err = CreateSnapshot(db, table, base, "snap", SnapshotOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, outFlags, err := v.Open(atName, sqlite3vfs.OpenMainDB|sqlite3vfs.OpenReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if outFlags&sqlite3vfs.OpenReadOnly != 0 {
+		t.Fatal("opened the snapshot instead of the file with the same name")
+	}
+	got := make([]byte, len("real file"))
+	_, err = f.ReadAt(got, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if string(got) != "real file" {
+		t.Fatalf("got content %q, expected the real file's", got)
+	}
+
+	writable, err := v.Access(atName, sqlite3vfs.AccessReadWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !writable {
+		t.Fatal("Access reported the real file as read-only")
+	}
+}
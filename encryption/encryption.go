@@ -0,0 +1,152 @@
+// Package encryption provides client-side encryption of sector data.
+//
+// Each sector is compressed and then sealed with an AEAD before it is
+// written to DynamoDB, so plaintext never leaves the process and any
+// modification of a stored sector is detected when it is read. The
+// sealed sector is bound to its sector ID, so sectors can't be swapped
+// with each other either.
+//
+// Keys come from a KeyProvider. A file is encrypted with the provider's
+// current key when it is created, and the key's ID is recorded in the
+// file's metadata so the file can still be read after the current key
+// has been rotated.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// AlgAES256GCM is AES-256 in GCM mode with random 96-bit nonces. It is
+// the only algorithm currently supported.
+const AlgAES256GCM = "aes-256-gcm"
+
+// KeySize is the size of the keys a KeyProvider must return.
+const KeySize = 32
+
+var (
+	// DecryptErr is returned (wrapped) when a sealed sector fails
+	// authentication because it was modified, or because it was read
+	// with the wrong key.
+	DecryptErr = errors.New("sector decryption failed")
+
+	// UnknownKeyErr should be returned (wrapped) by a KeyProvider that
+	// doesn't have the requested key.
+	UnknownKeyErr = errors.New("unknown encryption key")
+)
+
+// KeyProvider supplies the keys files are encrypted with.
+// Implementations must be safe for concurrent use.
+type KeyProvider interface {
+	// CurrentKey returns the key new files are encrypted with and
+	// its ID. The ID is stored in file metadata in plaintext.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider backed by a fixed set of keys.
+type StaticKeys struct {
+	// CurrentID is the ID of the key new files are encrypted with.
+	CurrentID string
+
+	// Keys maps key IDs to KeySize byte keys. Keep old keys around
+	// for as long as files encrypted with them exist.
+	Keys map[string][]byte
+}
+
+func (s StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := s.Key(s.CurrentID)
+	if err != nil {
+		return "", nil, err
+	}
+	return s.CurrentID, key, nil
+}
+
+func (s StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := s.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", UnknownKeyErr, id)
+	}
+	return key, nil
+}
+
+// Cipher seals and opens the sectors of a single file.
+type Cipher struct {
+	aead    cipher.AEAD
+	hashKey []byte
+}
+
+// NewCipher returns a Cipher for alg using key.
+func NewCipher(alg string, key []byte) (*Cipher, error) {
+	if alg != AlgAES256GCM {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", alg)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	// derive independent keys for sealing sectors and for hashing
+	// them, rather than using the key for both
+	block, err := aes.NewCipher(deriveKey(key, "donutdb sector encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{
+		aead:    aead,
+		hashKey: deriveKey(key, "donutdb sector hash"),
+	}, nil
+}
+
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha512.New512_256, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Seal appends the encrypted and authenticated form of plaintext to
+// dst. ad is authenticated but not stored, and must be passed to Open
+// unchanged.
+func (c *Cipher) Seal(dst, plaintext, ad []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	dst = append(dst, nonce...)
+	return c.aead.Seal(dst, nonce, plaintext, ad)
+}
+
+// Open appends the plaintext of a sealed sector to dst. It returns a
+// DecryptErr if sealed or ad were modified.
+func (c *Cipher) Open(dst, sealed, ad []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize+c.aead.Overhead() {
+		return nil, fmt.Errorf("%w: sealed sector too short", DecryptErr)
+	}
+
+	out, err := c.aead.Open(dst, sealed[:nonceSize], sealed[nonceSize:], ad)
+	if err != nil {
+		return nil, DecryptErr
+	}
+	return out, nil
+}
+
+// NewHash returns the keyed hash used for the sector IDs of encrypted
+// files. A plain hash of the sector content would let anyone with
+// access to the table confirm guesses about a sector's plaintext.
+func (c *Cipher) NewHash() hash.Hash {
+	return hmac.New(sha512.New512_256, c.hashKey)
+}
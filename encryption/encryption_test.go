@@ -0,0 +1,93 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCipherSealOpen(t *testing.T) {
+	keys := StaticKeys{
+		CurrentID: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, KeySize),
+			"k2": bytes.Repeat([]byte{2}, KeySize),
+		},
+	}
+
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "k1" {
+		t.Fatalf("current key id got=%q expected=k1", id)
+	}
+
+	c, err := NewCipher(AlgAES256GCM, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("the quick brown fox")
+	ad := []byte("0__abcd")
+
+	sealed := c.Seal(nil, plaintext, ad)
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatal("sealed data contains the plaintext")
+	}
+	if bytes.Equal(sealed, c.Seal(nil, plaintext, ad)) {
+		t.Fatal("sealing twice should use different nonces")
+	}
+
+	got, err := c.Open(nil, sealed, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("open got=%q expected=%q", got, plaintext)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := c.Open(nil, tampered, ad); !errors.Is(err, DecryptErr) {
+		t.Fatalf("tampered data err got=%v expected=%v", err, DecryptErr)
+	}
+
+	if _, err := c.Open(nil, sealed, []byte("1__abcd")); !errors.Is(err, DecryptErr) {
+		t.Fatalf("wrong additional data err got=%v expected=%v", err, DecryptErr)
+	}
+
+	if _, err := c.Open(nil, sealed[:4], ad); !errors.Is(err, DecryptErr) {
+		t.Fatalf("short data err got=%v expected=%v", err, DecryptErr)
+	}
+
+	key2, err := keys.Key("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewCipher(AlgAES256GCM, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Open(nil, sealed, ad); !errors.Is(err, DecryptErr) {
+		t.Fatalf("wrong key err got=%v expected=%v", err, DecryptErr)
+	}
+
+	h1 := c.NewHash()
+	h1.Write(plaintext)
+	h2 := c2.NewHash()
+	h2.Write(plaintext)
+	if bytes.Equal(h1.Sum(nil), h2.Sum(nil)) {
+		t.Fatal("sector hashes should depend on the key")
+	}
+
+	if _, err := keys.Key("k3"); !errors.Is(err, UnknownKeyErr) {
+		t.Fatalf("missing key err got=%v expected=%v", err, UnknownKeyErr)
+	}
+	if _, err := NewCipher(AlgAES256GCM, key[:16]); err == nil {
+		t.Fatal("expected error for short key")
+	}
+	if _, err := NewCipher("rot13", key); err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
@@ -0,0 +1,407 @@
+package donutdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/encryption"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/schemav1"
+	"github.com/psanford/donutdb/internal/schemav2"
+)
+
+// Checks reported in an FsckProblem.
+const (
+	// FsckMetadata means a file's metadata could not be read or
+	// decoded, or has invalid fields.
+	FsckMetadata = "metadata"
+
+	// FsckSectorList means a file's list of sectors is inconsistent
+	// with itself or with the file size.
+	FsckSectorList = dynamo.CheckSectorList
+
+	// FsckSectorMissing means a sector referenced by a file doesn't
+	// exist.
+	FsckSectorMissing = dynamo.CheckSectorMissing
+
+	// FsckSectorSize means a sector other than the last one is short,
+	// or the last sector doesn't end where the file does.
+	FsckSectorSize = dynamo.CheckSectorSize
+
+	// FsckHashMismatch means a sector's content doesn't match the hash
+	// in its sector ID.
+	FsckHashMismatch = dynamo.CorruptHashMismatch
+
+	// FsckDecompress means a sector could not be decompressed.
+	FsckDecompress = dynamo.CorruptDecompress
+
+	// FsckDecrypt means an encrypted sector failed authentication.
+	FsckDecrypt = dynamo.CorruptDecrypt
+
+	// FsckStaleLock means a lock row holds an expired lease, or belongs
+	// to a file that no longer exists.
+	FsckStaleLock = "stale_lock"
+
+	// FsckIntegrityCheck is a problem reported by SQLite's
+	// PRAGMA integrity_check. Fsck doesn't run it itself since that
+	// needs a SQLite driver; donutdb-cli fsck --integrity-check does.
+	FsckIntegrityCheck = "integrity_check"
+)
+
+// FsckOptions configures Fsck.
+type FsckOptions struct {
+	// Files limits the check to the named files. By default every file
+	// in the table is checked, along with its lock rows.
+	Files []string
+
+	// Keys is used to check the content of encrypted files. Without
+	// it only the presence of their sectors is checked.
+	Keys encryption.KeyProvider
+
+	// ReadConcurrency is the maximum number of BatchGetItem requests
+	// in flight at once while reading a file's sectors. Defaults to
+	// DefaultReadConcurrency.
+	ReadConcurrency int
+}
+
+// FsckReport is the result of an Fsck run.
+type FsckReport struct {
+	Files    []FsckFile    `json:"files"`
+	Problems []FsckProblem `json:"problems"`
+}
+
+// OK reports whether no problems were found.
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// FsckFile summarizes a checked file.
+type FsckFile struct {
+	Name          string `json:"name"`
+	SchemaVersion int    `json:"schema_version"`
+	Size          int64  `json:"size"`
+	Sectors       int    `json:"sectors"`
+
+	// ContentChecked is false if sector content couldn't be verified,
+	// because the file is encrypted and no key provider was given or
+	// its compression codec isn't registered.
+	ContentChecked bool `json:"content_checked"`
+}
+
+// FsckProblem is an inconsistency found by Fsck.
+type FsckProblem struct {
+	// File is the file the problem belongs to, if known.
+	File string `json:"file,omitempty"`
+
+	// Check is one of the Fsck* constants.
+	Check string `json:"check"`
+
+	// Key identifies the affected item, if any. schemav1 sectors
+	// are identified as hash_key/range_key.
+	Key string `json:"key,omitempty"`
+
+	Detail string `json:"detail"`
+}
+
+// Fsck checks the files in table for consistency: that their metadata
+// decodes and is valid, their sector lists are contiguous and match
+// their size, and every sector exists, decodes, matches its hash and
+// has the right size. It also reports lock rows left behind by clients
+// that didn't release their lock.
+//
+// Fsck only reads from the table. It should be run while no client is
+// writing, since sectors of an in progress transaction may look
+// inconsistent.
+func Fsck(db DynamoClient, table string, opts FsckOptions) (*FsckReport, error) {
+	if opts.ReadConcurrency < 1 {
+		opts.ReadConcurrency = DefaultReadConcurrency
+	}
+
+	var report FsckReport
+
+	metas, err := fsckLoadMeta(db, table, opts.Files, &report)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, meta := range metas {
+		name := meta.OrigName
+		summary := FsckFile{
+			Name:          name,
+			SchemaVersion: meta.MetaVersion,
+			Size:          meta.FileSize,
+			Sectors:       len(meta.Sectors),
+		}
+
+		if !fsckValidateMeta(meta, &report) {
+			report.Files = append(report.Files, summary)
+			continue
+		}
+
+		var (
+			problems       []dynamo.SectorProblem
+			contentChecked bool
+		)
+		if meta.MetaVersion >= 2 {
+			problems, contentChecked, err = schemav2.CheckSectors(db, table, meta, opts.Keys, opts.ReadConcurrency)
+		} else {
+			problems, contentChecked, err = schemav1.CheckSectors(db, table, meta)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("check sectors of %q err: %w", name, err)
+		}
+
+		summary.ContentChecked = contentChecked
+		report.Files = append(report.Files, summary)
+
+		for _, p := range problems {
+			report.Problems = append(report.Problems, FsckProblem{
+				File:   name,
+				Check:  p.Check,
+				Key:    p.Key,
+				Detail: p.Detail,
+			})
+		}
+	}
+
+	if len(opts.Files) == 0 {
+		err = fsckLocks(db, table, metas, &report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &report, nil
+}
+
+// fsckLoadMeta reads the metadata of the files to check. Metadata
+// that can't be read is reported as a problem rather than failing the
+// whole run.
+func fsckLoadMeta(db DynamoClient, table string, only []string, report *FsckReport) ([]*dynamo.FileMetaV1V2, error) {
+	want := make(map[string]bool)
+	for _, name := range only {
+		want[name] = true
+	}
+	include := func(name string) bool {
+		return len(want) == 0 || want[name]
+	}
+
+	fileRow, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileMetaKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get file metadata err: %w", err)
+	}
+
+	var (
+		metas []*dynamo.FileMetaV1V2
+		seen  = make(map[string]bool)
+	)
+
+	for name, v := range fileRow.Item {
+		if name == dynamo.HKey || name == dynamo.RKey || !include(name) {
+			continue
+		}
+		seen[name] = true
+
+		var meta dynamo.FileMetaV1V2
+		err = json.Unmarshal([]byte(aws.StringValue(v.S)), &meta)
+		if err != nil {
+			report.Problems = append(report.Problems, FsckProblem{
+				File:   name,
+				Check:  FsckMetadata,
+				Key:    dynamo.FileMetaKey,
+				Detail: fmt.Sprintf("decode metadata: %s", err),
+			})
+			continue
+		}
+		if meta.OrigName != name {
+			report.Problems = append(report.Problems, FsckProblem{
+				File:   name,
+				Check:  FsckMetadata,
+				Key:    dynamo.FileMetaKey,
+				Detail: fmt.Sprintf("orig_name is %q", meta.OrigName),
+			})
+			continue
+		}
+		metas = append(metas, &meta)
+	}
+
+	v3Names, err := schemav2.ListFilesV3(db, table)
+	if err != nil {
+		return nil, fmt.Errorf("list v3 files err: %w", err)
+	}
+	for _, name := range only {
+		if !seen[name] {
+			v3Names = append(v3Names, name)
+		}
+	}
+
+	for _, name := range v3Names {
+		if seen[name] || !include(name) {
+			continue
+		}
+		seen[name] = true
+
+		meta, _, err := schemav2.FetchMetaV3(db, table, name)
+		if err != nil {
+			report.Problems = append(report.Problems, FsckProblem{
+				File:   name,
+				Check:  FsckMetadata,
+				Key:    dynamo.MetaV3Key(name),
+				Detail: err.Error(),
+			})
+			continue
+		}
+		if meta == nil {
+			if len(want) > 0 {
+				return nil, fmt.Errorf("file %q not found", name)
+			}
+			report.Problems = append(report.Problems, FsckProblem{
+				File:   name,
+				Check:  FsckMetadata,
+				Key:    dynamo.FileDirV3Key,
+				Detail: "directory entry without metadata",
+			})
+			continue
+		}
+		metas = append(metas, meta)
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].OrigName < metas[j].OrigName
+	})
+
+	return metas, nil
+}
+
+// fsckValidateMeta reports invalid metadata fields. It returns false
+// if the sectors can't be checked.
+func fsckValidateMeta(meta *dynamo.FileMetaV1V2, report *FsckReport) bool {
+	var problems []string
+
+	if meta.MetaVersion < 0 || meta.MetaVersion > 3 {
+		problems = append(problems, fmt.Sprintf("unknown meta_version %d", meta.MetaVersion))
+	}
+	if meta.SectorSize <= 0 {
+		problems = append(problems, fmt.Sprintf("invalid sector_size %d", meta.SectorSize))
+	}
+	if meta.FileSize < 0 {
+		problems = append(problems, fmt.Sprintf("invalid file_size %d", meta.FileSize))
+	}
+	if meta.RandID == "" {
+		problems = append(problems, "missing rand_id")
+	}
+	if want := dynamo.FileLockPrefix + meta.RandID + "-" + meta.OrigName; meta.LockRowKey != want {
+		problems = append(problems, fmt.Sprintf("lock_row_key is %q, expected %q", meta.LockRowKey, want))
+	}
+	if (meta.DataRandID == "") != (meta.DataName == "") {
+		problems = append(problems, "data_rand_id and data_name must be set together")
+	}
+	if meta.MetaVersion < 2 {
+		if want := dynamo.FileDataPrefix + meta.RandID + "-" + meta.OrigName; meta.DataRowKey != want {
+			problems = append(problems, fmt.Sprintf("data_row_key is %q, expected %q", meta.DataRowKey, want))
+		}
+	}
+
+	for _, p := range problems {
+		report.Problems = append(report.Problems, FsckProblem{
+			File:   meta.OrigName,
+			Check:  FsckMetadata,
+			Detail: p,
+		})
+	}
+
+	// the sectors can still be found as long as the fields
+	// used to build their keys are sane
+	return meta.MetaVersion >= 0 && meta.MetaVersion <= 3 && meta.SectorSize > 0 && meta.FileSize >= 0 && meta.RandID != "" &&
+		(meta.DataRandID == "") == (meta.DataName == "")
+}
+
+// fsckLocks reports lock rows holding only expired leases, and lock
+// rows of files that no longer exist.
+func fsckLocks(db DynamoClient, table string, metas []*dynamo.FileMetaV1V2, report *FsckReport) error {
+	owners := make(map[string]string)
+	for _, meta := range metas {
+		owners[meta.LockRowKey] = meta.OrigName
+	}
+
+	now := time.Now()
+
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		out, err := dynamo.Scan(db, &dynamodb.ScanInput{
+			TableName:        &table,
+			ConsistentRead:   aws.Bool(true),
+			FilterExpression: aws.String("begins_with(hash_key, :prefix)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":prefix": {
+					S: aws.String(dynamo.FileLockPrefix),
+				},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return fmt.Errorf("scan lock rows err: %w", err)
+		}
+
+		for _, item := range out.Items {
+			hk := aws.StringValue(item[dynamo.HKey].S)
+			file, exists := owners[hk]
+
+			var (
+				leases  int
+				expired []string
+			)
+			for attr, v := range item {
+				if attr != "deadline_us" && !strings.HasPrefix(attr, "r_") {
+					continue
+				}
+				leases++
+				dus, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+				if err != nil || time.UnixMicro(dus).Before(now) {
+					expired = append(expired, attr)
+				}
+			}
+			sort.Strings(expired)
+
+			switch {
+			case !exists:
+				report.Problems = append(report.Problems, FsckProblem{
+					Check:  FsckStaleLock,
+					Key:    hk,
+					Detail: "lock row for a file that no longer exists",
+				})
+			case leases > 0 && len(expired) == leases:
+				report.Problems = append(report.Problems, FsckProblem{
+					File:   file,
+					Check:  FsckStaleLock,
+					Key:    hk,
+					Detail: fmt.Sprintf("expired leases: %s", strings.Join(expired, ", ")),
+				})
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+
+	return nil
+}
@@ -0,0 +1,490 @@
+package donutdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/schemav2"
+)
+
+// DefaultGCGracePeriod is the default minimum age of an unreferenced
+// sector before CollectGarbage will delete it.
+const DefaultGCGracePeriod = time.Hour
+
+// GCOptions configures CollectGarbage.
+type GCOptions struct {
+	// DryRun reports orphaned items without deleting them.
+	DryRun bool
+
+	// GracePeriod is the minimum age of an unreferenced sector before
+	// it is deleted. Sectors staged by a transaction that has not
+	// committed yet are not referenced by any metadata, so this must be
+	// longer than your longest running write transaction.
+	// Defaults to DefaultGCGracePeriod.
+	GracePeriod time.Duration
+}
+
+// GCResult summarizes a CollectGarbage run.
+type GCResult struct {
+	// ScannedItems is the number of items in the table.
+	ScannedItems int
+
+	// Orphans are the items that were deleted, or that would have
+	// been deleted for a dry run.
+	Orphans []GCOrphan
+
+	// Skipped is the number of unreferenced sectors that were kept
+	// because they were too new, their file was locked, or they were
+	// rewritten while we were running.
+	Skipped int
+}
+
+// GCOrphan is a data item not referenced by any file's metadata.
+type GCOrphan struct {
+	HashKey  string
+	RangeKey string
+
+	// File is the name of the file the item belongs to if that file
+	// still exists. It is empty for items left behind by deleted files.
+	File string
+}
+
+// CollectGarbage finds and deletes data items in table that are not
+// referenced by any file's current metadata, snapshot or metadata
+// history. This includes schemav2 sectors that were superseded by later
+// writes and the data and history of files whose metadata was removed
+// without cleaning up.
+//
+// It is safe to run while the table is in use: sectors newer than the
+// grace period or belonging to a locked file are left alone, and each
+// sector is only deleted if it hasn't been rewritten since it was scanned.
+func CollectGarbage(db DynamoClient, table string, opts GCOptions) (*GCResult, error) {
+	if opts.GracePeriod == 0 {
+		opts.GracePeriod = DefaultGCGracePeriod
+	}
+
+	type sectorItem struct {
+		hashKey string
+		ts      string
+	}
+
+	var (
+		result   GCResult
+		sectors  []sectorItem
+		v1Rows   []GCOrphan
+		v3Names  []string
+		snaps    = make(map[string]bool)
+		histRows []GCOrphan
+		lockRows = make(map[string]bool)
+	)
+
+	// Scan before reading the metadata. Anything referenced by the time
+	// we read the metadata is kept, and anything staged after that point
+	// is protected by the grace period.
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		out, err := dynamo.Scan(db, &dynamodb.ScanInput{
+			TableName:            &table,
+			ConsistentRead:       aws.Bool(true),
+			ProjectionExpression: aws.String("hash_key, range_key, #ts"),
+			ExpressionAttributeNames: map[string]*string{
+				"#ts": aws.String(dynamo.SectorTSAttr),
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("scan table err: %w", err)
+		}
+
+		for _, item := range out.Items {
+			result.ScannedItems++
+
+			hk := aws.StringValue(item[dynamo.HKey].S)
+			switch {
+			case strings.HasPrefix(hk, dynamo.FileDataV2Prefix), strings.HasPrefix(hk, dynamo.FileSectorMapV3Prefix):
+				var ts string
+				if v := item[dynamo.SectorTSAttr]; v != nil {
+					ts = aws.StringValue(v.N)
+				}
+				sectors = append(sectors, sectorItem{hashKey: hk, ts: ts})
+			case strings.HasPrefix(hk, dynamo.FileDataPrefix):
+				v1Rows = append(v1Rows, GCOrphan{
+					HashKey:  hk,
+					RangeKey: aws.StringValue(item[dynamo.RKey].N),
+				})
+			case strings.HasPrefix(hk, dynamo.FileMetaV3Prefix):
+				v3Names = append(v3Names, strings.TrimPrefix(hk, dynamo.FileMetaV3Prefix))
+			case strings.HasPrefix(hk, dynamo.FileSnapPrefix):
+				snaps[strings.TrimPrefix(hk, dynamo.FileSnapPrefix)] = true
+			case strings.HasPrefix(hk, dynamo.FileHistPrefix):
+				histRows = append(histRows, GCOrphan{
+					HashKey:  hk,
+					RangeKey: aws.StringValue(item[dynamo.RKey].N),
+				})
+			case strings.HasPrefix(hk, dynamo.FileLockPrefix):
+				lockRows[hk] = true
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+
+	metas, err := readAllFileMeta(db, table, v3Names)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshots are read after the files' metadata. Files with
+	// snapshots never delete sectors, so anything a snapshot taken
+	// after this point references is either in the metadata we just
+	// read or protected by the grace period.
+	var rootMetas []*dynamo.FileMetaV1V2
+	for file := range snaps {
+		fileSnaps, err := schemav2.ListSnapshots(db, table, file)
+		if err != nil {
+			return nil, fmt.Errorf("list snapshots of %q err: %w", file, err)
+		}
+		for _, snap := range fileSnaps {
+			err = schemav2.ResolveSectorMap(db, table, snap.Meta)
+			if err != nil {
+				return nil, fmt.Errorf("read snapshot %q of %q err: %w", snap.Name, file, err)
+			}
+			rootMetas = append(rootMetas, snap.Meta)
+		}
+	}
+
+	// The same goes for the metadata history of live files. The history
+	// of a file that no longer exists is garbage itself. History is
+	// matched by RandID alone: Rename copies it to the new name before
+	// the metadata moves, and that copy must survive until it does.
+	liveRandIDs := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		liveRandIDs[meta.RandID] = true
+	}
+	liveHistories := make(map[string]bool)
+	for _, row := range histRows {
+		if historyIsLive(row.HashKey, liveRandIDs) {
+			liveHistories[row.HashKey] = true
+		}
+	}
+	for hk := range liveHistories {
+		entries, err := schemav2.ListHistoryPartition(db, table, hk)
+		if err != nil {
+			return nil, fmt.Errorf("list metadata history %s err: %w", hk, err)
+		}
+		for _, entry := range entries {
+			err = schemav2.ResolveSectorMap(db, table, entry.Meta)
+			if err != nil {
+				return nil, fmt.Errorf("read metadata history %s/%d err: %w", hk, entry.Generation, err)
+			}
+			rootMetas = append(rootMetas, entry.Meta)
+		}
+	}
+
+	var (
+		now            = time.Now()
+		referenced     = make(map[string]bool)
+		liveV1Rows     = make(map[string]bool)
+		v2Prefixes     = make(map[string]string)
+		lockedV2Prefix = make(map[string]bool)
+	)
+
+	addReferences := func(meta *dynamo.FileMetaV1V2) {
+		randID, name := meta.SectorNamespace()
+		for _, id := range meta.Sectors {
+			referenced[dynamo.SectorKey(randID, name, id)] = true
+		}
+		for _, id := range meta.SectorChunks {
+			referenced[dynamo.SectorMapChunkKey(randID, name, id)] = true
+		}
+	}
+
+	for _, meta := range rootMetas {
+		addReferences(meta)
+	}
+
+	for _, meta := range metas {
+		if meta.MetaVersion >= 2 {
+			addReferences(meta)
+
+			var locked bool
+			if lockRows[meta.LockRowKey] {
+				locked, err = lockRowHeld(db, table, meta.LockRowKey, now)
+				if err != nil {
+					return nil, fmt.Errorf("read lock row of %q err: %w", meta.OrigName, err)
+				}
+			}
+
+			// a clone shares its sector namespace with the file it was
+			// cloned from, so it is locked if either of them is
+			randID, name := meta.SectorNamespace()
+			prefixes := []string{
+				dynamo.SectorKey(randID, name, ""),
+				dynamo.SectorMapChunkKey(randID, name, ""),
+			}
+			for _, prefix := range prefixes {
+				if _, ok := v2Prefixes[prefix]; !ok || meta.DataRandID == "" {
+					v2Prefixes[prefix] = meta.OrigName
+				}
+				lockedV2Prefix[prefix] = lockedV2Prefix[prefix] || locked
+			}
+		} else {
+			liveV1Rows[meta.DataRowKey] = true
+		}
+	}
+
+	// ownerPrefix returns the key prefix of the live file a sector
+	// belongs to, or "" if its file no longer exists.
+	ownerPrefix := func(hk string) string {
+		for prefix := range v2Prefixes {
+			if strings.HasPrefix(hk, prefix) {
+				return prefix
+			}
+		}
+		return ""
+	}
+
+	for _, s := range sectors {
+		if referenced[s.hashKey] {
+			continue
+		}
+
+		prefix := ownerPrefix(s.hashKey)
+		if lockedV2Prefix[prefix] {
+			result.Skipped++
+			continue
+		}
+
+		if s.ts != "" {
+			ts, err := strconv.ParseInt(s.ts, 10, 64)
+			if err != nil || now.Sub(time.Unix(ts, 0)) < opts.GracePeriod {
+				result.Skipped++
+				continue
+			}
+		}
+
+		orphan := GCOrphan{
+			HashKey:  s.hashKey,
+			RangeKey: "0",
+			File:     v2Prefixes[prefix],
+		}
+
+		if !opts.DryRun {
+			deleted, err := deleteSectorIfUnchanged(db, table, s.hashKey, s.ts)
+			if err != nil {
+				return nil, err
+			}
+			if !deleted {
+				result.Skipped++
+				continue
+			}
+		}
+
+		result.Orphans = append(result.Orphans, orphan)
+	}
+
+	for _, row := range v1Rows {
+		if liveV1Rows[row.HashKey] {
+			continue
+		}
+
+		if !opts.DryRun {
+			_, err := db.DeleteItem(&dynamodb.DeleteItemInput{
+				TableName: &table,
+				Key: map[string]*dynamodb.AttributeValue{
+					dynamo.HKey: {
+						S: aws.String(row.HashKey),
+					},
+					dynamo.RKey: {
+						N: aws.String(row.RangeKey),
+					},
+				},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("delete %s/%s err: %w", row.HashKey, row.RangeKey, err)
+			}
+		}
+
+		result.Orphans = append(result.Orphans, row)
+	}
+
+	for _, row := range histRows {
+		if liveHistories[row.HashKey] {
+			continue
+		}
+
+		if !opts.DryRun {
+			_, err := db.DeleteItem(&dynamodb.DeleteItemInput{
+				TableName: &table,
+				Key: map[string]*dynamodb.AttributeValue{
+					dynamo.HKey: {
+						S: aws.String(row.HashKey),
+					},
+					dynamo.RKey: {
+						N: aws.String(row.RangeKey),
+					},
+				},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("delete %s/%s err: %w", row.HashKey, row.RangeKey, err)
+			}
+		}
+
+		result.Orphans = append(result.Orphans, row)
+	}
+
+	return &result, nil
+}
+
+// lockRowHeld reports whether the lock row hashKey holds an unexpired
+// lease: the writer's deadline_us or, with the multi-reader strategy,
+// any reader's r_* attribute. The reader attributes can't be named in
+// a projection, so the whole row is read.
+func lockRowHeld(db DynamoClient, table, hashKey string, now time.Time) (bool, error) {
+	out, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: &hashKey,
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for attr, v := range out.Item {
+		if attr != "deadline_us" && !strings.HasPrefix(attr, "r_") {
+			continue
+		}
+		dus, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		if err != nil || time.UnixMicro(dus).After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// historyIsLive reports whether the history partition hashKey belongs
+// to a file with one of the given RandIDs. RandIDs can contain '-', so
+// every split point of HistoryKey's "<randID>-<name>" is tried.
+func historyIsLive(hashKey string, randIDs map[string]bool) bool {
+	rest := strings.TrimPrefix(hashKey, dynamo.FileHistPrefix)
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == '-' && randIDs[rest[:i]] {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteSectorIfUnchanged deletes a sector item as long as it hasn't been
+// rewritten since we observed ts. A writer may restage an identical
+// sector (same content, same key) at any time.
+func deleteSectorIfUnchanged(db DynamoClient, table, hashKey, ts string) (bool, error) {
+	input := &dynamodb.DeleteItemInput{
+		TableName: &table,
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(hashKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#ts": aws.String(dynamo.SectorTSAttr),
+		},
+	}
+
+	if ts == "" {
+		input.ConditionExpression = aws.String("attribute_not_exists(#ts)")
+	} else {
+		input.ConditionExpression = aws.String("#ts = :ts")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":ts": {
+				N: aws.String(ts),
+			},
+		}
+	}
+
+	_, err := db.DeleteItem(input)
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			return false, nil
+		}
+		return false, fmt.Errorf("delete sector %s err: %w", hashKey, err)
+	}
+
+	return true, nil
+}
+
+// readAllFileMeta returns the metadata of every file in table. v3
+// files are found from the directory partition as well as v3Names.
+func readAllFileMeta(db DynamoClient, table string, v3Names []string) ([]*dynamo.FileMetaV1V2, error) {
+	fileRow, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileMetaKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get file metadata err: %w", err)
+	}
+
+	metas := make([]*dynamo.FileMetaV1V2, 0, len(fileRow.Item))
+	for name, v := range fileRow.Item {
+		if name == dynamo.HKey || name == dynamo.RKey {
+			continue
+		}
+
+		var meta dynamo.FileMetaV1V2
+		err = json.Unmarshal([]byte(aws.StringValue(v.S)), &meta)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal file meta for %q err: %w", name, err)
+		}
+		metas = append(metas, &meta)
+	}
+
+	dirNames, err := schemav2.ListFilesV3(db, table)
+	if err != nil {
+		return nil, fmt.Errorf("list v3 files err: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range append(dirNames, v3Names...) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		meta, _, err := schemav2.FetchMetaV3(db, table, name)
+		if err != nil {
+			return nil, fmt.Errorf("get file meta for %q err: %w", name, err)
+		}
+		if meta != nil {
+			metas = append(metas, meta)
+		}
+	}
+
+	return metas, nil
+}
@@ -0,0 +1,55 @@
+package dynamo
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// MaxBatchWriteItems is the most requests DynamoDB accepts in a
+	// single BatchWriteItem call.
+	MaxBatchWriteItems = 25
+
+	// MaxUnprocessedRetries is how many times in a row the unprocessed
+	// part of a batch request is resent without any progress before
+	// giving up.
+	MaxUnprocessedRetries = 10
+
+	unprocessedBaseBackoff = 50 * time.Millisecond
+	unprocessedMaxBackoff  = 5 * time.Second
+)
+
+// UnprocessedRetrier paces resending the unprocessed items or keys of
+// a batch request. DynamoDB leaves part of a batch unprocessed when the
+// table is being throttled, so it backs off exponentially with full
+// jitter. The backoff resets whenever an attempt makes progress.
+type UnprocessedRetrier struct {
+	stalled int
+}
+
+// Retry records that remaining of the sent items were left unprocessed
+// and sleeps before they are resent. It returns an error once
+// MaxUnprocessedRetries attempts in a row made no progress.
+func (r *UnprocessedRetrier) Retry(remaining, sent int) error {
+	if remaining < sent {
+		r.stalled = 0
+	} else {
+		r.stalled++
+	}
+
+	if r.stalled > MaxUnprocessedRetries {
+		return fmt.Errorf("%d items still unprocessed after %d retries", remaining, MaxUnprocessedRetries)
+	}
+
+	backoff := unprocessedMaxBackoff
+	if r.stalled < 16 {
+		backoff = unprocessedBaseBackoff << r.stalled
+		if backoff > unprocessedMaxBackoff {
+			backoff = unprocessedMaxBackoff
+		}
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(backoff) + 1)))
+
+	return nil
+}
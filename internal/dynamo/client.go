@@ -0,0 +1,112 @@
+package dynamo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Client is the subset of dynamodbiface.DynamoDBAPI used by donutdb.
+// *dynamodb.DynamoDB satisfies this interface, as does any wrapper
+// or fake that implements these methods.
+//
+// Some operations use additional API calls when the client provides
+// them; see ContextClient, Scanner and TransactWriter.
+type Client interface {
+	GetItem(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	PutItem(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+	Query(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	BatchGetItem(*dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItem(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+// ContextClient is implemented by clients that can bound each request
+// with a context. WithContext uses these methods when they are
+// available.
+type ContextClient interface {
+	GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(aws.Context, *dynamodb.PutItemInput, ...request.Option) (*dynamodb.PutItemOutput, error)
+	UpdateItemWithContext(aws.Context, *dynamodb.UpdateItemInput, ...request.Option) (*dynamodb.UpdateItemOutput, error)
+	DeleteItemWithContext(aws.Context, *dynamodb.DeleteItemInput, ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	QueryWithContext(aws.Context, *dynamodb.QueryInput, ...request.Option) (*dynamodb.QueryOutput, error)
+	BatchGetItemWithContext(aws.Context, *dynamodb.BatchGetItemInput, ...request.Option) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItemWithContext(aws.Context, *dynamodb.BatchWriteItemInput, ...request.Option) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+// Scanner is implemented by clients that support Scan. It is needed
+// by garbage collection and fsck.
+type Scanner interface {
+	Scan(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
+}
+
+// TransactWriter is implemented by clients that support
+// TransactWriteItems. It is needed to rename schema V3 files.
+type TransactWriter interface {
+	TransactWriteItems(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+var (
+	_ Client         = (*dynamodb.DynamoDB)(nil)
+	_ ContextClient  = (*dynamodb.DynamoDB)(nil)
+	_ Scanner        = (*dynamodb.DynamoDB)(nil)
+	_ TransactWriter = (*dynamodb.DynamoDB)(nil)
+)
+
+// UnsupportedErr is returned when an operation needs an API call the
+// client does not implement.
+var UnsupportedErr = errors.New("operation not supported by dynamodb client")
+
+// Scan calls db.Scan if db is a Scanner.
+func Scan(db Client, input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	s, ok := db.(Scanner)
+	if !ok {
+		return nil, fmt.Errorf("%w: Scan", UnsupportedErr)
+	}
+	return s.Scan(input)
+}
+
+// TransactWriteItems calls db.TransactWriteItems if db is a
+// TransactWriter.
+func TransactWriteItems(db Client, input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	if !SupportsTransactions(db) {
+		return nil, fmt.Errorf("%w: TransactWriteItems", UnsupportedErr)
+	}
+	return db.(TransactWriter).TransactWriteItems(input)
+}
+
+// SupportsTransactions reports whether TransactWriteItems can be used
+// with db.
+func SupportsTransactions(db Client) bool {
+	for {
+		c, ok := db.(*contextClient)
+		if !ok {
+			break
+		}
+		db = c.Client
+	}
+	_, ok := db.(TransactWriter)
+	return ok
+}
+
+// ConditionFailedErr converts a transaction canceled because one of
+// its conditions failed into a *dynamodb.ConditionalCheckFailedException
+// with msg, so callers can handle it like the failed condition of a
+// single write. Any other error is returned unchanged.
+func ConditionFailedErr(err error, msg string) error {
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			if aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+				return &dynamodb.ConditionalCheckFailedException{
+					Message_: aws.String(msg),
+				}
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package dynamo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/sqlite3vfs"
+)
+
+// WithContext returns a Client that sends every request using the
+// *WithContext variant of the API call. Each request gets the context
+// returned by ctx (context.Background() if ctx is nil), bounded by
+// timeout if it is non-zero. If db does not implement the
+// *WithContext variant of a call, the context is checked before the
+// request and the plain call is used.
+func WithContext(db Client, ctx func() context.Context, timeout time.Duration) Client {
+	if ctx == nil {
+		ctx = context.Background
+	}
+	return &contextClient{
+		Client:  db,
+		ctx:     ctx,
+		timeout: timeout,
+	}
+}
+
+type contextClient struct {
+	Client
+	ctx     func() context.Context
+	timeout time.Duration
+}
+
+func (c *contextClient) requestCtx() (context.Context, context.CancelFunc) {
+	ctx := c.ctx()
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// contextErr reports an already canceled context the same way the
+// aws sdk does, for clients without *WithContext methods.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return nil
+}
+
+func (c *contextClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if cc, ok := c.Client.(ContextClient); ok {
+		return cc.GetItemWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.GetItem(input)
+}
+
+func (c *contextClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if cc, ok := c.Client.(ContextClient); ok {
+		return cc.PutItemWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.PutItem(input)
+}
+
+func (c *contextClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if cc, ok := c.Client.(ContextClient); ok {
+		return cc.UpdateItemWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.UpdateItem(input)
+}
+
+func (c *contextClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if cc, ok := c.Client.(ContextClient); ok {
+		return cc.DeleteItemWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.DeleteItem(input)
+}
+
+func (c *contextClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if cc, ok := c.Client.(ContextClient); ok {
+		return cc.QueryWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.Query(input)
+}
+
+func (c *contextClient) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if cc, ok := c.Client.(ContextClient); ok {
+		return cc.BatchGetItemWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.BatchGetItem(input)
+}
+
+func (c *contextClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if cc, ok := c.Client.(ContextClient); ok {
+		return cc.BatchWriteItemWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return c.Client.BatchWriteItem(input)
+}
+
+func (c *contextClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if sc, ok := c.Client.(interface {
+		ScanWithContext(aws.Context, *dynamodb.ScanInput, ...request.Option) (*dynamodb.ScanOutput, error)
+	}); ok {
+		return sc.ScanWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return Scan(c.Client, input)
+}
+
+func (c *contextClient) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	ctx, cancel := c.requestCtx()
+	defer cancel()
+	if tc, ok := c.Client.(interface {
+		TransactWriteItemsWithContext(aws.Context, *dynamodb.TransactWriteItemsInput, ...request.Option) (*dynamodb.TransactWriteItemsOutput, error)
+	}); ok {
+		return tc.TransactWriteItemsWithContext(ctx, input)
+	}
+	if err := contextErr(ctx); err != nil {
+		return nil, err
+	}
+	return TransactWriteItems(c.Client, input)
+}
+
+// IsCanceled reports whether err is the result of a request's context
+// being canceled or timing out.
+func IsCanceled(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == request.CanceledErrorCode
+}
+
+// AsIOError replaces *errp with sqlite3vfs.IOError if it is an error
+// SQLite should treat as an I/O failure: a canceled or timed out
+// request, or a lost lock lease. A CorruptSectorError becomes
+// sqlite3vfs.CorruptError. sqlite3vfs reports any other Go error to
+// SQLite as a generic SQLITE_ERROR.
+//
+// It is meant to be the first deferred call in a sqlite3vfs.File
+// method, so the change log still records the original error.
+func AsIOError(errp *error) {
+	if *errp == nil {
+		return
+	}
+	var corrupt *CorruptSectorError
+	if IsCanceled(*errp) || errors.Is(*errp, LeaseLostErr) {
+		*errp = sqlite3vfs.IOError
+	} else if errors.As(*errp, &corrupt) {
+		*errp = sqlite3vfs.CorruptError
+	}
+}
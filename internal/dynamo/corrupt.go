@@ -0,0 +1,96 @@
+package dynamo
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons a sector can fail its integrity check.
+const (
+	// CorruptHashMismatch means the sector's content doesn't match
+	// the hash in its sector ID.
+	CorruptHashMismatch = "hash_mismatch"
+
+	// CorruptDecompress means the sector's bytes could not be
+	// decompressed.
+	CorruptDecompress = "decompress"
+
+	// CorruptDecrypt means an encrypted sector failed authentication.
+	CorruptDecrypt = "decrypt"
+)
+
+var corruptSectorCount = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "donutdb",
+		Name:      "corrupt_sector_count",
+		Help:      "Sectors read from DynamoDB that failed their integrity check.",
+	},
+	[]string{"reason"},
+)
+
+// CorruptSectorError is returned when a sector read from DynamoDB fails
+// its integrity check.
+type CorruptSectorError struct {
+	// Key identifies the sector item: its hash_key, followed by
+	// its range_key for schemav1 sectors.
+	Key string
+
+	// Reason is one of the Corrupt* constants.
+	Reason string
+
+	// Err is the underlying error, if any.
+	Err error
+}
+
+// NewCorruptSectorError returns a CorruptSectorError and counts it in
+// the donutdb_corrupt_sector_count metric.
+func NewCorruptSectorError(key, reason string, err error) error {
+	corruptSectorCount.WithLabelValues(reason).Inc()
+	return &CorruptSectorError{
+		Key:    key,
+		Reason: reason,
+		Err:    err,
+	}
+}
+
+func (e *CorruptSectorError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("corrupt sector %s (%s): %s", e.Key, e.Reason, e.Err)
+	}
+	return fmt.Sprintf("corrupt sector %s (%s)", e.Key, e.Reason)
+}
+
+func (e *CorruptSectorError) Unwrap() error {
+	return e.Err
+}
+
+// Checks reported in a SectorProblem, in addition to the Corrupt*
+// reasons.
+const (
+	// CheckSectorList means the file's list of sectors is inconsistent
+	// with itself or with the file size.
+	CheckSectorList = "sector_list"
+
+	// CheckSectorMissing means a sector referenced by the file's
+	// metadata doesn't exist.
+	CheckSectorMissing = "sector_missing"
+
+	// CheckSectorSize means a sector other than the last one is short,
+	// or the last sector doesn't end where the file does.
+	CheckSectorSize = "sector_size"
+)
+
+// SectorProblem is an inconsistency in a file's sectors found by a
+// schema's CheckSectors.
+type SectorProblem struct {
+	// Key identifies the sector item, like CorruptSectorError.Key. It
+	// is empty for problems with the sector list as a whole.
+	Key string
+
+	// Check is a Check* constant or a Corrupt* reason.
+	Check string
+
+	Detail string
+}
@@ -1,13 +1,40 @@
 package dynamo
 
-import "errors"
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+)
 
 const (
 	DefaultSectorSize = 1 << 16
 
-	FileMetaKey    = "file-meta-v1"
-	FileDataPrefix = "file-v1-"
-	FileLockPrefix = "lock-global-v1-"
+	FileMetaKey      = "file-meta-v1"
+	FileDataPrefix   = "file-v1-"
+	FileDataV2Prefix = "file-v2-"
+	FileLockPrefix   = "lock-global-v1-"
+
+	// Schema v3 moves each file's metadata into its own item. Large
+	// sector lists are split into chunk items, and a directory partition
+	// lists every v3 file for LsFiles.
+	FileMetaV3Prefix      = "file-meta-v3-"
+	FileSectorMapV3Prefix = "file-smap-v3-"
+	FileDirV3Key          = "file-dir-v3"
+	MetaV3Attr            = "meta"
+
+	// Snapshots are frozen copies of a file's metadata, stored in a
+	// partition per file with one item per snapshot.
+	FileSnapPrefix = "file-snap-v1-"
+
+	// The committed metadata versions of files with history enabled,
+	// stored in a partition per file with the generation as the
+	// range_key.
+	FileHistPrefix = "file-hist-v1-"
+
+	// SectorTSAttr records when a v2 sector item was written (unix seconds).
+	// It lets garbage collection avoid sectors staged by an in progress
+	// transaction that are not yet referenced by any metadata.
+	SectorTSAttr = "ts"
 
 	HKey = "hash_key"
 	RKey = "range_key"
@@ -15,6 +42,59 @@ const (
 
 var SectorNotFoundErr = errors.New("sector not found")
 
+// MetaConflictErr is returned when a metadata update fails because
+// the metadata was changed by someone else since we read it. This
+// usually means our lock lease expired and another client took over.
+var MetaConflictErr = errors.New("file metadata was modified concurrently (lock lease lost?)")
+
+// LeaseLostErr is returned (wrapped) by a lock manager and the file
+// using it after its lock lease was lost, either because another
+// client took over the lock or because the lease expired before we
+// could renew it. Anything read or written under the lost lock can't
+// be trusted, so the current transaction must be rolled back.
+var LeaseLostErr = errors.New("lock lease lost")
+
+// FileMigratedErr is returned when locking a schemav1 file that has
+// since been migrated to a newer schema. The open file can no longer be
+// used; it has to be reopened.
+var FileMigratedErr = errors.New("file was migrated to a new schema version")
+
+// SectorKey returns the hash_key of a schemav2 sector item.
+func SectorKey(randID, name, sectorID string) string {
+	return FileDataV2Prefix + randID + "-" + name + "-" + sectorID
+}
+
+// MetaV3Key returns the hash_key of a v3 file metadata item.
+func MetaV3Key(name string) string {
+	return FileMetaV3Prefix + name
+}
+
+// SectorMapChunkKey returns the hash_key of a v3 sector map chunk item.
+func SectorMapChunkKey(randID, name, chunkID string) string {
+	return FileSectorMapV3Prefix + randID + "-" + name + "-" + chunkID
+}
+
+// SnapshotKey returns the hash_key of the partition holding the
+// snapshots of the file name.
+func SnapshotKey(name string) string {
+	return FileSnapPrefix + name
+}
+
+// HistoryKey returns the hash_key of the partition holding the
+// metadata history of a file.
+func HistoryKey(randID, name string) string {
+	return FileHistPrefix + randID + "-" + name
+}
+
+// DirV3RangeKey returns the range_key of name's entry in the v3
+// directory partition. Snapshots use the same hash of their name as
+// their range_key.
+func DirV3RangeKey(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return strconv.FormatUint(h.Sum64()&(1<<63-1), 10)
+}
+
 type FileMetaV1V2 struct {
 	MetaVersion int    `json:"meta_version"`
 	SectorSize  int64  `json:"sector_size"`
@@ -24,7 +104,51 @@ type FileMetaV1V2 struct {
 	LockRowKey  string `json:"lock_row_key"`
 	CompressAlg string `json:"compress_alg"`
 
-	// v2 only fields
+	// EncryptAlg and KeyID are set for files whose sectors are
+	// encrypted (schema v2 and v3 only).
+	EncryptAlg string `json:"encrypt_alg,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+
+	// Generation is incremented on every metadata update.
+	// Updates are conditional on the generation that was read.
+	Generation int64 `json:"generation"`
+
+	// v2 and v3 fields
 	FileSize int64    `json:"file_size"`
 	Sectors  []string `json:"sectors"`
+
+	// SharedSectors is set once the file's sectors may be referenced
+	// by something other than its own metadata, such as a snapshot or
+	// a clone.
+	// Writers then leave superseded sectors for garbage collection
+	// instead of deleting them.
+	SharedSectors bool `json:"shared_sectors,omitempty"`
+
+	// DataRandID and DataName, if set, are used instead of RandID and
+	// OrigName in the keys of the file's sectors and sector map chunks.
+	// A clone keeps using the sector namespace of the file it was
+	// cloned from, see SectorNamespace.
+	DataRandID string `json:"data_rand_id,omitempty"`
+	DataName   string `json:"data_name,omitempty"`
+
+	// HistorySize is the number of committed metadata versions kept in
+	// the file's history partition, so that the file can be rolled
+	// back to one of them. Files with history also have SharedSectors
+	// set, since older versions still reference replaced sectors.
+	HistorySize int `json:"history_size,omitempty"`
+
+	// v3 only fields
+
+	// SectorChunks are the ids of the sector map chunks holding
+	// Sectors when the list is too large to store inline.
+	SectorChunks []string `json:"sector_chunks,omitempty"`
+}
+
+// SectorNamespace returns the rand_id and name embedded in the keys of
+// the file's sectors and sector map chunks.
+func (m *FileMetaV1V2) SectorNamespace() (randID, name string) {
+	if m.DataRandID != "" {
+		return m.DataRandID, m.DataName
+	}
+	return m.RandID, m.OrigName
 }
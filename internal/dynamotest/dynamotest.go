@@ -14,8 +14,14 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/fakedynamo"
 )
 
+// SetupDynamoServer returns a DynamoDB client and table for tests.
+// If DONUTDB_DYNAMODB_LOCAL_DIR or DONUTDB_DYNAMODB_TEST_REGION are set
+// the tests run against DynamoDB Local or a real DynamoDB endpoint,
+// otherwise an in-memory fake is used.
 func SetupDynamoServer() (*DynamoServerInfo, error) {
 	info := DynamoServerInfo{
 		TableName: os.Getenv("DONUTDB_DYNAMODB_TEST_TABLE_NAME"),
@@ -81,25 +87,36 @@ func SetupDynamoServer() (*DynamoServerInfo, error) {
 		}
 	}
 
+	var tableCreator interface {
+		CreateTable(*dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error)
+	}
+
 	if info.Region == "" {
-		return nil, fmt.Errorf("Missing required environment variables to connect to dynamodb (either local or remote)")
+		fake := fakedynamo.New()
+		info.Fake = fake
+		info.DB = fake
+		tableCreator = fake
+	} else {
+		sess := session.Must(session.NewSessionWithOptions(session.Options{
+			Config: aws.Config{
+				Region:     &info.Region,
+				Endpoint:   &info.Addr,
+				MaxRetries: aws.Int(0),
+				// LogLevel: aws.LogLevel(aws.LogDebug),
+				// Logger:   aws.NewDefaultLogger(),
+			},
+		}))
+		db := dynamodb.New(sess)
+		info.DB = db
+		tableCreator = db
 	}
 
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:     &info.Region,
-			Endpoint:   &info.Addr,
-			MaxRetries: aws.Int(0),
-			// LogLevel: aws.LogLevel(aws.LogDebug),
-			// Logger:   aws.NewDefaultLogger(),
-		},
-	}))
-	info.DB = dynamodb.New(sess)
-
-	if info.TableName == "" {
-		info.TableName = fmt.Sprintf("donutdb-test-%d", time.Now().UnixNano())
-
-		_, err := info.DB.CreateTable(&dynamodb.CreateTableInput{
+	if info.TableName == "" || info.Fake != nil {
+		if info.TableName == "" {
+			info.TableName = fmt.Sprintf("donutdb-test-%d", time.Now().UnixNano())
+		}
+
+		_, err := tableCreator.CreateTable(&dynamodb.CreateTableInput{
 			TableName: &info.TableName,
 			AttributeDefinitions: []*dynamodb.AttributeDefinition{
 				{
@@ -137,5 +154,9 @@ type DynamoServerInfo struct {
 	Addr      string
 	TableName string
 	Cleanup   func()
-	DB        *dynamodb.DynamoDB
+	DB        dynamo.Client
+
+	// Fake is set when the tests are running against the
+	// in-memory fake instead of a real DynamoDB endpoint.
+	Fake *fakedynamo.DB
 }
@@ -0,0 +1,327 @@
+package fakedynamo
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// maxItemSize is the largest item DynamoDB will store.
+const maxItemSize = 400 * 1024
+
+type item map[string]*dynamodb.AttributeValue
+
+func copyItem(in map[string]*dynamodb.AttributeValue) item {
+	if in == nil {
+		return nil
+	}
+	out := make(item, len(in))
+	for k, v := range in {
+		out[k] = copyAV(v)
+	}
+	return out
+}
+
+func copyAV(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+
+	out := &dynamodb.AttributeValue{}
+	if v.B != nil {
+		out.B = append([]byte{}, v.B...)
+	}
+	if v.BOOL != nil {
+		b := *v.BOOL
+		out.BOOL = &b
+	}
+	if v.BS != nil {
+		out.BS = make([][]byte, len(v.BS))
+		for i, b := range v.BS {
+			out.BS[i] = append([]byte{}, b...)
+		}
+	}
+	if v.L != nil {
+		out.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			out.L[i] = copyAV(e)
+		}
+	}
+	if v.M != nil {
+		out.M = copyItem(v.M)
+	}
+	if v.N != nil {
+		n := *v.N
+		out.N = &n
+	}
+	if v.NS != nil {
+		out.NS = copyStrings(v.NS)
+	}
+	if v.NULL != nil {
+		b := *v.NULL
+		out.NULL = &b
+	}
+	if v.S != nil {
+		s := *v.S
+		out.S = &s
+	}
+	if v.SS != nil {
+		out.SS = copyStrings(v.SS)
+	}
+	return out
+}
+
+func copyStrings(in []*string) []*string {
+	out := make([]*string, len(in))
+	for i, s := range in {
+		ss := *s
+		out[i] = &ss
+	}
+	return out
+}
+
+// avType returns the DynamoDB type descriptor for v
+// (e.g. "S", "N", "B", "M").
+func avType(v *dynamodb.AttributeValue) string {
+	switch {
+	case v == nil:
+		return ""
+	case v.S != nil:
+		return "S"
+	case v.N != nil:
+		return "N"
+	case v.B != nil:
+		return "B"
+	case v.BOOL != nil:
+		return "BOOL"
+	case v.NULL != nil:
+		return "NULL"
+	case v.SS != nil:
+		return "SS"
+	case v.NS != nil:
+		return "NS"
+	case v.BS != nil:
+		return "BS"
+	case v.L != nil:
+		return "L"
+	case v.M != nil:
+		return "M"
+	}
+	return ""
+}
+
+func parseNumber(s string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(s)
+}
+
+// compareAV orders two scalar values of the same type. ok is false
+// if the values are not comparable.
+func compareAV(a, b *dynamodb.AttributeValue) (cmp int, ok bool) {
+	ta, tb := avType(a), avType(b)
+	if ta != tb {
+		return 0, false
+	}
+	switch ta {
+	case "S":
+		switch {
+		case *a.S < *b.S:
+			return -1, true
+		case *a.S > *b.S:
+			return 1, true
+		}
+		return 0, true
+	case "N":
+		na, okA := parseNumber(*a.N)
+		nb, okB := parseNumber(*b.N)
+		if !okA || !okB {
+			return 0, false
+		}
+		return na.Cmp(nb), true
+	case "B":
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+func equalAV(a, b *dynamodb.AttributeValue) bool {
+	ta, tb := avType(a), avType(b)
+	if ta != tb || ta == "" {
+		return false
+	}
+	switch ta {
+	case "S", "N", "B":
+		c, ok := compareAV(a, b)
+		return ok && c == 0
+	case "BOOL":
+		return *a.BOOL == *b.BOOL
+	case "NULL":
+		return true
+	case "SS":
+		return equalSet(stringSet(a.SS), stringSet(b.SS))
+	case "NS":
+		return equalSet(numberSet(a.NS), numberSet(b.NS))
+	case "BS":
+		return equalSet(bytesSet(a.BS), bytesSet(b.BS))
+	case "L":
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !equalAV(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case "M":
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, av := range a.M {
+			if !equalAV(av, b.M[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func stringSet(in []*string) map[string]bool {
+	out := make(map[string]bool, len(in))
+	for _, s := range in {
+		out[*s] = true
+	}
+	return out
+}
+
+func numberSet(in []*string) map[string]bool {
+	out := make(map[string]bool, len(in))
+	for _, s := range in {
+		out[canonicalNumber(*s)] = true
+	}
+	return out
+}
+
+func bytesSet(in [][]byte) map[string]bool {
+	out := make(map[string]bool, len(in))
+	for _, b := range in {
+		out[string(b)] = true
+	}
+	return out
+}
+
+func equalSet(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func canonicalNumber(s string) string {
+	n, ok := parseNumber(s)
+	if !ok {
+		return s
+	}
+	return n.RatString()
+}
+
+func sortedKeys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// avSize approximates DynamoDB's item size accounting.
+func avSize(v *dynamodb.AttributeValue) int {
+	switch avType(v) {
+	case "S":
+		return len(*v.S)
+	case "N":
+		return len(*v.N)/2 + 1
+	case "B":
+		return len(v.B)
+	case "BOOL", "NULL":
+		return 1
+	case "SS", "NS":
+		var n int
+		for _, s := range append(v.SS, v.NS...) {
+			n += len(*s)
+		}
+		return n
+	case "BS":
+		var n int
+		for _, b := range v.BS {
+			n += len(b)
+		}
+		return n
+	case "L":
+		n := 3
+		for _, e := range v.L {
+			n += 1 + avSize(e)
+		}
+		return n
+	case "M":
+		return 3 + itemSize(v.M)
+	}
+	return 0
+}
+
+func itemSize(it map[string]*dynamodb.AttributeValue) int {
+	var n int
+	for k, v := range it {
+		n += len(k) + avSize(v)
+	}
+	return n
+}
+
+// validateAV checks for values that DynamoDB would reject on write.
+func validateAV(v *dynamodb.AttributeValue) error {
+	switch avType(v) {
+	case "":
+		return validationErr("Supplied AttributeValue is empty, must contain exactly one of the supported datatypes")
+	case "N":
+		if _, ok := parseNumber(*v.N); !ok {
+			return validationErr("The parameter cannot be converted to a numeric value: %s", *v.N)
+		}
+	case "NS":
+		if len(v.NS) == 0 {
+			return validationErr("An number set may not be empty")
+		}
+		for _, n := range v.NS {
+			if _, ok := parseNumber(*n); !ok {
+				return validationErr("The parameter cannot be converted to a numeric value: %s", *n)
+			}
+		}
+	case "SS":
+		if len(v.SS) == 0 {
+			return validationErr("An string set may not be empty")
+		}
+	case "BS":
+		if len(v.BS) == 0 {
+			return validationErr("Binary sets should not be empty")
+		}
+	case "L":
+		for _, e := range v.L {
+			if err := validateAV(e); err != nil {
+				return err
+			}
+		}
+	case "M":
+		for _, e := range v.M {
+			if err := validateAV(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
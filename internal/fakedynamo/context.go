@@ -0,0 +1,81 @@
+package fakedynamo
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// checkContext returns the error the AWS SDK returns for a request
+// whose context is already done. The fake never blocks, so this is the
+// only point where a request can be canceled.
+func checkContext(ctx aws.Context) error {
+	if err := ctx.Err(); err != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return nil
+}
+
+func (db *DB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.GetItem(input)
+}
+
+func (db *DB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.PutItem(input)
+}
+
+func (db *DB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, _ ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.UpdateItem(input)
+}
+
+func (db *DB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.DeleteItem(input)
+}
+
+func (db *DB) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.Query(input)
+}
+
+func (db *DB) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, _ ...request.Option) (*dynamodb.ScanOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.Scan(input)
+}
+
+func (db *DB) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, _ ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.BatchGetItem(input)
+}
+
+func (db *DB) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, _ ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.BatchWriteItem(input)
+}
+
+func (db *DB) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, _ ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	return db.TransactWriteItems(input)
+}
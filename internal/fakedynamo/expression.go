@@ -0,0 +1,1150 @@
+package fakedynamo
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// exprContext resolves #name and :value placeholders and tracks
+// which ones were referenced so unused placeholders can be
+// rejected the same way DynamoDB does.
+type exprContext struct {
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newExprContext(names map[string]*string, values map[string]*dynamodb.AttributeValue) *exprContext {
+	return &exprContext{
+		names:      names,
+		values:     values,
+		usedNames:  make(map[string]bool),
+		usedValues: make(map[string]bool),
+	}
+}
+
+func (c *exprContext) checkUnused() error {
+	for k := range c.names {
+		if !c.usedNames[k] {
+			return validationErr("Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}", k)
+		}
+	}
+	for k := range c.values {
+		if !c.usedValues[k] {
+			return validationErr("Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}", k)
+		}
+	}
+	return nil
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokName
+	tokValue
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+	tokDot
+	tokLBracket
+	tokRBracket
+)
+
+type token struct {
+	kind tokKind
+	s    string
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "("})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")"})
+			i++
+		case c == ',':
+			toks = append(toks, token{tokComma, ","})
+			i++
+		case c == '.':
+			toks = append(toks, token{tokDot, "."})
+			i++
+		case c == '[':
+			toks = append(toks, token{tokLBracket, "["})
+			i++
+		case c == ']':
+			toks = append(toks, token{tokRBracket, "]"})
+			i++
+		case c == '=' || c == '+' || c == '-':
+			toks = append(toks, token{tokOp, string(c)})
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(s) && (s[i+1] == '=' || (c == '<' && s[i+1] == '>')) {
+				toks = append(toks, token{tokOp, s[i : i+2]})
+				i += 2
+			} else {
+				toks = append(toks, token{tokOp, string(c)})
+				i++
+			}
+		case c == '#' || c == ':':
+			j := i + 1
+			for j < len(s) && isIdentByte(s[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, validationErr("Invalid expression: syntax error at %q", s[i:])
+			}
+			kind := tokName
+			if c == ':' {
+				kind = tokValue
+			}
+			toks = append(toks, token{kind, s[i:j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			toks = append(toks, token{tokNumber, s[i:j]})
+			i = j
+		case isIdentByte(c):
+			j := i
+			for j < len(s) && isIdentByte(s[j]) {
+				j++
+			}
+			toks = append(toks, token{tokIdent, s[i:j]})
+			i = j
+		default:
+			return nil, validationErr("Invalid expression: unexpected character %q", c)
+		}
+	}
+	toks = append(toks, token{kind: tokEOF})
+	return toks, nil
+}
+
+type pathElem struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+type attrPath []pathElem
+
+func (p attrPath) String() string {
+	var sb strings.Builder
+	for i, e := range p {
+		if e.isIndex {
+			fmt.Fprintf(&sb, "[%d]", e.index)
+			continue
+		}
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(e.name)
+	}
+	return sb.String()
+}
+
+func (p attrPath) resolve(it item) *dynamodb.AttributeValue {
+	if len(p) == 0 || p[0].isIndex {
+		return nil
+	}
+	v := it[p[0].name]
+	for _, e := range p[1:] {
+		if v == nil {
+			return nil
+		}
+		if e.isIndex {
+			if v.L == nil || e.index >= len(v.L) {
+				return nil
+			}
+			v = v.L[e.index]
+		} else {
+			if v.M == nil {
+				return nil
+			}
+			v = v.M[e.name]
+		}
+	}
+	return v
+}
+
+type parser struct {
+	ctx  *exprContext
+	toks []token
+	pos  int
+}
+
+func newParser(ctx *exprContext, expr string) (*parser, error) {
+	toks, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{ctx: ctx, toks: toks}, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n >= len(p.toks) {
+		return token{kind: tokEOF}
+	}
+	return p.toks[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.s, kw)
+}
+
+func (p *parser) expect(kind tokKind, what string) error {
+	t := p.next()
+	if t.kind != kind {
+		return validationErr("Invalid expression: expected %s, got %q", what, t.s)
+	}
+	return nil
+}
+
+func (p *parser) expectEOF() error {
+	if t := p.peek(); t.kind != tokEOF {
+		return validationErr("Invalid expression: unexpected token %q", t.s)
+	}
+	return nil
+}
+
+func (p *parser) nameElem(t token) (string, error) {
+	switch t.kind {
+	case tokIdent:
+		return t.s, nil
+	case tokName:
+		n, ok := p.ctx.names[t.s]
+		if !ok || n == nil {
+			return "", validationErr("An expression attribute name used in the document path is not defined; attribute name: %s", t.s)
+		}
+		p.ctx.usedNames[t.s] = true
+		return *n, nil
+	}
+	return "", validationErr("Invalid expression: expected attribute name, got %q", t.s)
+}
+
+func (p *parser) parsePath() (attrPath, error) {
+	first, err := p.nameElem(p.next())
+	if err != nil {
+		return nil, err
+	}
+	path := attrPath{{name: first}}
+	for {
+		switch p.peek().kind {
+		case tokDot:
+			p.next()
+			name, err := p.nameElem(p.next())
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, pathElem{name: name})
+		case tokLBracket:
+			p.next()
+			t := p.next()
+			if t.kind != tokNumber {
+				return nil, validationErr("Invalid expression: expected list index, got %q", t.s)
+			}
+			idx, err := strconv.Atoi(t.s)
+			if err != nil {
+				return nil, validationErr("Invalid expression: bad list index %q", t.s)
+			}
+			if err := p.expect(tokRBracket, "]"); err != nil {
+				return nil, err
+			}
+			path = append(path, pathElem{index: idx, isIndex: true})
+		default:
+			return path, nil
+		}
+	}
+}
+
+func (p *parser) parseValueRef() (*dynamodb.AttributeValue, error) {
+	t := p.next()
+	v, ok := p.ctx.values[t.s]
+	if !ok || v == nil {
+		return nil, validationErr("An expression attribute value used in expression is not defined; attribute value: %s", t.s)
+	}
+	p.ctx.usedValues[t.s] = true
+	return v, nil
+}
+
+// operand is a value referenced by a condition or update expression.
+type operand interface {
+	value(it item) *dynamodb.AttributeValue
+}
+
+type pathOperand struct {
+	path attrPath
+}
+
+func (o pathOperand) value(it item) *dynamodb.AttributeValue {
+	return o.path.resolve(it)
+}
+
+type valueOperand struct {
+	v *dynamodb.AttributeValue
+}
+
+func (o valueOperand) value(it item) *dynamodb.AttributeValue {
+	return o.v
+}
+
+type sizeOperand struct {
+	path attrPath
+}
+
+func (o sizeOperand) value(it item) *dynamodb.AttributeValue {
+	v := o.path.resolve(it)
+	var n int
+	switch avType(v) {
+	case "S":
+		n = len(*v.S)
+	case "B":
+		n = len(v.B)
+	case "SS":
+		n = len(v.SS)
+	case "NS":
+		n = len(v.NS)
+	case "BS":
+		n = len(v.BS)
+	case "L":
+		n = len(v.L)
+	case "M":
+		n = len(v.M)
+	default:
+		return nil
+	}
+	s := strconv.Itoa(n)
+	return &dynamodb.AttributeValue{N: &s}
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokValue:
+		v, err := p.parseValueRef()
+		if err != nil {
+			return nil, err
+		}
+		return valueOperand{v}, nil
+	case tokIdent:
+		if strings.EqualFold(t.s, "size") && p.peekN(1).kind == tokLParen {
+			p.next()
+			p.next()
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokRParen, ")"); err != nil {
+				return nil, err
+			}
+			return sizeOperand{path}, nil
+		}
+	}
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{path}, nil
+}
+
+// condition is a parsed ConditionExpression, FilterExpression
+// or KeyConditionExpression.
+type condition interface {
+	eval(it item) bool
+}
+
+type andCond struct{ l, r condition }
+
+func (c andCond) eval(it item) bool { return c.l.eval(it) && c.r.eval(it) }
+
+type orCond struct{ l, r condition }
+
+func (c orCond) eval(it item) bool { return c.l.eval(it) || c.r.eval(it) }
+
+type notCond struct{ c condition }
+
+func (c notCond) eval(it item) bool { return !c.c.eval(it) }
+
+type cmpCond struct {
+	op   string
+	l, r operand
+}
+
+func (c cmpCond) eval(it item) bool {
+	l, r := c.l.value(it), c.r.value(it)
+	if l == nil || r == nil {
+		return false
+	}
+	switch c.op {
+	case "=":
+		return equalAV(l, r)
+	case "<>":
+		return !equalAV(l, r)
+	}
+	cmp, ok := compareAV(l, r)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+type betweenCond struct {
+	v, lo, hi operand
+}
+
+func (c betweenCond) eval(it item) bool {
+	v, lo, hi := c.v.value(it), c.lo.value(it), c.hi.value(it)
+	if v == nil || lo == nil || hi == nil {
+		return false
+	}
+	c1, ok1 := compareAV(v, lo)
+	c2, ok2 := compareAV(v, hi)
+	return ok1 && ok2 && c1 >= 0 && c2 <= 0
+}
+
+type inCond struct {
+	v    operand
+	list []operand
+}
+
+func (c inCond) eval(it item) bool {
+	v := c.v.value(it)
+	if v == nil {
+		return false
+	}
+	for _, o := range c.list {
+		if equalAV(v, o.value(it)) {
+			return true
+		}
+	}
+	return false
+}
+
+type funcCond struct {
+	name string
+	args []operand
+}
+
+var condFuncArgs = map[string]int{
+	"attribute_exists":     1,
+	"attribute_not_exists": 1,
+	"attribute_type":       2,
+	"begins_with":          2,
+	"contains":             2,
+}
+
+func (c funcCond) eval(it item) bool {
+	a := c.args[0].value(it)
+	switch c.name {
+	case "attribute_exists":
+		return a != nil
+	case "attribute_not_exists":
+		return a == nil
+	}
+
+	b := c.args[1].value(it)
+	if a == nil || b == nil {
+		return false
+	}
+
+	switch c.name {
+	case "attribute_type":
+		return b.S != nil && avType(a) == *b.S
+	case "begins_with":
+		if a.S != nil && b.S != nil {
+			return strings.HasPrefix(*a.S, *b.S)
+		}
+		if a.B != nil && b.B != nil {
+			return bytes.HasPrefix(a.B, b.B)
+		}
+	case "contains":
+		switch avType(a) {
+		case "S":
+			return b.S != nil && strings.Contains(*a.S, *b.S)
+		case "SS":
+			return b.S != nil && stringSet(a.SS)[*b.S]
+		case "NS":
+			return b.N != nil && numberSet(a.NS)[canonicalNumber(*b.N)]
+		case "BS":
+			return b.B != nil && bytesSet(a.BS)[string(b.B)]
+		case "L":
+			for _, e := range a.L {
+				if equalAV(e, b) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func parseCondition(ctx *exprContext, expr string) (condition, error) {
+	p, err := newParser(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEOF(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *parser) parseOr() (condition, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orCond{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (condition, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = andCond{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (condition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCond{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (condition, error) {
+	t := p.peek()
+	if t.kind == tokLParen {
+		p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	if t.kind == tokIdent && p.peekN(1).kind == tokLParen {
+		name := strings.ToLower(t.s)
+		if nargs, ok := condFuncArgs[name]; ok {
+			p.next()
+			p.next()
+			var args []operand
+			for {
+				o, err := p.parseOperand()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, o)
+				if p.peek().kind != tokComma {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect(tokRParen, ")"); err != nil {
+				return nil, err
+			}
+			if len(args) != nargs {
+				return nil, validationErr("Invalid expression: incorrect number of operands for function %s", name)
+			}
+			if _, isPath := args[0].(pathOperand); !isPath {
+				return nil, validationErr("Invalid expression: first operand of %s must be an attribute path", name)
+			}
+			return funcCond{name: name, args: args}, nil
+		}
+	}
+
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		lo, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, validationErr("Invalid expression: expected AND in BETWEEN")
+		}
+		p.next()
+		hi, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenCond{l, lo, hi}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expect(tokLParen, "("); err != nil {
+			return nil, err
+		}
+		var list []operand
+		for {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, o)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(tokRParen, ")"); err != nil {
+			return nil, err
+		}
+		return inCond{l, list}, nil
+	}
+
+	op := p.next()
+	switch op.s {
+	case "=", "<>", "<", "<=", ">", ">=":
+	default:
+		return nil, validationErr("Invalid expression: expected comparator, got %q", op.s)
+	}
+	if op.kind != tokOp {
+		return nil, validationErr("Invalid expression: expected comparator, got %q", op.s)
+	}
+	r, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return cmpCond{op: op.s, l: l, r: r}, nil
+}
+
+// parseProjection parses a ProjectionExpression into its list of
+// attribute paths.
+func parseProjection(ctx *exprContext, expr string) ([]attrPath, error) {
+	p, err := newParser(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+	var paths []attrPath
+	for {
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+	if err := p.expectEOF(); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+func project(it item, paths []attrPath) item {
+	if paths == nil {
+		return it
+	}
+	out := make(item)
+	for _, path := range paths {
+		v := path.resolve(it)
+		if v == nil {
+			continue
+		}
+		projectInto(out, path, v)
+	}
+	return out
+}
+
+// projectInto copies v into dst at path, creating intermediate maps
+// and lists as needed. List indexes are compacted, as DynamoDB does.
+func projectInto(dst item, path attrPath, v *dynamodb.AttributeValue) {
+	if len(path) == 1 {
+		dst[path[0].name] = copyAV(v)
+		return
+	}
+
+	cur := dst[path[0].name]
+	if cur == nil {
+		cur = &dynamodb.AttributeValue{}
+		dst[path[0].name] = cur
+	}
+	for i, e := range path[1:] {
+		last := i == len(path)-2
+		if e.isIndex {
+			if last {
+				cur.L = append(cur.L, copyAV(v))
+				return
+			}
+			next := &dynamodb.AttributeValue{}
+			cur.L = append(cur.L, next)
+			cur = next
+			continue
+		}
+		if cur.M == nil {
+			cur.M = make(map[string]*dynamodb.AttributeValue)
+		}
+		if last {
+			cur.M[e.name] = copyAV(v)
+			return
+		}
+		next := cur.M[e.name]
+		if next == nil {
+			next = &dynamodb.AttributeValue{}
+			cur.M[e.name] = next
+		}
+		cur = next
+	}
+}
+
+type updateKind int
+
+const (
+	updateSet updateKind = iota
+	updateRemove
+	updateAdd
+	updateDelete
+)
+
+type updateAction struct {
+	kind  updateKind
+	path  attrPath
+	value setValue
+}
+
+// setValue is the right hand side of an update action.
+type setValue interface {
+	compute(it item) (*dynamodb.AttributeValue, error)
+}
+
+type operandValue struct {
+	o operand
+}
+
+func (v operandValue) compute(it item) (*dynamodb.AttributeValue, error) {
+	av := v.o.value(it)
+	if av == nil {
+		return nil, validationErr("The provided expression refers to an attribute that does not exist in the item")
+	}
+	return av, nil
+}
+
+type arithValue struct {
+	op   string
+	l, r setValue
+}
+
+func (v arithValue) compute(it item) (*dynamodb.AttributeValue, error) {
+	l, err := v.l.compute(it)
+	if err != nil {
+		return nil, err
+	}
+	r, err := v.r.compute(it)
+	if err != nil {
+		return nil, err
+	}
+	if l.N == nil || r.N == nil {
+		return nil, validationErr("An operand in the update expression has an incorrect data type")
+	}
+	ln, _ := parseNumber(*l.N)
+	rn, _ := parseNumber(*r.N)
+	if v.op == "+" {
+		ln.Add(ln, rn)
+	} else {
+		ln.Sub(ln, rn)
+	}
+	s := formatNumber(ln)
+	return &dynamodb.AttributeValue{N: &s}, nil
+}
+
+type ifNotExistsValue struct {
+	path attrPath
+	def  setValue
+}
+
+func (v ifNotExistsValue) compute(it item) (*dynamodb.AttributeValue, error) {
+	if av := v.path.resolve(it); av != nil {
+		return av, nil
+	}
+	return v.def.compute(it)
+}
+
+type listAppendValue struct {
+	a, b setValue
+}
+
+func (v listAppendValue) compute(it item) (*dynamodb.AttributeValue, error) {
+	a, err := v.a.compute(it)
+	if err != nil {
+		return nil, err
+	}
+	b, err := v.b.compute(it)
+	if err != nil {
+		return nil, err
+	}
+	if a.L == nil || b.L == nil {
+		return nil, validationErr("An operand in the update expression has an incorrect data type")
+	}
+	out := &dynamodb.AttributeValue{L: make([]*dynamodb.AttributeValue, 0, len(a.L)+len(b.L))}
+	out.L = append(out.L, a.L...)
+	out.L = append(out.L, b.L...)
+	return out, nil
+}
+
+func formatNumber(n *big.Rat) string {
+	if n.IsInt() {
+		return n.Num().String()
+	}
+	return strings.TrimRight(strings.TrimRight(n.FloatString(38), "0"), ".")
+}
+
+func parseUpdate(ctx *exprContext, expr string) ([]updateAction, error) {
+	p, err := newParser(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []updateAction
+	seen := make(map[string]bool)
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, validationErr("Invalid UpdateExpression: syntax error at %q", t.s)
+		}
+		var kind updateKind
+		switch strings.ToUpper(t.s) {
+		case "SET":
+			kind = updateSet
+		case "REMOVE":
+			kind = updateRemove
+		case "ADD":
+			kind = updateAdd
+		case "DELETE":
+			kind = updateDelete
+		default:
+			return nil, validationErr("Invalid UpdateExpression: syntax error at %q", t.s)
+		}
+		section := strings.ToUpper(t.s)
+		if seen[section] {
+			return nil, validationErr("Invalid UpdateExpression: The %q section can only be used once in an update expression", section)
+		}
+		seen[section] = true
+
+		for {
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if len(path) != 1 {
+				return nil, validationErr("fakedynamo: nested update paths are not supported: %s", path)
+			}
+			action := updateAction{kind: kind, path: path}
+			switch kind {
+			case updateSet:
+				if op := p.next(); op.kind != tokOp || op.s != "=" {
+					return nil, validationErr("Invalid UpdateExpression: expected = after %s", path)
+				}
+				action.value, err = p.parseSetValue()
+				if err != nil {
+					return nil, err
+				}
+			case updateAdd, updateDelete:
+				if p.peek().kind != tokValue {
+					return nil, validationErr("Invalid UpdateExpression: expected value after %s", path)
+				}
+				v, err := p.parseValueRef()
+				if err != nil {
+					return nil, err
+				}
+				action.value = operandValue{valueOperand{v}}
+			}
+			actions = append(actions, action)
+
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if len(actions) == 0 {
+		return nil, validationErr("Invalid UpdateExpression: The expression can not be empty")
+	}
+
+	return actions, nil
+}
+
+func (p *parser) parseSetValue() (setValue, error) {
+	l, err := p.parseSetOperand()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == tokOp && (t.s == "+" || t.s == "-") {
+		p.next()
+		r, err := p.parseSetOperand()
+		if err != nil {
+			return nil, err
+		}
+		return arithValue{op: t.s, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) parseSetOperand() (setValue, error) {
+	t := p.peek()
+	if t.kind == tokIdent && p.peekN(1).kind == tokLParen {
+		switch strings.ToLower(t.s) {
+		case "if_not_exists":
+			p.next()
+			p.next()
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokComma, ","); err != nil {
+				return nil, err
+			}
+			def, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokRParen, ")"); err != nil {
+				return nil, err
+			}
+			return ifNotExistsValue{path: path, def: def}, nil
+		case "list_append":
+			p.next()
+			p.next()
+			a, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokComma, ","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseSetOperand()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokRParen, ")"); err != nil {
+				return nil, err
+			}
+			return listAppendValue{a: a, b: b}, nil
+		}
+	}
+	o, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return operandValue{o}, nil
+}
+
+// applyUpdate applies actions to a copy of orig, evaluating every
+// right hand side against orig. It returns the new item and the names
+// of the attributes that were touched.
+func applyUpdate(orig item, actions []updateAction) (item, []string, error) {
+	out := copyItem(orig)
+	if out == nil {
+		out = make(item)
+	}
+
+	var updated []string
+	for _, a := range actions {
+		name := a.path[0].name
+		updated = append(updated, name)
+
+		switch a.kind {
+		case updateSet:
+			v, err := a.value.compute(orig)
+			if err != nil {
+				return nil, nil, err
+			}
+			out[name] = copyAV(v)
+		case updateRemove:
+			delete(out, name)
+		case updateAdd:
+			v, _ := a.value.compute(orig)
+			cur := orig[name]
+			if cur == nil {
+				out[name] = copyAV(v)
+				continue
+			}
+			nv, err := addValues(cur, v)
+			if err != nil {
+				return nil, nil, err
+			}
+			out[name] = nv
+		case updateDelete:
+			v, _ := a.value.compute(orig)
+			cur := orig[name]
+			if cur == nil {
+				continue
+			}
+			nv, err := deleteValues(cur, v)
+			if err != nil {
+				return nil, nil, err
+			}
+			if nv == nil {
+				delete(out, name)
+			} else {
+				out[name] = nv
+			}
+		}
+	}
+
+	return out, updated, nil
+}
+
+func addValues(cur, v *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	ct, vt := avType(cur), avType(v)
+	if ct != vt {
+		return nil, validationErr("An operand in the update expression has an incorrect data type")
+	}
+	switch ct {
+	case "N":
+		a, _ := parseNumber(*cur.N)
+		b, _ := parseNumber(*v.N)
+		s := formatNumber(a.Add(a, b))
+		return &dynamodb.AttributeValue{N: &s}, nil
+	case "SS":
+		set := stringSet(cur.SS)
+		for k := range stringSet(v.SS) {
+			set[k] = true
+		}
+		out := &dynamodb.AttributeValue{}
+		for _, k := range sortedKeys(set) {
+			k := k
+			out.SS = append(out.SS, &k)
+		}
+		return out, nil
+	case "NS":
+		set := numberSet(cur.NS)
+		for k := range numberSet(v.NS) {
+			set[k] = true
+		}
+		out := &dynamodb.AttributeValue{}
+		for _, k := range sortedKeys(set) {
+			k := k
+			out.NS = append(out.NS, &k)
+		}
+		return out, nil
+	case "BS":
+		set := bytesSet(cur.BS)
+		for k := range bytesSet(v.BS) {
+			set[k] = true
+		}
+		out := &dynamodb.AttributeValue{}
+		for _, k := range sortedKeys(set) {
+			out.BS = append(out.BS, []byte(k))
+		}
+		return out, nil
+	}
+	return nil, validationErr("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: ADD, operand type: %s", ct)
+}
+
+func deleteValues(cur, v *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	ct, vt := avType(cur), avType(v)
+	if ct != vt {
+		return nil, validationErr("An operand in the update expression has an incorrect data type")
+	}
+	var set, del map[string]bool
+	switch ct {
+	case "SS":
+		set, del = stringSet(cur.SS), stringSet(v.SS)
+	case "NS":
+		set, del = numberSet(cur.NS), numberSet(v.NS)
+	case "BS":
+		set, del = bytesSet(cur.BS), bytesSet(v.BS)
+	default:
+		return nil, validationErr("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: DELETE, operand type: %s", ct)
+	}
+	for k := range del {
+		delete(set, k)
+	}
+	if len(set) == 0 {
+		return nil, nil
+	}
+	out := &dynamodb.AttributeValue{}
+	for _, k := range sortedKeys(set) {
+		k := k
+		switch ct {
+		case "SS":
+			out.SS = append(out.SS, &k)
+		case "NS":
+			out.NS = append(out.NS, &k)
+		case "BS":
+			out.BS = append(out.BS, []byte(k))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,1110 @@
+// Package fakedynamo is an in-memory implementation of the subset of
+// the DynamoDB API used by donutdb. It is intended for tests and
+// benchmarks that should not depend on DynamoDB Local or a real table.
+package fakedynamo
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	maxBatchGetKeys      = 100
+	maxBatchWriteItems   = 25
+	maxTransactItems     = 100
+	maxBatchGetRespBytes = 16 << 20
+	maxQueryPageBytes    = 1 << 20
+)
+
+// DB is an in-memory DynamoDB. The zero value is not usable,
+// use New.
+type DB struct {
+	mu     sync.Mutex
+	tables map[string]*table
+
+	// BatchGetItemLimit, if non-zero, is the maximum number of keys
+	// a single BatchGetItem call will process. Any remaining keys are
+	// returned in UnprocessedKeys, as DynamoDB does under throttling.
+	BatchGetItemLimit int
+
+	// BatchWriteItemLimit, if non-zero, is the maximum number of
+	// requests a single BatchWriteItem call will process. Any remaining
+	// requests are returned in UnprocessedItems.
+	BatchWriteItemLimit int
+}
+
+func New() *DB {
+	return &DB{
+		tables: make(map[string]*table),
+	}
+}
+
+type table struct {
+	name      string
+	hashKey   string
+	hashType  string
+	rangeKey  string
+	rangeType string
+
+	partitions map[string]*partition
+}
+
+// partition holds all items sharing a hash key, ordered by range key.
+type partition struct {
+	items []item
+}
+
+func validationErr(format string, args ...interface{}) error {
+	return awserr.New("ValidationException", fmt.Sprintf(format, args...), nil)
+}
+
+func conditionFailedErr() error {
+	return &dynamodb.ConditionalCheckFailedException{
+		Message_: aws.String("The conditional request failed"),
+	}
+}
+
+func (db *DB) getTable(name *string) (*table, error) {
+	if name == nil {
+		return nil, validationErr("TableName must not be empty")
+	}
+	t := db.tables[*name]
+	if t == nil {
+		return nil, &dynamodb.ResourceNotFoundException{
+			Message_: aws.String("Cannot do operations on a non-existent table"),
+		}
+	}
+	return t, nil
+}
+
+func (db *DB) CreateTable(input *dynamodb.CreateTableInput) (*dynamodb.CreateTableOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if input.TableName == nil || *input.TableName == "" {
+		return nil, validationErr("TableName must not be empty")
+	}
+	if _, exists := db.tables[*input.TableName]; exists {
+		return nil, &dynamodb.ResourceInUseException{
+			Message_: aws.String("Cannot create preexisting table"),
+		}
+	}
+
+	attrTypes := make(map[string]string)
+	for _, def := range input.AttributeDefinitions {
+		attrTypes[aws.StringValue(def.AttributeName)] = aws.StringValue(def.AttributeType)
+	}
+
+	t := &table{
+		name:       *input.TableName,
+		partitions: make(map[string]*partition),
+	}
+	for _, ks := range input.KeySchema {
+		name := aws.StringValue(ks.AttributeName)
+		typ, ok := attrTypes[name]
+		if !ok {
+			return nil, validationErr("Missing AttributeDefinition for key attribute %s", name)
+		}
+		switch aws.StringValue(ks.KeyType) {
+		case dynamodb.KeyTypeHash:
+			t.hashKey, t.hashType = name, typ
+		case dynamodb.KeyTypeRange:
+			t.rangeKey, t.rangeType = name, typ
+		default:
+			return nil, validationErr("Invalid KeyType for %s", name)
+		}
+	}
+	if t.hashKey == "" {
+		return nil, validationErr("No Hash Key specified in schema")
+	}
+
+	db.tables[t.name] = t
+
+	return &dynamodb.CreateTableOutput{
+		TableDescription: &dynamodb.TableDescription{
+			TableName:            input.TableName,
+			TableStatus:          aws.String(dynamodb.TableStatusActive),
+			KeySchema:            input.KeySchema,
+			AttributeDefinitions: input.AttributeDefinitions,
+		},
+	}, nil
+}
+
+func (db *DB) DeleteTable(input *dynamodb.DeleteTableInput) (*dynamodb.DeleteTableOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	delete(db.tables, t.name)
+
+	return &dynamodb.DeleteTableOutput{
+		TableDescription: &dynamodb.TableDescription{
+			TableName:   input.TableName,
+			TableStatus: aws.String(dynamodb.TableStatusDeleting),
+		},
+	}, nil
+}
+
+func (t *table) isKeyAttr(name string) bool {
+	return name == t.hashKey || (t.rangeKey != "" && name == t.rangeKey)
+}
+
+func (t *table) checkKeyAttr(name, typ string, v *dynamodb.AttributeValue) error {
+	if v == nil {
+		return validationErr("One of the required keys was not given a value")
+	}
+	if avType(v) != typ {
+		return validationErr("One or more parameter values were invalid: Type mismatch for key %s expected: %s actual: %s", name, typ, avType(v))
+	}
+	if (v.S != nil && *v.S == "") || (v.B != nil && len(v.B) == 0) {
+		return validationErr("One or more parameter values are not valid. The AttributeValue for a key attribute cannot contain an empty string value. Key: %s", name)
+	}
+	return validateAV(v)
+}
+
+// validateKey checks that key contains exactly the table's key
+// attributes.
+func (t *table) validateKey(key map[string]*dynamodb.AttributeValue) error {
+	want := 1
+	if t.rangeKey != "" {
+		want = 2
+	}
+	if len(key) != want {
+		return validationErr("The provided key element does not match the schema")
+	}
+	if err := t.checkKeyAttr(t.hashKey, t.hashType, key[t.hashKey]); err != nil {
+		return err
+	}
+	if t.rangeKey != "" {
+		if err := t.checkKeyAttr(t.rangeKey, t.rangeType, key[t.rangeKey]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateItem checks that it is storable in t.
+func (t *table) validateItem(it map[string]*dynamodb.AttributeValue) error {
+	if err := t.checkKeyAttr(t.hashKey, t.hashType, it[t.hashKey]); err != nil {
+		return err
+	}
+	if t.rangeKey != "" {
+		if err := t.checkKeyAttr(t.rangeKey, t.rangeType, it[t.rangeKey]); err != nil {
+			return err
+		}
+	}
+	for _, v := range it {
+		if err := validateAV(v); err != nil {
+			return err
+		}
+	}
+	if itemSize(it) > maxItemSize {
+		return validationErr("Item size has exceeded the maximum allowed size")
+	}
+	return nil
+}
+
+func (t *table) partitionID(hk *dynamodb.AttributeValue) string {
+	switch avType(hk) {
+	case "N":
+		return canonicalNumber(*hk.N)
+	case "B":
+		return string(hk.B)
+	}
+	return *hk.S
+}
+
+// find returns the partition for key and the index at which the item
+// is (or would be) stored.
+func (t *table) find(key map[string]*dynamodb.AttributeValue) (*partition, int, bool) {
+	p := t.partitions[t.partitionID(key[t.hashKey])]
+	if p == nil {
+		return nil, 0, false
+	}
+	if t.rangeKey == "" {
+		return p, 0, len(p.items) > 0
+	}
+
+	rk := key[t.rangeKey]
+	idx := sort.Search(len(p.items), func(i int) bool {
+		c, _ := compareAV(p.items[i][t.rangeKey], rk)
+		return c >= 0
+	})
+	if idx < len(p.items) {
+		c, _ := compareAV(p.items[idx][t.rangeKey], rk)
+		return p, idx, c == 0
+	}
+	return p, idx, false
+}
+
+func (t *table) get(key map[string]*dynamodb.AttributeValue) item {
+	p, idx, found := t.find(key)
+	if !found {
+		return nil
+	}
+	return p.items[idx]
+}
+
+func (t *table) put(it item) {
+	p, idx, found := t.find(it)
+	if found {
+		p.items[idx] = it
+		return
+	}
+	if p == nil {
+		p = &partition{}
+		t.partitions[t.partitionID(it[t.hashKey])] = p
+	}
+	p.items = append(p.items, nil)
+	copy(p.items[idx+1:], p.items[idx:])
+	p.items[idx] = it
+}
+
+func (t *table) delete(key map[string]*dynamodb.AttributeValue) {
+	p, idx, found := t.find(key)
+	if !found {
+		return
+	}
+	p.items = append(p.items[:idx], p.items[idx+1:]...)
+	if len(p.items) == 0 {
+		delete(t.partitions, t.partitionID(key[t.hashKey]))
+	}
+}
+
+func (t *table) keyOf(it item) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{
+		t.hashKey: copyAV(it[t.hashKey]),
+	}
+	if t.rangeKey != "" {
+		key[t.rangeKey] = copyAV(it[t.rangeKey])
+	}
+	return key
+}
+
+// readProjection builds the projection for the read APIs, which accept
+// either a ProjectionExpression or the legacy AttributesToGet.
+func readProjection(ctx *exprContext, projExpr *string, attrsToGet []*string) ([]attrPath, error) {
+	if projExpr != nil && attrsToGet != nil {
+		return nil, validationErr("Can not use both expression and non-expression parameters in the same request")
+	}
+	if projExpr != nil {
+		return parseProjection(ctx, *projExpr)
+	}
+	if attrsToGet != nil {
+		paths := make([]attrPath, 0, len(attrsToGet))
+		for _, a := range attrsToGet {
+			paths = append(paths, attrPath{{name: aws.StringValue(a)}})
+		}
+		return paths, nil
+	}
+	return nil, nil
+}
+
+// parseOptionalCondition parses cond if it is set.
+func parseOptionalCondition(ctx *exprContext, cond *string) (condition, error) {
+	if cond == nil {
+		return nil, nil
+	}
+	return parseCondition(ctx, *cond)
+}
+
+func (db *DB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(input.Key); err != nil {
+		return nil, err
+	}
+
+	ctx := newExprContext(input.ExpressionAttributeNames, nil)
+	proj, err := readProjection(ctx, input.ProjectionExpression, input.AttributesToGet)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.GetItemOutput{}
+	if it := t.get(input.Key); it != nil {
+		out.Item = copyItem(project(it, proj))
+	}
+	return out, nil
+}
+
+func (db *DB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateItem(input.Item); err != nil {
+		return nil, err
+	}
+
+	rv := aws.StringValue(input.ReturnValues)
+	if rv != "" && rv != dynamodb.ReturnValueNone && rv != dynamodb.ReturnValueAllOld {
+		return nil, validationErr("ReturnValues can only be ALL_OLD or NONE")
+	}
+
+	ctx := newExprContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	cond, err := parseOptionalCondition(ctx, input.ConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	existing := t.get(input.Item)
+	if cond != nil && !cond.eval(existing) {
+		return nil, conditionFailedErr()
+	}
+
+	t.put(copyItem(input.Item))
+
+	out := &dynamodb.PutItemOutput{}
+	if rv == dynamodb.ReturnValueAllOld && existing != nil {
+		out.Attributes = copyItem(existing)
+	}
+	return out, nil
+}
+
+func (db *DB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(input.Key); err != nil {
+		return nil, err
+	}
+	if input.UpdateExpression == nil {
+		return nil, validationErr("fakedynamo: UpdateItem requires an UpdateExpression")
+	}
+
+	ctx := newExprContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	actions, err := parseUpdate(ctx, *input.UpdateExpression)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range actions {
+		if t.isKeyAttr(a.path[0].name) {
+			return nil, validationErr("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", a.path[0].name)
+		}
+	}
+	cond, err := parseOptionalCondition(ctx, input.ConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	existing := t.get(input.Key)
+	if cond != nil && !cond.eval(existing) {
+		return nil, conditionFailedErr()
+	}
+
+	base := existing
+	if base == nil {
+		base = copyItem(input.Key)
+	}
+	updated, names, err := applyUpdate(base, actions)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateItem(updated); err != nil {
+		return nil, err
+	}
+
+	t.put(updated)
+
+	out := &dynamodb.UpdateItemOutput{}
+	switch aws.StringValue(input.ReturnValues) {
+	case "", dynamodb.ReturnValueNone:
+	case dynamodb.ReturnValueAllOld:
+		out.Attributes = copyItem(existing)
+	case dynamodb.ReturnValueAllNew:
+		out.Attributes = copyItem(updated)
+	case dynamodb.ReturnValueUpdatedOld:
+		out.Attributes = pick(existing, names)
+	case dynamodb.ReturnValueUpdatedNew:
+		out.Attributes = pick(updated, names)
+	default:
+		return nil, validationErr("Invalid ReturnValues: %s", aws.StringValue(input.ReturnValues))
+	}
+	return out, nil
+}
+
+func pick(it item, names []string) item {
+	out := make(item)
+	for _, n := range names {
+		if v, ok := it[n]; ok {
+			out[n] = copyAV(v)
+		}
+	}
+	return out
+}
+
+func (db *DB) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validateKey(input.Key); err != nil {
+		return nil, err
+	}
+
+	rv := aws.StringValue(input.ReturnValues)
+	if rv != "" && rv != dynamodb.ReturnValueNone && rv != dynamodb.ReturnValueAllOld {
+		return nil, validationErr("ReturnValues can only be ALL_OLD or NONE")
+	}
+
+	ctx := newExprContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	cond, err := parseOptionalCondition(ctx, input.ConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	existing := t.get(input.Key)
+	if cond != nil && !cond.eval(existing) {
+		return nil, conditionFailedErr()
+	}
+
+	t.delete(input.Key)
+
+	out := &dynamodb.DeleteItemOutput{}
+	if rv == dynamodb.ReturnValueAllOld && existing != nil {
+		out.Attributes = copyItem(existing)
+	}
+	return out, nil
+}
+
+// hashKeyFromCondition extracts the value the hash key is compared
+// against in a KeyConditionExpression.
+func (t *table) hashKeyFromCondition(c condition) *dynamodb.AttributeValue {
+	switch c := c.(type) {
+	case andCond:
+		if v := t.hashKeyFromCondition(c.l); v != nil {
+			return v
+		}
+		return t.hashKeyFromCondition(c.r)
+	case cmpCond:
+		if c.op != "=" {
+			return nil
+		}
+		l, lok := c.l.(pathOperand)
+		r, rok := c.r.(valueOperand)
+		if lok && rok && len(l.path) == 1 && l.path[0].name == t.hashKey {
+			return r.v
+		}
+		r2, rok := c.r.(pathOperand)
+		l2, lok := c.l.(valueOperand)
+		if lok && rok && len(r2.path) == 1 && r2.path[0].name == t.hashKey {
+			return l2.v
+		}
+	}
+	return nil
+}
+
+func (db *DB) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if input.IndexName != nil {
+		return nil, validationErr("fakedynamo: secondary indexes are not supported")
+	}
+	if input.KeyConditionExpression == nil {
+		return nil, validationErr("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request.")
+	}
+
+	ctx := newExprContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	keyCond, err := parseCondition(ctx, *input.KeyConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	hk := t.hashKeyFromCondition(keyCond)
+	if hk == nil {
+		return nil, validationErr("Query condition missed key schema element: %s", t.hashKey)
+	}
+	var filter condition
+	if input.FilterExpression != nil {
+		filter, err = parseCondition(ctx, *input.FilterExpression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	proj, err := readProjection(ctx, input.ProjectionExpression, input.AttributesToGet)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	var items []item
+	if p := t.partitions[t.partitionID(hk)]; p != nil {
+		items = make([]item, len(p.items))
+		copy(items, p.items)
+	}
+	if !aws.BoolValue(input.ScanIndexForward) && input.ScanIndexForward != nil {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	if input.ExclusiveStartKey != nil {
+		if err := t.validateKey(input.ExclusiveStartKey); err != nil {
+			return nil, err
+		}
+		items = skipPast(t, items, input.ExclusiveStartKey)
+	}
+
+	matches := make([]item, 0, len(items))
+	for _, it := range items {
+		if keyCond.eval(it) {
+			matches = append(matches, it)
+		}
+	}
+
+	out := &dynamodb.QueryOutput{}
+	t.page(matches, aws.Int64Value(input.Limit), filter, proj, aws.StringValue(input.Select) == dynamodb.SelectCount,
+		func(it item) { out.Items = append(out.Items, it) },
+		func(count, scanned int64, lek map[string]*dynamodb.AttributeValue) {
+			out.Count, out.ScannedCount, out.LastEvaluatedKey = &count, &scanned, lek
+		})
+	if out.Items == nil && aws.StringValue(input.Select) != dynamodb.SelectCount {
+		out.Items = []map[string]*dynamodb.AttributeValue{}
+	}
+	return out, nil
+}
+
+// skipPast drops items up to and including the item with startKey.
+func skipPast(t *table, items []item, startKey map[string]*dynamodb.AttributeValue) []item {
+	for i, it := range items {
+		if t.sameKey(it, startKey) {
+			return items[i+1:]
+		}
+	}
+	return nil
+}
+
+func (t *table) sameKey(a, b map[string]*dynamodb.AttributeValue) bool {
+	if !equalAV(a[t.hashKey], b[t.hashKey]) {
+		return false
+	}
+	return t.rangeKey == "" || equalAV(a[t.rangeKey], b[t.rangeKey])
+}
+
+// page applies Limit, the 1MB page size limit, FilterExpression and
+// projection to candidate items, shared by Query and Scan.
+func (t *table) page(items []item, limit int64, filter condition, proj []attrPath, countOnly bool, emit func(item), done func(count, scanned int64, lek map[string]*dynamodb.AttributeValue)) {
+	var (
+		count, scanned int64
+		size           int
+		lek            map[string]*dynamodb.AttributeValue
+	)
+	for i, it := range items {
+		scanned++
+		size += itemSize(it)
+		if filter == nil || filter.eval(it) {
+			count++
+			if !countOnly {
+				emit(copyItem(project(it, proj)))
+			}
+		}
+		more := i < len(items)-1
+		if more && ((limit > 0 && scanned >= limit) || size >= maxQueryPageBytes) {
+			lek = t.keyOf(it)
+			break
+		}
+	}
+	done(count, scanned, lek)
+}
+
+func (db *DB) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t, err := db.getTable(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if input.IndexName != nil {
+		return nil, validationErr("fakedynamo: secondary indexes are not supported")
+	}
+	if input.Segment != nil || input.TotalSegments != nil {
+		return nil, validationErr("fakedynamo: parallel scans are not supported")
+	}
+
+	ctx := newExprContext(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	var filter condition
+	if input.FilterExpression != nil {
+		filter, err = parseCondition(ctx, *input.FilterExpression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	proj, err := readProjection(ctx, input.ProjectionExpression, input.AttributesToGet)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(t.partitions))
+	for id := range t.partitions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var items []item
+	for _, id := range ids {
+		items = append(items, t.partitions[id].items...)
+	}
+
+	if input.ExclusiveStartKey != nil {
+		if err := t.validateKey(input.ExclusiveStartKey); err != nil {
+			return nil, err
+		}
+		items = skipPast(t, items, input.ExclusiveStartKey)
+	}
+
+	out := &dynamodb.ScanOutput{}
+	t.page(items, aws.Int64Value(input.Limit), filter, proj, aws.StringValue(input.Select) == dynamodb.SelectCount,
+		func(it item) { out.Items = append(out.Items, it) },
+		func(count, scanned int64, lek map[string]*dynamodb.AttributeValue) {
+			out.Count, out.ScannedCount, out.LastEvaluatedKey = &count, &scanned, lek
+		})
+	if out.Items == nil && aws.StringValue(input.Select) != dynamodb.SelectCount {
+		out.Items = []map[string]*dynamodb.AttributeValue{}
+	}
+	return out, nil
+}
+
+// ScanPages iterates over the pages of a Scan, mirroring the helper
+// on *dynamodb.DynamoDB.
+func (db *DB) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	in := *input
+	for {
+		out, err := db.Scan(&in)
+		if err != nil {
+			return err
+		}
+		lastPage := len(out.LastEvaluatedKey) == 0
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		in.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (db *DB) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var total int
+	tableNames := make([]string, 0, len(input.RequestItems))
+	for name, ka := range input.RequestItems {
+		tableNames = append(tableNames, name)
+		total += len(ka.Keys)
+	}
+	sort.Strings(tableNames)
+
+	if total == 0 {
+		return nil, validationErr("The requestItems parameter is required for BatchGetItem")
+	}
+	if total > maxBatchGetKeys {
+		return nil, validationErr("Too many items requested for the BatchGetItem call")
+	}
+
+	type tableReq struct {
+		t    *table
+		ka   *dynamodb.KeysAndAttributes
+		proj []attrPath
+	}
+	reqs := make([]tableReq, 0, len(tableNames))
+	for _, name := range tableNames {
+		name := name
+		t, err := db.getTable(&name)
+		if err != nil {
+			return nil, err
+		}
+		ka := input.RequestItems[name]
+		ctx := newExprContext(ka.ExpressionAttributeNames, nil)
+		proj, err := readProjection(ctx, ka.ProjectionExpression, ka.AttributesToGet)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.checkUnused(); err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]bool)
+		for _, key := range ka.Keys {
+			if err := t.validateKey(key); err != nil {
+				return nil, err
+			}
+			id := t.keyID(key)
+			if seen[id] {
+				return nil, validationErr("Provided list of item keys contains duplicates")
+			}
+			seen[id] = true
+		}
+		reqs = append(reqs, tableReq{t: t, ka: ka, proj: proj})
+	}
+
+	out := &dynamodb.BatchGetItemOutput{
+		Responses: make(map[string][]map[string]*dynamodb.AttributeValue),
+	}
+
+	var processed, respSize int
+	for _, req := range reqs {
+		out.Responses[req.t.name] = []map[string]*dynamodb.AttributeValue{}
+		var unprocessed []map[string]*dynamodb.AttributeValue
+		for _, key := range req.ka.Keys {
+			if (db.BatchGetItemLimit > 0 && processed >= db.BatchGetItemLimit) || respSize >= maxBatchGetRespBytes {
+				unprocessed = append(unprocessed, copyItem(key))
+				continue
+			}
+			processed++
+			if it := req.t.get(key); it != nil {
+				projected := copyItem(project(it, req.proj))
+				respSize += itemSize(projected)
+				out.Responses[req.t.name] = append(out.Responses[req.t.name], projected)
+			}
+		}
+		if len(unprocessed) > 0 {
+			if out.UnprocessedKeys == nil {
+				out.UnprocessedKeys = make(map[string]*dynamodb.KeysAndAttributes)
+			}
+			out.UnprocessedKeys[req.t.name] = &dynamodb.KeysAndAttributes{
+				Keys:                     unprocessed,
+				ConsistentRead:           req.ka.ConsistentRead,
+				ProjectionExpression:     req.ka.ProjectionExpression,
+				ExpressionAttributeNames: req.ka.ExpressionAttributeNames,
+				AttributesToGet:          req.ka.AttributesToGet,
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// keyID is a unique string for a primary key within t.
+func (t *table) keyID(key map[string]*dynamodb.AttributeValue) string {
+	id := t.partitionID(key[t.hashKey])
+	if t.rangeKey != "" {
+		rk := key[t.rangeKey]
+		switch avType(rk) {
+		case "N":
+			id += "\x00" + canonicalNumber(*rk.N)
+		case "B":
+			id += "\x00" + string(rk.B)
+		case "S":
+			id += "\x00" + *rk.S
+		}
+	}
+	return id
+}
+
+func (db *DB) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var total int
+	tableNames := make([]string, 0, len(input.RequestItems))
+	for name, reqs := range input.RequestItems {
+		tableNames = append(tableNames, name)
+		total += len(reqs)
+	}
+	sort.Strings(tableNames)
+
+	if total == 0 {
+		return nil, validationErr("The requestItems parameter is required for BatchWriteItem")
+	}
+	if total > maxBatchWriteItems {
+		return nil, validationErr("Too many items requested for the BatchWriteItem call")
+	}
+
+	// validate the whole batch before applying any of it
+	tables := make(map[string]*table)
+	for _, name := range tableNames {
+		name := name
+		t, err := db.getTable(&name)
+		if err != nil {
+			return nil, err
+		}
+		tables[name] = t
+
+		seen := make(map[string]bool)
+		for _, req := range input.RequestItems[name] {
+			var key map[string]*dynamodb.AttributeValue
+			switch {
+			case req.PutRequest != nil && req.DeleteRequest == nil:
+				if err := t.validateItem(req.PutRequest.Item); err != nil {
+					return nil, err
+				}
+				key = req.PutRequest.Item
+			case req.DeleteRequest != nil && req.PutRequest == nil:
+				if err := t.validateKey(req.DeleteRequest.Key); err != nil {
+					return nil, err
+				}
+				key = req.DeleteRequest.Key
+			default:
+				return nil, validationErr("WriteRequest must contain exactly one of PutRequest or DeleteRequest")
+			}
+			id := t.keyID(key)
+			if seen[id] {
+				return nil, validationErr("Provided list of item keys contains duplicates")
+			}
+			seen[id] = true
+		}
+	}
+
+	out := &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: make(map[string][]*dynamodb.WriteRequest),
+	}
+
+	var processed int
+	for _, name := range tableNames {
+		t := tables[name]
+		for _, req := range input.RequestItems[name] {
+			if db.BatchWriteItemLimit > 0 && processed >= db.BatchWriteItemLimit {
+				out.UnprocessedItems[name] = append(out.UnprocessedItems[name], req)
+				continue
+			}
+			processed++
+			if req.PutRequest != nil {
+				t.put(copyItem(req.PutRequest.Item))
+			} else {
+				t.delete(req.DeleteRequest.Key)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// txOp is a validated action of a TransactWriteItems call. Updates are
+// resolved to the item they produce, so every write is a put or a
+// delete by the time the transaction is applied.
+type txOp struct {
+	t       *table
+	key     map[string]*dynamodb.AttributeValue
+	cond    condition
+	put     item
+	actions []updateAction
+	del     bool
+}
+
+// prepareTransactItem validates a single TransactWriteItem.
+func (db *DB) prepareTransactItem(ti *dynamodb.TransactWriteItem) (*txOp, error) {
+	var (
+		op         txOp
+		count      int
+		tableName  *string
+		names      map[string]*string
+		values     map[string]*dynamodb.AttributeValue
+		condExpr   *string
+		updateExpr *string
+	)
+
+	if c := ti.ConditionCheck; c != nil {
+		count++
+		if c.ConditionExpression == nil {
+			return nil, validationErr("ConditionCheck requires a ConditionExpression")
+		}
+		tableName, op.key, names, values, condExpr = c.TableName, c.Key, c.ExpressionAttributeNames, c.ExpressionAttributeValues, c.ConditionExpression
+	}
+	if p := ti.Put; p != nil {
+		count++
+		tableName, op.key, names, values, condExpr = p.TableName, p.Item, p.ExpressionAttributeNames, p.ExpressionAttributeValues, p.ConditionExpression
+		op.put = copyItem(p.Item)
+	}
+	if u := ti.Update; u != nil {
+		count++
+		if u.UpdateExpression == nil {
+			return nil, validationErr("fakedynamo: Update requires an UpdateExpression")
+		}
+		tableName, op.key, names, values, condExpr = u.TableName, u.Key, u.ExpressionAttributeNames, u.ExpressionAttributeValues, u.ConditionExpression
+		updateExpr = u.UpdateExpression
+	}
+	if d := ti.Delete; d != nil {
+		count++
+		tableName, op.key, names, values, condExpr = d.TableName, d.Key, d.ExpressionAttributeNames, d.ExpressionAttributeValues, d.ConditionExpression
+		op.del = true
+	}
+	if count != 1 {
+		return nil, validationErr("TransactItems can only contain one of Check, Put, Update or Delete")
+	}
+
+	t, err := db.getTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	op.t = t
+
+	if op.put != nil {
+		err = t.validateItem(op.put)
+	} else {
+		err = t.validateKey(op.key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := newExprContext(names, values)
+	if updateExpr != nil {
+		op.actions, err = parseUpdate(ctx, *updateExpr)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range op.actions {
+			if t.isKeyAttr(a.path[0].name) {
+				return nil, validationErr("One or more parameter values were invalid: Cannot update attribute %s. This attribute is part of the key", a.path[0].name)
+			}
+		}
+	}
+	op.cond, err = parseOptionalCondition(ctx, condExpr)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	return &op, nil
+}
+
+// TransactWriteItems applies all of the request's actions or, if any
+// of their conditions fail, none of them. A failed condition returns a
+// TransactionCanceledException with a cancellation reason per action.
+func (db *DB) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(input.TransactItems) == 0 {
+		return nil, validationErr("The transactItems parameter is required for TransactWriteItems")
+	}
+	if len(input.TransactItems) > maxTransactItems {
+		return nil, validationErr("Member must have length less than or equal to %d", maxTransactItems)
+	}
+
+	ops := make([]*txOp, 0, len(input.TransactItems))
+	seen := make(map[string]bool)
+	for _, ti := range input.TransactItems {
+		op, err := db.prepareTransactItem(ti)
+		if err != nil {
+			return nil, err
+		}
+		id := op.t.name + "\x00" + op.t.keyID(op.key)
+		if seen[id] {
+			return nil, validationErr("Transaction request cannot include multiple operations on one item")
+		}
+		seen[id] = true
+		ops = append(ops, op)
+	}
+
+	// check every condition and compute every update before applying
+	// any of them
+	var failed bool
+	reasons := make([]*dynamodb.CancellationReason, len(ops))
+	for i, op := range ops {
+		existing := op.t.get(op.key)
+		reasons[i] = &dynamodb.CancellationReason{
+			Code: aws.String("None"),
+		}
+		if op.cond != nil && !op.cond.eval(existing) {
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+			reasons[i].Message = aws.String("The conditional request failed")
+			failed = true
+			continue
+		}
+
+		if op.actions != nil {
+			base := existing
+			if base == nil {
+				base = copyItem(op.key)
+			}
+			updated, _, err := applyUpdate(base, op.actions)
+			if err != nil {
+				return nil, err
+			}
+			if err := op.t.validateItem(updated); err != nil {
+				return nil, err
+			}
+			op.put = updated
+		}
+	}
+	if failed {
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            aws.String("Transaction cancelled, please refer cancellation reasons for specific reasons"),
+			CancellationReasons: reasons,
+		}
+	}
+
+	for _, op := range ops {
+		if op.put != nil {
+			op.t.put(op.put)
+		} else if op.del {
+			op.t.delete(op.key)
+		}
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// Dump returns a copy of every item in table, ordered by key.
+// It is intended for test assertions.
+func (db *DB) Dump(tableName string) []map[string]*dynamodb.AttributeValue {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	t := db.tables[tableName]
+	if t == nil {
+		return nil
+	}
+
+	ids := make([]string, 0, len(t.partitions))
+	for id := range t.partitions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var out []map[string]*dynamodb.AttributeValue
+	for _, id := range ids {
+		for _, it := range t.partitions[id].items {
+			out = append(out, copyItem(it))
+		}
+	}
+	return out
+}
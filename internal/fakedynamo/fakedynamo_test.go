@@ -0,0 +1,407 @@
+package fakedynamo
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var tableName = "fake-test"
+
+func newTestDB(t *testing.T) *DB {
+	db := New()
+	_, err := db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: &tableName,
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("hash_key"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("range_key"), AttributeType: aws.String("N")},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("hash_key"), KeyType: aws.String("HASH")},
+			{AttributeName: aws.String("range_key"), KeyType: aws.String("RANGE")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func key(hk string, rk int) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"hash_key":  {S: aws.String(hk)},
+		"range_key": {N: aws.String(strconv.Itoa(rk))},
+	}
+}
+
+func isConditionFailed(err error) bool {
+	_, ok := err.(*dynamodb.ConditionalCheckFailedException)
+	return ok
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := newTestDB(t)
+
+	put := func(owner, deadline string, cond *string, vals map[string]*dynamodb.AttributeValue) error {
+		it := key("lock", 0)
+		it["owner_id"] = &dynamodb.AttributeValue{S: aws.String(owner)}
+		it["deadline_us"] = &dynamodb.AttributeValue{N: aws.String(deadline)}
+		_, err := db.PutItem(&dynamodb.PutItemInput{
+			TableName:                 &tableName,
+			Item:                      it,
+			ConditionExpression:       cond,
+			ExpressionAttributeValues: vals,
+		})
+		return err
+	}
+
+	err := put("a", "100", aws.String("attribute_not_exists(deadline_us)"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = put("b", "200", aws.String("attribute_not_exists(deadline_us)"), nil)
+	if !isConditionFailed(err) {
+		t.Fatalf("expected condition failure but got %v", err)
+	}
+
+	cond := aws.String("deadline_us = :dus AND owner_id = :own")
+	err = put("b", "200", cond, map[string]*dynamodb.AttributeValue{
+		":dus": {N: aws.String("100.0")},
+		":own": {S: aws.String("a")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = put("c", "300", cond, map[string]*dynamodb.AttributeValue{
+		":dus": {N: aws.String("100")},
+		":own": {S: aws.String("a")},
+	})
+	if !isConditionFailed(err) {
+		t.Fatalf("expected condition failure but got %v", err)
+	}
+
+	// unused values are rejected
+	err = put("c", "300", aws.String("attribute_exists(deadline_us)"), map[string]*dynamodb.AttributeValue{
+		":own": {S: aws.String("a")},
+	})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "ValidationException" {
+		t.Fatalf("expected ValidationException but got %v", err)
+	}
+}
+
+func TestUpdateItem(t *testing.T) {
+	db := newTestDB(t)
+
+	update := func(expr string, cond *string, names map[string]*string, vals map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+		out, err := db.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 &tableName,
+			Key:                       key("file-meta-v1", 0),
+			UpdateExpression:          &expr,
+			ConditionExpression:       cond,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: vals,
+			ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.Attributes, nil
+	}
+
+	names := map[string]*string{"#fname": aws.String("foo.db")}
+	meta := map[string]*dynamodb.AttributeValue{":meta": {S: aws.String("{}")}}
+
+	_, err := update("SET #fname=:meta", aws.String("attribute_not_exists(#fname)"), names, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = update("SET #fname=:meta", aws.String("attribute_not_exists(#fname)"), names, meta)
+	if !isConditionFailed(err) {
+		t.Fatalf("expected condition failure but got %v", err)
+	}
+
+	attrs, err := update("SET gen = if_not_exists(gen, :zero) + :one", nil, nil, map[string]*dynamodb.AttributeValue{
+		":zero": {N: aws.String("0")},
+		":one":  {N: aws.String("1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aws.StringValue(attrs["gen"].N); got != "1" {
+		t.Fatalf("gen got=%s expected=1", got)
+	}
+
+	attrs, err = update("REMOVE #fname", aws.String("#fname=:meta"), names, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := attrs["foo.db"]; exists {
+		t.Fatalf("attribute was not removed: %v", attrs)
+	}
+
+	_, err = update("SET range_key = :one", nil, nil, map[string]*dynamodb.AttributeValue{
+		":one": {N: aws.String("1")},
+	})
+	if err == nil {
+		t.Fatal("expected error updating a key attribute")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	db := newTestDB(t)
+
+	for i := 0; i < 10; i++ {
+		it := key("data", i*4096)
+		it["bytes"] = &dynamodb.AttributeValue{B: []byte{byte(i)}}
+		_, err := db.PutItem(&dynamodb.PutItemInput{
+			TableName: &tableName,
+			Item:      it,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := db.Query(&dynamodb.QueryInput{
+		TableName:              &tableName,
+		KeyConditionExpression: aws.String("hash_key = :hk AND range_key BETWEEN :first AND :last"),
+		ProjectionExpression:   aws.String("range_key, bytes"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hk":    {S: aws.String("data")},
+			":first": {N: aws.String("8192")},
+			":last":  {N: aws.String("20480")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 4 {
+		t.Fatalf("got %d items, expected 4", len(out.Items))
+	}
+	if _, ok := out.Items[0]["hash_key"]; ok {
+		t.Fatal("projection returned hash_key")
+	}
+
+	out, err = db.Query(&dynamodb.QueryInput{
+		TableName:              &tableName,
+		KeyConditionExpression: aws.String("hash_key = :hk"),
+		ScanIndexForward:       aws.Bool(false),
+		Limit:                  aws.Int64(1),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hk": {S: aws.String("data")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Items) != 1 || aws.StringValue(out.Items[0]["range_key"].N) != "36864" {
+		t.Fatalf("expected last sector, got %v", out.Items)
+	}
+	if out.LastEvaluatedKey == nil {
+		t.Fatal("expected LastEvaluatedKey")
+	}
+}
+
+func TestBatchUnprocessed(t *testing.T) {
+	db := newTestDB(t)
+	db.BatchWriteItemLimit = 10
+	db.BatchGetItemLimit = 7
+
+	var reqs []*dynamodb.WriteRequest
+	for i := 0; i < 25; i++ {
+		it := key("sector-"+strconv.Itoa(i), 0)
+		it["bytes"] = &dynamodb.AttributeValue{B: []byte{byte(i)}}
+		reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: it}})
+	}
+
+	var written int
+	for len(reqs) > 0 {
+		out, err := db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{tableName: reqs},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		written += len(reqs) - len(out.UnprocessedItems[tableName])
+		reqs = out.UnprocessedItems[tableName]
+	}
+	if written != 25 {
+		t.Fatalf("wrote %d items, expected 25", written)
+	}
+
+	var keys []map[string]*dynamodb.AttributeValue
+	for i := 0; i < 30; i++ {
+		keys = append(keys, key("sector-"+strconv.Itoa(i), 0))
+	}
+
+	var got, calls int
+	for len(keys) > 0 {
+		out, err := db.BatchGetItem(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				tableName: {Keys: keys},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		got += len(out.Responses[tableName])
+		keys = nil
+		if unprocessed := out.UnprocessedKeys[tableName]; unprocessed != nil {
+			keys = unprocessed.Keys
+		}
+	}
+	if got != 25 {
+		t.Fatalf("got %d items, expected 25", got)
+	}
+	if calls != 5 {
+		t.Fatalf("made %d calls, expected 5", calls)
+	}
+
+	dup := []map[string]*dynamodb.AttributeValue{key("a", 0), key("a", 0)}
+	_, err := db.BatchGetItem(&dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			tableName: {Keys: dup},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected error for duplicate keys")
+	}
+}
+
+func TestBatchWriteRequestShape(t *testing.T) {
+	db := newTestDB(t)
+
+	reqs := []*dynamodb.WriteRequest{
+		{},
+		{
+			PutRequest:    &dynamodb.PutRequest{Item: key("a", 0)},
+			DeleteRequest: &dynamodb.DeleteRequest{Key: key("a", 0)},
+		},
+	}
+	for _, req := range reqs {
+		_, err := db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{tableName: {req}},
+		})
+		aerr, ok := err.(awserr.Error)
+		if !ok || aerr.Code() != "ValidationException" {
+			t.Fatalf("expected ValidationException but got %v", err)
+		}
+		if !strings.Contains(aerr.Message(), "PutRequest or DeleteRequest") {
+			t.Fatalf("unexpected message: %s", aerr.Message())
+		}
+	}
+}
+
+func TestItemSizeLimit(t *testing.T) {
+	db := newTestDB(t)
+
+	it := key("big", 0)
+	it["bytes"] = &dynamodb.AttributeValue{B: make([]byte, maxItemSize)}
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName: &tableName,
+		Item:      it,
+	})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "ValidationException" {
+		t.Fatalf("expected ValidationException but got %v", err)
+	}
+}
+
+func TestTransactWriteItems(t *testing.T) {
+	db := newTestDB(t)
+
+	it := key("file-meta-v3-a.db", 0)
+	it["meta"] = &dynamodb.AttributeValue{S: aws.String("a")}
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName: &tableName,
+		Item:      it,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	move := func(src, dst string) error {
+		dstItem := key(dst, 0)
+		dstItem["meta"] = &dynamodb.AttributeValue{S: aws.String("a")}
+		_, err := db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Put: &dynamodb.Put{
+						TableName:           &tableName,
+						Item:                dstItem,
+						ConditionExpression: aws.String("attribute_not_exists(hash_key)"),
+					},
+				},
+				{
+					Delete: &dynamodb.Delete{
+						TableName:           &tableName,
+						Key:                 key(src, 0),
+						ConditionExpression: aws.String("meta = :meta"),
+						ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+							":meta": {S: aws.String("a")},
+						},
+					},
+				},
+				{
+					Update: &dynamodb.Update{
+						TableName:        &tableName,
+						Key:              key("counter", 0),
+						UpdateExpression: aws.String("ADD moves :one"),
+						ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+							":one": {N: aws.String("1")},
+						},
+					},
+				},
+			},
+		})
+		return err
+	}
+
+	err = move("file-meta-v3-a.db", "file-meta-v3-b.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the source is gone now, so nothing may be applied
+	err = move("file-meta-v3-a.db", "file-meta-v3-c.db")
+	cerr, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		t.Fatalf("expected TransactionCanceledException but got %v", err)
+	}
+	var codes []string
+	for _, r := range cerr.CancellationReasons {
+		codes = append(codes, aws.StringValue(r.Code))
+	}
+	if got := strings.Join(codes, ","); got != "None,ConditionalCheckFailed,None" {
+		t.Fatalf("cancellation reasons got=%s", got)
+	}
+
+	var hashKeys []string
+	for _, it := range db.Dump(tableName) {
+		hashKeys = append(hashKeys, aws.StringValue(it["hash_key"].S))
+		if aws.StringValue(it["hash_key"].S) == "counter" && aws.StringValue(it["moves"].N) != "1" {
+			t.Fatalf("counter got=%s expected=1", aws.StringValue(it["moves"].N))
+		}
+	}
+	if got := strings.Join(hashKeys, ","); got != "counter,file-meta-v3-b.db" {
+		t.Fatalf("items got=%s", got)
+	}
+
+	// a transaction may only touch each item once
+	_, err = db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Delete: &dynamodb.Delete{TableName: &tableName, Key: key("counter", 0)}},
+			{Delete: &dynamodb.Delete{TableName: &tableName, Key: key("counter", 0)}},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "ValidationException" {
+		t.Fatalf("expected ValidationException but got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -13,34 +14,46 @@ import (
 	"github.com/psanford/sqlite3vfs"
 )
 
-var DeadlineDuration = 2 * time.Second
-var RenewDuration = 750 * time.Millisecond
-
 type globalLockManager struct {
-	db        *dynamodb.DynamoDB
-	table     string
-	lockName  string
+	db       dynamo.Client
+	table    string
+	lockName string
+	ownerID  string
+	opts     Options
+
+	// opMu serializes the requests that change the lock row, so the
+	// heartbeat can renew the lease without holding mu.
+	opMu sync.Mutex
+
+	// mu protects lockLevel and lease, which are shared with
+	// the heartbeat goroutine. It is never held while waiting for
+	// opMu.
+	mu        sync.Mutex
 	lockLevel sqlite3vfs.LockType
-	ownerID   string
+	lease     leaseState
 
-	startTicker   chan startTickerMsg
-	stopTicker    chan struct{}
-	unlockEvent   chan struct{}
+	stopHeartbeat chan struct{}
 	heartbeatDone chan struct{}
 
 	err error
 }
 
-func NewGlobalLockManger(db *dynamodb.DynamoDB, table, lockName, owner string) *globalLockManager {
+func NewGlobalLockManger(db dynamo.Client, table, lockName, owner string, opts Options) *globalLockManager {
+	opts = opts.withDefaults()
+
 	lm := &globalLockManager{
 		db:       db,
 		table:    table,
 		lockName: lockName,
 		ownerID:  owner,
+		opts:     opts,
+
+		lease: leaseState{
+			lockName:    lockName,
+			onLeaseLost: opts.OnLeaseLost,
+		},
 
-		startTicker:   make(chan startTickerMsg),
-		stopTicker:    make(chan struct{}),
-		unlockEvent:   make(chan struct{}),
+		stopHeartbeat: make(chan struct{}),
 		heartbeatDone: make(chan struct{}),
 	}
 
@@ -49,19 +62,41 @@ func NewGlobalLockManger(db *dynamodb.DynamoDB, table, lockName, owner string) *
 	return lm
 }
 
-func (m *globalLockManager) Lock(elock sqlite3vfs.LockType) error {
-	if m.err != nil {
-		return m.err
+func (m *globalLockManager) key() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: &m.lockName,
+		},
+		dynamo.RKey: {
+			N: aws.String("0"),
+		},
 	}
+}
 
-	if elock < m.lockLevel {
-		return nil
+// Lock acquires elock, retrying according to the retry policy
+// while another client holds a conflicting lock.
+func (m *globalLockManager) Lock(elock sqlite3vfs.LockType) error {
+	return m.opts.Retry.do(func() error {
+		return m.tryLock(elock)
+	})
+}
+
+func (m *globalLockManager) tryLock(elock sqlite3vfs.LockType) error {
+	m.mu.Lock()
+	done, err := m.lockHeld(elock)
+	m.mu.Unlock()
+	if done {
+		return err
 	}
 
-	if m.lockLevel > sqlite3vfs.LockNone {
-		// we already hold the lock, update the internal state and return
-		m.lockLevel = elock
-		return nil
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the lock may have changed while we waited for opMu
+	if done, err := m.lockHeld(elock); done {
+		return err
 	}
 
 	handleUpdateItemResult := func(deadline string, err error) error {
@@ -76,11 +111,7 @@ func (m *globalLockManager) Lock(elock sqlite3vfs.LockType) error {
 
 		// we got the lock!
 		m.lockLevel = elock
-		select {
-		case m.startTicker <- startTickerMsg{prevDeadline: deadline}:
-		case <-time.After(10 * time.Second):
-			panic("startTicker msg send blocked for more than 10s, something is wrong")
-		}
+		m.lease.deadline = deadline
 		return nil
 	}
 
@@ -88,14 +119,7 @@ func (m *globalLockManager) Lock(elock sqlite3vfs.LockType) error {
 		TableName:       &m.table,
 		ConsistentRead:  aws.Bool(true),
 		AttributesToGet: []*string{aws.String("owner_id"), aws.String("deadline_us")},
-		Key: map[string]*dynamodb.AttributeValue{
-			dynamo.HKey: {
-				S: &m.lockName,
-			},
-			dynamo.RKey: {
-				N: aws.String("0"),
-			},
-		},
+		Key:             m.key(),
 	})
 
 	if err != nil {
@@ -107,8 +131,7 @@ func (m *globalLockManager) Lock(elock sqlite3vfs.LockType) error {
 	if !exists {
 		// no one holds the lock, lets try to get it
 
-		deadline := time.Now().Add(DeadlineDuration)
-		deadlineUsS := strconv.FormatInt(deadline.UnixMicro(), 10)
+		deadlineUsS := m.opts.newDeadline()
 
 		_, err = m.db.PutItem(&dynamodb.PutItemInput{
 			TableName:           &m.table,
@@ -140,8 +163,7 @@ func (m *globalLockManager) Lock(elock sqlite3vfs.LockType) error {
 	if time.Now().UnixMicro() > oldDeadlineUs {
 		// the existing lock has expired, lets try to take it
 
-		deadline := time.Now().Add(DeadlineDuration)
-		deadlineUsS := strconv.FormatInt(deadline.UnixMicro(), 10)
+		deadlineUsS := m.opts.newDeadline()
 
 		_, err = m.db.PutItem(&dynamodb.PutItemInput{
 			TableName:           &m.table,
@@ -177,7 +199,37 @@ func (m *globalLockManager) Lock(elock sqlite3vfs.LockType) error {
 	return sqlite3vfs.BusyError
 }
 
+// lockHeld handles the requests to lock to elock that don't need the
+// lock row: it returns true if the lock manager is unusable or we
+// already hold the lock. The caller must hold m.mu.
+func (m *globalLockManager) lockHeld(elock sqlite3vfs.LockType) (bool, error) {
+	if m.err != nil {
+		return true, m.err
+	}
+
+	if err := m.lease.check(m.lockLevel); err != nil {
+		return true, err
+	}
+
+	if elock < m.lockLevel {
+		return true, nil
+	}
+
+	if m.lockLevel > sqlite3vfs.LockNone {
+		// we already hold the lock, update the internal state and return
+		m.lockLevel = elock
+		return true, nil
+	}
+
+	return false, nil
+}
+
 func (m *globalLockManager) Unlock(elock sqlite3vfs.LockType) error {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.err != nil {
 		return m.err
 	}
@@ -196,31 +248,66 @@ func (m *globalLockManager) Unlock(elock sqlite3vfs.LockType) error {
 
 	if elock == sqlite3vfs.LockShared {
 		m.lockLevel = sqlite3vfs.LockShared
-		return nil
+		return m.lease.check(m.lockLevel)
 	}
 
+	return m.release()
+}
+
+// release gives up the lock. The caller must hold m.mu.
+func (m *globalLockManager) release() error {
+	lost := m.lease.check(m.lockLevel)
+
 	m.lockLevel = sqlite3vfs.LockNone
+	deadline := m.lease.deadline
+	m.lease.reset()
 
-	select {
-	case m.stopTicker <- struct{}{}:
-	case <-time.After(10 * time.Second):
-		panic("stopTicker msg send blocked for more than 10s, something is wrong")
+	if lost != nil {
+		// the lock isn't ours anymore, there's nothing to clean up
+		return nil
 	}
 
-	select {
-	case <-m.unlockEvent:
-	case <-time.After(10 * time.Second):
-		panic("unlockEvent waited for more than 10s, something is wrong")
+	_, err := m.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           &m.table,
+		ConditionExpression: aws.String("deadline_us = :dus AND owner_id = :own"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dus": {
+				N: &deadline,
+			},
+			":own": {
+				S: &m.ownerID,
+			},
+		},
+		Key: m.key(),
+	})
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			// someone else took over the lock after our lease expired
+			return nil
+		}
+		m.err = err
+		return err
 	}
 
 	return nil
 }
 
 func (m *globalLockManager) Level() sqlite3vfs.LockType {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.lockLevel
 }
 
+func (m *globalLockManager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lease.check(m.lockLevel)
+}
+
 func (m *globalLockManager) CheckReservedLock() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.lockLevel > sqlite3vfs.LockNone {
 		// we hold a lock
 		return true, nil
@@ -230,14 +317,7 @@ func (m *globalLockManager) CheckReservedLock() (bool, error) {
 		TableName:       &m.table,
 		ConsistentRead:  aws.Bool(true),
 		AttributesToGet: []*string{aws.String("owner_id"), aws.String("deadline_us")},
-		Key: map[string]*dynamodb.AttributeValue{
-			dynamo.HKey: {
-				S: &m.lockName,
-			},
-			dynamo.RKey: {
-				N: aws.String("0"),
-			},
-		},
+		Key:             m.key(),
 	})
 	if err != nil {
 		return false, err
@@ -263,130 +343,99 @@ func (m *globalLockManager) CheckReservedLock() (bool, error) {
 }
 
 func (m *globalLockManager) Close() error {
-	close(m.stopTicker)
+	close(m.stopHeartbeat)
 	<-m.heartbeatDone
 
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err == nil && m.lockLevel > sqlite3vfs.LockNone {
+		m.release()
+	}
+
 	retErr := m.err
 	m.err = errors.New("lock manager closed")
 	return retErr
 }
 
 func (m *globalLockManager) heartbeatLoop() {
-	ticker := time.NewTicker(RenewDuration)
-	ticker.Stop()
+	ticker := time.NewTicker(m.opts.RenewInterval)
+	defer ticker.Stop()
 
 	defer close(m.heartbeatDone)
 
-	var (
-		running        bool
-		prevDeadlineUs string
-	)
-
 	for {
 		select {
-		case startMsg := <-m.startTicker:
-			if running {
-				panic("Got startTicker event for a lock we already held")
-			}
-
-			running = true
-			prevDeadlineUs = startMsg.prevDeadline
-			ticker.Reset(RenewDuration)
-		case _, ok := <-m.stopTicker:
-			if !running && ok {
-				// we should only get normal stopTicker events when we
-				// actually hold a lock. This doesn't include close events
-				panic("Got stopTicker event but we don't hold a lock")
-			}
-
-			// we might not be running if this was a close event
-			if running {
-				_, err := m.db.DeleteItem(&dynamodb.DeleteItemInput{
-					TableName:           &m.table,
-					ConditionExpression: aws.String("deadline_us = :dus AND owner_id = :own"),
-					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-						":dus": {
-							N: &prevDeadlineUs,
-						},
-						":own": {
-							S: &m.ownerID,
-						},
-					},
-					Key: map[string]*dynamodb.AttributeValue{
-						dynamo.HKey: {
-							S: &m.lockName,
-						},
-						dynamo.RKey: {
-							N: aws.String("0"),
-						},
-					},
-				})
-				if err != nil {
-					m.err = err
-				}
-
-				if ok {
-					m.unlockEvent <- struct{}{}
-				}
-			}
-
-			running = false
-			ticker.Stop()
-
-			if !ok {
-				// closed chan means we are shutting down
-				return
-			}
+		case <-m.stopHeartbeat:
+			return
 		case <-ticker.C:
-			if !running {
-				// we could get a stray tick since we don't attempt to drain
-				// the ticker chan, so ignore it if we're not in the running state
-				continue
-			}
+			m.renew()
+		}
+	}
+}
 
-			deadline := time.Now().Add(DeadlineDuration)
-			deadlineUsS := strconv.FormatInt(deadline.UnixMicro(), 10)
-
-			_, err := m.db.PutItem(&dynamodb.PutItemInput{
-				TableName:           &m.table,
-				ConditionExpression: aws.String("deadline_us = :dus AND owner_id = :own"),
-				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-					":dus": {
-						N: &prevDeadlineUs,
-					},
-					":own": {
-						S: &m.ownerID,
-					},
-				},
-				Item: map[string]*dynamodb.AttributeValue{
-					dynamo.HKey: {
-						S: &m.lockName,
-					},
-					dynamo.RKey: {
-						N: aws.String("0"),
-					},
-					"owner_id": {
-						S: &m.ownerID,
-					},
-					"deadline_us": {
-						N: &deadlineUsS,
-					},
-				},
-			})
-
-			if err != nil {
-				if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
-					panic("lost lock while heartbeating!")
-				}
-				// maybe there was a transient error that we'll recover from on the next tick
-				log.Printf("Error heartbeating: %s", err)
-			}
+// renew extends our lease if we hold the lock. m.mu is only held
+// around the state it reads and updates, not the request itself, so
+// Level, Err and Lock don't wait on DynamoDB latency.
+func (m *globalLockManager) renew() {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+
+	m.mu.Lock()
+	if m.lockLevel == sqlite3vfs.LockNone || m.lease.lost != nil {
+		m.mu.Unlock()
+		return
+	}
+	prevDeadline := m.lease.deadline
+	level := m.lockLevel
+	m.mu.Unlock()
+
+	deadlineUsS := m.opts.newDeadline()
+
+	_, err := m.db.PutItem(&dynamodb.PutItemInput{
+		TableName:           &m.table,
+		ConditionExpression: aws.String("deadline_us = :dus AND owner_id = :own"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dus": {
+				N: &prevDeadline,
+			},
+			":own": {
+				S: &m.ownerID,
+			},
+		},
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: &m.lockName,
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+			"owner_id": {
+				S: &m.ownerID,
+			},
+			"deadline_us": {
+				N: &deadlineUsS,
+			},
+		},
+	})
 
-			prevDeadlineUs = deadlineUsS
+	// opMu kept the lock from being released or retaken meanwhile
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			m.lease.markLost("lock taken by another client")
+			return
 		}
+		// maybe there was a transient error that we'll recover from on the next tick,
+		// unless our lease runs out first
+		log.Printf("Error heartbeating: %s", err)
+		m.lease.check(level)
+		return
 	}
-}
 
-type startTickerMsg struct {
-	prevDeadline string
+	m.lease.deadline = deadlineUsS
 }
@@ -2,47 +2,61 @@ package lock_test
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/psanford/donutdb"
+	"github.com/psanford/donutdb/internal/dynamo"
 	"github.com/psanford/donutdb/internal/dynamotest"
 	"github.com/psanford/donutdb/internal/lock"
 	"github.com/psanford/sqlite3vfs"
 )
 
 func TestConcurrentAccess(t *testing.T) {
+	testConcurrentAccess(t, donutdb.GlobalLock, "")
+}
+
+func TestConcurrentAccessMultiReader(t *testing.T) {
+	// With shared readers two deferred transactions can both read and
+	// then deadlock trying to write, so take the write lock up front.
+	testConcurrentAccess(t, donutdb.MultiReaderLock, "&_txlock=immediate")
+}
+
+func testConcurrentAccess(t *testing.T, strategy donutdb.LockStrategy, dsnOpts string) {
 	serverInfo, err := dynamotest.SetupDynamoServer()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	origRenewDuration := lock.RenewDuration
-	lock.RenewDuration = 50 * time.Millisecond
-	defer func() {
-		lock.RenewDuration = origRenewDuration
-	}()
-
 	defer serverInfo.Cleanup()
 
-	vfs1 := donutdb.New(serverInfo.DB, serverInfo.TableName)
+	lease := donutdb.WithLockLease(lock.DefaultLeaseDuration, 50*time.Millisecond)
+
+	vfs1 := donutdb.New(serverInfo.DB, serverInfo.TableName, donutdb.WithLockStrategy(strategy), lease)
 
-	err = sqlite3vfs.RegisterVFS("dynamodb1", vfs1)
+	vfsName1 := fmt.Sprintf("dynamodb1-%d", strategy)
+	err = sqlite3vfs.RegisterVFS(vfsName1, vfs1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	vfs2 := donutdb.New(serverInfo.DB, serverInfo.TableName)
-	err = sqlite3vfs.RegisterVFS("dynamodb2", vfs2)
+	vfs2 := donutdb.New(serverInfo.DB, serverInfo.TableName, donutdb.WithLockStrategy(strategy), lease)
+	vfsName2 := fmt.Sprintf("dynamodb2-%d", strategy)
+	err = sqlite3vfs.RegisterVFS(vfsName2, vfs2)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	dbName := fmt.Sprintf("donutdb-test-%d.db", time.Now().UnixNano())
-	db0, err := sql.Open("sqlite3", dbName+"?vfs=dynamodb1")
+	db0, err := sql.Open("sqlite3", dbName+"?vfs="+vfsName1+dsnOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,7 +77,7 @@ count int
 		t.Fatal(err)
 	}
 
-	db1, err := sql.Open("sqlite3", dbName+"?vfs=dynamodb2")
+	db1, err := sql.Open("sqlite3", dbName+"?vfs="+vfsName2+dsnOpts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,3 +146,268 @@ count int
 	}
 
 }
+
+func TestGlobalLockLeaseLost(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	lockName := fmt.Sprintf("lock-global-v1-test-%d", time.Now().UnixNano())
+
+	lostChan := make(chan error, 1)
+	m := lock.NewGlobalLockManger(serverInfo.DB, serverInfo.TableName, lockName, "owner", lock.Options{
+		RenewInterval: 50 * time.Millisecond,
+		OnLeaseLost: func(err error) {
+			lostChan <- err
+		},
+	})
+	defer m.Close()
+
+	err = m.Lock(sqlite3vfs.LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Lock(sqlite3vfs.LockExclusive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else takes over the lock out from under us
+	key := map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: &lockName,
+		},
+		dynamo.RKey: {
+			N: aws.String("0"),
+		},
+	}
+	deadline := strconv.FormatInt(time.Now().Add(time.Minute).UnixMicro(), 10)
+	_, err = serverInfo.DB.PutItem(&dynamodb.PutItemInput{
+		TableName: &serverInfo.TableName,
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: key[dynamo.HKey],
+			dynamo.RKey: key[dynamo.RKey],
+			"owner_id": {
+				S: aws.String("thief"),
+			},
+			"deadline_us": {
+				N: &deadline,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-lostChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for OnLeaseLost")
+	}
+	if !errors.Is(err, lock.LeaseLostErr) {
+		t.Fatalf("OnLeaseLost err got=%v expected LeaseLostErr", err)
+	}
+
+	if err := m.Err(); !errors.Is(err, lock.LeaseLostErr) {
+		t.Fatalf("Err got=%v expected LeaseLostErr", err)
+	}
+	if err := m.Lock(sqlite3vfs.LockExclusive); !errors.Is(err, lock.LeaseLostErr) {
+		t.Fatalf("Lock got=%v expected LeaseLostErr", err)
+	}
+
+	// releasing the lock clears the error without touching the new owner's lock
+	err = m.Unlock(sqlite3vfs.LockNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Err(); err != nil {
+		t.Fatalf("Err after unlock got=%v expected nil", err)
+	}
+
+	item, err := serverInfo.DB.GetItem(&dynamodb.GetItemInput{
+		TableName:      &serverInfo.TableName,
+		ConsistentRead: aws.Bool(true),
+		Key:            key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := aws.StringValue(item.Item["owner_id"].S); owner != "thief" {
+		t.Fatalf("lock owner got=%q expected=%q", owner, "thief")
+	}
+
+	if err := m.Lock(sqlite3vfs.LockShared); err != sqlite3vfs.BusyError {
+		t.Fatalf("Lock got=%v expected busy", err)
+	}
+
+	_, err = serverInfo.DB.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: &serverInfo.TableName,
+		Key:       key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Lock(sqlite3vfs.LockShared)
+	if err != nil {
+		t.Fatalf("Lock after thief released got=%v", err)
+	}
+}
+
+func TestLockRetry(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	lockName := fmt.Sprintf("lock-global-v1-test-%d", time.Now().UnixNano())
+
+	holder := lock.NewGlobalLockManger(serverInfo.DB, serverInfo.TableName, lockName, "holder", lock.Options{})
+	defer holder.Close()
+
+	impatient := lock.NewGlobalLockManger(serverInfo.DB, serverInfo.TableName, lockName, "impatient", lock.Options{
+		Retry: lock.RetryPolicy{
+			Timeout: 100 * time.Millisecond,
+		},
+	})
+	defer impatient.Close()
+
+	patient := lock.NewGlobalLockManger(serverInfo.DB, serverInfo.TableName, lockName, "patient", lock.Options{
+		Retry: lock.RetryPolicy{
+			Timeout: 10 * time.Second,
+		},
+	})
+	defer patient.Close()
+
+	err = holder.Lock(sqlite3vfs.LockShared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = impatient.Lock(sqlite3vfs.LockShared)
+	if err != sqlite3vfs.BusyError {
+		t.Fatalf("Lock got=%v expected busy", err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("Lock gave up after %s, expected to retry for at least 100ms", waited)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		holder.Unlock(sqlite3vfs.LockNone)
+	}()
+
+	err = patient.Lock(sqlite3vfs.LockShared)
+	if err != nil {
+		t.Fatalf("Lock got=%v expected to get the lock once it was released", err)
+	}
+}
+
+// stallingClient blocks PutItem and UpdateItem calls while stalled,
+// reporting each blocked call on blocked.
+type stallingClient struct {
+	dynamo.Client
+	blocked chan struct{}
+
+	mu    sync.Mutex
+	stall chan struct{}
+}
+
+func (c *stallingClient) setStall(stall bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stall {
+		c.stall = make(chan struct{})
+	} else if c.stall != nil {
+		close(c.stall)
+		c.stall = nil
+	}
+}
+
+func (c *stallingClient) wait() {
+	c.mu.Lock()
+	stall := c.stall
+	c.mu.Unlock()
+	if stall == nil {
+		return
+	}
+	select {
+	case c.blocked <- struct{}{}:
+	default:
+	}
+	<-stall
+}
+
+func (c *stallingClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	c.wait()
+	return c.Client.PutItem(input)
+}
+
+func (c *stallingClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	c.wait()
+	return c.Client.UpdateItem(input)
+}
+
+func TestRenewDoesNotBlockState(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	managers := map[string]func(db dynamo.Client, name string) lock.LockManager{
+		"global": func(db dynamo.Client, name string) lock.LockManager {
+			return lock.NewGlobalLockManger(db, serverInfo.TableName, name, "owner", lock.Options{
+				RenewInterval: 10 * time.Millisecond,
+			})
+		},
+		"multi-reader": func(db dynamo.Client, name string) lock.LockManager {
+			return lock.NewMultiReaderLockManager(db, serverInfo.TableName, name, "owner", lock.Options{
+				RenewInterval: 10 * time.Millisecond,
+			})
+		},
+	}
+
+	for label, newManager := range managers {
+		db := &stallingClient{
+			Client:  serverInfo.DB,
+			blocked: make(chan struct{}, 1),
+		}
+
+		name := fmt.Sprintf("lock-global-v1-renew-%s-%d", label, time.Now().UnixNano())
+		m := newManager(db, name)
+
+		err = m.Lock(sqlite3vfs.LockShared)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// hold up the next heartbeat
+		db.setStall(true)
+		select {
+		case <-db.blocked:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: heartbeat never ran", label)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			m.Level()
+			m.Err()
+			m.Lock(sqlite3vfs.LockShared)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Level, Err or Lock blocked on a heartbeat in flight", label)
+		}
+
+		db.setStall(false)
+		m.Close()
+	}
+}
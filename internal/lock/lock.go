@@ -1,6 +1,14 @@
 package lock
 
-import "github.com/psanford/sqlite3vfs"
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/sqlite3vfs"
+)
 
 type LockManager interface {
 	Lock(sqlite3vfs.LockType) error
@@ -8,4 +16,159 @@ type LockManager interface {
 	Close() error
 	Level() sqlite3vfs.LockType
 	CheckReservedLock() (bool, error)
+
+	// Err returns a LeaseLostErr if the lease backing the currently
+	// held lock has been lost. Once the lock is released with
+	// Unlock(LockNone) the lock manager can be used again.
+	Err() error
+}
+
+// LeaseLostErr is returned (wrapped) after a LockManager's lease was
+// lost. See dynamo.LeaseLostErr.
+var LeaseLostErr = dynamo.LeaseLostErr
+
+const (
+	DefaultLeaseDuration = 2 * time.Second
+	DefaultRenewInterval = 750 * time.Millisecond
+
+	DefaultRetryMinBackoff = 10 * time.Millisecond
+	DefaultRetryMaxBackoff = 250 * time.Millisecond
+)
+
+// Options configures a LockManager.
+type Options struct {
+	// OnLeaseLost is called, in its own goroutine, when the lock
+	// manager loses its lease.
+	OnLeaseLost func(error)
+
+	// LeaseDuration is how long a lease is valid for after it was
+	// last renewed. Defaults to DefaultLeaseDuration.
+	LeaseDuration time.Duration
+
+	// RenewInterval is how often a held lease is renewed. It must be
+	// shorter than LeaseDuration. Defaults to DefaultRenewInterval.
+	RenewInterval time.Duration
+
+	// Retry controls how Lock waits for a lock held by another client.
+	Retry RetryPolicy
+}
+
+// RetryPolicy controls how long Lock keeps retrying a busy lock
+// before giving up with sqlite3vfs.BusyError.
+type RetryPolicy struct {
+	// Timeout is the total time to keep retrying for. Zero disables
+	// retries, so Lock returns sqlite3vfs.BusyError right away.
+	Timeout time.Duration
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// attempts. Each sleep is jittered to between half and all of the
+	// current backoff. They default to DefaultRetryMinBackoff and
+	// DefaultRetryMaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// withDefaults returns a copy of opts with defaults filled in.
+func (opts Options) withDefaults() Options {
+	if opts.LeaseDuration <= 0 {
+		opts.LeaseDuration = DefaultLeaseDuration
+	}
+	if opts.RenewInterval <= 0 {
+		opts.RenewInterval = DefaultRenewInterval
+	}
+	if opts.Retry.MinBackoff <= 0 {
+		opts.Retry.MinBackoff = DefaultRetryMinBackoff
+	}
+	if opts.Retry.MaxBackoff < opts.Retry.MinBackoff {
+		opts.Retry.MaxBackoff = DefaultRetryMaxBackoff
+		if opts.Retry.MaxBackoff < opts.Retry.MinBackoff {
+			opts.Retry.MaxBackoff = opts.Retry.MinBackoff
+		}
+	}
+	return opts
+}
+
+// newDeadline returns the deadline_us for a lease taken out now.
+func (opts Options) newDeadline() string {
+	return strconv.FormatInt(time.Now().Add(opts.LeaseDuration).UnixMicro(), 10)
+}
+
+// do calls try until it returns something other than
+// sqlite3vfs.BusyError or the retry timeout has passed.
+func (p RetryPolicy) do(try func() error) error {
+	err := try()
+	if err != sqlite3vfs.BusyError || p.Timeout <= 0 {
+		return err
+	}
+
+	deadline := time.Now().Add(p.Timeout)
+	backoff := p.MinBackoff
+	for err == sqlite3vfs.BusyError {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+
+		// jitter the sleep so clients waiting on the same lock
+		// don't all retry at once
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if sleep > remaining {
+			sleep = remaining
+		}
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+
+		err = try()
+	}
+
+	return err
+}
+
+// leaseState tracks the lease a lock manager currently holds. It is
+// protected by the lock manager's mutex.
+type leaseState struct {
+	lockName    string
+	onLeaseLost func(error)
+
+	// deadline is the deadline_us of our lease.
+	deadline string
+	lost     error
+}
+
+// check returns the lost lease error, marking the lease as lost first
+// if it has already expired.
+func (l *leaseState) check(level sqlite3vfs.LockType) error {
+	if l.lost != nil || level == sqlite3vfs.LockNone {
+		return l.lost
+	}
+
+	deadlineUs, err := strconv.ParseInt(l.deadline, 10, 64)
+	if err == nil && time.Now().UnixMicro() > deadlineUs {
+		l.markLost("lease expired at %s", time.UnixMicro(deadlineUs).Format(time.RFC3339Nano))
+	}
+
+	return l.lost
+}
+
+// markLost poisons the lease and notifies OnLeaseLost.
+func (l *leaseState) markLost(format string, args ...interface{}) {
+	if l.lost != nil {
+		return
+	}
+
+	l.lost = fmt.Errorf("%w: %s: %s", LeaseLostErr, l.lockName, fmt.Sprintf(format, args...))
+
+	if l.onLeaseLost != nil {
+		go l.onLeaseLost(l.lost)
+	}
+}
+
+// reset clears the lease once the lock has been released.
+func (l *leaseState) reset() {
+	l.deadline = ""
+	l.lost = nil
 }
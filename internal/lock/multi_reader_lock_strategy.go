@@ -0,0 +1,553 @@
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/sqlite3vfs"
+)
+
+// readerAttrPrefix prefixes the per-client reader lease attributes
+// in a multi-reader lock item.
+const readerAttrPrefix = "r_"
+
+// multiReaderLockManager allows many clients to hold SHARED locks on
+// a file at the same time while only one client can write.
+//
+// All of the lock state lives in the file's lock item. Every client
+// holding SHARED or higher has its own reader lease attribute
+// (r_${owner_id}) whose value is the lease deadline. A client holding
+// RESERVED, PENDING or EXCLUSIVE also owns the writer slot, stored in
+// the same owner_id and deadline_us attributes the global lock uses,
+// along with the level it holds.
+//
+// New readers are turned away while the writer slot is PENDING or
+// EXCLUSIVE. EXCLUSIVE is only granted once every other reader lease
+// has been released or has expired.
+//
+// All clients accessing a file must use the same lock strategy.
+type multiReaderLockManager struct {
+	db         dynamo.Client
+	table      string
+	lockName   string
+	ownerID    string
+	readerAttr string
+	opts       Options
+
+	// opMu serializes the requests that change the lock row, so the
+	// heartbeat can renew the lease without holding mu.
+	opMu sync.Mutex
+
+	// mu protects lockLevel and lease, which are shared with
+	// the heartbeat goroutine. It is never held while waiting for
+	// opMu.
+	mu        sync.Mutex
+	lockLevel sqlite3vfs.LockType
+	// lease.deadline is the deadline_us of both our reader lease
+	// and, if we hold it, the writer slot.
+	lease leaseState
+
+	stopHeartbeat chan struct{}
+	heartbeatDone chan struct{}
+
+	err error
+}
+
+func NewMultiReaderLockManager(db dynamo.Client, table, lockName, owner string, opts Options) *multiReaderLockManager {
+	opts = opts.withDefaults()
+
+	lm := &multiReaderLockManager{
+		db:         db,
+		table:      table,
+		lockName:   lockName,
+		ownerID:    owner,
+		readerAttr: readerAttrPrefix + owner,
+		opts:       opts,
+
+		lease: leaseState{
+			lockName:    lockName,
+			onLeaseLost: opts.OnLeaseLost,
+		},
+
+		stopHeartbeat: make(chan struct{}),
+		heartbeatDone: make(chan struct{}),
+	}
+
+	go lm.heartbeatLoop()
+
+	return lm
+}
+
+func (m *multiReaderLockManager) key() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: &m.lockName,
+		},
+		dynamo.RKey: {
+			N: aws.String("0"),
+		},
+	}
+}
+
+func levelValue(l sqlite3vfs.LockType) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{
+		N: aws.String(strconv.Itoa(int(l))),
+	}
+}
+
+// Lock acquires elock, retrying according to the retry policy
+// while another client holds a conflicting lock.
+func (m *multiReaderLockManager) Lock(elock sqlite3vfs.LockType) error {
+	return m.opts.Retry.do(func() error {
+		return m.tryLock(elock)
+	})
+}
+
+func (m *multiReaderLockManager) tryLock(elock sqlite3vfs.LockType) error {
+	m.mu.Lock()
+	done, err := m.lockHeld(elock)
+	m.mu.Unlock()
+	if done {
+		return err
+	}
+
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the lock may have changed while we waited for opMu
+	if done, err := m.lockHeld(elock); done {
+		return err
+	}
+
+	switch elock {
+	case sqlite3vfs.LockShared:
+		return m.lockShared()
+	case sqlite3vfs.LockReserved:
+		return m.lockWriter(sqlite3vfs.LockReserved)
+	case sqlite3vfs.LockExclusive:
+		if m.lockLevel < sqlite3vfs.LockPending {
+			err := m.lockWriter(sqlite3vfs.LockPending)
+			if err != nil {
+				return err
+			}
+		}
+		return m.lockExclusive()
+	}
+
+	return fmt.Errorf("invalid lock request to level %s", elock)
+}
+
+// lockHeld returns true if the lock manager is unusable or we already
+// hold elock, so locking doesn't need the lock row. The caller must
+// hold m.mu.
+func (m *multiReaderLockManager) lockHeld(elock sqlite3vfs.LockType) (bool, error) {
+	if m.err != nil {
+		return true, m.err
+	}
+
+	if err := m.lease.check(m.lockLevel); err != nil {
+		return true, err
+	}
+
+	return elock <= m.lockLevel, nil
+}
+
+// lockShared adds our reader lease, as long as no one holds (or is
+// waiting for) an EXCLUSIVE lock.
+func (m *multiReaderLockManager) lockShared() error {
+	deadline := m.opts.newDeadline()
+
+	_, err := m.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           &m.table,
+		Key:                 m.key(),
+		UpdateExpression:    aws.String("SET #r = :dus"),
+		ConditionExpression: aws.String("attribute_not_exists(deadline_us) OR #level < :pending OR deadline_us < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#r":     &m.readerAttr,
+			"#level": aws.String("level"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dus":     {N: &deadline},
+			":pending": levelValue(sqlite3vfs.LockPending),
+			":now":     {N: aws.String(strconv.FormatInt(time.Now().UnixMicro(), 10))},
+		},
+	})
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			// a writer holds or is waiting for an exclusive lock
+			return sqlite3vfs.BusyError
+		}
+		return err
+	}
+
+	m.lease.deadline = deadline
+	m.lockLevel = sqlite3vfs.LockShared
+	return nil
+}
+
+// lockWriter takes the writer slot at level, or updates the level if
+// we already hold it.
+func (m *multiReaderLockManager) lockWriter(level sqlite3vfs.LockType) error {
+	if m.lockLevel >= sqlite3vfs.LockReserved {
+		_, err := m.db.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:           &m.table,
+			Key:                 m.key(),
+			UpdateExpression:    aws.String("SET #level = :level"),
+			ConditionExpression: aws.String("owner_id = :own AND deadline_us = :dus"),
+			ExpressionAttributeNames: map[string]*string{
+				"#level": aws.String("level"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":level": levelValue(level),
+				":own":   {S: &m.ownerID},
+				":dus":   {N: &m.lease.deadline},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		m.lockLevel = level
+		return nil
+	}
+
+	deadline := m.opts.newDeadline()
+
+	_, err := m.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           &m.table,
+		Key:                 m.key(),
+		UpdateExpression:    aws.String("SET owner_id = :own, deadline_us = :dus, #level = :level, #r = :dus"),
+		ConditionExpression: aws.String("#r = :prev AND (attribute_not_exists(deadline_us) OR owner_id = :own OR deadline_us < :now)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#r":     &m.readerAttr,
+			"#level": aws.String("level"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":own":   {S: &m.ownerID},
+			":dus":   {N: &deadline},
+			":level": levelValue(level),
+			":prev":  {N: &m.lease.deadline},
+			":now":   {N: aws.String(strconv.FormatInt(time.Now().UnixMicro(), 10))},
+		},
+	})
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			// someone else holds the writer slot
+			return sqlite3vfs.BusyError
+		}
+		return err
+	}
+
+	m.lease.deadline = deadline
+	m.lockLevel = level
+	return nil
+}
+
+// lockExclusive upgrades our PENDING lock to EXCLUSIVE once all other
+// readers are gone. Expired reader leases are removed.
+func (m *multiReaderLockManager) lockExclusive() error {
+	item, err := m.db.GetItem(&dynamodb.GetItemInput{
+		TableName:      &m.table,
+		ConsistentRead: aws.Bool(true),
+		Key:            m.key(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		nowUs      = time.Now().UnixMicro()
+		conditions = []string{"owner_id = :own", "deadline_us = :dus"}
+		removes    []string
+		names      = map[string]*string{
+			"#level": aws.String("level"),
+		}
+		values = map[string]*dynamodb.AttributeValue{
+			":own":  {S: &m.ownerID},
+			":dus":  {N: &m.lease.deadline},
+			":excl": levelValue(sqlite3vfs.LockExclusive),
+		}
+	)
+
+	for attr, v := range item.Item {
+		if !strings.HasPrefix(attr, readerAttrPrefix) || attr == m.readerAttr {
+			continue
+		}
+
+		readerDeadline, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		if err == nil && readerDeadline > nowUs {
+			// an active reader, we have to wait for it to finish
+			return sqlite3vfs.BusyError
+		}
+
+		// Remove the expired lease, but only if it wasn't renewed
+		// after we read it.
+		i := len(removes)
+		attr := attr
+		names[fmt.Sprintf("#r%d", i)] = &attr
+		values[fmt.Sprintf(":r%d", i)] = v
+		conditions = append(conditions, fmt.Sprintf("#r%d = :r%d", i, i))
+		removes = append(removes, fmt.Sprintf("#r%d", i))
+	}
+
+	update := "SET #level = :excl"
+	if len(removes) > 0 {
+		update += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	_, err = m.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 &m.table,
+		Key:                       m.key(),
+		UpdateExpression:          &update,
+		ConditionExpression:       aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			return sqlite3vfs.BusyError
+		}
+		return err
+	}
+
+	m.lockLevel = sqlite3vfs.LockExclusive
+	return nil
+}
+
+func (m *multiReaderLockManager) Unlock(elock sqlite3vfs.LockType) error {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	if elock > sqlite3vfs.LockShared {
+		panic(fmt.Sprintf("Invalid unlock request to level %s", elock))
+	}
+
+	if elock >= m.lockLevel {
+		return nil
+	}
+
+	return m.release(elock)
+}
+
+// release drops our locks down to elock. The caller must hold m.mu.
+func (m *multiReaderLockManager) release(elock sqlite3vfs.LockType) error {
+	if lost := m.lease.check(m.lockLevel); lost != nil {
+		if elock > sqlite3vfs.LockNone {
+			return lost
+		}
+
+		// Our leases may have been taken over, so only clean up
+		// our own reader lease (if it is still there).
+		m.removeReader()
+		m.lockLevel = sqlite3vfs.LockNone
+		m.lease.reset()
+		return nil
+	}
+
+	var err error
+
+	if m.lockLevel >= sqlite3vfs.LockReserved {
+		update := "REMOVE owner_id, deadline_us, #level"
+		names := map[string]*string{
+			"#level": aws.String("level"),
+		}
+		if elock == sqlite3vfs.LockNone {
+			update += ", #r"
+			names["#r"] = &m.readerAttr
+		}
+
+		_, err = m.db.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                &m.table,
+			Key:                      m.key(),
+			UpdateExpression:         &update,
+			ConditionExpression:      aws.String("owner_id = :own AND deadline_us = :dus"),
+			ExpressionAttributeNames: names,
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":own": {S: &m.ownerID},
+				":dus": {N: &m.lease.deadline},
+			},
+		})
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match && elock == sqlite3vfs.LockNone {
+			// our writer lease expired and was taken over,
+			// we still need to clear our reader lease
+			err = m.removeReader()
+		}
+	} else if elock == sqlite3vfs.LockNone {
+		err = m.removeReader()
+	}
+
+	m.lockLevel = elock
+	if elock == sqlite3vfs.LockNone {
+		m.lease.reset()
+	}
+	if err != nil {
+		m.err = err
+	}
+	return err
+}
+
+func (m *multiReaderLockManager) removeReader() error {
+	_, err := m.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        &m.table,
+		Key:              m.key(),
+		UpdateExpression: aws.String("REMOVE #r"),
+		ExpressionAttributeNames: map[string]*string{
+			"#r": &m.readerAttr,
+		},
+	})
+	return err
+}
+
+func (m *multiReaderLockManager) Level() sqlite3vfs.LockType {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lockLevel
+}
+
+func (m *multiReaderLockManager) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lease.check(m.lockLevel)
+}
+
+func (m *multiReaderLockManager) CheckReservedLock() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lockLevel >= sqlite3vfs.LockReserved {
+		// we hold the writer slot
+		return true, nil
+	}
+
+	item, err := m.db.GetItem(&dynamodb.GetItemInput{
+		TableName:       &m.table,
+		ConsistentRead:  aws.Bool(true),
+		AttributesToGet: []*string{aws.String("deadline_us")},
+		Key:             m.key(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	deadlineUsS, exists := item.Item["deadline_us"]
+	if !exists {
+		// no writer
+		return false, nil
+	}
+
+	deadlineUs, err := strconv.ParseInt(*deadlineUsS.N, 10, 64)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Now().UnixMicro() < deadlineUs, nil
+}
+
+func (m *multiReaderLockManager) Close() error {
+	close(m.stopHeartbeat)
+	<-m.heartbeatDone
+
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err == nil && m.lockLevel > sqlite3vfs.LockNone {
+		m.release(sqlite3vfs.LockNone)
+	}
+
+	retErr := m.err
+	m.err = errors.New("lock manager closed")
+	return retErr
+}
+
+func (m *multiReaderLockManager) heartbeatLoop() {
+	ticker := time.NewTicker(m.opts.RenewInterval)
+	defer ticker.Stop()
+
+	defer close(m.heartbeatDone)
+
+	for {
+		select {
+		case <-m.stopHeartbeat:
+			return
+		case <-ticker.C:
+			m.renew()
+		}
+	}
+}
+
+// renew extends the deadline of the leases we hold. Like the global
+// lock's renew, it only holds m.mu around the state, not the request.
+func (m *multiReaderLockManager) renew() {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+
+	m.mu.Lock()
+	if m.lockLevel == sqlite3vfs.LockNone || m.err != nil || m.lease.lost != nil {
+		m.mu.Unlock()
+		return
+	}
+	prevDeadline := m.lease.deadline
+	level := m.lockLevel
+	m.mu.Unlock()
+
+	deadline := m.opts.newDeadline()
+
+	update := "SET #r = :dus"
+	cond := "#r = :prev"
+	values := map[string]*dynamodb.AttributeValue{
+		":dus":  {N: &deadline},
+		":prev": {N: &prevDeadline},
+	}
+	if level >= sqlite3vfs.LockReserved {
+		update += ", deadline_us = :dus"
+		cond += " AND owner_id = :own AND deadline_us = :prev"
+		values[":own"] = &dynamodb.AttributeValue{S: &m.ownerID}
+	}
+
+	_, err := m.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           &m.table,
+		Key:                 m.key(),
+		UpdateExpression:    &update,
+		ConditionExpression: &cond,
+		ExpressionAttributeNames: map[string]*string{
+			"#r": &m.readerAttr,
+		},
+		ExpressionAttributeValues: values,
+	})
+
+	// opMu kept the lock level from changing meanwhile
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			m.lease.markLost("lease removed by another client")
+			return
+		}
+		// maybe there was a transient error that we'll recover from on the next tick,
+		// unless our lease runs out first
+		log.Printf("Error heartbeating: %s", err)
+		m.lease.check(level)
+		return
+	}
+
+	m.lease.deadline = deadline
+}
@@ -0,0 +1,83 @@
+package lock_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/psanford/donutdb/internal/dynamotest"
+	"github.com/psanford/donutdb/internal/lock"
+	"github.com/psanford/sqlite3vfs"
+)
+
+func TestMultiReaderLock(t *testing.T) {
+	serverInfo, err := dynamotest.SetupDynamoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverInfo.Cleanup()
+
+	lockName := fmt.Sprintf("lock-global-v1-test-%d", time.Now().UnixNano())
+
+	reader := lock.NewMultiReaderLockManager(serverInfo.DB, serverInfo.TableName, lockName, "reader", lock.Options{})
+	defer reader.Close()
+	writer := lock.NewMultiReaderLockManager(serverInfo.DB, serverInfo.TableName, lockName, "writer", lock.Options{})
+	defer writer.Close()
+	late := lock.NewMultiReaderLockManager(serverInfo.DB, serverInfo.TableName, lockName, "late", lock.Options{})
+	defer late.Close()
+
+	mustLock := func(m lock.LockManager, l sqlite3vfs.LockType) {
+		t.Helper()
+		if err := m.Lock(l); err != nil {
+			t.Fatalf("lock %s: %s", l, err)
+		}
+	}
+	mustBusy := func(m lock.LockManager, l sqlite3vfs.LockType) {
+		t.Helper()
+		if err := m.Lock(l); err != sqlite3vfs.BusyError {
+			t.Fatalf("lock %s: expected busy but got %v", l, err)
+		}
+	}
+
+	// readers and a single writer can share the file
+	mustLock(reader, sqlite3vfs.LockShared)
+	mustLock(writer, sqlite3vfs.LockShared)
+	mustLock(writer, sqlite3vfs.LockReserved)
+	mustBusy(reader, sqlite3vfs.LockReserved)
+
+	reserved, err := reader.CheckReservedLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Fatal("expected reader to see the reserved lock")
+	}
+
+	// exclusive waits for the existing reader and holds off new ones
+	mustBusy(writer, sqlite3vfs.LockExclusive)
+	if l := writer.Level(); l != sqlite3vfs.LockPending {
+		t.Fatalf("writer level got=%s expected=%s", l, sqlite3vfs.LockPending)
+	}
+	mustBusy(late, sqlite3vfs.LockShared)
+
+	if err := reader.Unlock(sqlite3vfs.LockNone); err != nil {
+		t.Fatal(err)
+	}
+	mustLock(writer, sqlite3vfs.LockExclusive)
+	mustBusy(late, sqlite3vfs.LockShared)
+
+	// dropping back to shared lets readers in again
+	if err := writer.Unlock(sqlite3vfs.LockShared); err != nil {
+		t.Fatal(err)
+	}
+	mustLock(late, sqlite3vfs.LockShared)
+	mustLock(reader, sqlite3vfs.LockShared)
+
+	reserved, err = late.CheckReservedLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved {
+		t.Fatal("expected no reserved lock")
+	}
+}
@@ -0,0 +1,54 @@
+package lock
+
+import (
+	"fmt"
+
+	"github.com/psanford/sqlite3vfs"
+)
+
+// readOnlyLockManager is used for files that can never change, like
+// snapshots. There is nothing to coordinate with other clients, so
+// SHARED is granted without touching DynamoDB and anything higher is
+// refused.
+type readOnlyLockManager struct {
+	lockLevel sqlite3vfs.LockType
+}
+
+func NewReadOnlyLockManager() *readOnlyLockManager {
+	return &readOnlyLockManager{}
+}
+
+func (m *readOnlyLockManager) Lock(elock sqlite3vfs.LockType) error {
+	if elock > sqlite3vfs.LockShared {
+		return sqlite3vfs.ReadOnlyError
+	}
+	m.lockLevel = elock
+	return nil
+}
+
+func (m *readOnlyLockManager) Unlock(elock sqlite3vfs.LockType) error {
+	if elock > sqlite3vfs.LockShared {
+		panic(fmt.Sprintf("Invalid unlock request to level %s", elock))
+	}
+	if elock < m.lockLevel {
+		m.lockLevel = elock
+	}
+	return nil
+}
+
+func (m *readOnlyLockManager) Close() error {
+	m.lockLevel = sqlite3vfs.LockNone
+	return nil
+}
+
+func (m *readOnlyLockManager) Level() sqlite3vfs.LockType {
+	return m.lockLevel
+}
+
+func (m *readOnlyLockManager) CheckReservedLock() (bool, error) {
+	return false, nil
+}
+
+func (m *readOnlyLockManager) Err() error {
+	return nil
+}
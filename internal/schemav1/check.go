@@ -0,0 +1,124 @@
+package schemav1
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// CheckSectors verifies the sectors of a v1 file: that they start at
+// offset 0 with no gaps, decompress, and are full unless they are the
+// last one. v1 sectors carry no hash and the file size is defined by
+// the last sector, so that is all that can be checked.
+//
+// The returned bool reports whether sector content was checked, which
+// requires the file's codec to be registered.
+func CheckSectors(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) ([]dynamo.SectorProblem, bool, error) {
+	f := &File{
+		dataRowKey: meta.DataRowKey,
+		rawName:    meta.OrigName,
+		randID:     meta.RandID,
+		sectorSize: meta.SectorSize,
+		table:      table,
+		db:         db,
+	}
+
+	checkContent := true
+	codec, err := compression.Lookup(meta.CompressAlg)
+	if errors.Is(err, compression.UnknownCodecErr) {
+		checkContent = false
+	} else if err != nil {
+		return nil, false, err
+	}
+	f.codec = codec
+
+	var (
+		problems []dynamo.SectorProblem
+		expected int64
+		// prevShort is the offset of the previous sector if it was
+		// short, or -1. Only the last sector may be short.
+		prevShort int64 = -1
+	)
+
+	report := func(offset int64, check, detail string) {
+		problems = append(problems, dynamo.SectorProblem{
+			Key:    f.dataRowKey + "/" + strconv.FormatInt(offset, 10),
+			Check:  check,
+			Detail: detail,
+		})
+	}
+
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		out, err := db.Query(&dynamodb.QueryInput{
+			TableName:              &table,
+			ConsistentRead:         aws.Bool(true),
+			KeyConditionExpression: aws.String("hash_key = :hk"),
+			ProjectionExpression:   aws.String("range_key, bytes"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":hk": {
+					S: &f.dataRowKey,
+				},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, item := range out.Items {
+			offset, err := strconv.ParseInt(aws.StringValue(item[dynamo.RKey].N), 10, 64)
+			if err != nil {
+				report(-1, dynamo.CheckSectorList, fmt.Sprintf("bad range_key %q", aws.StringValue(item[dynamo.RKey].N)))
+				continue
+			}
+
+			if offset%f.sectorSize != 0 {
+				report(offset, dynamo.CheckSectorList, fmt.Sprintf("offset %d is not a multiple of the sector size %d", offset, f.sectorSize))
+			}
+			for ; expected < offset; expected += f.sectorSize {
+				report(expected, dynamo.CheckSectorMissing, fmt.Sprintf("sector at offset %d not found", expected))
+			}
+			expected = offset + f.sectorSize
+
+			if prevShort >= 0 {
+				report(prevShort, dynamo.CheckSectorSize, "only the last sector may be short")
+				prevShort = -1
+			}
+
+			if !checkContent {
+				continue
+			}
+
+			var stored []byte
+			if b := item["bytes"]; b != nil {
+				stored = b.B
+			}
+			data, err := f.codec.Decompress(make([]byte, 0, f.sectorSize), stored)
+			if err != nil {
+				// counts the corruption like a read would
+				f.corruptSector(offset, err)
+				report(offset, dynamo.CorruptDecompress, err.Error())
+				continue
+			}
+
+			if int64(len(data)) > f.sectorSize {
+				report(offset, dynamo.CheckSectorSize, fmt.Sprintf("sector is %d bytes, larger than the sector size %d", len(data), f.sectorSize))
+			} else if int64(len(data)) < f.sectorSize {
+				prevShort = offset
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = out.LastEvaluatedKey
+	}
+
+	return problems, checkContent, nil
+}
@@ -0,0 +1,88 @@
+package schemav1
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// CopyRows copies every data row of the v1 file meta in srcTable to
+// dst's data rows in dstTable. The rows are written exactly as they
+// are stored, without decompressing them. check is called before each
+// batch is written; copying stops if it returns an error.
+func CopyRows(srcDB dynamo.Client, srcTable string, meta *dynamo.FileMetaV1V2, dstDB dynamo.Client, dstTable string, dst *dynamo.FileMetaV1V2, check func() error) error {
+	f := &File{
+		dataRowKey: meta.DataRowKey,
+		rawName:    meta.OrigName,
+		sectorSize: meta.SectorSize,
+		table:      srcTable,
+		db:         srcDB,
+	}
+
+	var reqs []*dynamodb.WriteRequest
+	flush := func() error {
+		if err := check(); err != nil {
+			return err
+		}
+		err := batchPut(dstDB, dstTable, reqs)
+		reqs = reqs[:0]
+		return err
+	}
+
+	err := f.queryRows("range_key, bytes", func(offset int64, item map[string]*dynamodb.AttributeValue) error {
+		copied := map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dst.DataRowKey),
+			},
+			dynamo.RKey: item[dynamo.RKey],
+		}
+		if b := item["bytes"]; b != nil {
+			copied["bytes"] = b
+		}
+		reqs = append(reqs, &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: copied,
+			},
+		})
+
+		if len(reqs) == 25 {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(reqs) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// batchPut sends up to 25 write requests in a single BatchWriteItem,
+// resending any that are left unprocessed.
+func batchPut(db dynamo.Client, table string, reqs []*dynamodb.WriteRequest) error {
+	var retrier dynamo.UnprocessedRetrier
+	for len(reqs) > 0 {
+		resp, err := db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				table: reqs,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		unprocessed := resp.UnprocessedItems[table]
+		if len(unprocessed) > 0 {
+			err = retrier.Retry(len(unprocessed), len(reqs))
+			if err != nil {
+				return err
+			}
+		}
+		reqs = unprocessed
+	}
+
+	return nil
+}
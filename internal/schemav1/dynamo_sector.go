@@ -7,12 +7,9 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/klauspost/compress/zstd"
 	"github.com/psanford/donutdb/internal/dynamo"
 )
 
-var decoder, _ = zstd.NewReader(nil)
-
 func (f *File) getSector(sectorOffset int64) (*Sector, error) {
 	rangeKeyStr := strconv.FormatInt(sectorOffset, 10)
 
@@ -49,9 +46,9 @@ func (f *File) getSector(sectorOffset int64) (*Sector, error) {
 	compressedSectorData := attr.B
 
 	sectorData := make([]byte, 0, f.sectorSize)
-	sectorData, err = decoder.DecodeAll(compressedSectorData, sectorData)
+	sectorData, err = f.codec.Decompress(sectorData, compressedSectorData)
 	if err != nil {
-		panic(err)
+		return nil, f.corruptSector(sectorOffset, err)
 	}
 
 	s := Sector{
@@ -98,9 +95,9 @@ func (f *File) getLastSector() (*Sector, error) {
 	compressedSectorData := item["bytes"].B
 
 	sectorData := make([]byte, 0, f.sectorSize)
-	sectorData, err = decoder.DecodeAll(compressedSectorData, sectorData)
+	sectorData, err = f.codec.Decompress(sectorData, compressedSectorData)
 	if err != nil {
-		panic(err)
+		return nil, f.corruptSector(sectorOffset, err)
 	}
 
 	return &Sector{
@@ -168,9 +165,9 @@ func (f *File) getSectorRange(firstSector, lastSector int64) ([]Sector, error) {
 			compressedSectorData := item["bytes"].B
 
 			sectorData := make([]byte, 0, f.sectorSize)
-			sectorData, err = decoder.DecodeAll(compressedSectorData, sectorData)
+			sectorData, err = f.codec.Decompress(sectorData, compressedSectorData)
 			if err != nil {
-				panic(err)
+				return nil, f.corruptSector(sectorOffset, err)
 			}
 
 			sectors = append(sectors, Sector{
@@ -199,3 +196,11 @@ type Sector struct {
 	Offset int64
 	Data   []byte
 }
+
+// corruptSector returns the error for a sector whose bytes failed to
+// decompress. schemav1 sectors carry no hash, so that is the only
+// corruption we can detect.
+func (f *File) corruptSector(sectorOffset int64, err error) error {
+	key := f.dataRowKey + "/" + strconv.FormatInt(sectorOffset, 10)
+	return dynamo.NewCorruptSectorError(key, dynamo.CorruptDecompress, err)
+}
@@ -9,7 +9,7 @@ import (
 	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/compression"
 	"github.com/psanford/donutdb/internal/changelog"
 	"github.com/psanford/donutdb/internal/dynamo"
 	"github.com/psanford/donutdb/internal/lock"
@@ -24,20 +24,30 @@ type File struct {
 	closed     bool
 
 	changeLogWriter *json.Encoder
-	db              *dynamodb.DynamoDB
+	db              dynamo.Client
 	table           string
+	codec           compression.Codec
 
 	cachedSize int64
 
 	lockManager lock.LockManager
 }
 
-func FileFromMeta(meta *dynamo.FileMetaV1V2, table, ownerID string, db *dynamodb.DynamoDB, changeLogWriter *json.Encoder) (*File, error) {
+func FileFromMeta(meta *dynamo.FileMetaV1V2, table string, db dynamo.Client, changeLogWriter *json.Encoder, lockManager lock.LockManager) (*File, error) {
 
 	if meta.MetaVersion > 1 {
 		return nil, fmt.Errorf("cannot instanciate schemav1 file for MetaVersion=%d", meta.MetaVersion)
 	}
 
+	if meta.KeyID != "" {
+		return nil, errors.New("schemav1 files cannot be encrypted")
+	}
+
+	codec, err := compression.Lookup(meta.CompressAlg)
+	if err != nil {
+		return nil, err
+	}
+
 	f := &File{
 		dataRowKey:      dynamo.FileDataPrefix + meta.RandID + "-" + meta.OrigName,
 		rawName:         meta.OrigName,
@@ -46,8 +56,9 @@ func FileFromMeta(meta *dynamo.FileMetaV1V2, table, ownerID string, db *dynamodb
 		table:           table,
 		db:              db,
 		changeLogWriter: changeLogWriter,
+		codec:           codec,
 
-		lockManager: lock.NewGlobalLockManger(db, table, meta.LockRowKey, ownerID),
+		lockManager: lockManager,
 	}
 	return f, nil
 }
@@ -62,6 +73,8 @@ func (f *File) Close() error {
 }
 
 func (f *File) ReadAt(p []byte, off int64) (retN int, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -144,6 +157,8 @@ func (f *File) ReadAt(p []byte, off int64) (retN int, retErr error) {
 }
 
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
+	defer dynamo.AsIOError(&err)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -336,6 +351,8 @@ func (f *File) SanityCheckSectors() error {
 }
 
 func (f *File) Truncate(size int64) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -393,7 +410,9 @@ func (f *File) sectorForPos(pos int64) int64 {
 	return pos - (pos % f.sectorSize)
 }
 
-func (f *File) Sync(flag sqlite3vfs.SyncType) error {
+func (f *File) Sync(flag sqlite3vfs.SyncType) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -411,10 +430,12 @@ func (f *File) Sync(flag sqlite3vfs.SyncType) error {
 		}()
 	}
 
-	return nil
+	return f.lockManager.Err()
 }
 
 func (f *File) FileSize() (retSize int64, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -434,6 +455,12 @@ func (f *File) FileSize() (retSize int64, retErr error) {
 		}()
 	}
 
+	// ReadAt, WriteAt and Truncate all start with a FileSize call,
+	// so this also stops them from running after the lease was lost.
+	if err := f.lockManager.Err(); err != nil {
+		return 0, err
+	}
+
 	sector, err := f.getLastSector()
 	if err == dynamo.SectorNotFoundErr {
 		return 0, nil
@@ -453,6 +480,8 @@ func (f *File) FileSize() (retSize int64, retErr error) {
 }
 
 func (f *File) Lock(elock sqlite3vfs.LockType) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	//    UNLOCKED -> SHARED
 	//    SHARED -> RESERVED
 	//    SHARED -> (PENDING) -> EXCLUSIVE
@@ -497,10 +526,27 @@ func (f *File) Lock(elock sqlite3vfs.LockType) (retErr error) {
 		return errors.New("can only transition to Reserved lock from Shared lock")
 	}
 
-	return f.lockManager.Lock(elock)
+	err := f.lockManager.Lock(elock)
+	if err != nil {
+		return err
+	}
+
+	// A migration holds the lock while it swaps the metadata, so once
+	// we have the lock we know whether we are still a v1 file.
+	if curLevel == sqlite3vfs.LockNone {
+		err = f.checkNotMigrated()
+		if err != nil {
+			f.lockManager.Unlock(sqlite3vfs.LockNone)
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (f *File) Unlock(elock sqlite3vfs.LockType) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:       time.Now(),
@@ -524,6 +570,8 @@ func (f *File) Unlock(elock sqlite3vfs.LockType) (retErr error) {
 }
 
 func (f *File) CheckReservedLock() (retB bool, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -0,0 +1,176 @@
+package schemav1
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// ScanSectors calls fn with the decompressed content of each sector of
+// a v1 file, in order. It fails if the sectors aren't contiguous from
+// offset 0 or a sector other than the last one is short, since the
+// file content can't be reconstructed reliably then.
+func ScanSectors(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, fn func(data []byte) error) error {
+	codec, err := compression.Lookup(meta.CompressAlg)
+	if err != nil {
+		return err
+	}
+
+	f := &File{
+		dataRowKey: meta.DataRowKey,
+		rawName:    meta.OrigName,
+		sectorSize: meta.SectorSize,
+		table:      table,
+		db:         db,
+		codec:      codec,
+	}
+
+	var (
+		expected  int64
+		prevShort bool
+	)
+
+	return f.queryRows("range_key, bytes", func(offset int64, item map[string]*dynamodb.AttributeValue) error {
+		if offset != expected {
+			return fmt.Errorf("sector at offset %d not found in %s", expected, f.dataRowKey)
+		}
+		if prevShort {
+			return fmt.Errorf("short sector before offset %d in %s", offset, f.dataRowKey)
+		}
+		expected += f.sectorSize
+
+		var stored []byte
+		if b := item["bytes"]; b != nil {
+			stored = b.B
+		}
+		data, err := f.codec.Decompress(make([]byte, 0, f.sectorSize), stored)
+		if err != nil {
+			return f.corruptSector(offset, err)
+		}
+		if int64(len(data)) > f.sectorSize {
+			return fmt.Errorf("sector at offset %d in %s is larger than the sector size", offset, f.dataRowKey)
+		}
+		prevShort = int64(len(data)) < f.sectorSize
+
+		return fn(data)
+	})
+}
+
+// DeleteSectors removes every data row of a v1 file.
+func DeleteSectors(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) (int, error) {
+	f := &File{
+		dataRowKey: meta.DataRowKey,
+		rawName:    meta.OrigName,
+		sectorSize: meta.SectorSize,
+		table:      table,
+		db:         db,
+	}
+
+	secWriter := &SectorWriter{
+		F: f,
+	}
+
+	var count int
+	err := f.queryRows("range_key", func(offset int64, item map[string]*dynamodb.AttributeValue) error {
+		count++
+		return secWriter.DeleteSector(offset)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = secWriter.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// queryRows calls fn for each of the file's data rows in offset order,
+// projecting only the attributes in projection.
+func (f *File) queryRows(projection string, fn func(offset int64, item map[string]*dynamodb.AttributeValue) error) error {
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		out, err := f.db.Query(&dynamodb.QueryInput{
+			TableName:              &f.table,
+			ConsistentRead:         aws.Bool(true),
+			KeyConditionExpression: aws.String("hash_key = :hk"),
+			ProjectionExpression:   &projection,
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":hk": {
+					S: &f.dataRowKey,
+				},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			offset, err := strconv.ParseInt(aws.StringValue(item[dynamo.RKey].N), 10, 64)
+			if err != nil {
+				return fmt.Errorf("range_key does not parse to an int: %s %w", aws.StringValue(item[dynamo.RKey].N), err)
+			}
+
+			err = fn(offset, item)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+// checkNotMigrated returns FileMigratedErr if the file's metadata now
+// describes a newer schema version. v1 writes never touch the metadata,
+// so without this check a client that opened the file before it was
+// migrated would keep writing to the old data rows.
+func (f *File) checkNotMigrated() error {
+	existing, err := f.db.GetItem(&dynamodb.GetItemInput{
+		TableName:            &f.table,
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#fname"),
+		ExpressionAttributeNames: map[string]*string{
+			"#fname": aws.String(f.rawName),
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileMetaKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	item := existing.Item[f.rawName]
+	if item == nil {
+		return nil
+	}
+
+	var meta dynamo.FileMetaV1V2
+	err = json.Unmarshal([]byte(aws.StringValue(item.S)), &meta)
+	if err != nil {
+		return fmt.Errorf("decode file metadata err: %w", err)
+	}
+
+	if meta.RandID == f.randID && meta.MetaVersion > 1 {
+		return fmt.Errorf("%w: %q", dynamo.FileMigratedErr, f.rawName)
+	}
+
+	return nil
+}
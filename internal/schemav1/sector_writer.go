@@ -1,11 +1,9 @@
 package schemav1
 
 import (
-	"fmt"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/klauspost/compress/zstd"
 	"github.com/psanford/donutdb/internal/dynamo"
 )
 
@@ -20,8 +18,6 @@ type SectorWriter struct {
 	pendingDeleteSectors []int64
 }
 
-var encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
-
 func (w *SectorWriter) WriteSector(s *Sector) error {
 	if w.err != nil {
 		return w.err
@@ -65,7 +61,7 @@ func (w *SectorWriter) Flush() error {
 		rangeKeyStr := strconv.FormatInt(s.Offset, 10)
 
 		compBytes := make([]byte, 0, len(s.Data))
-		compBytes = encoder.EncodeAll(s.Data, compBytes)
+		compBytes = w.F.codec.Compress(compBytes, s.Data)
 
 		req := &dynamodb.WriteRequest{
 			PutRequest: &dynamodb.PutRequest{
@@ -102,23 +98,28 @@ func (w *SectorWriter) Flush() error {
 		reqs = append(reqs, req)
 	}
 
-	items := map[string][]*dynamodb.WriteRequest{
-		w.F.table: reqs,
-	}
-
-	resp, err := w.F.db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
-		RequestItems: items,
-	})
+	var retrier dynamo.UnprocessedRetrier
+	for len(reqs) > 0 {
+		resp, err := w.F.db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				w.F.table: reqs,
+			},
+		})
 
-	if err != nil {
-		w.err = err
-		return err
-	}
+		if err != nil {
+			w.err = err
+			return err
+		}
 
-	if len(resp.UnprocessedItems) > 0 {
-		// we should retry these, but until we do we need to error
-		w.err = fmt.Errorf("unprocessed items: %v", resp.UnprocessedItems)
-		return w.err
+		unprocessed := resp.UnprocessedItems[w.F.table]
+		if len(unprocessed) > 0 {
+			err = retrier.Retry(len(unprocessed), len(reqs))
+			if err != nil {
+				w.err = err
+				return err
+			}
+		}
+		reqs = unprocessed
 	}
 
 	w.pendingWriteSectors = w.pendingWriteSectors[:0]
@@ -0,0 +1,169 @@
+package schemav2
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/encryption"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+var sectorIDRe = regexp.MustCompile(`^(\d+)__([0-9a-f]{64})$`)
+
+// CheckSectors verifies the sectors of a v2 or v3 file: that the
+// sector list is contiguous and matches the file size, and that every
+// sector exists, decodes, matches the hash in its ID and is full
+// unless it is the last one.
+//
+// The content of an encrypted file can only be checked with its key,
+// and a file whose codec isn't registered can't be decoded at all. The
+// returned bool reports whether sector content was checked; presence
+// is always checked.
+func CheckSectors(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, keys encryption.KeyProvider, concurrency int) ([]dynamo.SectorProblem, bool, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sectorRandID, sectorName := meta.SectorNamespace()
+
+	f := &File{
+		rawName:         meta.OrigName,
+		sectorRandID:    sectorRandID,
+		sectorName:      sectorName,
+		sectorSize:      meta.SectorSize,
+		metaVersion:     meta.MetaVersion,
+		table:           table,
+		db:              db,
+		sectcache:       &nopCache{},
+		readConcurrency: concurrency,
+	}
+
+	checkContent := meta.KeyID == "" || keys != nil
+	if checkContent {
+		codec, err := compression.Lookup(meta.CompressAlg)
+		if errors.Is(err, compression.UnknownCodecErr) {
+			checkContent = false
+		} else if err != nil {
+			return nil, false, err
+		}
+		f.codec = codec
+
+		f.cipher, err = newCipher(meta, keys)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		problems []dynamo.SectorProblem
+	)
+	report := func(key, check, detail string) {
+		mu.Lock()
+		defer mu.Unlock()
+		problems = append(problems, dynamo.SectorProblem{
+			Key:    key,
+			Check:  check,
+			Detail: detail,
+		})
+	}
+
+	expectCount := int64(0)
+	if meta.SectorSize > 0 {
+		expectCount = (meta.FileSize + meta.SectorSize - 1) / meta.SectorSize
+	}
+	if int64(len(meta.Sectors)) != expectCount {
+		report("", dynamo.CheckSectorList, fmt.Sprintf("file size %d needs %d sectors of %d bytes but the sector list has %d", meta.FileSize, expectCount, meta.SectorSize, len(meta.Sectors)))
+	}
+
+	// expectLen returns the size sector idx should have
+	expectLen := func(idx int) int64 {
+		if idx < len(meta.Sectors)-1 {
+			return meta.SectorSize
+		}
+		return meta.FileSize - int64(idx)*meta.SectorSize
+	}
+
+	indexOf := make(map[string]int, len(meta.Sectors))
+	var keyItems []map[string]*dynamodb.AttributeValue
+	for i, id := range meta.Sectors {
+		m := sectorIDRe.FindStringSubmatch(id)
+		if m == nil {
+			report(f.sectorKey(id), dynamo.CheckSectorList, fmt.Sprintf("sector %d has malformed id %q", i, id))
+			continue
+		}
+		if idx, _ := strconv.Atoi(m[1]); idx != i {
+			report(f.sectorKey(id), dynamo.CheckSectorList, fmt.Sprintf("sector %d has the id of sector %d", i, idx))
+			continue
+		}
+
+		indexOf[id] = i
+		keyItems = append(keyItems, map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(f.sectorKey(id)),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		})
+	}
+
+	var batches [][]map[string]*dynamodb.AttributeValue
+	for len(keyItems) > 0 {
+		n := maxBatchGetKeys
+		if len(keyItems) < n {
+			n = len(keyItems)
+		}
+		batches = append(batches, keyItems[:n])
+		keyItems = keyItems[n:]
+	}
+
+	found := make(map[string]bool, len(indexOf))
+	err := runConcurrently(len(batches), f.readConcurrency, func(i int) error {
+		return f.batchGetSectors(batches[i], func(sectorID string, stored []byte) error {
+			mu.Lock()
+			found[sectorID] = true
+			mu.Unlock()
+
+			if !checkContent {
+				return nil
+			}
+
+			data, err := f.decodeSector(sectorID, stored)
+			var corrupt *dynamo.CorruptSectorError
+			if errors.As(err, &corrupt) {
+				detail := "content does not match the sector id"
+				if corrupt.Err != nil {
+					detail = corrupt.Err.Error()
+				}
+				report(corrupt.Key, corrupt.Reason, detail)
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			idx := indexOf[sectorID]
+			if want := expectLen(idx); int64(len(data)) != want {
+				report(f.sectorKey(sectorID), dynamo.CheckSectorSize, fmt.Sprintf("sector %d is %d bytes, expected %d", idx, len(data), want))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i, id := range meta.Sectors {
+		if _, ok := indexOf[id]; ok && !found[id] {
+			report(f.sectorKey(id), dynamo.CheckSectorMissing, fmt.Sprintf("sector %d not found", i))
+		}
+	}
+
+	return problems, checkContent, nil
+}
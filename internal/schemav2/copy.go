@@ -0,0 +1,127 @@
+package schemav2
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// CopySectors copies the sectors and sector map chunks referenced by
+// meta from srcTable to the namespace of dst in dstTable. The two
+// clients may talk to different regions or endpoints.
+//
+// Items are streamed through BatchGetItem and BatchWriteItem with their
+// stored bytes untouched, so nothing is decompressed or decrypted and
+// the codec and keys don't need to be available. Sector ids don't
+// depend on where a sector is stored, so dst can reuse meta's sector
+// list as is. Up to concurrency batches are copied at once. check is
+// called before each batch and stops the copy if it returns an error.
+func CopySectors(srcDB dynamo.Client, srcTable string, meta *dynamo.FileMetaV1V2, dstDB dynamo.Client, dstTable string, dst *dynamo.FileMetaV1V2, concurrency int, check func() error) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	src := copyEndpoint(srcDB, srcTable, meta)
+	src.readConcurrency = concurrency
+	dstFile := copyEndpoint(dstDB, dstTable, dst)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	err := copyItems(src, dstFile, meta.Sectors, (*File).sectorKey, ts, check)
+	if err != nil {
+		return err
+	}
+	return copyItems(src, dstFile, meta.SectorChunks, (*File).sectorMapChunkKey, ts, check)
+}
+
+// copyEndpoint returns a File that is only good for building the item
+// keys of meta's namespace and sending batch requests.
+func copyEndpoint(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) *File {
+	sectorRandID, sectorName := meta.SectorNamespace()
+	return &File{
+		rawName:          meta.OrigName,
+		sectorRandID:     sectorRandID,
+		sectorName:       sectorName,
+		sectorSize:       meta.SectorSize,
+		metaVersion:      meta.MetaVersion,
+		table:            table,
+		db:               db,
+		readConcurrency:  1,
+		writeConcurrency: 1,
+	}
+}
+
+// copyItems copies the items with ids from src to dst, in batches of
+// maxBatchGetKeys. key builds an item's hash_key in a file's
+// namespace. The copies get ts as their timestamp, so garbage
+// collection leaves them alone until the copy's metadata exists.
+func copyItems(src, dst *File, ids []string, key func(*File, string) string, ts string, check func() error) error {
+	var batches [][]string
+	for len(ids) > 0 {
+		n := maxBatchGetKeys
+		if len(ids) < n {
+			n = len(ids)
+		}
+		batches = append(batches, ids[:n])
+		ids = ids[n:]
+	}
+
+	return runConcurrently(len(batches), src.readConcurrency, func(i int) error {
+		if err := check(); err != nil {
+			return err
+		}
+
+		batch := batches[i]
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, len(batch))
+		for _, id := range batch {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{
+				dynamo.HKey: {
+					S: aws.String(key(src, id)),
+				},
+				dynamo.RKey: {
+					N: aws.String("0"),
+				},
+			})
+		}
+
+		found := make(map[string]bool, len(batch))
+		reqs := make([]*dynamodb.WriteRequest, 0, len(batch))
+		err := src.batchGetSectors(keys, func(id string, stored []byte) error {
+			found[id] = true
+			reqs = append(reqs, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{
+					Item: map[string]*dynamodb.AttributeValue{
+						dynamo.HKey: {
+							S: aws.String(key(dst, id)),
+						},
+						dynamo.RKey: {
+							N: aws.String("0"),
+						},
+						"bytes": {
+							B: stored,
+						},
+						dynamo.SectorTSAttr: {
+							N: &ts,
+						},
+					},
+				},
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range batch {
+			if !found[id] {
+				return fmt.Errorf("item %q not found", key(src, id))
+			}
+		}
+
+		return dst.batchWrite(reqs)
+	})
+}
@@ -2,32 +2,34 @@ package schemav2
 
 import (
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/klauspost/compress/zstd"
 	"github.com/psanford/donutdb/internal/dynamo"
 )
 
-var zstdDecoder, _ = zstd.NewReader(nil)
-
-var uncompressFunc = func(in []byte, sectorSize int64) ([]byte, error) {
-	sectorData := make([]byte, 0, sectorSize)
-	return zstdDecoder.DecodeAll(in, sectorData)
-}
-
-// var uncompressFunc = func(in []byte, sectorSize int64) ([]byte, error) {
-// 	return in, nil
-// }
+// maxBatchGetKeys is the most keys DynamoDB accepts in a single
+// BatchGetItem request.
+const maxBatchGetKeys = 100
 
 func (f *File) getSectors(sectorIDs []string) ([]Sector, error) {
-	sectors := make(map[string]Sector)
+	var (
+		mu      sync.Mutex
+		sectors = make(map[string]Sector)
+		fetched []string
+	)
 
 	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(sectorIDs))
 	for _, sectorID := range sectorIDs {
 
 		cachedData := f.sectcache.Get(sectorID)
+		if cachedData != nil && !f.sectorMatchesID(sectorID, cachedData) {
+			// fall back to DynamoDB rather than trusting a bad cache entry
+			cacheCorruptSectorCount.Inc()
+			cachedData = nil
+		}
 		if cachedData != nil {
 			sector := Sector{
 				Data:  cachedData,
@@ -37,7 +39,7 @@ func (f *File) getSectors(sectorIDs []string) ([]Sector, error) {
 			continue
 		}
 
-		key := "file-v2-" + f.randID + "-" + f.rawName + "-" + sectorID
+		key := f.sectorKey(sectorID)
 		keys = append(keys, map[string]*dynamodb.AttributeValue{
 			dynamo.HKey: {
 				S: &key,
@@ -48,23 +50,66 @@ func (f *File) getSectors(sectorIDs []string) ([]Sector, error) {
 		})
 	}
 
+	var batches [][]map[string]*dynamodb.AttributeValue
 	for len(keys) > 0 {
-		var batchKeys []map[string]*dynamodb.AttributeValue
-		if len(keys) > 100 {
-			batchKeys = keys[:100]
-			keys = keys[100:]
-		} else {
-			batchKeys = keys
-			keys = nil
+		n := maxBatchGetKeys
+		if len(keys) < n {
+			n = len(keys)
 		}
+		batches = append(batches, keys[:n])
+		keys = keys[n:]
+	}
 
-		fieldsToFetch := strings.Join([]string{"bytes", dynamo.HKey}, ",")
+	err := runConcurrently(len(batches), f.readConcurrency, func(i int) error {
+		return f.batchGetSectors(batches[i], func(sectorID string, stored []byte) error {
+			data, err := f.decodeSector(sectorID, stored)
+			if err != nil {
+				return err
+			}
 
+			mu.Lock()
+			defer mu.Unlock()
+			sectors[sectorID] = Sector{
+				Data:  data,
+				Valid: true,
+			}
+			fetched = append(fetched, sectorID)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// CacheV2 implementations aren't required to be safe for
+	// concurrent use, so only touch the cache from this goroutine.
+	for _, sectorID := range fetched {
+		f.sectcache.Put(sectorID, sectors[sectorID].Data)
+	}
+
+	out := make([]Sector, len(sectorIDs))
+	for i, sectorID := range sectorIDs {
+		sector := sectors[sectorID]
+		sector.ID = sectorID
+		out[i] = sector
+	}
+
+	return out, nil
+}
+
+// batchGetSectors fetches the sectors for keys, retrying any keys
+// DynamoDB leaves unprocessed. found is called with the stored bytes
+// of each sector; if it returns an error batchGetSectors stops.
+func (f *File) batchGetSectors(keys []map[string]*dynamodb.AttributeValue, found func(sectorID string, stored []byte) error) error {
+	fieldsToFetch := strings.Join([]string{"bytes", dynamo.HKey}, ",")
+
+	var retrier dynamo.UnprocessedRetrier
+	for len(keys) > 0 {
 		args := &dynamodb.BatchGetItemInput{
 			RequestItems: map[string]*dynamodb.KeysAndAttributes{
 				f.table: {
 					ProjectionExpression: &fieldsToFetch,
-					Keys:                 batchKeys,
+					Keys:                 keys,
 				},
 			},
 		}
@@ -72,43 +117,108 @@ func (f *File) getSectors(sectorIDs []string) ([]Sector, error) {
 		t0 := time.Now()
 		out, err := f.db.BatchGetItem(args)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		batchGetItemHist.Observe(float64(time.Since(t0).Seconds()))
-		batchGetItemCount.Add(float64(len(batchKeys)))
+		batchGetItemCount.Add(float64(len(keys)))
 
 		for _, item := range out.Responses[f.table] {
 			fullID := item[dynamo.HKey].S
 			parts := strings.Split(*fullID, "-")
 			sectorID := parts[len(parts)-1]
 
-			compressedSectorData := item["bytes"].B
+			var stored []byte
+			if b := item["bytes"]; b != nil {
+				stored = b.B
+			}
 
-			sectorData, err := uncompressFunc(compressedSectorData, f.sectorSize)
+			err = found(sectorID, stored)
 			if err != nil {
-				panic(err)
+				return err
 			}
+		}
 
-			sector := Sector{
-				Data:  sectorData,
-				Valid: true,
+		var unprocessed []map[string]*dynamodb.AttributeValue
+		if ka := out.UnprocessedKeys[f.table]; ka != nil {
+			unprocessed = ka.Keys
+		}
+		if len(unprocessed) > 0 {
+			err = retrier.Retry(len(unprocessed), len(keys))
+			if err != nil {
+				return err
 			}
-			sectors[sectorID] = sector
-
-			f.sectcache.Put(sectorID, sectorData)
 		}
-		if len(out.UnprocessedKeys) > 0 {
-			keys = append(keys, out.UnprocessedKeys[f.table].Keys...)
+		keys = unprocessed
+	}
+
+	return nil
+}
+
+// runConcurrently calls fn(0) through fn(n-1) with at most limit calls
+// running at once, and returns the first error.
+func runConcurrently(n, limit int, fn func(i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+	if n <= 1 || limit == 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
 		}
+		return nil
 	}
 
-	out := make([]Sector, len(sectorIDs))
-	for i, sectorID := range sectorIDs {
-		sector := sectors[sectorID]
-		sector.ID = sectorID
-		out[i] = sector
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		sem      = make(chan struct{}, limit)
+	)
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := fn(i); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+				})
+			}
+		}(i)
 	}
+	wg.Wait()
 
-	return out, nil
+	return firstErr
+}
+
+// decodeSector decrypts and decompresses the stored bytes of a sector
+// and checks the result against the hash in its sector ID.
+func (f *File) decodeSector(sectorID string, stored []byte) ([]byte, error) {
+	compressed, err := f.openSector(sectorID, stored)
+	if err != nil {
+		return nil, dynamo.NewCorruptSectorError(f.sectorKey(sectorID), dynamo.CorruptDecrypt, err)
+	}
+
+	data, err := f.codec.Decompress(make([]byte, 0, f.sectorSize), compressed)
+	if err != nil {
+		return nil, dynamo.NewCorruptSectorError(f.sectorKey(sectorID), dynamo.CorruptDecompress, err)
+	}
+
+	if !f.sectorMatchesID(sectorID, data) {
+		return nil, dynamo.NewCorruptSectorError(f.sectorKey(sectorID), dynamo.CorruptHashMismatch, nil)
+	}
+
+	return data, nil
+}
+
+// sectorMatchesID reports whether data hashes to the hash in sectorID.
+func (f *File) sectorMatchesID(sectorID string, data []byte) bool {
+	i := strings.LastIndex(sectorID, "__")
+	if i < 0 {
+		return false
+	}
+	return sectorID[i+2:] == f.sectorHash(data)
 }
@@ -0,0 +1,86 @@
+package schemav2
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"github.com/psanford/donutdb/encryption"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/sectorcache"
+)
+
+// newCipher returns the cipher for an encrypted file, or nil if the
+// file isn't encrypted.
+func newCipher(meta *dynamo.FileMetaV1V2, keys encryption.KeyProvider) (*encryption.Cipher, error) {
+	if meta.KeyID == "" {
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("file %s is encrypted with key %q but no key provider is configured", meta.OrigName, meta.KeyID)
+	}
+
+	key, err := keys.Key(meta.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("get key for file %s: %w", meta.OrigName, err)
+	}
+
+	return encryption.NewCipher(meta.EncryptAlg, key)
+}
+
+// sectorHash returns the hex encoded hash of a sector's content that
+// is part of its sector ID. Encrypted files use a keyed hash so the IDs
+// don't reveal anything about the plaintext.
+func (f *File) sectorHash(data []byte) string {
+	var h hash.Hash
+	if f.cipher != nil {
+		h = f.cipher.NewHash()
+	} else {
+		h = sha512.New512_256()
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sealSector encrypts the compressed bytes of a sector, if the file is
+// encrypted. The sector ID is authenticated along with the data so a
+// stored sector can't be substituted for another one.
+func (f *File) sealSector(sectorID string, data []byte) []byte {
+	if f.cipher == nil {
+		return data
+	}
+	return f.cipher.Seal(nil, data, []byte(sectorID))
+}
+
+// openSector reverses sealSector.
+func (f *File) openSector(sectorID string, data []byte) ([]byte, error) {
+	if f.cipher == nil {
+		return data, nil
+	}
+	return f.cipher.Open(nil, data, []byte(sectorID))
+}
+
+// sealedCache encrypts the sectors of an encrypted file before they
+// reach the sector cache, which may keep them on disk. Entries that
+// fail to decrypt are treated as misses.
+type sealedCache struct {
+	inner  sectorcache.CacheV2
+	cipher *encryption.Cipher
+}
+
+func (c *sealedCache) Get(id string) []byte {
+	sealed := c.inner.Get(id)
+	if sealed == nil {
+		return nil
+	}
+	data, err := c.cipher.Open(nil, sealed, []byte(id))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (c *sealedCache) Put(id string, data []byte) {
+	c.inner.Put(id, c.cipher.Seal(nil, data, []byte(id)))
+}
@@ -11,6 +11,8 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/encryption"
 	"github.com/psanford/donutdb/internal/changelog"
 	"github.com/psanford/donutdb/internal/dynamo"
 	"github.com/psanford/donutdb/internal/lock"
@@ -21,49 +23,150 @@ import (
 type File struct {
 	dataRowKey string
 	rawName    string
-	randID     string
 	sectorSize int64
-	closed     bool
+	// sectorRandID and sectorName are embedded in the keys of the
+	// file's sectors and sector map chunks. For clones they are those
+	// of the file they were cloned from.
+	sectorRandID string
+	sectorName   string
+	// metaVersion is 2 for files whose metadata lives in the shared
+	// file-meta-v1 item and 3 for files with their own metadata item.
+	metaVersion int
+	closed      bool
 
 	changeLogWriter *json.Encoder
-	db              *dynamodb.DynamoDB
+	db              dynamo.Client
 	table           string
 	sectcache       sectorcache.CacheV2
+	codec           compression.Codec
+	// cipher is nil unless the file is encrypted.
+	cipher *encryption.Cipher
 
 	sectorWriter *SectorWriter
 
+	// sectorMapCache holds the v3 sector map chunks referenced by the
+	// most recently fetched metadata.
+	sectorMapCache map[string][]string
+
+	// lockedMeta and lockedRawMeta are the committed metadata as of
+	// when we took our current lock. No other client can commit while
+	// we hold SHARED or higher, so they stay valid until we drop back
+	// to LockNone.
+	lockedMeta    *dynamo.FileMetaV1V2
+	lockedRawMeta string
+
+	// frozenMeta is set for read-only snapshots. It is used instead of
+	// the file's current metadata and never changes.
+	frozenMeta *dynamo.FileMetaV1V2
+
 	cachedSize int64
 
 	lockManager lock.LockManager
+
+	readConcurrency  int
+	writeConcurrency int
+	readAhead        readAheadState
 }
 
-func FileFromMeta(meta *dynamo.FileMetaV1V2, table, ownerID string, db *dynamodb.DynamoDB, changeLogWriter *json.Encoder, cache sectorcache.CacheV2) (*File, error) {
-	if meta.MetaVersion != 2 {
+// Options configures optional behavior of a File.
+type Options struct {
+	// ReadConcurrency is the maximum number of BatchGetItem requests
+	// in flight at once when reading many sectors. Values below 1 mean
+	// 1, which is also the vfs default (donutdb.DefaultReadConcurrency).
+	ReadConcurrency int
+
+	// WriteConcurrency is the maximum number of BatchWriteItem
+	// requests in flight at once when staging or deleting sectors.
+	// Values below 1 mean 1, which is also the vfs default
+	// (donutdb.DefaultWriteConcurrency).
+	WriteConcurrency int
+
+	// ReadAhead is the number of sectors to prefetch into the sector
+	// cache in the background once sequential reads are detected. Zero
+	// disables read-ahead. Read-ahead requires a sector cache that is
+	// safe for concurrent use.
+	ReadAhead int
+
+	// Keys supplies the key for files encrypted at creation. It is
+	// required to open an encrypted file.
+	Keys encryption.KeyProvider
+}
+
+func FileFromMeta(meta *dynamo.FileMetaV1V2, table string, db dynamo.Client, changeLogWriter *json.Encoder, cache sectorcache.CacheV2, lockManager lock.LockManager, opts Options) (*File, error) {
+	if meta.MetaVersion != 2 && meta.MetaVersion != 3 {
 		return nil, fmt.Errorf("cannot instanciate schemav2 file for MetaVersion=%d", meta.MetaVersion)
 	}
 
+	codec, err := compression.Lookup(meta.CompressAlg)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, err := newCipher(meta, opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+
 	if cache == nil {
 		cache = &nopCache{}
+		// there's nowhere to put prefetched sectors
+		opts.ReadAhead = 0
+	} else if cipher != nil {
+		cache = &sealedCache{
+			inner:  cache,
+			cipher: cipher,
+		}
+	}
+
+	if opts.ReadConcurrency < 1 {
+		opts.ReadConcurrency = 1
+	}
+	if opts.WriteConcurrency < 1 {
+		opts.WriteConcurrency = 1
 	}
 
+	sectorRandID, sectorName := meta.SectorNamespace()
+
 	f := File{
 		dataRowKey:      dynamo.FileDataPrefix + meta.RandID + "-" + meta.OrigName,
 		rawName:         meta.OrigName,
-		randID:          meta.RandID,
+		sectorRandID:    sectorRandID,
+		sectorName:      sectorName,
 		sectorSize:      meta.SectorSize,
+		metaVersion:     meta.MetaVersion,
 		table:           table,
 		db:              db,
 		changeLogWriter: changeLogWriter,
 		sectcache:       cache,
+		codec:           codec,
+		cipher:          cipher,
+
+		lockManager: lockManager,
 
-		lockManager: lock.NewGlobalLockManger(db, table, meta.LockRowKey, ownerID),
+		readConcurrency:  opts.ReadConcurrency,
+		writeConcurrency: opts.WriteConcurrency,
+		readAhead: readAheadState{
+			window: opts.ReadAhead,
+		},
 	}
 
 	return &f, nil
 }
 
+// SnapshotFromMeta returns a read-only File for a snapshot, whose
+// content is the frozen metadata meta.
+func SnapshotFromMeta(meta *dynamo.FileMetaV1V2, table string, db dynamo.Client, changeLogWriter *json.Encoder, cache sectorcache.CacheV2, opts Options) (*File, error) {
+	f, err := FileFromMeta(meta, table, db, changeLogWriter, cache, lock.NewReadOnlyLockManager(), opts)
+	if err != nil {
+		return nil, err
+	}
+	f.frozenMeta = meta
+	return f, nil
+}
+
 func (f *File) Close() error {
 	f.closed = true
+	f.readAhead.wg.Wait()
 
 	f.Sync(sqlite3vfs.SyncNormal)
 
@@ -75,6 +178,8 @@ func (f *File) Close() error {
 }
 
 func (f *File) ReadAt(p []byte, off int64) (retN int, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -102,12 +207,17 @@ func (f *File) ReadAt(p []byte, off int64) (retN int, retErr error) {
 		return 0, os.ErrClosed
 	}
 
+	if err := f.checkLease(); err != nil {
+		return 0, err
+	}
+
 	if f.sectorWriter != nil {
-		err := f.sectorWriter.Flush()
+		// make sure any sectors we've written are readable
+		// from dynamo before we try to fetch them
+		err := f.sectorWriter.stage()
 		if err != nil {
 			return 0, err
 		}
-		f.sectorWriter = nil
 	}
 
 	firstSectorIdx := f.sectorIdxForPos(off)
@@ -166,6 +276,8 @@ func (f *File) ReadAt(p []byte, off int64) (retN int, retErr error) {
 		return n, retErr
 	}
 
+	f.maybeReadAhead(meta.Sectors, firstSectorIdx, lastSectorIdx)
+
 	if lastByte >= meta.FileSize {
 		return n, io.EOF
 	}
@@ -174,6 +286,8 @@ func (f *File) ReadAt(p []byte, off int64) (retN int, retErr error) {
 }
 
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
+	defer dynamo.AsIOError(&err)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -201,12 +315,21 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 		return 0, os.ErrClosed
 	}
 
+	if f.frozenMeta != nil {
+		return 0, sqlite3vfs.ReadOnlyError
+	}
+
+	if err := f.checkLease(); err != nil {
+		return 0, err
+	}
+
 	var writeCount int
 
-	meta, err := f.currentMeta()
+	w, err := f.writer()
 	if err != nil {
 		return 0, err
 	}
+	meta := w.meta
 
 	oldFileSize := meta.FileSize
 
@@ -218,13 +341,6 @@ func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
 		}
 	}()
 
-	if f.sectorWriter == nil {
-		f.sectorWriter = &SectorWriter{
-			F:    f,
-			meta: meta,
-		}
-	}
-
 	if firstSectorIdx >= len(meta.Sectors) {
 		if meta.FileSize%f.sectorSize != 0 {
 			// the last sector is not full, we need to fetch it and append to it
@@ -348,6 +464,8 @@ func (f *File) SanityCheckSectors() error {
 }
 
 func (f *File) Truncate(size int64) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -367,6 +485,14 @@ func (f *File) Truncate(size int64) (retErr error) {
 		}()
 	}
 
+	if f.frozenMeta != nil {
+		return sqlite3vfs.ReadOnlyError
+	}
+
+	if err := f.checkLease(); err != nil {
+		return err
+	}
+
 	meta, err := f.currentMeta()
 	if err != nil {
 		return err
@@ -376,26 +502,31 @@ func (f *File) Truncate(size int64) (retErr error) {
 		return nil
 	}
 
-	if f.sectorWriter == nil {
-		f.sectorWriter = &SectorWriter{
-			F:    f,
-			meta: meta,
-		}
+	w, err := f.writer()
+	if err != nil {
+		return err
 	}
+	meta = w.meta
+
 	firstSectorIdx := f.sectorIdxForPos(size)
 
 	firstSectorIdxToDelete := firstSectorIdx
 
 	if size%f.sectorSize != 0 {
 		firstSectorIdxToDelete++
-		sectors, err := f.getSectors([]string{meta.Sectors[firstSectorIdx]})
-		if err != nil {
-			return err
-		}
 
-		sectors[0].Data = sectors[0].Data[:size%f.sectorSize]
+		var data []byte
+		if pendingSector, found := w.pendingWriteSectors[firstSectorIdx]; found {
+			data = pendingSector.Data
+		} else {
+			sectors, err := f.getSectors([]string{meta.Sectors[firstSectorIdx]})
+			if err != nil {
+				return err
+			}
+			data = sectors[0].Data
+		}
 
-		f.sectorWriter.WriteSector(firstSectorIdx, sectors[0].Data)
+		w.WriteSector(firstSectorIdx, data[:size%f.sectorSize])
 	}
 
 	lastSectorIdx := len(meta.Sectors) - 1
@@ -404,6 +535,8 @@ func (f *File) Truncate(size int64) (retErr error) {
 		f.sectorWriter.DeleteSector(meta.Sectors[sectToDelete])
 	}
 
+	w.truncatePending(firstSectorIdxToDelete)
+	meta.Sectors = meta.Sectors[:firstSectorIdxToDelete]
 	meta.FileSize = size
 	return nil
 }
@@ -414,7 +547,9 @@ func (f *File) sectorIdxForPos(pos int64) int {
 	return int(pos / f.sectorSize)
 }
 
-func (f *File) Sync(flag sqlite3vfs.SyncType) error {
+func (f *File) Sync(flag sqlite3vfs.SyncType) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -432,22 +567,108 @@ func (f *File) Sync(flag sqlite3vfs.SyncType) error {
 		}()
 	}
 
+	return f.commit()
+}
+
+// commit atomically publishes any pending writes.
+func (f *File) commit() error {
+	if err := f.checkLease(); err != nil {
+		return err
+	}
+
 	if f.sectorWriter != nil {
 		err := f.sectorWriter.Flush()
 		if err != nil {
+			// we don't know if the metadata was updated
+			f.lockedMeta = nil
 			return err
 		}
+		if f.lockedMeta != nil {
+			f.lockedMeta = f.sectorWriter.meta
+			f.lockedRawMeta = f.sectorWriter.baseMeta
+		}
 		f.sectorWriter = nil
 	}
 
 	return nil
 }
 
+// checkLease returns an error if the lease on the lock we hold has
+// been lost. Any uncommitted writes are discarded since they were made
+// without a valid lock.
+func (f *File) checkLease() error {
+	err := f.lockManager.Err()
+	if err != nil {
+		f.sectorWriter = nil
+		f.lockedMeta = nil
+	}
+	return err
+}
+
+// writer returns the SectorWriter for the current set of
+// uncommitted changes, creating it if necessary.
+func (f *File) writer() (*SectorWriter, error) {
+	if f.sectorWriter != nil {
+		return f.sectorWriter, nil
+	}
+
+	meta, rawMeta, err := f.fetchMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	f.sectorWriter = f.newSectorWriter(meta, rawMeta)
+	return f.sectorWriter, nil
+}
+
 func (f *File) currentMeta() (*dynamo.FileMetaV1V2, error) {
 	if f.sectorWriter != nil {
 		return f.sectorWriter.meta, nil
 	}
 
+	meta, _, err := f.fetchMeta()
+	return meta, err
+}
+
+// fetchMeta returns the committed file metadata, both decoded and in
+// its raw serialized form. While we hold a lock it is only read from
+// dynamo once. The returned metadata must not be modified.
+func (f *File) fetchMeta() (*dynamo.FileMetaV1V2, string, error) {
+	if f.frozenMeta != nil {
+		return f.frozenMeta, "", nil
+	}
+
+	if f.lockedMeta != nil {
+		return f.lockedMeta, f.lockedRawMeta, nil
+	}
+
+	meta, rawMeta, err := f.readMeta()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if f.lockManager.Level() >= sqlite3vfs.LockShared {
+		f.lockedMeta = meta
+		f.lockedRawMeta = rawMeta
+	}
+
+	return meta, rawMeta, nil
+}
+
+// readMeta reads the committed file metadata from dynamo.
+func (f *File) readMeta() (*dynamo.FileMetaV1V2, string, error) {
+	if f.metaVersion == 3 {
+		meta, rawMeta, chunks, err := fetchMetaV3(f.db, f.table, f.rawName, f.sectorMapCache)
+		if err != nil {
+			return nil, "", err
+		}
+		if meta == nil {
+			return nil, "", fmt.Errorf("file metadata not found for %q", f.rawName)
+		}
+		f.sectorMapCache = chunks
+		return meta, rawMeta, nil
+	}
+
 	t0 := time.Now()
 	existing, err := f.db.GetItem(&dynamodb.GetItemInput{
 		TableName:            &f.table,
@@ -465,7 +686,7 @@ func (f *File) currentMeta() (*dynamo.FileMetaV1V2, error) {
 		},
 	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	GetItemHist.Observe(float64(time.Since(t0).Seconds()))
@@ -474,18 +695,20 @@ func (f *File) currentMeta() (*dynamo.FileMetaV1V2, error) {
 
 	item := existing.Item[f.rawName]
 	if item == nil {
-		return nil, fmt.Errorf("file metadata not found for %q", f.rawName)
+		return nil, "", fmt.Errorf("file metadata not found for %q", f.rawName)
 	}
 
 	err = json.Unmarshal([]byte(*item.S), &meta)
 	if err != nil {
-		return nil, fmt.Errorf("decode file metadata err: %w", err)
+		return nil, "", fmt.Errorf("decode file metadata err: %w", err)
 	}
 
-	return &meta, nil
+	return &meta, *item.S, nil
 }
 
 func (f *File) FileSize() (retSize int64, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -505,6 +728,10 @@ func (f *File) FileSize() (retSize int64, retErr error) {
 		}()
 	}
 
+	if err := f.checkLease(); err != nil {
+		return 0, err
+	}
+
 	meta, err := f.currentMeta()
 	if err != nil {
 		return 0, err
@@ -522,6 +749,8 @@ func (f *File) FileSize() (retSize int64, retErr error) {
 }
 
 func (f *File) Lock(elock sqlite3vfs.LockType) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	//    UNLOCKED -> SHARED
 	//    SHARED -> RESERVED
 	//    SHARED -> (PENDING) -> EXCLUSIVE
@@ -566,10 +795,16 @@ func (f *File) Lock(elock sqlite3vfs.LockType) (retErr error) {
 		return errors.New("can only transition to Reserved lock from Shared lock")
 	}
 
+	if curLevel == sqlite3vfs.LockNone {
+		f.lockedMeta = nil
+	}
+
 	return f.lockManager.Lock(elock)
 }
 
 func (f *File) Unlock(elock sqlite3vfs.LockType) (retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:       time.Now(),
@@ -589,10 +824,30 @@ func (f *File) Unlock(elock sqlite3vfs.LockType) (retErr error) {
 		}()
 	}
 
-	return f.lockManager.Unlock(elock)
+	// publish anything written under this lock before we give it up,
+	// even if sqlite never called Sync. With synchronous=OFF this is the
+	// only commit point, so a lost lease is reported here just like
+	// Sync reports it.
+	commitErr := f.commit()
+	if commitErr != nil {
+		// the writes are lost either way, don't hold on to the lock
+		f.sectorWriter = nil
+	}
+
+	if elock == sqlite3vfs.LockNone {
+		f.lockedMeta = nil
+	}
+
+	err := f.lockManager.Unlock(elock)
+	if commitErr != nil {
+		return commitErr
+	}
+	return err
 }
 
 func (f *File) CheckReservedLock() (retB bool, retErr error) {
+	defer dynamo.AsIOError(&retErr)
+
 	if f.changeLogWriter != nil {
 		r := changelog.Record{
 			TS:     time.Now(),
@@ -647,16 +902,34 @@ func (f *File) DeviceCharacteristics() sqlite3vfs.DeviceCharacteristic {
 	return c
 }
 
-func (f *File) updateMeta(meta *dynamo.FileMetaV1V2) error {
+// commitMeta replaces the file metadata with meta, but only if the
+// current metadata still matches baseMeta. Since the metadata is stored
+// as a JSON attribute we condition on the exact value we read, which
+// includes its generation. Files with history enabled also record the
+// new version in their history. It returns the serialized form of the
+// new metadata.
+func (f *File) commitMeta(meta *dynamo.FileMetaV1V2, baseMeta string) (string, error) {
+	if f.metaVersion == 3 {
+		rawMeta, err := f.commitMetaV3(meta, baseMeta)
+		if err != nil {
+			return "", err
+		}
+		f.recordHistory(meta, rawMeta)
+		return rawMeta, nil
+	}
+
+	meta.Generation++
+
 	metaBytes, err := json.Marshal(meta)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	t0 := time.Now()
 	_, err = f.db.UpdateItem(&dynamodb.UpdateItemInput{
-		TableName:        &f.table,
-		UpdateExpression: aws.String("SET #fname=:meta"),
+		TableName:           &f.table,
+		UpdateExpression:    aws.String("SET #fname=:meta"),
+		ConditionExpression: aws.String("#fname=:base"),
 		Key: map[string]*dynamodb.AttributeValue{
 			dynamo.HKey: {
 				S: aws.String(dynamo.FileMetaKey),
@@ -672,24 +945,65 @@ func (f *File) updateMeta(meta *dynamo.FileMetaV1V2) error {
 			":meta": {
 				S: aws.String(string(metaBytes)),
 			},
+			":base": {
+				S: &baseMeta,
+			},
 		},
 	})
 
 	UpdateItemHist.Observe(time.Since(t0).Seconds())
 
-	return err
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			return "", fmt.Errorf("%w: %q at generation %d", dynamo.MetaConflictErr, f.rawName, meta.Generation-1)
+		}
+		return "", err
+	}
+
+	f.recordHistory(meta, string(metaBytes))
+
+	return string(metaBytes), nil
+}
+
+// sectorKey returns the hash_key for the sector item with the given id.
+func (f *File) sectorKey(id string) string {
+	return dynamo.SectorKey(f.sectorRandID, f.sectorName, id)
 }
 
 func (f *File) CleanupSectors(meta *dynamo.FileMetaV1V2) error {
-	secWriter := &SectorWriter{
-		F:                   f,
-		meta:                meta,
-		skipMetadataUpdates: true,
+	if meta.SharedSectors {
+		// snapshots or clones may still reference any of these,
+		// leave them for garbage collection
+		return nil
 	}
 
+	secWriter := f.newSectorWriter(meta, "")
+	secWriter.skipMetadataUpdates = true
+
 	for _, sect := range meta.Sectors {
 		secWriter.DeleteSector(sect)
 	}
 
-	return secWriter.Flush()
+	err := secWriter.Flush()
+	if err != nil {
+		return err
+	}
+
+	reqs := make([]*dynamodb.WriteRequest, 0, len(meta.SectorChunks))
+	for _, id := range meta.SectorChunks {
+		reqs = append(reqs, &dynamodb.WriteRequest{
+			DeleteRequest: &dynamodb.DeleteRequest{
+				Key: map[string]*dynamodb.AttributeValue{
+					dynamo.HKey: {
+						S: aws.String(f.sectorMapChunkKey(id)),
+					},
+					dynamo.RKey: {
+						N: aws.String("0"),
+					},
+				},
+			},
+		})
+	}
+
+	return f.batchWrite(reqs)
 }
@@ -0,0 +1,240 @@
+package schemav2
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// Files with HistorySize set record every metadata version they commit
+// in their history partition, dynamo.HistoryKey, with the generation as
+// the range_key. Only the newest HistorySize versions are kept. Like
+// snapshots, the recorded versions are roots for garbage collection.
+
+// HistoryEntry is a committed metadata version read from a file's
+// history.
+type HistoryEntry struct {
+	Generation int64
+	Committed  time.Time
+
+	// Meta is the metadata of this version. Its sector list isn't
+	// loaded if it is stored in sector map chunks, see
+	// ResolveSectorMap.
+	Meta *dynamo.FileMetaV1V2
+}
+
+// recordHistory adds the newly committed meta to the file's history
+// and drops versions that no longer fit. rawMeta is meta as stored.
+//
+// The commit has already happened, so failures are only logged. A
+// version missing from the history just can't be rolled back to.
+func (f *File) recordHistory(meta *dynamo.FileMetaV1V2, rawMeta string) {
+	if meta.HistorySize < 1 {
+		return
+	}
+
+	historyKey := dynamo.HistoryKey(meta.RandID, meta.OrigName)
+
+	_, err := f.db.PutItem(&dynamodb.PutItemInput{
+		TableName: &f.table,
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: &historyKey,
+			},
+			dynamo.RKey: {
+				N: aws.String(strconv.FormatInt(meta.Generation, 10)),
+			},
+			dynamo.MetaV3Attr: {
+				S: &rawMeta,
+			},
+			dynamo.SectorTSAttr: {
+				N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("donutdb: record metadata history for %q err: %s", f.rawName, err)
+		return
+	}
+
+	oldest := meta.Generation - int64(meta.HistorySize) + 1
+	err = deleteHistory(f.db, f.table, historyKey, oldest)
+	if err != nil {
+		log.Printf("donutdb: trim metadata history for %q err: %s", f.rawName, err)
+	}
+}
+
+// ListHistory returns the recorded metadata versions of the file
+// described by meta, oldest first. Their sector lists aren't resolved.
+func ListHistory(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) ([]HistoryEntry, error) {
+	return listHistory(db, table, dynamo.HistoryKey(meta.RandID, meta.OrigName))
+}
+
+// ListHistoryPartition is ListHistory for the history partition
+// historyKey, which may belong to a file that no longer exists.
+func ListHistoryPartition(db dynamo.Client, table, historyKey string) ([]HistoryEntry, error) {
+	return listHistory(db, table, historyKey)
+}
+
+func listHistory(db dynamo.Client, table, historyKey string) ([]HistoryEntry, error) {
+	var (
+		entries  []HistoryEntry
+		startKey map[string]*dynamodb.AttributeValue
+	)
+
+	for {
+		out, err := db.Query(&dynamodb.QueryInput{
+			TableName:              &table,
+			ConsistentRead:         aws.Bool(true),
+			KeyConditionExpression: aws.String("hash_key = :hk"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":hk": {
+					S: &historyKey,
+				},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			entry := HistoryEntry{}
+
+			entry.Generation, err = strconv.ParseInt(aws.StringValue(item[dynamo.RKey].N), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("decode history generation err: %w", err)
+			}
+
+			if ts := item[dynamo.SectorTSAttr]; ts != nil {
+				sec, err := strconv.ParseInt(aws.StringValue(ts.N), 10, 64)
+				if err == nil {
+					entry.Committed = time.Unix(sec, 0)
+				}
+			}
+
+			var meta dynamo.FileMetaV1V2
+			err = json.Unmarshal([]byte(aws.StringValue(item[dynamo.MetaV3Attr].S)), &meta)
+			if err != nil {
+				return nil, fmt.Errorf("decode history generation %d metadata err: %w", entry.Generation, err)
+			}
+			entry.Meta = &meta
+
+			entries = append(entries, entry)
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return entries, nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+// DeleteHistory removes the recorded metadata versions of the file
+// described by meta.
+func DeleteHistory(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) error {
+	return deleteHistory(db, table, dynamo.HistoryKey(meta.RandID, meta.OrigName), 0)
+}
+
+// DeleteHistoryPartition is DeleteHistory for the history partition
+// historyKey.
+func DeleteHistoryPartition(db dynamo.Client, table, historyKey string) error {
+	return deleteHistory(db, table, historyKey, 0)
+}
+
+// deleteHistory deletes the versions in historyKey older than keep, or
+// all of them if keep is 0.
+func deleteHistory(db dynamo.Client, table, historyKey string, keep int64) error {
+	input := &dynamodb.QueryInput{
+		TableName:              &table,
+		ConsistentRead:         aws.Bool(true),
+		ProjectionExpression:   aws.String("hash_key, range_key"),
+		KeyConditionExpression: aws.String("hash_key = :hk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hk": {
+				S: &historyKey,
+			},
+		},
+	}
+	if keep > 0 {
+		input.KeyConditionExpression = aws.String("hash_key = :hk AND range_key < :keep")
+		input.ExpressionAttributeValues[":keep"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(keep, 10)),
+		}
+	}
+
+	for {
+		out, err := db.Query(input)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+				TableName: &table,
+				Key: map[string]*dynamodb.AttributeValue{
+					dynamo.HKey: item[dynamo.HKey],
+					dynamo.RKey: item[dynamo.RKey],
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// CopyHistory copies the recorded metadata versions of the file
+// described by meta to the history partition it will have once it is
+// renamed to name.
+func CopyHistory(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, name string) error {
+	srcKey := dynamo.HistoryKey(meta.RandID, meta.OrigName)
+	dstKey := dynamo.HistoryKey(meta.RandID, name)
+
+	input := &dynamodb.QueryInput{
+		TableName:              &table,
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("hash_key = :hk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":hk": {
+				S: &srcKey,
+			},
+		},
+	}
+
+	for {
+		out, err := db.Query(input)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			item[dynamo.HKey] = &dynamodb.AttributeValue{
+				S: &dstKey,
+			}
+			_, err = db.PutItem(&dynamodb.PutItemInput{
+				TableName: &table,
+				Item:      item,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,750 @@
+package schemav2
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// Schema v3 stores the same sector data as v2, but each file's metadata
+// lives in its own item (dynamo.MetaV3Key) instead of sharing the
+// file-meta-v1 item with every other file.
+//
+// Files with up to SectorMapChunkSize sectors keep their sector list
+// inline in the metadata item. Larger files split the list into content
+// addressed chunk items and the metadata only references the chunk ids.
+// Like sectors, chunks are written before the metadata swap that makes
+// them visible, so a commit is still a single conditional update.
+
+// SectorMapChunkSize is the number of sector ids stored per sector map
+// chunk item.
+const SectorMapChunkSize = 1024
+
+// sectorMapCodec compresses sector map chunks. Chunks always use the
+// default codec rather than the file's, so a file's sector list can be
+// read even in a process that doesn't have its codec registered.
+var sectorMapCodec, _ = compression.Lookup(compression.DefaultName)
+
+// FetchMetaV3 reads the metadata for the v3 file name, including its
+// full sector list. It returns a nil meta if the file does not exist.
+// The returned string is the raw metadata attribute, which is used as
+// the condition for later updates.
+func FetchMetaV3(db dynamo.Client, table, name string) (*dynamo.FileMetaV1V2, string, error) {
+	meta, rawMeta, _, err := fetchMetaV3(db, table, name, nil)
+	return meta, rawMeta, err
+}
+
+// fetchMetaV3 is FetchMetaV3 with a cache of previously loaded sector
+// map chunks. Chunks are immutable so they can be cached indefinitely.
+// It returns a new cache with only the chunks used by this metadata.
+func fetchMetaV3(db dynamo.Client, table, name string, chunkCache map[string][]string) (*dynamo.FileMetaV1V2, string, map[string][]string, error) {
+	t0 := time.Now()
+	existing, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:            &table,
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#meta"),
+		ExpressionAttributeNames: map[string]*string{
+			"#meta": aws.String(dynamo.MetaV3Attr),
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.MetaV3Key(name)),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	GetItemHist.Observe(time.Since(t0).Seconds())
+
+	item := existing.Item[dynamo.MetaV3Attr]
+	if item == nil {
+		return nil, "", nil, nil
+	}
+
+	var meta dynamo.FileMetaV1V2
+	err = json.Unmarshal([]byte(*item.S), &meta)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("decode file metadata err: %w", err)
+	}
+
+	if len(meta.SectorChunks) == 0 {
+		return &meta, *item.S, nil, nil
+	}
+
+	chunks, err := getSectorMapChunks(db, table, &meta, chunkCache)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	for _, id := range meta.SectorChunks {
+		meta.Sectors = append(meta.Sectors, chunks[id]...)
+	}
+
+	return &meta, *item.S, chunks, nil
+}
+
+// getSectorMapChunks fetches the sector map chunks referenced by meta
+// that aren't already in cache.
+func getSectorMapChunks(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, cache map[string][]string) (map[string][]string, error) {
+	chunks := make(map[string][]string, len(meta.SectorChunks))
+	randID, name := meta.SectorNamespace()
+
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(meta.SectorChunks))
+	for _, id := range meta.SectorChunks {
+		if sectors, ok := cache[id]; ok {
+			chunks[id] = sectors
+			continue
+		}
+
+		keys = append(keys, map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.SectorMapChunkKey(randID, name, id)),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		})
+	}
+
+	keyPrefix := dynamo.SectorMapChunkKey(randID, name, "")
+
+	for len(keys) > 0 {
+		batchKeys := keys
+		if len(batchKeys) > 100 {
+			batchKeys = keys[:100]
+		}
+		keys = keys[len(batchKeys):]
+
+		t0 := time.Now()
+		out, err := db.BatchGetItem(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				table: {
+					ConsistentRead:       aws.Bool(true),
+					ProjectionExpression: aws.String("hash_key, bytes"),
+					Keys:                 batchKeys,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		batchGetItemHist.Observe(time.Since(t0).Seconds())
+		batchGetItemCount.Add(float64(len(batchKeys)))
+
+		for _, item := range out.Responses[table] {
+			id := (*item[dynamo.HKey].S)[len(keyPrefix):]
+
+			data, err := sectorMapCodec.Decompress(nil, item["bytes"].B)
+			if err != nil {
+				return nil, dynamo.NewCorruptSectorError(*item[dynamo.HKey].S, dynamo.CorruptDecompress, err)
+			}
+			if i := strings.LastIndex(id, "__"); i < 0 || id[i+2:] != fmt.Sprintf("%x", sha512.Sum512_256(data)) {
+				return nil, dynamo.NewCorruptSectorError(*item[dynamo.HKey].S, dynamo.CorruptHashMismatch, nil)
+			}
+
+			var sectors []string
+			err = json.Unmarshal(data, &sectors)
+			if err != nil {
+				return nil, fmt.Errorf("decode sector map chunk %s err: %w", id, err)
+			}
+			chunks[id] = sectors
+		}
+
+		if unprocessed := out.UnprocessedKeys[table]; unprocessed != nil {
+			keys = append(keys, unprocessed.Keys...)
+		}
+	}
+
+	for _, id := range meta.SectorChunks {
+		if _, ok := chunks[id]; !ok {
+			return nil, fmt.Errorf("sector map chunk %s not found for %q", id, meta.OrigName)
+		}
+	}
+
+	return chunks, nil
+}
+
+// splitSectorMap divides sectors into chunks of SectorMapChunkSize,
+// returning the content addressed id and encoded form of each chunk.
+func splitSectorMap(sectors []string) ([]string, [][]byte, error) {
+	var (
+		ids     []string
+		encoded [][]byte
+	)
+
+	for i := 0; i*SectorMapChunkSize < len(sectors); i++ {
+		end := (i + 1) * SectorMapChunkSize
+		if end > len(sectors) {
+			end = len(sectors)
+		}
+
+		data, err := json.Marshal(sectors[i*SectorMapChunkSize : end])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		sum := sha512.Sum512_256(data)
+		ids = append(ids, fmt.Sprintf("%d__%x", i, sum))
+		encoded = append(encoded, data)
+	}
+
+	return ids, encoded, nil
+}
+
+// CreateMetaV3 creates the metadata item and directory entry for a
+// new v3 file. It returns a *dynamodb.ConditionalCheckFailedException
+// if the file already exists.
+//
+// Both items are written in a single transaction, so a client that
+// loses a create race leaves the winner's directory entry alone. The
+// transaction also checks that no v1 or v2 file has the name.
+func CreateMetaV3(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) error {
+	stored := *meta
+	if len(stored.SectorChunks) > 0 {
+		stored.Sectors = nil
+	}
+
+	metaBytes, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	dirItem := map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: aws.String(dynamo.FileDirV3Key),
+		},
+		dynamo.RKey: {
+			N: aws.String(dynamo.DirV3RangeKey(meta.OrigName)),
+		},
+		"name": {
+			S: &meta.OrigName,
+		},
+		"rand_id": {
+			S: &meta.RandID,
+		},
+		dynamo.SectorTSAttr: {
+			N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+		},
+	}
+	metaPut := &dynamodb.PutItemInput{
+		TableName:           &table,
+		ConditionExpression: aws.String("attribute_not_exists(hash_key)"),
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.MetaV3Key(meta.OrigName)),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+			dynamo.MetaV3Attr: {
+				S: aws.String(string(metaBytes)),
+			},
+		},
+	}
+
+	// v1 and v2 files live in the shared file-meta-v1 item
+	v1Key := map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: aws.String(dynamo.FileMetaKey),
+		},
+		dynamo.RKey: {
+			N: aws.String("0"),
+		},
+	}
+	exists := fmt.Sprintf("file %q already exists", meta.OrigName)
+
+	if !dynamo.SupportsTransactions(db) {
+		out, err := db.GetItem(&dynamodb.GetItemInput{
+			TableName:            &table,
+			ConsistentRead:       aws.Bool(true),
+			Key:                  v1Key,
+			ProjectionExpression: aws.String("#fname"),
+			ExpressionAttributeNames: map[string]*string{
+				"#fname": &meta.OrigName,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Item) > 0 {
+			return &dynamodb.ConditionalCheckFailedException{
+				Message_: &exists,
+			}
+		}
+
+		// The directory entry is written first and removed last so
+		// that every metadata item always has one. Garbage collection
+		// depends on this to find all live files.
+		err = putDirEntryV3(db, table, meta, dirItem)
+		if err != nil {
+			return err
+		}
+		_, err = db.PutItem(metaPut)
+		return err
+	}
+
+	_, err = dynamo.TransactWriteItems(db, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				ConditionCheck: &dynamodb.ConditionCheck{
+					TableName:           &table,
+					ConditionExpression: aws.String("attribute_not_exists(#fname)"),
+					Key:                 v1Key,
+					ExpressionAttributeNames: map[string]*string{
+						"#fname": &meta.OrigName,
+					},
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName: &table,
+					Item:      dirItem,
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName:           &table,
+					ConditionExpression: metaPut.ConditionExpression,
+					Item:                metaPut.Item,
+				},
+			},
+		},
+	})
+	return dynamo.ConditionFailedErr(err, exists)
+}
+
+// staleDirEntryAge is how old a directory entry without a metadata
+// item has to be before CreateMetaV3 treats it as left over from a
+// failed create or delete rather than a create still in progress.
+const staleDirEntryAge = time.Minute
+
+// putDirEntryV3 writes the directory entry for a new v3 file without
+// the help of a transaction. It won't replace another file's entry
+// unless that file has no metadata and the entry is stale. It returns
+// a *dynamodb.ConditionalCheckFailedException if the name is taken.
+func putDirEntryV3(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, dirItem map[string]*dynamodb.AttributeValue) error {
+	_, err := db.PutItem(&dynamodb.PutItemInput{
+		TableName:           &table,
+		Item:                dirItem,
+		ConditionExpression: aws.String("attribute_not_exists(hash_key) OR rand_id = :rid"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":rid": {
+				S: &meta.RandID,
+			},
+		},
+	})
+	if _, match := err.(*dynamodb.ConditionalCheckFailedException); !match {
+		return err
+	}
+
+	existing, _, ferr := FetchMetaV3(db, table, meta.OrigName)
+	if ferr != nil || existing != nil {
+		return err
+	}
+
+	out, ferr := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: dirItem[dynamo.HKey],
+			dynamo.RKey: dirItem[dynamo.RKey],
+		},
+	})
+	if ferr != nil {
+		return err
+	}
+	oldRandID := out.Item["rand_id"]
+	tsAttr := out.Item[dynamo.SectorTSAttr]
+	if oldRandID == nil || oldRandID.S == nil || tsAttr == nil || tsAttr.N == nil {
+		return err
+	}
+	ts, ferr := strconv.ParseInt(*tsAttr.N, 10, 64)
+	if ferr != nil || time.Since(time.Unix(ts, 0)) < staleDirEntryAge {
+		return err
+	}
+
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           &table,
+		Item:                dirItem,
+		ConditionExpression: aws.String("rand_id = :old"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":old": oldRandID,
+		},
+	})
+	return err
+}
+
+// DeleteMetaV3 removes a v3 file's metadata item, as long as it still
+// matches rawMeta, and then its directory entry.
+func DeleteMetaV3(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, rawMeta string) error {
+	_, err := db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           &table,
+		ConditionExpression: aws.String("#meta=:meta"),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.MetaV3Key(meta.OrigName)),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#meta": aws.String(dynamo.MetaV3Attr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":meta": {
+				S: &rawMeta,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only remove the directory entry if it is still ours. If the file
+	// was recreated in the mean time it belongs to the new file.
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           &table,
+		ConditionExpression: aws.String("rand_id=:rid"),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileDirV3Key),
+			},
+			dynamo.RKey: {
+				N: aws.String(dynamo.DirV3RangeKey(meta.OrigName)),
+			},
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":rid": {
+				S: &meta.RandID,
+			},
+		},
+	})
+	if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+		return nil
+	}
+	return err
+}
+
+// RenameMetaV3 replaces a v3 file's metadata item and directory entry
+// with ones for renamed, which has the same RandID but a new name, in a
+// single transaction. The transaction is canceled, returning a
+// *dynamodb.TransactionCanceledException, if the metadata no longer
+// matches rawMeta or a file with the new name exists in any schema
+// version.
+func RenameMetaV3(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, rawMeta string, renamed *dynamo.FileMetaV1V2) error {
+	stored := *renamed
+	if len(stored.SectorChunks) > 0 {
+		stored.Sectors = nil
+	}
+
+	metaBytes, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	_, err = dynamo.TransactWriteItems(db, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				// v1 and v2 files live in the shared file-meta-v1 item
+				ConditionCheck: &dynamodb.ConditionCheck{
+					TableName:           &table,
+					ConditionExpression: aws.String("attribute_not_exists(#fname)"),
+					Key: map[string]*dynamodb.AttributeValue{
+						dynamo.HKey: {
+							S: aws.String(dynamo.FileMetaKey),
+						},
+						dynamo.RKey: {
+							N: aws.String("0"),
+						},
+					},
+					ExpressionAttributeNames: map[string]*string{
+						"#fname": &renamed.OrigName,
+					},
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName:           &table,
+					ConditionExpression: aws.String("attribute_not_exists(hash_key)"),
+					Item: map[string]*dynamodb.AttributeValue{
+						dynamo.HKey: {
+							S: aws.String(dynamo.MetaV3Key(renamed.OrigName)),
+						},
+						dynamo.RKey: {
+							N: aws.String("0"),
+						},
+						dynamo.MetaV3Attr: {
+							S: aws.String(string(metaBytes)),
+						},
+					},
+				},
+			},
+			{
+				Delete: &dynamodb.Delete{
+					TableName:           &table,
+					ConditionExpression: aws.String("#meta=:meta"),
+					Key: map[string]*dynamodb.AttributeValue{
+						dynamo.HKey: {
+							S: aws.String(dynamo.MetaV3Key(meta.OrigName)),
+						},
+						dynamo.RKey: {
+							N: aws.String("0"),
+						},
+					},
+					ExpressionAttributeNames: map[string]*string{
+						"#meta": aws.String(dynamo.MetaV3Attr),
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":meta": {
+							S: &rawMeta,
+						},
+					},
+				},
+			},
+			{
+				Put: &dynamodb.Put{
+					TableName: &table,
+					Item: map[string]*dynamodb.AttributeValue{
+						dynamo.HKey: {
+							S: aws.String(dynamo.FileDirV3Key),
+						},
+						dynamo.RKey: {
+							N: aws.String(dynamo.DirV3RangeKey(renamed.OrigName)),
+						},
+						"name": {
+							S: &renamed.OrigName,
+						},
+						"rand_id": {
+							S: &renamed.RandID,
+						},
+						dynamo.SectorTSAttr: {
+							N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+						},
+					},
+				},
+			},
+			{
+				Delete: &dynamodb.Delete{
+					TableName:           &table,
+					ConditionExpression: aws.String("rand_id=:rid"),
+					Key: map[string]*dynamodb.AttributeValue{
+						dynamo.HKey: {
+							S: aws.String(dynamo.FileDirV3Key),
+						},
+						dynamo.RKey: {
+							N: aws.String(dynamo.DirV3RangeKey(meta.OrigName)),
+						},
+					},
+					ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+						":rid": {
+							S: &meta.RandID,
+						},
+					},
+				},
+			},
+		},
+	})
+	return err
+}
+
+// ListFilesV3 returns the names of all v3 files in the directory
+// partition.
+func ListFilesV3(db dynamo.Client, table string) ([]string, error) {
+	var (
+		names    []string
+		startKey map[string]*dynamodb.AttributeValue
+	)
+
+	for {
+		out, err := db.Query(&dynamodb.QueryInput{
+			TableName:              &table,
+			ConsistentRead:         aws.Bool(true),
+			KeyConditionExpression: aws.String("hash_key = :hk"),
+			ProjectionExpression:   aws.String("#name"),
+			ExpressionAttributeNames: map[string]*string{
+				"#name": aws.String("name"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":hk": {
+					S: aws.String(dynamo.FileDirV3Key),
+				},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			if name := item["name"]; name != nil {
+				names = append(names, *name.S)
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return names, nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+// commitMetaV3 is commitMeta for v3 files. Any sector map chunks that
+// changed are written before the conditional metadata update.
+func (f *File) commitMetaV3(meta *dynamo.FileMetaV1V2, baseMeta string) (string, error) {
+	meta.Generation++
+
+	stored := *meta
+	stored.SectorChunks = nil
+
+	if len(meta.Sectors) > SectorMapChunkSize {
+		ids, encoded, err := splitSectorMap(meta.Sectors)
+		if err != nil {
+			return "", err
+		}
+
+		existing := make(map[string]bool, len(meta.SectorChunks))
+		for _, id := range meta.SectorChunks {
+			existing[id] = true
+		}
+
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+		var reqs []*dynamodb.WriteRequest
+		for i, id := range ids {
+			if existing[id] {
+				continue
+			}
+			reqs = append(reqs, &dynamodb.WriteRequest{
+				PutRequest: &dynamodb.PutRequest{
+					Item: map[string]*dynamodb.AttributeValue{
+						dynamo.HKey: {
+							S: aws.String(f.sectorMapChunkKey(id)),
+						},
+						dynamo.RKey: {
+							N: aws.String("0"),
+						},
+						"bytes": {
+							B: sectorMapCodec.Compress(nil, encoded[i]),
+						},
+						dynamo.SectorTSAttr: {
+							N: &ts,
+						},
+					},
+				},
+			})
+		}
+
+		err = f.batchWrite(reqs)
+		if err != nil {
+			return "", err
+		}
+
+		stored.Sectors = nil
+		stored.SectorChunks = ids
+	}
+
+	metaBytes, err := json.Marshal(stored)
+	if err != nil {
+		return "", err
+	}
+
+	t0 := time.Now()
+	_, err = f.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           &f.table,
+		UpdateExpression:    aws.String("SET #meta=:meta"),
+		ConditionExpression: aws.String("#meta=:base"),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.MetaV3Key(f.rawName)),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#meta": aws.String(dynamo.MetaV3Attr),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":meta": {
+				S: aws.String(string(metaBytes)),
+			},
+			":base": {
+				S: &baseMeta,
+			},
+		},
+	})
+
+	UpdateItemHist.Observe(time.Since(t0).Seconds())
+
+	if err != nil {
+		if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+			return "", fmt.Errorf("%w: %q at generation %d", dynamo.MetaConflictErr, f.rawName, meta.Generation-1)
+		}
+		return "", err
+	}
+
+	replaced := meta.SectorChunks
+	meta.SectorChunks = stored.SectorChunks
+
+	// Like superseded sectors in Flush, chunks the new metadata no
+	// longer references are removed unless something else may share
+	// them. The commit already succeeded, so a failed delete only
+	// leaves the chunks for garbage collection.
+	if !meta.SharedSectors {
+		f.deleteSectorMapChunks(replaced, stored.SectorChunks)
+	}
+
+	return string(metaBytes), nil
+}
+
+// deleteSectorMapChunks deletes the chunk items in old that aren't in
+// keep.
+func (f *File) deleteSectorMapChunks(old, keep []string) {
+	live := make(map[string]bool, len(keep))
+	for _, id := range keep {
+		live[id] = true
+	}
+
+	var reqs []*dynamodb.WriteRequest
+	for _, id := range old {
+		if live[id] {
+			continue
+		}
+		live[id] = true
+		reqs = append(reqs, &dynamodb.WriteRequest{
+			DeleteRequest: &dynamodb.DeleteRequest{
+				Key: map[string]*dynamodb.AttributeValue{
+					dynamo.HKey: {
+						S: aws.String(f.sectorMapChunkKey(id)),
+					},
+					dynamo.RKey: {
+						N: aws.String("0"),
+					},
+				},
+			},
+		})
+	}
+
+	f.batchWrite(reqs)
+}
+
+// sectorMapChunkKey returns the hash_key for the sector map chunk
+// item with the given id.
+func (f *File) sectorMapChunkKey(id string) string {
+	return dynamo.SectorMapChunkKey(f.sectorRandID, f.sectorName, id)
+}
@@ -0,0 +1,73 @@
+package schemav2
+
+import (
+	"fmt"
+
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// ImportSectors writes the sectors produced by scan as the content of
+// the v2 file described by meta, then commits meta with a single
+// conditional update against baseMeta, the raw metadata the file had
+// in the file-meta-v1 item before. This is how a file in another
+// layout is converted to v2 without readers ever seeing a partial copy.
+//
+// meta must not have any sectors yet. scan calls write once per
+// sector, in order, and every sector but the last must be full.
+//
+// Sectors are content addressed, so importing the same content again
+// after an interrupted import rewrites the same items. The returned
+// metadata is what was committed.
+func ImportSectors(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, baseMeta string, opts Options, scan func(write func(data []byte) error) error) (*dynamo.FileMetaV1V2, error) {
+	if meta.MetaVersion != 2 {
+		return nil, fmt.Errorf("cannot import into MetaVersion=%d", meta.MetaVersion)
+	}
+	if len(meta.Sectors) > 0 || meta.FileSize > 0 {
+		return nil, fmt.Errorf("cannot import into non-empty file %q", meta.OrigName)
+	}
+
+	f, err := FileFromMeta(meta, table, db, nil, nil, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	w := f.newSectorWriter(meta, baseMeta)
+
+	var idx int
+	err = scan(func(data []byte) error {
+		if w.meta.FileSize != int64(idx)*f.sectorSize {
+			return fmt.Errorf("short sector before sector %d", idx)
+		}
+		if int64(len(data)) > f.sectorSize {
+			return fmt.Errorf("sector %d is larger than the sector size", idx)
+		}
+		if len(data) == 0 {
+			// v1 truncates to a sector boundary by leaving an empty
+			// sector, v2 has no sector at all
+			return nil
+		}
+
+		copied := make([]byte, len(data))
+		copy(copied, data)
+		err := w.WriteSector(idx, copied)
+		idx++
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.stage()
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit even if the file is empty, the metadata swap is what
+	// makes it a v2 file.
+	_, err = f.commitMeta(w.meta, w.baseMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	return w.meta, nil
+}
@@ -54,3 +54,24 @@ var BatchWriteItemCount = promauto.NewCounter(
 		Name:      "batch_write_item_count",
 	},
 )
+
+var readAheadSectorCount = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "read_ahead_sector_count",
+	},
+)
+
+var batchWriteUnprocessedCount = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "batch_write_item_unprocessed_count",
+	},
+)
+
+var cacheCorruptSectorCount = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "cache_corrupt_sector_count",
+	},
+)
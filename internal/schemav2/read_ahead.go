@@ -0,0 +1,93 @@
+package schemav2
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// readAheadState tracks a file's read pattern so sectors can be
+// prefetched into the sector cache during sequential scans.
+type readAheadState struct {
+	// window is the number of sectors to prefetch, 0 if disabled.
+	window int
+
+	// nextIdx is the sector index just past the previous read.
+	nextIdx int
+	// sequential counts consecutive reads that moved forward
+	// from where the previous read ended.
+	sequential int
+	// prefetchedTo is the end of the range already prefetched.
+	prefetchedTo int
+
+	// running is 1 while a prefetch is in flight.
+	running int32
+	wg      sync.WaitGroup
+}
+
+// sequentialReadsBeforeReadAhead is how many forward sequential reads
+// must be seen before prefetching starts, so random access doesn't
+// trigger it.
+const sequentialReadsBeforeReadAhead = 2
+
+// maybeReadAhead records a read of sectors [firstIdx, endIdx) and, if
+// the file is being read sequentially, starts prefetching the sectors
+// that follow.
+func (f *File) maybeReadAhead(sectors []string, firstIdx, endIdx int) {
+	ra := &f.readAhead
+	if ra.window <= 0 {
+		return
+	}
+
+	// SQLite pages are usually smaller than a sector, so a
+	// sequential scan reads the same sector several times
+	if firstIdx == ra.nextIdx || firstIdx == ra.nextIdx-1 {
+		if endIdx > ra.nextIdx {
+			ra.sequential++
+		}
+	} else {
+		ra.sequential = 0
+		ra.prefetchedTo = 0
+	}
+	ra.nextIdx = endIdx
+
+	if ra.sequential < sequentialReadsBeforeReadAhead {
+		return
+	}
+
+	// stay at least half a window ahead of the reader
+	if ra.prefetchedTo-endIdx > ra.window/2 {
+		return
+	}
+
+	start := endIdx
+	if ra.prefetchedTo > start {
+		start = ra.prefetchedTo
+	}
+	end := endIdx + ra.window
+	if end > len(sectors) {
+		end = len(sectors)
+	}
+	if start >= end {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&ra.running, 0, 1) {
+		return
+	}
+
+	ra.prefetchedTo = end
+	ids := append([]string(nil), sectors[start:end]...)
+
+	ra.wg.Add(1)
+	go func() {
+		defer ra.wg.Done()
+		defer atomic.StoreInt32(&ra.running, 0)
+
+		// errors are ignored, the reader will fetch the
+		// sectors itself if they didn't make it into the cache
+		_, err := f.getSectors(ids)
+		if err == nil {
+			readAheadSectorCount.Add(float64(len(ids)))
+		}
+	}()
+}
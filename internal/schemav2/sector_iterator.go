@@ -39,7 +39,7 @@ func (i *sectorIterator) Next() bool {
 	}
 
 	if len(i.cachedSectors) == 0 {
-		maxSectors := 100
+		maxSectors := maxBatchGetKeys * i.f.readConcurrency
 		if len(i.sectorsToFetch) < maxSectors {
 			maxSectors = len(i.sectorsToFetch)
 		}
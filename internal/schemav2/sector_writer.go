@@ -1,51 +1,63 @@
 package schemav2
 
 import (
-	"crypto/sha512"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/klauspost/compress/zstd"
 	"github.com/psanford/donutdb/internal/dynamo"
 	"golang.org/x/exp/maps"
 )
 
 // SectorWriter is a buffered writer for sectors.
-// You must call flush() and check its error to ensure
-// all sectors are actually written
+//
+// Sectors are content addressed, so writing a sector item never
+// changes what readers see. As the buffer fills, pending sectors are
+// staged to DynamoDB under their new ids. The new sectors only become
+// visible when Flush atomically swaps in the updated file metadata.
+// You must call Flush() and check its error to commit the writes.
 type SectorWriter struct {
 	F    *File
 	meta *dynamo.FileMetaV1V2
 	err  error
 
+	// baseMeta is the serialized metadata this writer started from.
+	// Flush only commits if it is still the current metadata.
+	baseMeta string
+	// baseSectors is the set of sector ids referenced by baseMeta.
+	baseSectors map[string]bool
+
 	skipMetadataUpdates  bool
 	pendingWriteSectors  map[int]Sector
+	stagedSectors        map[string]bool
 	pendingDeleteSectors []string
 }
 
-var encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+func (f *File) newSectorWriter(meta *dynamo.FileMetaV1V2, rawMeta string) *SectorWriter {
+	baseSectors := make(map[string]bool, len(meta.Sectors))
+	for _, id := range meta.Sectors {
+		baseSectors[id] = true
+	}
 
-var compressFunc = func(data []byte) []byte {
-	compBytes := make([]byte, 0, len(data))
-	return encoder.EncodeAll(data, compBytes)
-}
+	metaCopy := *meta
+	metaCopy.Sectors = append([]string(nil), meta.Sectors...)
 
-// var compressFunc = func(data []byte) []byte {
-// 	return data
-// }
+	return &SectorWriter{
+		F:           f,
+		meta:        &metaCopy,
+		baseMeta:    rawMeta,
+		baseSectors: baseSectors,
+	}
+}
 
 func (w *SectorWriter) WriteSector(idx int, data []byte) error {
 	if w.err != nil {
 		return w.err
 	}
 
-	h := sha512.New512_256()
-	h.Write(data)
-	sum := h.Sum(nil)
-
-	id := fmt.Sprintf("%d__%x", idx, sum)
+	id := fmt.Sprintf("%d__%s", idx, w.F.sectorHash(data))
 	s := &Sector{
 		Data: data,
 		ID:   id,
@@ -74,13 +86,17 @@ func (w *SectorWriter) WriteSector(idx int, data []byte) error {
 	}
 	w.meta.Sectors[idx] = s.ID
 
-	if len(w.pendingWriteSectors)+len(w.pendingDeleteSectors) == 25 {
-		return w.Flush()
+	// stage once we have enough sectors to keep every concurrent
+	// batch write full
+	if len(w.pendingWriteSectors) >= dynamo.MaxBatchWriteItems*w.F.writeConcurrency {
+		return w.stage()
 	}
 
 	return nil
 }
 
+// DeleteSector marks a sector to be deleted once the metadata no
+// longer referencing it has been committed.
 func (w *SectorWriter) DeleteSector(id string) error {
 	if w.err != nil {
 		return w.err
@@ -88,29 +104,45 @@ func (w *SectorWriter) DeleteSector(id string) error {
 
 	w.pendingDeleteSectors = append(w.pendingDeleteSectors, id)
 
-	if len(w.pendingWriteSectors)+len(w.pendingDeleteSectors) == 25 {
-		return w.Flush()
-	}
-
 	return nil
 }
 
-func (w *SectorWriter) Flush() error {
+// truncatePending drops any pending writes for sectors at or
+// after idx.
+func (w *SectorWriter) truncatePending(idx int) {
+	for pendingIdx := range w.pendingWriteSectors {
+		if pendingIdx >= idx {
+			delete(w.pendingWriteSectors, pendingIdx)
+		}
+	}
+}
+
+// stage writes all pending sectors to DynamoDB without updating
+// the file metadata.
+func (w *SectorWriter) stage() error {
 	if w.err != nil {
 		return w.err
 	}
 
-	if len(w.pendingWriteSectors)+len(w.pendingDeleteSectors) == 0 {
+	if len(w.pendingWriteSectors) == 0 {
 		return nil
 	}
-	reqs := make([]*dynamodb.WriteRequest, 0, len(w.pendingWriteSectors)+len(w.pendingDeleteSectors))
+
+	reqs := make([]*dynamodb.WriteRequest, 0, len(w.pendingWriteSectors))
+
+	if w.stagedSectors == nil {
+		w.stagedSectors = make(map[string]bool)
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
 
 	for _, s := range w.pendingWriteSectors {
 		w.F.sectcache.Put(s.ID, s.Data)
 
-		compBytes := compressFunc(s.Data)
+		compBytes := w.F.codec.Compress(make([]byte, 0, len(s.Data)), s.Data)
+		compBytes = w.F.sealSector(s.ID, compBytes)
 
-		key := "file-v2-" + w.F.randID + "-" + w.F.rawName + "-" + s.ID
+		key := w.F.sectorKey(s.ID)
 
 		req := &dynamodb.WriteRequest{
 			PutRequest: &dynamodb.PutRequest{
@@ -124,14 +156,78 @@ func (w *SectorWriter) Flush() error {
 					"bytes": {
 						B: compBytes,
 					},
+					dynamo.SectorTSAttr: {
+						N: &ts,
+					},
 				},
 			},
 		}
 		reqs = append(reqs, req)
+		w.stagedSectors[s.ID] = true
 	}
 
+	err := w.F.batchWrite(reqs)
+	if err != nil {
+		w.err = err
+		return err
+	}
+
+	maps.Clear(w.pendingWriteSectors)
+
+	return nil
+}
+
+// Flush stages any pending sectors and then commits the new file
+// metadata with a single conditional update. Sectors that are no
+// longer referenced are deleted after the commit succeeds.
+func (w *SectorWriter) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	err := w.stage()
+	if err != nil {
+		return err
+	}
+
+	if !w.skipMetadataUpdates && (len(w.stagedSectors) > 0 || len(w.pendingDeleteSectors) > 0) {
+		newMeta, err := w.F.commitMeta(w.meta, w.baseMeta)
+		if err != nil {
+			w.err = err
+			return err
+		}
+		w.baseMeta = newMeta
+	}
+
+	// Anything we staged that didn't make it into the final metadata
+	// was never visible to readers, so it is safe to remove.
+	live := make(map[string]bool, len(w.meta.Sectors))
+	for _, id := range w.meta.Sectors {
+		live[id] = true
+	}
+	toDelete := make(map[string]bool)
+	for id := range w.stagedSectors {
+		if !live[id] && !w.baseSectors[id] {
+			toDelete[id] = true
+		}
+	}
 	for _, id := range w.pendingDeleteSectors {
-		key := "file-v2-" + w.F.randID + "-" + w.F.rawName + "-" + id
+		if !live[id] || w.skipMetadataUpdates {
+			toDelete[id] = true
+		}
+	}
+
+	// Any sector of a file with shared sectors may be referenced
+	// elsewhere, even one we only staged since an identical sector
+	// has the same id. Garbage collection removes them once they
+	// aren't.
+	if w.meta.SharedSectors {
+		toDelete = nil
+	}
+
+	reqs := make([]*dynamodb.WriteRequest, 0, len(toDelete))
+	for id := range toDelete {
+		key := w.F.sectorKey(id)
 		req := &dynamodb.WriteRequest{
 			DeleteRequest: &dynamodb.DeleteRequest{
 				Key: map[string]*dynamodb.AttributeValue{
@@ -147,32 +243,65 @@ func (w *SectorWriter) Flush() error {
 		reqs = append(reqs, req)
 	}
 
-	items := map[string][]*dynamodb.WriteRequest{
-		w.F.table: reqs,
-	}
-
-	t0 := time.Now()
-	resp, err := w.F.db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
-		RequestItems: items,
-	})
+	err = w.F.batchWrite(reqs)
 	if err != nil {
 		w.err = err
 		return err
 	}
 
-	if len(resp.UnprocessedItems) > 0 {
-		w.err = fmt.Errorf("unprocessed items: %v", resp.UnprocessedItems)
+	w.pendingDeleteSectors = w.pendingDeleteSectors[:0]
+	maps.Clear(w.stagedSectors)
+	w.baseSectors = live
+
+	return nil
+}
+
+// batchWrite sends reqs to DynamoDB in batches of 25, with up to
+// writeConcurrency batches in flight at once.
+func (f *File) batchWrite(reqs []*dynamodb.WriteRequest) error {
+	var batches [][]*dynamodb.WriteRequest
+	for len(reqs) > 0 {
+		n := dynamo.MaxBatchWriteItems
+		if len(reqs) < n {
+			n = len(reqs)
+		}
+		batches = append(batches, reqs[:n])
+		reqs = reqs[n:]
 	}
 
-	BatchWriteItemHist.Observe(time.Since(t0).Seconds())
-	BatchWriteItemCount.Add(float64(len(items)))
+	return runConcurrently(len(batches), f.writeConcurrency, func(i int) error {
+		return f.writeBatch(batches[i])
+	})
+}
 
-	maps.Clear(w.pendingWriteSectors)
-	w.pendingDeleteSectors = w.pendingDeleteSectors[:0]
+// writeBatch sends a single BatchWriteItem request, resending any
+// unprocessed items with backoff.
+func (f *File) writeBatch(batch []*dynamodb.WriteRequest) error {
+	var retrier dynamo.UnprocessedRetrier
+	for {
+		t0 := time.Now()
+		resp, err := f.db.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				f.table: batch,
+			},
+		})
+		if err != nil {
+			return err
+		}
 
-	if !w.skipMetadataUpdates {
-		w.err = w.F.updateMeta(w.meta)
-	}
+		BatchWriteItemHist.Observe(time.Since(t0).Seconds())
+		BatchWriteItemCount.Add(float64(len(batch)))
+
+		unprocessed := resp.UnprocessedItems[f.table]
+		if len(unprocessed) == 0 {
+			return nil
+		}
 
-	return w.err
+		batchWriteUnprocessedCount.Add(float64(len(unprocessed)))
+		err = retrier.Retry(len(unprocessed), len(batch))
+		if err != nil {
+			return err
+		}
+		batch = unprocessed
+	}
 }
@@ -0,0 +1,233 @@
+package schemav2
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+)
+
+// A snapshot is a frozen copy of a file's metadata. Since sectors are
+// content addressed and never modified, the copy keeps describing the
+// file's content at the time it was taken for as long as the sectors
+// it references are kept around. Once a file has a snapshot its
+// metadata has SharedSectors set, so writers stop deleting superseded
+// sectors and leave that to garbage collection, which treats snapshots
+// as roots.
+//
+// Snapshots of a file live in the dynamo.SnapshotKey(name) partition
+// with the hash of the snapshot name as the range_key. Large sector
+// lists reference the file's sector map chunks rather than being
+// copied inline.
+
+// Snapshot is a snapshot read from its partition.
+type Snapshot struct {
+	Name    string
+	Created time.Time
+
+	// Meta is the frozen metadata. Its sector list isn't loaded if it
+	// is stored in sector map chunks, see ResolveSectorMap.
+	Meta *dynamo.FileMetaV1V2
+}
+
+func snapshotItemKey(file, name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: aws.String(dynamo.SnapshotKey(file)),
+		},
+		dynamo.RKey: {
+			N: aws.String(dynamo.DirV3RangeKey(name)),
+		},
+	}
+}
+
+// PutSnapshot stores meta as the snapshot name of its file. It returns
+// a *dynamodb.ConditionalCheckFailedException if the snapshot already
+// exists.
+func PutSnapshot(db dynamo.Client, table, name string, meta *dynamo.FileMetaV1V2) error {
+	stored := *meta
+	if len(stored.SectorChunks) > 0 {
+		stored.Sectors = nil
+	}
+
+	metaBytes, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	item := snapshotItemKey(meta.OrigName, name)
+	item["name"] = &dynamodb.AttributeValue{
+		S: &name,
+	}
+	item[dynamo.MetaV3Attr] = &dynamodb.AttributeValue{
+		S: aws.String(string(metaBytes)),
+	}
+	item[dynamo.SectorTSAttr] = &dynamodb.AttributeValue{
+		N: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
+	}
+
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName:           &table,
+		ConditionExpression: aws.String("attribute_not_exists(hash_key)"),
+		Item:                item,
+	})
+	return err
+}
+
+// FetchSnapshot reads the snapshot name of file, including its full
+// sector list. It returns nil if there is no such snapshot.
+func FetchSnapshot(db dynamo.Client, table, file, name string) (*Snapshot, error) {
+	out, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:      &table,
+		ConsistentRead: aws.Bool(true),
+		Key:            snapshotItemKey(file, name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out.Item) == 0 || aws.StringValue(out.Item["name"].S) != name {
+		return nil, nil
+	}
+
+	snap, err := decodeSnapshot(out.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ResolveSectorMap(db, table, snap.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// ListSnapshots returns the snapshots of file. Their sector lists
+// aren't resolved.
+func ListSnapshots(db dynamo.Client, table, file string) ([]Snapshot, error) {
+	var (
+		snaps    []Snapshot
+		startKey map[string]*dynamodb.AttributeValue
+	)
+
+	for {
+		out, err := db.Query(&dynamodb.QueryInput{
+			TableName:              &table,
+			ConsistentRead:         aws.Bool(true),
+			KeyConditionExpression: aws.String("hash_key = :hk"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":hk": {
+					S: aws.String(dynamo.SnapshotKey(file)),
+				},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			snap, err := decodeSnapshot(item)
+			if err != nil {
+				return nil, err
+			}
+			snaps = append(snaps, *snap)
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return snaps, nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+// DeleteSnapshot removes the snapshot name of file. Its sectors are
+// left for garbage collection. It returns false if there was no such
+// snapshot.
+func DeleteSnapshot(db dynamo.Client, table, file, name string) (bool, error) {
+	_, err := db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           &table,
+		Key:                 snapshotItemKey(file, name),
+		ConditionExpression: aws.String("#name = :name"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String("name"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":name": {
+				S: &name,
+			},
+		},
+	})
+	if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func decodeSnapshot(item map[string]*dynamodb.AttributeValue) (*Snapshot, error) {
+	snap := Snapshot{
+		Name: aws.StringValue(item["name"].S),
+	}
+
+	if ts := item[dynamo.SectorTSAttr]; ts != nil {
+		sec, err := strconv.ParseInt(aws.StringValue(ts.N), 10, 64)
+		if err == nil {
+			snap.Created = time.Unix(sec, 0)
+		}
+	}
+
+	var meta dynamo.FileMetaV1V2
+	err := json.Unmarshal([]byte(aws.StringValue(item[dynamo.MetaV3Attr].S)), &meta)
+	if err != nil {
+		return nil, fmt.Errorf("decode snapshot %q metadata err: %w", snap.Name, err)
+	}
+	snap.Meta = &meta
+
+	return &snap, nil
+}
+
+// ResolveSectorMap loads the sector list of meta from its sector map
+// chunks, if it has any.
+func ResolveSectorMap(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2) error {
+	if len(meta.SectorChunks) == 0 || len(meta.Sectors) > 0 {
+		return nil
+	}
+
+	chunks, err := getSectorMapChunks(db, table, meta, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range meta.SectorChunks {
+		meta.Sectors = append(meta.Sectors, chunks[id]...)
+	}
+	return nil
+}
+
+// CommitMeta replaces the metadata of the file described by meta, as
+// long as its current metadata still matches baseMeta. It is used to
+// change the metadata of a file that isn't open, while holding its
+// lock. It returns the serialized form of the new metadata.
+func CommitMeta(db dynamo.Client, table string, meta *dynamo.FileMetaV1V2, baseMeta string) (string, error) {
+	sectorRandID, sectorName := meta.SectorNamespace()
+
+	f := &File{
+		rawName:          meta.OrigName,
+		sectorRandID:     sectorRandID,
+		sectorName:       sectorName,
+		sectorSize:       meta.SectorSize,
+		metaVersion:      meta.MetaVersion,
+		table:            table,
+		db:               db,
+		readConcurrency:  1,
+		writeConcurrency: 1,
+	}
+	return f.commitMeta(meta, baseMeta)
+}
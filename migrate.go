@@ -0,0 +1,256 @@
+package donutdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/encryption"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/lock"
+	"github.com/psanford/donutdb/internal/schemav1"
+	"github.com/psanford/donutdb/internal/schemav2"
+	"github.com/psanford/sqlite3vfs"
+)
+
+// FileMigratedErr is returned (wrapped) when a schemav1 file that was
+// opened before it was migrated by MigrateToV2 is locked again. The
+// file has to be reopened to use its new layout.
+var FileMigratedErr = dynamo.FileMigratedErr
+
+// DefaultMigrateLockTimeout is how long MigrateToV2 waits for other
+// clients to release the file's lock by default.
+const DefaultMigrateLockTimeout = 30 * time.Second
+
+// MigrateOptions configures MigrateToV2.
+type MigrateOptions struct {
+	// LockTimeout is how long to wait for other clients to release
+	// the file's lock. Defaults to DefaultMigrateLockTimeout.
+	LockTimeout time.Duration
+
+	// WriteConcurrency is the maximum number of BatchWriteItem
+	// requests in flight at once while copying sectors. Defaults to
+	// DefaultWriteConcurrency.
+	WriteConcurrency int
+
+	// Keys, if set, encrypts the migrated file with the provider's
+	// current key.
+	Keys encryption.KeyProvider
+}
+
+// MigrateResult summarizes a MigrateToV2 run.
+type MigrateResult struct {
+	// Migrated is false if the file was already v2 or later. Any v1
+	// data rows left behind by an interrupted migration are still
+	// removed.
+	Migrated bool
+
+	// Size and Sectors describe the migrated file.
+	Size    int64
+	Sectors int
+
+	// RemovedRows is the number of v1 data rows deleted.
+	RemovedRows int
+}
+
+// MigrateToV2 converts the schemav1 file name to the schemav2 layout.
+//
+// It takes an exclusive lock on the file, which excludes clients using
+// either lock strategy, copies every sector into a content addressed v2
+// sector item and then swaps the file's metadata to v2 with a single
+// conditional update. Readers see either the old file or the complete
+// new one. The v1 data rows are deleted once the swap has succeeded.
+// Clients that had the file open as v1 get FileMigratedErr the next
+// time they lock it.
+//
+// An interrupted migration can be resumed by running it again. If it
+// stopped before the swap the file is still v1 and the sectors are
+// copied again; copying is idempotent since sectors are content
+// addressed, and any copies that are never committed are removed by
+// CollectGarbage. If it stopped after the swap only the cleanup of the
+// v1 data rows remains to be done.
+func MigrateToV2(db DynamoClient, table, name string, opts MigrateOptions) (*MigrateResult, error) {
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultMigrateLockTimeout
+	}
+	if opts.WriteConcurrency < 1 {
+		opts.WriteConcurrency = DefaultWriteConcurrency
+	}
+
+	meta, _, err := fetchMetaV1(db, table, name)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		v3Meta, _, err := schemav2.FetchMetaV3(db, table, name)
+		if err != nil {
+			return nil, err
+		}
+		if v3Meta == nil {
+			return nil, fmt.Errorf("file %q not found", name)
+		}
+		return &MigrateResult{
+			Size:    v3Meta.FileSize,
+			Sectors: len(v3Meta.Sectors),
+		}, nil
+	}
+
+	if meta.MetaVersion >= 2 {
+		return migrateCleanup(db, table, meta, &MigrateResult{
+			Size:    meta.FileSize,
+			Sectors: len(meta.Sectors),
+		})
+	}
+
+	lm, err := lockExclusive(db, table, meta, opts.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer lm.Close()
+
+	// the file may have been migrated or deleted while we waited
+	meta, rawMeta, err := fetchMetaV1(db, table, name)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("file %q not found", name)
+	}
+	if meta.MetaVersion >= 2 {
+		return migrateCleanup(db, table, meta, &MigrateResult{
+			Size:    meta.FileSize,
+			Sectors: len(meta.Sectors),
+		})
+	}
+
+	newMeta := *meta
+	newMeta.MetaVersion = 2
+	newMeta.DataRowKey = ""
+	if opts.Keys != nil {
+		keyID, _, err := opts.Keys.CurrentKey()
+		if err != nil {
+			return nil, fmt.Errorf("get current encryption key: %w", err)
+		}
+		newMeta.EncryptAlg = encryption.AlgAES256GCM
+		newMeta.KeyID = keyID
+	}
+
+	// The lease is checked as we go so that losing it stops the copy,
+	// and once more right before the swap. The swap itself is
+	// conditional on the v1 metadata, which no v1 writer ever changes.
+	committed, err := schemav2.ImportSectors(db, table, &newMeta, rawMeta, schemav2.Options{
+		WriteConcurrency: opts.WriteConcurrency,
+		Keys:             opts.Keys,
+	}, func(write func([]byte) error) error {
+		err := schemav1.ScanSectors(db, table, meta, func(data []byte) error {
+			if err := lm.Err(); err != nil {
+				return err
+			}
+			return write(data)
+		})
+		if err != nil {
+			return err
+		}
+		return lm.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("migrate %q err: %w", name, err)
+	}
+
+	return migrateCleanup(db, table, meta, &MigrateResult{
+		Migrated: true,
+		Size:     committed.FileSize,
+		Sectors:  len(committed.Sectors),
+	})
+}
+
+// migrateCleanup deletes the v1 data rows of a migrated file.
+func migrateCleanup(db DynamoClient, table string, meta *dynamo.FileMetaV1V2, result *MigrateResult) (*MigrateResult, error) {
+	v1Meta := *meta
+	v1Meta.DataRowKey = dynamo.FileDataPrefix + meta.RandID + "-" + meta.OrigName
+
+	removed, err := schemav1.DeleteSectors(db, table, &v1Meta)
+	if err != nil {
+		return nil, fmt.Errorf("delete v1 data rows of %q err: %w", meta.OrigName, err)
+	}
+	result.RemovedRows = removed
+
+	return result, nil
+}
+
+// lockExclusive takes an exclusive lock on the file described by meta
+// on behalf of an administrative operation, waiting up to timeout for
+// other clients to release it. With a zero timeout it doesn't wait and
+// fails with FileLockedErr instead. The multi-reader lock's exclusive
+// level excludes clients using either lock strategy. The caller must
+// Close the returned lock manager.
+func lockExclusive(db DynamoClient, table string, meta *dynamo.FileMetaV1V2, timeout time.Duration) (lock.LockManager, error) {
+	ownerIDBytes := make([]byte, 8)
+	if _, err := rand.Read(ownerIDBytes); err != nil {
+		return nil, err
+	}
+
+	lm := lock.NewMultiReaderLockManager(db, table, meta.LockRowKey, hex.EncodeToString(ownerIDBytes), lock.Options{
+		Retry: lock.RetryPolicy{
+			Timeout: timeout,
+		},
+	})
+
+	for _, level := range []sqlite3vfs.LockType{sqlite3vfs.LockShared, sqlite3vfs.LockExclusive} {
+		err := lm.Lock(level)
+		if err == sqlite3vfs.BusyError && timeout == 0 {
+			lm.Close()
+			return nil, fmt.Errorf("%w: %q", FileLockedErr, meta.OrigName)
+		} else if err == sqlite3vfs.BusyError {
+			lm.Close()
+			return nil, fmt.Errorf("file %q is still locked after %s", meta.OrigName, timeout)
+		} else if err != nil {
+			lm.Close()
+			return nil, fmt.Errorf("lock %q err: %w", meta.OrigName, err)
+		}
+	}
+
+	return lm, nil
+}
+
+// fetchMetaV1 reads name's entry in the shared file-meta-v1 item,
+// which holds the metadata of v1 and v2 files. It returns a nil meta if
+// there is no such entry. The returned string is the raw metadata.
+func fetchMetaV1(db DynamoClient, table, name string) (*dynamo.FileMetaV1V2, string, error) {
+	existing, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName:            &table,
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#fname"),
+		ExpressionAttributeNames: map[string]*string{
+			"#fname": aws.String(name),
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileMetaKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	item := existing.Item[name]
+	if item == nil {
+		return nil, "", nil
+	}
+
+	var meta dynamo.FileMetaV1V2
+	err = json.Unmarshal([]byte(aws.StringValue(item.S)), &meta)
+	if err != nil {
+		return nil, "", fmt.Errorf("decode file metadata err: %w", err)
+	}
+
+	return &meta, aws.StringValue(item.S), nil
+}
@@ -1,9 +1,14 @@
 package donutdb
 
 import (
+	"context"
 	"errors"
 	"io"
+	"time"
 
+	"github.com/psanford/donutdb/compression"
+	"github.com/psanford/donutdb/encryption"
+	"github.com/psanford/donutdb/internal/lock"
 	"github.com/psanford/donutdb/sectorcache"
 )
 
@@ -16,6 +21,18 @@ type options struct {
 	changeLogWriter      io.Writer
 	defaultSchemaVersion int
 	sectorCache          sectorcache.CacheV2
+	lockStrategy         LockStrategy
+	leaseLostHandler     func(name string, err error)
+	lockOptions          lock.Options
+	ctx                  context.Context
+	fileContext          func(name string) context.Context
+	requestTimeout       time.Duration
+	readConcurrency      int
+	writeConcurrency     int
+	readAhead            int
+	compression          compression.Codec
+	keys                 encryption.KeyProvider
+	metaHistory          int
 }
 
 type sectorSizeOption struct {
@@ -53,7 +70,7 @@ type defaultSchemaVersionOption struct {
 }
 
 func (o defaultSchemaVersionOption) setOption(opts *options) error {
-	if o.version < 0 || o.version > 2 {
+	if o.version < 0 || o.version > 3 {
 		return errors.New("unknown schema version specified")
 	}
 	opts.defaultSchemaVersion = o.version
@@ -82,3 +99,350 @@ func WithSectorCacheV2(c sectorcache.CacheV2) Option {
 		sectorCache: c,
 	}
 }
+
+// LockStrategy selects how SQLite file locks are implemented on top
+// of DynamoDB. All clients accessing a file must use the same strategy.
+type LockStrategy int
+
+const (
+	// GlobalLock allows only one client at a time to hold any lock
+	// on a file, including readers. This is the default.
+	GlobalLock LockStrategy = iota
+
+	// MultiReaderLock allows many clients to hold SHARED locks at
+	// the same time, with a single writer. Readers are only blocked
+	// while a writer is waiting for or holds an EXCLUSIVE lock.
+	MultiReaderLock
+)
+
+type lockStrategyOption struct {
+	strategy LockStrategy
+}
+
+func (o lockStrategyOption) setOption(opts *options) error {
+	if o.strategy != GlobalLock && o.strategy != MultiReaderLock {
+		return errors.New("unknown lock strategy specified")
+	}
+	opts.lockStrategy = o.strategy
+	return nil
+}
+
+// WithLockStrategy sets the lock strategy used for files opened
+// by the vfs.
+func WithLockStrategy(s LockStrategy) Option {
+	return &lockStrategyOption{
+		strategy: s,
+	}
+}
+
+type leaseLostHandlerOption struct {
+	handler func(name string, err error)
+}
+
+func (o leaseLostHandlerOption) setOption(opts *options) error {
+	opts.leaseLostHandler = o.handler
+	return nil
+}
+
+// WithLeaseLostHandler sets a function to be called, in its own
+// goroutine, whenever the lock lease for a file is lost. err wraps
+// LeaseLostErr.
+func WithLeaseLostHandler(h func(name string, err error)) Option {
+	return &leaseLostHandlerOption{
+		handler: h,
+	}
+}
+
+type lockLeaseOption struct {
+	leaseDuration time.Duration
+	renewInterval time.Duration
+}
+
+func (o lockLeaseOption) setOption(opts *options) error {
+	if o.leaseDuration <= 0 || o.renewInterval <= 0 {
+		return errors.New("lock lease duration and renew interval must be positive")
+	}
+	if o.renewInterval >= o.leaseDuration {
+		return errors.New("lock renew interval must be shorter than the lease duration")
+	}
+	opts.lockOptions.LeaseDuration = o.leaseDuration
+	opts.lockOptions.RenewInterval = o.renewInterval
+	return nil
+}
+
+// WithLockLease sets how long a file lock lease is valid for and how
+// often it is renewed while held. A client that can't renew its lease
+// within leaseDuration loses the lock. A longer lease tolerates slower
+// or more variable DynamoDB latency, but other clients must wait that
+// long to take over the lock of a client that died while holding it.
+// The defaults are a 2s lease renewed every 750ms.
+func WithLockLease(leaseDuration, renewInterval time.Duration) Option {
+	return &lockLeaseOption{
+		leaseDuration: leaseDuration,
+		renewInterval: renewInterval,
+	}
+}
+
+// LockRetryPolicy controls how long acquiring a file lock keeps retrying
+// while another client holds a conflicting lock.
+type LockRetryPolicy struct {
+	// Timeout is the total time to keep retrying for before SQLite gets
+	// a busy error ("database is locked"). Zero disables retries.
+	Timeout time.Duration
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// attempts. Each sleep is jittered to between half and all of the
+	// current backoff. They default to 10ms and 250ms.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type lockRetryOption struct {
+	policy LockRetryPolicy
+}
+
+func (o lockRetryOption) setOption(opts *options) error {
+	p := o.policy
+	if p.Timeout < 0 || p.MinBackoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("lock retry durations must not be negative")
+	}
+	if p.MaxBackoff != 0 && p.MaxBackoff < p.MinBackoff {
+		return errors.New("lock retry max backoff must not be less than min backoff")
+	}
+	opts.lockOptions.Retry = lock.RetryPolicy{
+		Timeout:    p.Timeout,
+		MinBackoff: p.MinBackoff,
+		MaxBackoff: p.MaxBackoff,
+	}
+	return nil
+}
+
+// WithLockRetry makes lock acquisition retry with backoff while the
+// lock is held by another client, instead of immediately returning a
+// busy error. This smooths over short contention without relying on
+// SQLite's busy handler.
+func WithLockRetry(p LockRetryPolicy) Option {
+	return &lockRetryOption{
+		policy: p,
+	}
+}
+
+type contextOption struct {
+	ctx context.Context
+}
+
+func (o contextOption) setOption(opts *options) error {
+	if o.ctx == nil {
+		return errors.New("nil context")
+	}
+	opts.ctx = o.ctx
+	return nil
+}
+
+// WithContext binds ctx to the vfs. Every DynamoDB request made by the
+// vfs and its files, including lock renewals, uses ctx. Once ctx is
+// done all further file operations fail and SQLite reports an I/O
+// error.
+func WithContext(ctx context.Context) Option {
+	return &contextOption{
+		ctx: ctx,
+	}
+}
+
+type fileContextOption struct {
+	fileContext func(name string) context.Context
+}
+
+func (o fileContextOption) setOption(opts *options) error {
+	opts.fileContext = o.fileContext
+	return nil
+}
+
+// WithFileContext sets a function that returns the context to use for
+// DynamoDB requests made while opening, reading, writing or deleting
+// the file name. It is called for every request, so it can return a
+// different context over the life of an open file, for example the
+// context of the current Lambda invocation. Returning nil falls back to
+// the context set with WithContext.
+//
+// Lock renewals run in the background and are not tied to any single
+// operation, so they only use the WithContext context.
+func WithFileContext(f func(name string) context.Context) Option {
+	return &fileContextOption{
+		fileContext: f,
+	}
+}
+
+type requestTimeoutOption struct {
+	timeout time.Duration
+}
+
+func (o requestTimeoutOption) setOption(opts *options) error {
+	if o.timeout < 0 {
+		return errors.New("request timeout must not be negative")
+	}
+	opts.requestTimeout = o.timeout
+	return nil
+}
+
+// WithRequestTimeout bounds how long any single DynamoDB request may
+// take. A request that times out fails the SQLite operation with an
+// I/O error instead of blocking it indefinitely. Zero (the default)
+// means no timeout beyond what the DynamoDB client itself enforces.
+func WithRequestTimeout(d time.Duration) Option {
+	return &requestTimeoutOption{
+		timeout: d,
+	}
+}
+
+// DefaultReadConcurrency is the default maximum number of parallel
+// BatchGetItem requests used to read a large range of sectors. Higher
+// values are opt-in since they multiply the read capacity a single
+// large read can consume at once.
+const DefaultReadConcurrency = 1
+
+type readConcurrencyOption struct {
+	n int
+}
+
+func (o readConcurrencyOption) setOption(opts *options) error {
+	if o.n < 1 {
+		return errors.New("read concurrency must be at least 1")
+	}
+	opts.readConcurrency = o.n
+	return nil
+}
+
+// WithReadConcurrency sets the maximum number of BatchGetItem requests
+// a schemav2 file issues in parallel when SQLite reads a large range
+// of sectors. Defaults to DefaultReadConcurrency.
+func WithReadConcurrency(n int) Option {
+	return &readConcurrencyOption{
+		n: n,
+	}
+}
+
+// DefaultWriteConcurrency is the default maximum number of parallel
+// BatchWriteItem requests used to write sectors on Sync. Like
+// DefaultReadConcurrency, higher values are opt-in.
+const DefaultWriteConcurrency = 1
+
+type writeConcurrencyOption struct {
+	n int
+}
+
+func (o writeConcurrencyOption) setOption(opts *options) error {
+	if o.n < 1 {
+		return errors.New("write concurrency must be at least 1")
+	}
+	opts.writeConcurrency = o.n
+	return nil
+}
+
+// WithWriteConcurrency sets the maximum number of BatchWriteItem
+// requests a schemav2 file issues in parallel when staging sectors.
+// Defaults to DefaultWriteConcurrency.
+func WithWriteConcurrency(n int) Option {
+	return &writeConcurrencyOption{
+		n: n,
+	}
+}
+
+type readAheadOption struct {
+	sectors int
+}
+
+func (o readAheadOption) setOption(opts *options) error {
+	if o.sectors < 0 {
+		return errors.New("read ahead must not be negative")
+	}
+	opts.readAhead = o.sectors
+	return nil
+}
+
+// WithReadAhead enables read-ahead for schemav2 files. Once a file is
+// being read sequentially, as in a full table scan, up to sectors
+// sectors past the current read are prefetched into the sector cache
+// in the background.
+//
+// Read-ahead only works with a sector cache (see WithSectorCacheV2),
+// which must be safe for concurrent use.
+func WithReadAhead(sectors int) Option {
+	return &readAheadOption{
+		sectors: sectors,
+	}
+}
+
+type compressionOption struct {
+	codec compression.Codec
+}
+
+func (o compressionOption) setOption(opts *options) error {
+	if o.codec == nil {
+		return errors.New("compression codec must not be nil")
+	}
+	opts.compression = o.codec
+	return nil
+}
+
+// WithCompression sets the codec sectors of newly created files are
+// compressed with. The codec is recorded in each file's metadata and
+// existing files keep using the codec they were created with, so a
+// codec that isn't built in (see compression.ZstdDict and
+// compression.Register) must be registered in every process that opens
+// the file. Defaults to zstd at its fastest level.
+func WithCompression(c compression.Codec) Option {
+	return &compressionOption{
+		codec: c,
+	}
+}
+
+type encryptionOption struct {
+	keys encryption.KeyProvider
+}
+
+func (o encryptionOption) setOption(opts *options) error {
+	if o.keys == nil {
+		return errors.New("key provider must not be nil")
+	}
+	opts.keys = o.keys
+	return nil
+}
+
+// WithEncryption encrypts the sectors of newly created files with
+// AES-256-GCM using the current key from keys. The key's ID is recorded
+// in each file's metadata, and keys is also used to look up the key
+// when an encrypted file is opened. Files that already exist keep
+// their encryption state. Encryption requires schema version 2 or
+// later.
+func WithEncryption(keys encryption.KeyProvider) Option {
+	return &encryptionOption{
+		keys: keys,
+	}
+}
+
+type metaHistoryOption struct {
+	versions int
+}
+
+func (o metaHistoryOption) setOption(opts *options) error {
+	if o.versions < 0 {
+		return errors.New("metadata history size must not be negative")
+	}
+	opts.metaHistory = o.versions
+	return nil
+}
+
+// WithMetaHistory keeps the last versions committed metadata versions
+// of newly created database files, so that they can be rolled back
+// with Rollback. The history size is recorded in each file's metadata
+// and applies to every client writing the file; use SetMetaHistory to
+// change it for existing files. While a file has history, sectors
+// replaced by a write are left for CollectGarbage to remove once no
+// recorded version references them. History requires schema version 2
+// or later.
+func WithMetaHistory(versions int) Option {
+	return &metaHistoryOption{
+		versions: versions,
+	}
+}
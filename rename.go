@@ -0,0 +1,228 @@
+package donutdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/schemav2"
+)
+
+// FileLockedErr is returned (wrapped) by operations that don't wait for
+// locks when another client has the file locked.
+var FileLockedErr = errors.New("file is locked")
+
+// Rename renames the schemav2 file src to dst.
+//
+// Sector keys embed the name a file was created with, so instead of
+// copying any data the renamed metadata keeps referencing src's
+// sectors by their original keys. The metadata is moved with a single
+// DynamoDB transaction, so other clients see either src or dst, never
+// both or neither.
+//
+// Rename doesn't wait for locks: it fails with FileLockedErr if any
+// client has src locked, and with FileExistsErr if dst already exists.
+// Handles to src that are still open fail once they lock the file
+// again. The file's metadata history moves along with it, but snapshots
+// belong to the name they were taken of and stay with src.
+func Rename(db DynamoClient, table, src, dst string) error {
+	if src == dst {
+		return fmt.Errorf("can't rename %q onto itself", src)
+	}
+
+	existing, _, err := fetchFileMeta(db, table, dst)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("%w: %q", FileExistsErr, dst)
+	}
+
+	meta, rawMeta, lm, err := lockFile(db, table, src, 0)
+	if err != nil {
+		return err
+	}
+	if meta.MetaVersion >= 3 && !dynamo.SupportsTransactions(db) {
+		lm.Close()
+		return fmt.Errorf("rename %q: schema v3 files need a client that supports TransactWriteItems: %w", src, dynamo.UnsupportedErr)
+	}
+
+	renamed := *meta
+	renamed.OrigName = dst
+	renamed.LockRowKey = dynamo.FileLockPrefix + meta.RandID + "-" + dst
+	renamed.DataRandID, renamed.DataName = meta.SectorNamespace()
+	if renamed.DataRandID == renamed.RandID && renamed.DataName == dst {
+		// renamed back to the name its sectors were written under
+		renamed.DataRandID, renamed.DataName = "", ""
+	}
+
+	// The history is keyed by name, so it is copied ahead of the rename
+	// while the lock keeps new versions from being recorded.
+	if meta.HistorySize > 0 {
+		err = schemav2.CopyHistory(db, table, meta, dst)
+		if err != nil {
+			lm.Close()
+			return fmt.Errorf("copy metadata history of %q err: %w", src, err)
+		}
+	}
+
+	err = lm.Err()
+	if err == nil {
+		if meta.MetaVersion >= 3 {
+			err = schemav2.RenameMetaV3(db, table, meta, rawMeta, &renamed)
+		} else {
+			err = renameMetaV1(db, table, meta, rawMeta, &renamed)
+		}
+	}
+	lm.Close()
+
+	if err != nil {
+		if meta.HistorySize > 0 {
+			if herr := schemav2.DeleteHistory(db, table, &renamed); herr != nil {
+				log.Printf("donutdb: delete copied metadata history of %q err: %s", src, herr)
+			}
+		}
+
+		var (
+			canceled *dynamodb.TransactionCanceledException
+			failed   *dynamodb.ConditionalCheckFailedException
+		)
+		if errors.As(err, &canceled) || errors.As(err, &failed) {
+			existing, _, ferr := fetchFileMeta(db, table, dst)
+			if ferr == nil && existing != nil {
+				return fmt.Errorf("%w: %q", FileExistsErr, dst)
+			}
+		}
+		return fmt.Errorf("rename %q err: %w", src, err)
+	}
+
+	// The rename is done at this point. Anything left behind is only
+	// reported by Fsck or removed by CollectGarbage, so don't fail.
+	if meta.HistorySize > 0 {
+		err = schemav2.DeleteHistory(db, table, meta)
+		if err != nil {
+			log.Printf("donutdb: delete metadata history of renamed file %q err: %s", src, err)
+		}
+	}
+
+	// A stale handle to src may have locked the old row again since we
+	// released it. Leave the row alone while it holds a live lease;
+	// Fsck reports it as stale once the lease is gone.
+	_, err = db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           &table,
+		ConditionExpression: aws.String("attribute_not_exists(deadline_us) OR deadline_us < :now"),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: &meta.LockRowKey,
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(time.Now().UnixMicro(), 10)),
+			},
+		},
+	})
+	if _, match := err.(*dynamodb.ConditionalCheckFailedException); err != nil && !match {
+		log.Printf("donutdb: delete lock row of renamed file %q err: %s", src, err)
+	}
+
+	return nil
+}
+
+// renameMetaV1 moves a v2 file's entry in the shared file-meta-v1 item
+// to renamed's name in a single transaction, which also checks that no
+// v3 file has that name. The transaction is canceled if the entry no
+// longer matches rawMeta or the new name is taken.
+//
+// Clients without TransactWriteItems check for the v3 file first and
+// then make the conditional update on its own, which leaves a small
+// window for a v3 file with the new name to be created in between.
+func renameMetaV1(db DynamoClient, table string, meta *dynamo.FileMetaV1V2, rawMeta string, renamed *dynamo.FileMetaV1V2) error {
+	metaBytes, err := json.Marshal(renamed)
+	if err != nil {
+		return err
+	}
+
+	v3Key := map[string]*dynamodb.AttributeValue{
+		dynamo.HKey: {
+			S: aws.String(dynamo.MetaV3Key(renamed.OrigName)),
+		},
+		dynamo.RKey: {
+			N: aws.String("0"),
+		},
+	}
+	update := &dynamodb.Update{
+		TableName:           &table,
+		UpdateExpression:    aws.String("SET #dst=:meta REMOVE #src"),
+		ConditionExpression: aws.String("attribute_not_exists(#dst) AND #src=:raw"),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamo.HKey: {
+				S: aws.String(dynamo.FileMetaKey),
+			},
+			dynamo.RKey: {
+				N: aws.String("0"),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#src": &meta.OrigName,
+			"#dst": &renamed.OrigName,
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":meta": {
+				S: aws.String(string(metaBytes)),
+			},
+			":raw": {
+				S: &rawMeta,
+			},
+		},
+	}
+
+	if !dynamo.SupportsTransactions(db) {
+		out, err := db.GetItem(&dynamodb.GetItemInput{
+			TableName:      &table,
+			Key:            v3Key,
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Item) > 0 {
+			return fmt.Errorf("%w: %q", FileExistsErr, renamed.OrigName)
+		}
+
+		_, err = db.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 update.TableName,
+			UpdateExpression:          update.UpdateExpression,
+			ConditionExpression:       update.ConditionExpression,
+			Key:                       update.Key,
+			ExpressionAttributeNames:  update.ExpressionAttributeNames,
+			ExpressionAttributeValues: update.ExpressionAttributeValues,
+		})
+		return err
+	}
+
+	_, err = dynamo.TransactWriteItems(db, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{
+				ConditionCheck: &dynamodb.ConditionCheck{
+					TableName:           &table,
+					ConditionExpression: aws.String("attribute_not_exists(hash_key)"),
+					Key:                 v3Key,
+				},
+			},
+			{
+				Update: update,
+			},
+		},
+	})
+	return err
+}
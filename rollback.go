@@ -0,0 +1,193 @@
+package donutdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/psanford/donutdb/internal/schemav2"
+)
+
+// HistoryVersion describes a committed metadata version recorded in a
+// file's history.
+type HistoryVersion struct {
+	// Generation is the version number. It increases by one with
+	// every commit.
+	Generation int64
+	Committed  time.Time
+
+	// Size and Sectors describe the file at this version.
+	Size    int64
+	Sectors int
+}
+
+// RollbackOptions configures Rollback. Exactly one of Version and Time
+// selects the version to roll back to.
+type RollbackOptions struct {
+	// LockTimeout is how long to wait for other clients to release
+	// the file's lock. Defaults to DefaultMigrateLockTimeout.
+	LockTimeout time.Duration
+
+	// Version rolls back to the recorded version with this generation.
+	Version int64
+
+	// Time rolls back to the newest recorded version committed at or
+	// before Time.
+	Time time.Time
+}
+
+// HistoryOptions configures SetMetaHistory.
+type HistoryOptions struct {
+	// LockTimeout is how long to wait for other clients to release
+	// the file's lock. Defaults to DefaultMigrateLockTimeout.
+	LockTimeout time.Duration
+}
+
+// MetaHistory returns the recorded metadata versions of file, oldest
+// first. Only files with history enabled (see WithMetaHistory and
+// SetMetaHistory) have any.
+func MetaHistory(db DynamoClient, table, file string) ([]HistoryVersion, error) {
+	meta, _, err := fetchFileMeta(db, table, file)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("file %q not found", file)
+	}
+
+	entries, err := schemav2.ListHistory(db, table, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]HistoryVersion, 0, len(entries))
+	for _, entry := range entries {
+		err = schemav2.ResolveSectorMap(db, table, entry.Meta)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, historyVersion(entry))
+	}
+	return versions, nil
+}
+
+// SetMetaHistory sets how many committed metadata versions of file are
+// kept for Rollback. Zero disables history and removes the recorded
+// versions. Enabling history records the current version right away.
+func SetMetaHistory(db DynamoClient, table, file string, versions int, opts HistoryOptions) error {
+	if versions < 0 {
+		return fmt.Errorf("invalid metadata history size %d", versions)
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultMigrateLockTimeout
+	}
+
+	meta, rawMeta, lm, err := lockFile(db, table, file, opts.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lm.Close()
+
+	if meta.HistorySize == versions {
+		return nil
+	}
+
+	newMeta := *meta
+	newMeta.HistorySize = versions
+	if versions > 0 {
+		newMeta.SharedSectors = true
+	}
+
+	if err := lm.Err(); err != nil {
+		return err
+	}
+
+	_, err = schemav2.CommitMeta(db, table, &newMeta, rawMeta)
+	if err != nil {
+		return fmt.Errorf("set metadata history of %q err: %w", file, err)
+	}
+
+	if versions == 0 {
+		err = schemav2.DeleteHistory(db, table, &newMeta)
+		if err != nil {
+			return fmt.Errorf("delete metadata history of %q err: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// Rollback reinstates an earlier version of file from its metadata
+// history, selected by opts.
+//
+// It takes an exclusive lock on the file and then swaps the old
+// version's sector list in with a single conditional update, so other
+// clients see either the current file or the rolled back one. The
+// rollback is itself committed as a new version, so it can be undone
+// by rolling back again. It returns the version that was reinstated.
+func Rollback(db DynamoClient, table, file string, opts RollbackOptions) (*HistoryVersion, error) {
+	if (opts.Version > 0) == !opts.Time.IsZero() {
+		return nil, fmt.Errorf("exactly one of a version or a time to roll back to is required")
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultMigrateLockTimeout
+	}
+
+	meta, rawMeta, lm, err := lockFile(db, table, file, opts.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer lm.Close()
+
+	entries, err := schemav2.ListHistory(db, table, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *schemav2.HistoryEntry
+	for i, entry := range entries {
+		if opts.Version > 0 && entry.Generation == opts.Version {
+			target = &entries[i]
+		} else if opts.Version == 0 && !entry.Committed.After(opts.Time) {
+			target = &entries[i]
+		}
+	}
+	if target == nil {
+		if opts.Version > 0 {
+			return nil, fmt.Errorf("version %d of %q is not in its metadata history", opts.Version, file)
+		}
+		return nil, fmt.Errorf("%q has no recorded version from before %s", file, opts.Time.Format(time.RFC3339))
+	}
+
+	err = schemav2.ResolveSectorMap(db, table, target.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the content goes back in time; everything else about the
+	// file stays as it is now
+	newMeta := *meta
+	newMeta.FileSize = target.Meta.FileSize
+	newMeta.Sectors = target.Meta.Sectors
+	newMeta.SectorChunks = target.Meta.SectorChunks
+
+	if err := lm.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = schemav2.CommitMeta(db, table, &newMeta, rawMeta)
+	if err != nil {
+		return nil, fmt.Errorf("rollback %q err: %w", file, err)
+	}
+
+	version := historyVersion(*target)
+	return &version, nil
+}
+
+func historyVersion(entry schemav2.HistoryEntry) HistoryVersion {
+	return HistoryVersion{
+		Generation: entry.Generation,
+		Committed:  entry.Committed,
+		Size:       entry.Meta.FileSize,
+		Sectors:    len(entry.Meta.Sectors),
+	}
+}
@@ -0,0 +1,421 @@
+package sectorcache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	diskHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "donutdb_sectorcache",
+		Name:      "disk_hits_total",
+	})
+	diskMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "donutdb_sectorcache",
+		Name:      "disk_misses_total",
+	})
+	diskEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "donutdb_sectorcache",
+		Name:      "disk_evictions_total",
+	})
+	diskCorruptions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "donutdb_sectorcache",
+		Name:      "disk_corrupt_total",
+	})
+)
+
+// Each cache file is a header followed by the sector ID and data:
+//
+//	magic [4]byte
+//	flags uint8
+//	crc   uint32 (castagnoli, over the ID and the stored data)
+//	idLen uint16
+//	id    [idLen]byte
+//	data  []byte
+var diskMagic = []byte("dsc1")
+
+const (
+	diskHeaderLen = 4 + 1 + 4 + 2
+
+	diskFlagZstd = 1 << 0
+
+	diskTmpPrefix = ".tmp-"
+
+	// diskSubdir is the directory inside the one passed to
+	// NewDiskCache that holds the cache files, so the cache never
+	// touches anything else in a shared directory like /tmp.
+	diskSubdir = "donutdb-sectors"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DiskCacheOptions configures a DiskCache.
+type DiskCacheOptions struct {
+	// MaxBytes is the maximum total size of the cache files. The least
+	// recently used sectors are removed to stay under it.
+	MaxBytes int64
+
+	// Compress stores sectors zstd compressed. This fits more sectors
+	// in the same space at the cost of decompressing them on every hit.
+	Compress bool
+}
+
+// DiskCache is a CacheV2 that stores sectors as files in a directory,
+// so they survive process restarts (for example a Lambda function's
+// /tmp between cold starts on the same instance). It is safe for
+// concurrent use, but a directory should only be used by one DiskCache
+// at a time.
+//
+// The files live in a donutdb-sectors subdirectory, and only files
+// named like cache files are ever indexed or removed.
+//
+// Files are written atomically and checksummed. A corrupt or
+// unreadable file is treated as a cache miss and removed.
+type DiskCache struct {
+	dir  string
+	opts DiskCacheOptions
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+	stats Stats
+}
+
+type diskEntry struct {
+	name string
+	size int64
+}
+
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// NewDiskCache returns a DiskCache storing sectors in the
+// donutdb-sectors subdirectory of dir, creating both if needed.
+// Sectors already there from a previous run are kept, oldest first in
+// line for eviction.
+func NewDiskCache(dir string, opts DiskCacheOptions) (*DiskCache, error) {
+	if opts.MaxBytes <= 0 {
+		return nil, errors.New("disk cache MaxBytes must be positive")
+	}
+
+	dir = filepath.Join(dir, diskSubdir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		dir:   dir,
+		opts:  opts,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+
+	err = c.load()
+	if err != nil {
+		return nil, fmt.Errorf("load disk cache %s err: %w", dir, err)
+	}
+
+	return c, nil
+}
+
+// load indexes the files left in the cache directory by a previous run.
+func (c *DiskCache) load() error {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type existing struct {
+		entry   diskEntry
+		modTime time.Time
+	}
+	var files []existing
+
+	for _, de := range dirEntries {
+		if !de.Type().IsRegular() {
+			continue
+		}
+		name := de.Name()
+		if strings.HasPrefix(name, diskTmpPrefix) {
+			// a write that never finished
+			os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+		if !isCacheFileName(name) {
+			continue
+		}
+		info, err := de.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		files = append(files, existing{
+			entry: diskEntry{
+				name: name,
+				size: info.Size(),
+			},
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range files {
+		entry := f.entry
+		c.items[entry.name] = c.order.PushBack(&entry)
+		c.size += entry.size
+	}
+	for c.size > c.opts.MaxBytes {
+		c.evictOldest()
+	}
+
+	return nil
+}
+
+func fileName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// isCacheFileName reports whether name could have come from fileName.
+func isCacheFileName(name string) bool {
+	if len(name) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns the cached data for id, or nil if it isn't cached
+// or its cache file is corrupt.
+func (c *DiskCache) Get(id string) []byte {
+	name := fileName(id)
+
+	c.mu.Lock()
+	elem, ok := c.items[name]
+	if ok {
+		c.order.MoveToFront(elem)
+	} else {
+		c.stats.Misses++
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		diskMisses.Inc()
+		return nil
+	}
+
+	path := filepath.Join(c.dir, name)
+	data, err := c.readFile(path, id)
+	if err != nil {
+		c.mu.Lock()
+		c.stats.Misses++
+		if !errors.Is(err, fs.ErrNotExist) {
+			c.stats.Corrupt++
+			diskCorruptions.Inc()
+		}
+		c.remove(name)
+		c.mu.Unlock()
+		diskMisses.Inc()
+		return nil
+	}
+
+	c.mu.Lock()
+	c.stats.Hits++
+	c.mu.Unlock()
+	diskHits.Inc()
+
+	// keep the eviction order across restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return data
+}
+
+var corruptErr = errors.New("corrupt cache file")
+
+func (c *DiskCache) readFile(path, id string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < diskHeaderLen || !bytes.Equal(raw[:4], diskMagic) {
+		return nil, corruptErr
+	}
+
+	flags := raw[4]
+	crc := binary.BigEndian.Uint32(raw[5:9])
+	idLen := int(binary.BigEndian.Uint16(raw[9:11]))
+	body := raw[diskHeaderLen:]
+	if len(body) < idLen || crc32.Checksum(body, crcTable) != crc {
+		return nil, corruptErr
+	}
+
+	if string(body[:idLen]) != id {
+		// a sha256 collision on the file name, which should never happen
+		return nil, corruptErr
+	}
+
+	data := body[idLen:]
+	if flags&diskFlagZstd != 0 {
+		data, err = zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, corruptErr
+		}
+	}
+
+	return data, nil
+}
+
+// Put stores data for id. Errors writing the cache file are ignored,
+// the sector just isn't cached.
+func (c *DiskCache) Put(id string, data []byte) {
+	name := fileName(id)
+
+	c.mu.Lock()
+	if elem, ok := c.items[name]; ok {
+		// sector IDs are content hashes so the data can't have changed
+		c.order.MoveToFront(elem)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	var flags byte
+	if c.opts.Compress {
+		data = zstdEncoder.EncodeAll(data, nil)
+		flags |= diskFlagZstd
+	}
+
+	body := make([]byte, 0, len(id)+len(data))
+	body = append(body, id...)
+	body = append(body, data...)
+
+	header := make([]byte, diskHeaderLen)
+	copy(header, diskMagic)
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:9], crc32.Checksum(body, crcTable))
+	binary.BigEndian.PutUint16(header[9:11], uint16(len(id)))
+
+	size := int64(len(header) + len(body))
+	if size > c.opts.MaxBytes || len(id) > 0xffff {
+		return
+	}
+
+	err := c.writeFile(name, header, body)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[name]; ok {
+		// raced with another Put of the same sector
+		return
+	}
+
+	c.items[name] = c.order.PushFront(&diskEntry{
+		name: name,
+		size: size,
+	})
+	c.size += size
+
+	for c.size > c.opts.MaxBytes {
+		c.evictOldest()
+	}
+}
+
+// writeFile atomically creates the cache file name.
+func (c *DiskCache) writeFile(name string, header, body []byte) error {
+	f, err := os.CreateTemp(c.dir, diskTmpPrefix)
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	_, err = f.Write(header)
+	if err == nil {
+		_, err = f.Write(body)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
+
+// evictOldest removes the least recently used sector. The caller
+// must hold c.mu.
+func (c *DiskCache) evictOldest() {
+	elem := c.order.Back()
+	if elem == nil {
+		return
+	}
+
+	c.remove(elem.Value.(*diskEntry).name)
+	c.stats.Evictions++
+	diskEvictions.Inc()
+}
+
+// remove deletes the cache file name. The caller must hold c.mu.
+func (c *DiskCache) remove(name string) {
+	elem, ok := c.items[name]
+	if !ok {
+		return
+	}
+
+	entry := c.order.Remove(elem).(*diskEntry)
+	delete(c.items, name)
+	c.size -= entry.size
+
+	os.Remove(filepath.Join(c.dir, name))
+}
+
+// Stats returns the cache's counters.
+func (c *DiskCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Entries = len(c.items)
+	s.Bytes = c.size
+	return s
+}
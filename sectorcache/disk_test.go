@@ -0,0 +1,181 @@
+package sectorcache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCache(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		cacheDir := filepath.Join(dir, diskSubdir)
+
+		// left behind by a crashed write
+		err := os.MkdirAll(cacheDir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(cacheDir, diskTmpPrefix+"123"), []byte("partial"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := DiskCacheOptions{
+			MaxBytes: 1 << 20,
+			Compress: compress,
+		}
+		c, err := NewDiskCache(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := os.Stat(filepath.Join(cacheDir, diskTmpPrefix+"123")); !os.IsNotExist(err) {
+			t.Fatalf("expected temp file to be removed, stat err=%v", err)
+		}
+
+		a := bytes.Repeat([]byte("a"), 4096)
+		b := bytes.Repeat([]byte("b"), 4096)
+		c.Put("0__aaaa", a)
+		c.Put("1__bbbb", b)
+
+		if got := c.Get("0__aaaa"); !bytes.Equal(got, a) {
+			t.Fatalf("compress=%t get a mismatch", compress)
+		}
+		if got := c.Get("2__cccc"); got != nil {
+			t.Fatalf("compress=%t expected miss", compress)
+		}
+
+		// a new cache on the same directory sees the old sectors
+		c, err = NewDiskCache(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Get("1__bbbb"); !bytes.Equal(got, b) {
+			t.Fatalf("compress=%t get b after reopen mismatch", compress)
+		}
+
+		// flip a byte in b's cache file
+		path := filepath.Join(cacheDir, fileName("1__bbbb"))
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[len(raw)-1] ^= 0xff
+		err = os.WriteFile(path, raw, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := c.Get("1__bbbb"); got != nil {
+			t.Fatalf("compress=%t expected corrupt sector to be a miss", compress)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("compress=%t expected corrupt file to be removed, stat err=%v", compress, err)
+		}
+
+		stats := c.Stats()
+		if stats.Hits != 1 || stats.Misses != 1 || stats.Corrupt != 1 || stats.Entries != 1 {
+			t.Fatalf("compress=%t unexpected stats %+v", compress, stats)
+		}
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+
+	sector := make([]byte, 1000)
+	fileSize := int64(diskHeaderLen + len("0__x") + len(sector))
+
+	c, err := NewDiskCache(dir, DiskCacheOptions{
+		MaxBytes: 3 * fileSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put("0__x", sector)
+	c.Put("1__x", sector)
+	c.Put("2__x", sector)
+	c.Get("0__x")
+	c.Put("3__x", sector)
+
+	if got := c.Get("1__x"); got != nil {
+		t.Fatal("expected least recently used sector to be evicted")
+	}
+	for _, id := range []string{"0__x", "2__x", "3__x"} {
+		if got := c.Get(id); got == nil {
+			t.Fatalf("expected %s to be cached", id)
+		}
+	}
+
+	dirEntries, err := os.ReadDir(filepath.Join(dir, diskSubdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirEntries) != 3 {
+		t.Fatalf("cache dir has %d files, expected 3", len(dirEntries))
+	}
+
+	// reopening with a smaller limit trims the cache
+	c, err = NewDiskCache(dir, DiskCacheOptions{
+		MaxBytes: fileSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Entries != 1 || stats.Bytes != fileSize {
+		t.Fatalf("unexpected stats after reopen %+v", stats)
+	}
+}
+
+func TestDiskCacheForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, diskSubdir)
+	err := os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files that aren't the cache's, next to and inside its directory
+	foreign := []string{
+		filepath.Join(dir, "notes.txt"),
+		filepath.Join(dir, diskTmpPrefix+"other-program"),
+		filepath.Join(dir, fileName("0__x")),
+		filepath.Join(cacheDir, "notes.txt"),
+	}
+	for _, path := range foreign {
+		err = os.WriteFile(path, bytes.Repeat([]byte("z"), 4096), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sector := make([]byte, 1000)
+	fileSize := int64(diskHeaderLen + len("0__x") + len(sector))
+
+	c, err := NewDiskCache(dir, DiskCacheOptions{
+		MaxBytes: fileSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Entries != 0 {
+		t.Fatalf("indexed foreign files: %+v", stats)
+	}
+
+	// each Put evicts the previous sector
+	for _, id := range []string{"0__x", "1__x", "2__x"} {
+		c.Put(id, sector)
+	}
+	if stats := c.Stats(); stats.Entries != 1 || stats.Evictions != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	for _, path := range foreign {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("foreign file %s removed: %s", path, err)
+		}
+	}
+}
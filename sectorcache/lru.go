@@ -0,0 +1,149 @@
+package sectorcache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lruHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "donutdb_sectorcache",
+		Name:      "lru_hits_total",
+	})
+	lruMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "donutdb_sectorcache",
+		Name:      "lru_misses_total",
+	})
+	lruEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "donutdb_sectorcache",
+		Name:      "lru_evictions_total",
+	})
+)
+
+// LRU is a CacheV2 that holds up to a fixed number of bytes of sector
+// data, evicting the least recently used sectors first. It is safe for
+// concurrent use, so a single LRU can be shared by every file of a vfs.
+//
+// Sector IDs are content hashes, so cached sectors never go stale.
+type LRU struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+	stats Stats
+}
+
+type lruEntry struct {
+	id   string
+	data []byte
+}
+
+// Stats are counters for a cache's activity since it was created.
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Corrupt is the number of cache entries that failed their
+	// integrity check and were dropped.
+	Corrupt uint64
+
+	// Entries and Bytes are the current number of cached sectors
+	// and their total size.
+	Entries int
+	Bytes   int64
+}
+
+// NewLRU returns an LRU cache that holds up to maxBytes of sector data.
+func NewLRU(maxBytes int64) *LRU {
+	return &LRU{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached data for id, or nil if it
+// isn't cached. Callers are free to modify the returned slice.
+func (c *LRU) Get(id string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[id]
+	if !ok {
+		c.stats.Misses++
+		lruMisses.Inc()
+		return nil
+	}
+
+	c.stats.Hits++
+	lruHits.Inc()
+	c.order.MoveToFront(elem)
+
+	data := elem.Value.(*lruEntry).data
+	out := make([]byte, len(data))
+	copy(out, data)
+	return out
+}
+
+// Put caches a copy of data for id. Sectors larger than the cache
+// are ignored.
+func (c *LRU) Put(id string, data []byte) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[id]; ok {
+		// sector IDs are content hashes so the data can't have changed
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	entry := &lruEntry{
+		id:   id,
+		data: make([]byte, len(data)),
+	}
+	copy(entry.data, data)
+
+	c.items[id] = c.order.PushFront(entry)
+	c.size += int64(len(data))
+
+	for c.size > c.maxBytes {
+		c.evictOldest()
+	}
+}
+
+// evictOldest removes the least recently used sector. The caller
+// must hold c.mu.
+func (c *LRU) evictOldest() {
+	elem := c.order.Back()
+	if elem == nil {
+		return
+	}
+
+	entry := c.order.Remove(elem).(*lruEntry)
+	delete(c.items, entry.id)
+	c.size -= int64(len(entry.data))
+
+	c.stats.Evictions++
+	lruEvictions.Inc()
+}
+
+// Stats returns the cache's counters.
+func (c *LRU) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Entries = len(c.items)
+	s.Bytes = c.size
+	return s
+}
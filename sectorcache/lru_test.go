@@ -0,0 +1,91 @@
+package sectorcache
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := NewLRU(30)
+
+	c.Put("a", bytes.Repeat([]byte("a"), 10))
+	c.Put("b", bytes.Repeat([]byte("b"), 10))
+	c.Put("c", bytes.Repeat([]byte("c"), 10))
+
+	// a becomes the most recently used, so b is evicted next
+	got := c.Get("a")
+	if !bytes.Equal(got, bytes.Repeat([]byte("a"), 10)) {
+		t.Fatalf("get a got=%q", got)
+	}
+
+	// callers may modify what Get returns without affecting the cache
+	got[0] = 'x'
+	if got := c.Get("a"); got[0] != 'a' {
+		t.Fatalf("cached data was modified through Get result: %q", got)
+	}
+
+	// and what they passed to Put
+	d := bytes.Repeat([]byte("d"), 10)
+	c.Put("d", d)
+	d[0] = 'x'
+	if got := c.Get("d"); got[0] != 'd' {
+		t.Fatalf("cached data was modified through Put arg: %q", got)
+	}
+
+	if got := c.Get("b"); got != nil {
+		t.Fatalf("expected b to be evicted but got %q", got)
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if got := c.Get(id); got == nil {
+			t.Fatalf("expected %s to be cached", id)
+		}
+	}
+
+	// too big to ever fit
+	c.Put("huge", make([]byte, 31))
+	if got := c.Get("huge"); got != nil {
+		t.Fatalf("expected oversized sector not to be cached")
+	}
+
+	stats := c.Stats()
+	expect := Stats{
+		Hits:      6,
+		Misses:    2,
+		Evictions: 1,
+		Entries:   3,
+		Bytes:     30,
+	}
+	if stats != expect {
+		t.Fatalf("stats got=%+v expected=%+v", stats, expect)
+	}
+}
+
+func TestLRUConcurrent(t *testing.T) {
+	c := NewLRU(1 << 10)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id := fmt.Sprintf("%d", (i*j)%50)
+				if data := c.Get(id); data != nil && len(data) != 100 {
+					t.Errorf("get %s got len=%d", id, len(data))
+				}
+				c.Put(id, make([]byte, 100))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	if stats.Bytes > 1<<10 {
+		t.Fatalf("cache size %d exceeds limit", stats.Bytes)
+	}
+	if stats.Bytes != int64(stats.Entries)*100 {
+		t.Fatalf("cache size %d doesn't match %d entries", stats.Bytes, stats.Entries)
+	}
+}
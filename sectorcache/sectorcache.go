@@ -1,6 +1,18 @@
 package sectorcache
 
+// CacheV2 caches schemav2 sector data by sector ID. Sector IDs
+// include a hash of the sector's content, so a cached sector never
+// needs to be invalidated.
+//
+// The file may modify the slice returned by Get, and may keep using
+// the slice passed to Put, so implementations must not share memory
+// with their callers.
 type CacheV2 interface {
 	Get(string) []byte
 	Put(string, []byte)
 }
+
+var (
+	_ CacheV2 = (*LRU)(nil)
+	_ CacheV2 = (*DiskCache)(nil)
+)
@@ -0,0 +1,211 @@
+package donutdb
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/psanford/donutdb/internal/dynamo"
+	"github.com/psanford/donutdb/internal/lock"
+	"github.com/psanford/donutdb/internal/schemav2"
+)
+
+// SnapshotExistsErr is returned (wrapped) by CreateSnapshot if the file
+// already has a snapshot with the requested name.
+var SnapshotExistsErr = errors.New("snapshot already exists")
+
+// SnapshotSeparator separates a file name from a snapshot name. Opening
+// "file.db@name" through the VFS opens the snapshot name of file.db
+// read-only, unless a file is actually named "file.db@name".
+const SnapshotSeparator = "@"
+
+// SnapshotOptions configures CreateSnapshot.
+type SnapshotOptions struct {
+	// LockTimeout is how long to wait for other clients to release
+	// the file's lock. Defaults to DefaultMigrateLockTimeout.
+	LockTimeout time.Duration
+}
+
+// SnapshotInfo describes a snapshot.
+type SnapshotInfo struct {
+	File    string
+	Name    string
+	Created time.Time
+
+	// Size is the size of the file when the snapshot was taken.
+	Size int64
+}
+
+// CreateSnapshot records the current content of the schemav2 file as
+// the read-only snapshot name.
+//
+// A snapshot is a copy of the file's metadata, so creating one is cheap
+// no matter how large the file is. It is taken under an exclusive lock
+// so it always captures a committed transaction. From then on writes to
+// the file no longer delete the sectors they replace, and Delete leaves
+// the file's sectors in place; CollectGarbage removes them once neither
+// the file nor any of its snapshots reference them.
+//
+// Open "file@name" through the VFS to read a snapshot.
+func CreateSnapshot(db DynamoClient, table, file, name string, opts SnapshotOptions) (*SnapshotInfo, error) {
+	if name == "" || strings.Contains(name, SnapshotSeparator) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = DefaultMigrateLockTimeout
+	}
+
+	meta, lm, err := lockSharedSectors(db, table, file, opts.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer lm.Close()
+
+	if err := lm.Err(); err != nil {
+		return nil, err
+	}
+
+	err = schemav2.PutSnapshot(db, table, name, meta)
+	if _, match := err.(*dynamodb.ConditionalCheckFailedException); match {
+		return nil, fmt.Errorf("%w: %q of %q", SnapshotExistsErr, name, file)
+	} else if err != nil {
+		return nil, fmt.Errorf("snapshot %q err: %w", file, err)
+	}
+
+	return &SnapshotInfo{
+		File:    file,
+		Name:    name,
+		Created: time.Now(),
+		Size:    meta.FileSize,
+	}, nil
+}
+
+// ListSnapshots returns the snapshots of file, oldest first. Snapshots
+// outlive their file, so they are listed even if file was deleted.
+func ListSnapshots(db DynamoClient, table, file string) ([]SnapshotInfo, error) {
+	snaps, err := schemav2.ListSnapshots(db, table, file)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SnapshotInfo, 0, len(snaps))
+	for _, snap := range snaps {
+		infos = append(infos, SnapshotInfo{
+			File:    file,
+			Name:    snap.Name,
+			Created: snap.Created,
+			Size:    snap.Meta.FileSize,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].Created.Equal(infos[j].Created) {
+			return infos[i].Created.Before(infos[j].Created)
+		}
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// DeleteSnapshot removes the snapshot name of file. The sectors only it
+// referenced are removed by the next CollectGarbage run.
+func DeleteSnapshot(db DynamoClient, table, file, name string) error {
+	found, err := schemav2.DeleteSnapshot(db, table, file, name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("snapshot %q of %q not found", name, file)
+	}
+	return nil
+}
+
+// lockSharedSectors takes an exclusive lock on the schemav2 file and
+// marks its sectors as shared, so that from now on they are only ever
+// deleted by garbage collection. It returns the file's metadata as of
+// when it was locked. The caller must Close the returned lock manager.
+func lockSharedSectors(db DynamoClient, table, file string, timeout time.Duration) (*dynamo.FileMetaV1V2, lock.LockManager, error) {
+	meta, rawMeta, lm, err := lockFile(db, table, file, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !meta.SharedSectors {
+		shared := *meta
+		shared.SharedSectors = true
+		_, err = schemav2.CommitMeta(db, table, &shared, rawMeta)
+		if err != nil {
+			lm.Close()
+			return nil, nil, fmt.Errorf("share sectors of %q err: %w", file, err)
+		}
+		meta = &shared
+	}
+
+	return meta, lm, nil
+}
+
+// lockFile takes an exclusive lock on the schemav2 file and returns its
+// metadata as of when it was locked, along with the raw metadata. The
+// caller must Close the returned lock manager.
+func lockFile(db DynamoClient, table, file string, timeout time.Duration) (*dynamo.FileMetaV1V2, string, lock.LockManager, error) {
+	return lockFileVersion(db, table, file, timeout, 2)
+}
+
+// lockFileVersion is lockFile for files of schema version minVersion
+// or later.
+func lockFileVersion(db DynamoClient, table, file string, timeout time.Duration, minVersion int) (*dynamo.FileMetaV1V2, string, lock.LockManager, error) {
+	meta, _, err := fetchFileMeta(db, table, file)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if meta == nil {
+		return nil, "", nil, fmt.Errorf("file %q not found", file)
+	}
+	if meta.MetaVersion < minVersion {
+		return nil, "", nil, fmt.Errorf("file %q: schema version %d or later is required", file, minVersion)
+	}
+
+	lm, err := lockExclusive(db, table, meta, timeout)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	// the file may have been changed or replaced while we waited
+	lockedID := meta.RandID
+	meta, rawMeta, err := fetchFileMeta(db, table, file)
+	if err != nil {
+		lm.Close()
+		return nil, "", nil, err
+	}
+	if meta == nil || meta.RandID != lockedID {
+		lm.Close()
+		return nil, "", nil, fmt.Errorf("file %q was deleted or replaced while waiting for its lock", file)
+	}
+
+	return meta, rawMeta, lm, nil
+}
+
+// splitSnapshotName splits a "file@snapshot" name. It returns false if
+// name doesn't name a snapshot.
+func splitSnapshotName(name string) (string, string, bool) {
+	idx := strings.LastIndex(name, SnapshotSeparator)
+	if idx < 1 || idx == len(name)-1 {
+		return "", "", false
+	}
+	return name[:idx], name[idx+1:], true
+}
+
+// fetchFileMeta reads the metadata of the file name, whichever schema
+// version it uses. It returns a nil meta if there is no such file. The
+// returned string is the raw metadata.
+func fetchFileMeta(db DynamoClient, table, name string) (*dynamo.FileMetaV1V2, string, error) {
+	meta, rawMeta, err := schemav2.FetchMetaV3(db, table, name)
+	if err != nil || meta != nil {
+		return meta, rawMeta, err
+	}
+	return fetchMetaV1(db, table, name)
+}